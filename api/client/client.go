@@ -5,9 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/meirizal/terraform-experiment/api/server"
+	"golang.org/x/exp/slices"
 )
 
 // Client holds all of the information required to connect to a server
@@ -16,32 +22,171 @@ type Client struct {
 	port       int
 	authToken  string
 	httpClient *http.Client
+	// override is sent in server.OverrideHeader with every change if it is not empty
+	override string
+	// changeTimeout is how long to wait for a change held for approval or queued by the change calendar
+	changeTimeout time.Duration
+	// namespace is the namespace requests are made in if it is not empty, instead of the token's namespace
+	namespace string
+	// apiVersion is the version of the API requests are made in, or empty for the unversioned routes
+	apiVersion string
 }
 
+// namespacedRoutes are the first segments of the paths the server serves in a namespace
+var namespacedRoutes = []string{"item", "device", "change", "event", "operation", "window", "webhook"}
+
+const (
+	// defaultChangeTimeout is how long a change is waited for unless WithChangeTimeout says otherwise
+	defaultChangeTimeout = 30 * time.Minute
+	// maxChangePoll is the longest wait between two checks of a change being waited for
+	maxChangePoll = 5 * time.Second
+)
+
 // NewClient returns a new client configured to communicate on a server with the
 // given hostname and port and to send an Authorization Header with the value of
 // token
 func NewClient(hostname string, port int, token string) *Client {
 	return &Client{
-		hostname:   hostname,
-		port:       port,
-		authToken:  token,
-		httpClient: &http.Client{},
+		hostname:      hostname,
+		port:          port,
+		authToken:     token,
+		httpClient:    &http.Client{},
+		changeTimeout: defaultChangeTimeout,
+		apiVersion:    server.APIVersion1,
+	}
+}
+
+// WithChangeTimeout returns a copy of the client waiting up to timeout for a change the server held for
+// approval or queued by its change calendar to be made, before failing with a ChangeError
+func (c *Client) WithChangeTimeout(timeout time.Duration) *Client {
+	copied := *c
+	copied.changeTimeout = timeout
+	return &copied
+}
+
+// SetEmergencyOverride sends reason with every change, so that the server makes changes its change calendar
+// doesn't allow and records reason on their operations. An empty reason stops overriding
+func (c *Client) SetEmergencyOverride(reason string) {
+	c.override = reason
+}
+
+// SetNamespace makes the requests for items, devices, changes and operations in namespace, which must be the
+// token's namespace if the server has tokens. An empty namespace uses the token's namespace, or the default
+// namespace if the server has no tokens
+func (c *Client) SetNamespace(namespace string) {
+	c.namespace = namespace
+}
+
+// SetAPIVersion makes the requests in version of the API, server.APIVersion1 unless it is set. An empty version
+// makes them on the unversioned routes, for servers from before the API had versions
+func (c *Client) SetAPIVersion(version string) error {
+	if version != "" && !slices.Contains(server.APIVersions, version) {
+		return fmt.Errorf("API version %s is not supported, the supported versions are %s", version, strings.Join(server.APIVersions, ", "))
 	}
+	c.apiVersion = version
+	return nil
+}
+
+// ItemOption narrows down, sorts or selects the fields of the items returned by GetAll and GetItemPage
+type ItemOption func(url.Values)
+
+// ItemHost only returns the items whose host matches pattern, a host or a pattern where * matches any
+// characters
+func ItemHost(pattern string) ItemOption {
+	return func(query url.Values) { query.Set("host", pattern) }
+}
+
+// ItemType only returns the items of the interface type typ
+func ItemType(typ string) ItemOption {
+	return func(query url.Values) { query.Set("type", typ) }
+}
+
+// ItemShutdown only returns the items that are shut down, or that aren't
+func ItemShutdown(shutdown bool) ItemOption {
+	return func(query url.Values) { query.Set("shutdown", strconv.FormatBool(shutdown)) }
+}
+
+// ItemPolicy only returns the items with the input or output service policy policy
+func ItemPolicy(policy string) ItemOption {
+	return func(query url.Values) { query.Set("policy", policy) }
+}
+
+// ItemTag only returns the items with tag, and every other tag asked for
+func ItemTag(tag string) ItemOption {
+	return func(query url.Values) { query.Add("tag", tag) }
+}
+
+// ItemFields only returns fields of each item, which always has its host
+func ItemFields(fields ...string) ItemOption {
+	return func(query url.Values) { query.Set("fields", strings.Join(fields, ",")) }
+}
+
+// ItemSort sorts the items by field, in descending order if it is prefixed with -
+func ItemSort(field string) ItemOption {
+	return func(query url.Values) { query.Set("sort", field) }
 }
 
-// GetAll Retrieves all of the Items from the server
-func (c *Client) GetAll() (*map[string]server.Item, error) {
-	body, err := c.httpRequest("item", "GET", bytes.Buffer{})
+// ItemLimit returns up to limit items in each page
+func ItemLimit(limit int) ItemOption {
+	return func(query url.Values) { query.Set("limit", strconv.Itoa(limit)) }
+}
+
+// GetAll Retrieves all of the Items from the server, or with opts all of the items matching them, fetching
+// them a page at a time
+func (c *Client) GetAll(opts ...ItemOption) (*map[string]server.Item, error) {
+	items := map[string]server.Item{}
+	if len(opts) == 0 {
+		body, err := c.httpRequest("item", "GET", bytes.Buffer{})
+		if err != nil {
+			return nil, err
+		}
+		err = json.NewDecoder(body).Decode(&items)
+		if err != nil {
+			return nil, err
+		}
+		return &items, nil
+	}
+
+	cursor := ""
+	for {
+		page, err := c.GetItemPage(cursor, opts...)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			items[item.Host] = item
+		}
+		if page.NextCursor == "" {
+			return &items, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// GetItemPage retrieves the page of the items matching opts after cursor, the NextCursor of the page before
+// it or empty for the first page
+func (c *Client) GetItemPage(cursor string, opts ...ItemOption) (*server.ItemPage, error) {
+	query := url.Values{}
+	for _, opt := range opts {
+		opt(query)
+	}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	if len(query) == 0 {
+		query.Set("sort", "host")
+	}
+	body, err := c.httpRequest("item?"+query.Encode(), "GET", bytes.Buffer{})
 	if err != nil {
 		return nil, err
 	}
-	items := map[string]server.Item{}
-	err = json.NewDecoder(body).Decode(&items)
+	defer body.Close()
+	page := &server.ItemPage{}
+	err = json.NewDecoder(body).Decode(page)
 	if err != nil {
 		return nil, err
 	}
-	return &items, nil
+	return page, nil
 }
 
 // GetItem gets an item with a specific name from the server
@@ -72,63 +217,440 @@ func (c *Client) NewItem(item *server.Item) error {
 	return nil
 }
 
-// UpdateItem updates the values of an item
+// UpdateItem updates the values of an item. If the item has a revision, the server refuses the update when the
+// item has been changed since that revision, with an error IsPreconditionFailed reports
 func (c *Client) UpdateItem(item *server.Item) error {
 	buf := bytes.Buffer{}
 	err := json.NewEncoder(&buf).Encode(item)
 	if err != nil {
 		return err
 	}
-	_, err = c.httpRequest(fmt.Sprintf("item/%s", item.Host), "PUT", buf)
+	_, err = c.httpRequestWithHeader(fmt.Sprintf("item/%s", item.Host), "PUT", buf, ifMatch(item.Revision))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// DeleteItem removes an item from the server
+// DeleteItem removes an item from the server. Like UpdateItem, it is refused if the item has a revision and
+// has been changed since
 func (c *Client) DeleteItem(item *server.Item) error {
 	buf := bytes.Buffer{}
 	err := json.NewEncoder(&buf).Encode(item)
 	if err != nil {
 		return err
 	}
-	_, err = c.httpRequest(fmt.Sprintf("item/%s", item.Host), "DELETE", buf)
+	_, err = c.httpRequestWithHeader(fmt.Sprintf("item/%s", item.Host), "DELETE", buf, ifMatch(item.Revision))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// PatchItem changes some of the fields of the item name with patch and returns the patched item. patch is
+// either a JSON Merge Patch of the fields to change, e.g. map[string]interface{}{"mtu": 9000} where nil sets
+// a field back to its default, or a JSON Patch given as []server.PatchOperation. Like UpdateItem, it is
+// refused if revision isn't 0 and the item has been changed since that revision
+func (c *Client) PatchItem(name string, revision int64, patch interface{}) (*server.Item, error) {
+	buf := bytes.Buffer{}
+	err := json.NewEncoder(&buf).Encode(patch)
+	if err != nil {
+		return nil, err
+	}
+	header := ifMatch(revision)
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", server.MergePatchType)
+	if _, ok := patch.([]server.PatchOperation); ok {
+		header.Set("Content-Type", server.JSONPatchType)
+	}
+	body, err := c.httpRequestWithHeader(fmt.Sprintf("item/%s", name), "PATCH", buf, header)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	item := &server.Item{}
+	err = json.NewDecoder(body).Decode(item)
+	if err == io.EOF {
+		// a change that waited for approval or the change calendar is answered without the item
+		return c.GetItem(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// ifMatch returns the If-Match header for changing an item only if it is still at revision, or nil if
+// revision is 0
+func ifMatch(revision int64) http.Header {
+	if revision == 0 {
+		return nil
+	}
+	return http.Header{"If-Match": {strconv.Quote(strconv.FormatInt(revision, 10))}}
+}
+
+// GetItemConfig reads the running configuration of an item's interface from its device
+func (c *Client) GetItemConfig(name string) (string, error) {
+	body, err := c.httpRequest(fmt.Sprintf("item/%s/config", name), "GET", bytes.Buffer{})
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	config, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return string(config), nil
+}
+
+// SaveDevice saves the running configuration of the device at host to its startup configuration, returning
+// the save operation
+func (c *Client) SaveDevice(host string) (*server.Operation, error) {
+	body, err := c.httpRequest(fmt.Sprintf("device/%s/save", url.PathEscape(host)), "POST", bytes.Buffer{})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	operation := &server.Operation{}
+	err = json.NewDecoder(body).Decode(operation)
+	if err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+// GetBackups retrieves the backed up versions of the running configuration of the device at host, without
+// their content
+func (c *Client) GetBackups(host string) ([]server.Backup, error) {
+	body, err := c.httpRequest(fmt.Sprintf("device/%s/backup", url.PathEscape(host)), "GET", bytes.Buffer{})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	backups := []server.Backup{}
+	err = json.NewDecoder(body).Decode(&backups)
+	if err != nil {
+		return nil, err
+	}
+	return backups, nil
+}
+
+// GetBackup retrieves a single version of the running configuration of the device at host, including its
+// content
+func (c *Client) GetBackup(host string, version int) (*server.Backup, error) {
+	body, err := c.httpRequest(fmt.Sprintf("device/%s/backup/%d", url.PathEscape(host), version), "GET", bytes.Buffer{})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	backup := &server.Backup{}
+	err = json.NewDecoder(body).Decode(backup)
+	if err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// GetBackupDiff returns the unified diff between two versions of the running configuration of the device at
+// host. A zero to compares with the latest version and a zero from with the version before to
+func (c *Client) GetBackupDiff(host string, from, to int) (string, error) {
+	query := url.Values{}
+	if from != 0 {
+		query.Set("from", strconv.Itoa(from))
+	}
+	if to != 0 {
+		query.Set("to", strconv.Itoa(to))
+	}
+	path := fmt.Sprintf("device/%s/diff", url.PathEscape(host))
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	body, err := c.httpRequest(path, "GET", bytes.Buffer{})
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	diff, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return string(diff), nil
+}
+
+// GetDeadLetters retrieves the events of the namespace the server could not deliver to a webhook
+func (c *Client) GetDeadLetters() ([]server.DeadLetter, error) {
+	body, err := c.httpRequest("webhook/dead-letter", "GET", bytes.Buffer{})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	letters := []server.DeadLetter{}
+	err = json.NewDecoder(body).Decode(&letters)
+	if err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
+
+// GetWindows retrieves the maintenance windows and change freezes of the namespace, and those of every
+// namespace, in the server's change calendar
+func (c *Client) GetWindows() ([]server.Window, error) {
+	body, err := c.httpRequest("window", "GET", bytes.Buffer{})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	windows := []server.Window{}
+	err = json.NewDecoder(body).Decode(&windows)
+	if err != nil {
+		return nil, err
+	}
+	return windows, nil
+}
+
+// NewWindow adds a maintenance window or change freeze of the namespace to the server's change calendar
+func (c *Client) NewWindow(window *server.Window) error {
+	buf := bytes.Buffer{}
+	err := json.NewEncoder(&buf).Encode(window)
+	if err != nil {
+		return err
+	}
+	body, err := c.httpRequest("window", "POST", buf)
+	if err != nil {
+		return err
+	}
+	body.Close()
+	return nil
+}
+
+// DeleteWindow removes a maintenance window or change freeze of the namespace from the server's change
+// calendar
+func (c *Client) DeleteWindow(name string) error {
+	body, err := c.httpRequest(fmt.Sprintf("window/%s", url.PathEscape(name)), "DELETE", bytes.Buffer{})
+	if err != nil {
+		return err
+	}
+	body.Close()
+	return nil
+}
+
+// GetChanges retrieves the changes the server held for approval or queued by its change calendar, including
+// those already made, rejected or cancelled, oldest first
+func (c *Client) GetChanges() ([]server.QueuedChange, error) {
+	body, err := c.httpRequest("change", "GET", bytes.Buffer{})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	changes := []server.QueuedChange{}
+	err = json.NewDecoder(body).Decode(&changes)
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// GetChange retrieves a change the server held for approval or queued by its change calendar
+func (c *Client) GetChange(id string) (*server.QueuedChange, error) {
+	body, err := c.httpRequest(fmt.Sprintf("change/%s", id), "GET", bytes.Buffer{})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	change := &server.QueuedChange{}
+	err = json.NewDecoder(body).Decode(change)
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// ApproveChange approves a change waiting for approval, which must have been submitted with a different
+// token, giving reason if it is not empty
+func (c *Client) ApproveChange(id, reason string) (*server.QueuedChange, error) {
+	return c.reviewChange(id, "approve", reason)
+}
+
+// RejectChange rejects a change waiting for approval, giving reason if it is not empty
+func (c *Client) RejectChange(id, reason string) (*server.QueuedChange, error) {
+	return c.reviewChange(id, "reject", reason)
+}
+
+func (c *Client) reviewChange(id, decision, reason string) (*server.QueuedChange, error) {
+	buf := bytes.Buffer{}
+	err := json.NewEncoder(&buf).Encode(server.Review{Reason: reason})
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.httpRequest(fmt.Sprintf("change/%s/%s", id, decision), "POST", buf)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	change := &server.QueuedChange{}
+	err = json.NewDecoder(body).Decode(change)
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// waitForChange polls a change the server answered a request with until it is made, failing with a
+// ChangeError if it is not made or the change timeout runs out first. The server doesn't keep the response
+// to the change, so the body returned for it is empty
+func (c *Client) waitForChange(change server.QueuedChange) (io.ReadCloser, error) {
+	log.Printf("[INFO] change %s is %s, waiting up to %s for it to be made", change.ID, change.Status, c.changeTimeout)
+	deadline := time.Now().Add(c.changeTimeout)
+	poll := 100 * time.Millisecond
+	for {
+		switch change.Status {
+		case server.ChangeApplied:
+			return io.NopCloser(strings.NewReader("")), nil
+		case server.ChangeFailed, server.ChangeCancelled:
+			return nil, &ChangeError{ChangeID: change.ID, Status: change.Status, Message: change.Error}
+		case server.ChangeRejected:
+			return nil, &ChangeError{ChangeID: change.ID, Status: change.Status, Message: change.Reason}
+		}
+		if time.Now().Add(poll).After(deadline) {
+			return nil, &ChangeError{ChangeID: change.ID, Status: change.Status, Message: fmt.Sprintf("not made within %s", c.changeTimeout)}
+		}
+		time.Sleep(poll)
+		if poll *= 2; poll > maxChangePoll {
+			poll = maxChangePoll
+		}
+		latest, err := c.GetChange(change.ID)
+		if err != nil {
+			return nil, fmt.Errorf("change %s: %w", change.ID, err)
+		}
+		change = *latest
+	}
+}
+
+// GetOperations retrieves the device operations recorded by the server, without their transcripts. If
+// host is not empty only the operations for that device are returned
+func (c *Client) GetOperations(host string) ([]server.Operation, error) {
+	path := "operation"
+	if host != "" {
+		path = fmt.Sprintf("operation?host=%s", url.QueryEscape(host))
+	}
+	body, err := c.httpRequest(path, "GET", bytes.Buffer{})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	operations := []server.Operation{}
+	err = json.NewDecoder(body).Decode(&operations)
+	if err != nil {
+		return nil, err
+	}
+	return operations, nil
+}
+
+// GetOperation retrieves a single device operation, including its session transcript
+func (c *Client) GetOperation(id string) (*server.Operation, error) {
+	body, err := c.httpRequest(fmt.Sprintf("operation/%s", id), "GET", bytes.Buffer{})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	operation := &server.Operation{}
+	err = json.NewDecoder(body).Decode(operation)
+	if err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+// GetTemplates retrieves the configuration templates loaded by the server and their versions
+func (c *Client) GetTemplates() ([]server.TemplateInfo, error) {
+	body, err := c.httpRequest("template", "GET", bytes.Buffer{})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	templates := []server.TemplateInfo{}
+	err = json.NewDecoder(body).Decode(&templates)
+	if err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
 func (c *Client) httpRequest(path, method string, body bytes.Buffer) (closer io.ReadCloser, err error) {
+	return c.httpRequestWithHeader(path, method, body, nil)
+}
+
+// httpRequestWithHeader is httpRequest with header added to the request, replacing the headers it sets
+func (c *Client) httpRequestWithHeader(path, method string, body bytes.Buffer, header http.Header) (closer io.ReadCloser, err error) {
 	req, err := http.NewRequest(method, c.requestPath(path), &body)
 	if err != nil {
 		return nil, err
 	}
+	// The request ID is logged here and by the server so that provider logs (TF_LOG) can be matched
+	// against the server logs for the same request
+	requestID := server.NewRequestID()
 	req.Header.Add("Authorization", c.authToken)
+	req.Header.Add(server.RequestIDHeader, requestID)
+	if c.apiVersion != "" {
+		req.Header.Add(server.APIVersionHeader, c.apiVersion)
+	}
 	switch method {
 	case "GET":
 	case "DELETE":
 	default:
 		req.Header.Add("Content-Type", "application/json")
 	}
+	if c.override != "" && method != "GET" {
+		req.Header.Add(server.OverrideHeader, c.override)
+	}
+	for key, values := range header {
+		req.Header[http.CanonicalHeaderKey(key)] = values
+	}
 
+	log.Printf("[DEBUG] %s %s request_id=%s", method, req.URL.Path, requestID)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("request %s failed: %w", requestID, err)
 	}
+	log.Printf("[DEBUG] %s %s request_id=%s status=%d", method, req.URL.Path, requestID, resp.StatusCode)
 
+	// a change held for approval or queued by the change calendar is answered with where to follow it
+	if resp.StatusCode == http.StatusAccepted && method != "GET" {
+		defer resp.Body.Close()
+		var change server.QueuedChange
+		if err := json.NewDecoder(resp.Body).Decode(&change); err != nil {
+			return nil, fmt.Errorf("request %s: %w", requestID, err)
+		}
+		return c.waitForChange(change)
+	}
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		apiErr := &APIError{StatusCode: resp.StatusCode, RequestID: requestID}
 		respBody := new(bytes.Buffer)
 		_, err := respBody.ReadFrom(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("got a non 200 status code: %v", resp.StatusCode)
+		body := server.Error{}
+		if err != nil || json.Unmarshal(respBody.Bytes(), &body) != nil || body.Message == "" {
+			// Not every response comes from the API handlers, e.g. a proxy in front of the server
+			body = server.Error{Code: server.CodeInternal, Message: strings.TrimSpace(respBody.String())}
 		}
-		return nil, fmt.Errorf("got a non 200 status code: %v - %s", resp.StatusCode, respBody.String())
+		apiErr.Code, apiErr.Message, apiErr.Field = body.Code, body.Message, body.Field
+		for _, fe := range body.Errors {
+			apiErr.FieldErrors = append(apiErr.FieldErrors, FieldError{Field: fe.Field, Code: fe.Code, Message: fe.Message})
+		}
+		return nil, apiErr
 	}
 	return resp.Body, nil
 }
 
 func (c *Client) requestPath(path string) string {
+	root := strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '?' })
+	if c.namespace != "" && len(root) > 0 && slices.Contains(namespacedRoutes, root[0]) {
+		path = fmt.Sprintf("namespace/%s/%s", url.PathEscape(c.namespace), path)
+	}
+	if c.apiVersion != "" {
+		path = fmt.Sprintf("v%s/%s", c.apiVersion, path)
+	}
 	return fmt.Sprintf("%s:%v/%s", c.hostname, c.port, path)
 }
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/meirizal/terraform-experiment/api/server"
+)
+
+// APIError is returned when the server responds with a non 200 status code. It carries the error body
+// sent by the server along with the status code and the ID of the request
+type APIError struct {
+	StatusCode int
+	RequestID  string
+	Code       string
+	Message    string
+	Field      string
+	// FieldErrors lists each invalid field when the server rejected an item as invalid
+	FieldErrors []FieldError
+}
+
+// FieldError describes a single invalid field of a request
+type FieldError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Message)
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if e.Field != "" {
+		msg = fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	if len(e.FieldErrors) > 0 {
+		fields := make([]string, 0, len(e.FieldErrors))
+		for _, fe := range e.FieldErrors {
+			fields = append(fields, fe.Error())
+		}
+		msg = fmt.Sprintf("%s: %s", msg, strings.Join(fields, "; "))
+	}
+	return fmt.Sprintf("got a non 200 status code: %v (request_id %s) - %s", e.StatusCode, e.RequestID, msg)
+}
+
+// ChangeError is returned when a change the server held for approval or queued by its change calendar was
+// rejected, cancelled or failed, or was still waiting when the client stopped waiting for it. ChangeID is
+// the change to follow up on the server
+type ChangeError struct {
+	ChangeID string
+	Status   string
+	Message  string
+}
+
+func (e *ChangeError) Error() string {
+	if e.Status == server.ChangePending || e.Status == server.ChangeQueued {
+		return fmt.Sprintf("change %s is still %s: %s", e.ChangeID, e.Status, e.Message)
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("change %s was %s", e.ChangeID, e.Status)
+	}
+	return fmt.Sprintf("change %s was %s: %s", e.ChangeID, e.Status, e.Message)
+}
+
+// IsNotFound reports whether err is an APIError for something that does not exist on the server
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsPreconditionFailed reports whether err is an APIError for a change refused because the item was changed
+// since it was read
+func IsPreconditionFailed(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusPreconditionFailed
+}
+
+// ValidationErrors returns the invalid fields if err is an APIError rejecting an item as invalid, or nil
+// otherwise
+func ValidationErrors(err error) []FieldError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnprocessableEntity {
+		return apiErr.FieldErrors
+	}
+	return nil
+}
@@ -1,34 +1,265 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/meirizal/terraform-experiment/api/server"
+	"golang.org/x/exp/slices"
 )
 
 func main() {
+	listen := flag.String("listen", "localhost:3001", "the host:port to serve the API on")
+	grpcListen := flag.String("grpc-listen", "", "the host:port to serve the gRPC API on, empty to serve only the REST API")
+	grpcCert := flag.String("grpc-cert", "", "a PEM file with the certificate to serve the gRPC API over TLS with, required unless it is served on a loopback address")
+	grpcKey := flag.String("grpc-key", "", "a PEM file with the private key of the gRPC certificate")
 	seed := flag.String("seed", "", "a file location with some data in JSON form to seed the server content")
+	maxOperations := flag.Int("transcript-max-operations", server.DefaultTranscriptMaxOperations, "the number of operation transcripts to keep, 0 for no limit")
+	maxAge := flag.Duration("transcript-max-age", server.DefaultTranscriptMaxAge, "how long to keep operation transcripts, 0 for no limit")
+	var redactPatterns patternList
+	flag.Var(&redactPatterns, "redact", "a regular expression to redact from transcripts, can be repeated")
+	templateDir := flag.String("template-dir", "", "a directory of templates overriding or adding to the embedded templates")
+	templateReload := flag.Duration("template-reload", 5*time.Second, "how often to check the template directory for changes, 0 to disable reloading")
+	restconfCA := flag.String("restconf-ca", "", "a PEM file of CA certificates to verify RESTCONF device certificates with instead of the system roots")
+	restconfInsecure := flag.Bool("restconf-insecure", false, "skip verifying RESTCONF device certificates")
+	gnmiCA := flag.String("gnmi-ca", "", "a PEM file of CA certificates to verify gNMI device certificates with instead of the system roots")
+	gnmiInsecure := flag.Bool("gnmi-insecure", false, "skip verifying gNMI device certificates")
+	savePolicy := flag.String("save-policy", server.DefaultSavePolicy, "when to save the running configuration after a change, one of "+strings.Join(server.SavePolicies, ", "))
+	saveIdle := flag.Duration("save-idle", time.Minute, "how long a device has to be left unchanged before it is saved with the idle save policy")
+	webhooks := flag.String("webhooks", "", "a file location with the webhooks to send events to in JSON form")
+	webhookAttempts := flag.Int("webhook-attempts", 5, "how many times a webhook delivery is attempted before it is dead-lettered")
+	webhookBackoff := flag.Duration("webhook-backoff", time.Second, "the wait before retrying a failed webhook delivery, doubled for every retry")
+	backupVersions := flag.Int("backup-versions", 50, "the number of running configuration backups to keep per device, 0 to disable backups")
+	sshRetryAttempts := flag.Int("ssh-retry-attempts", 4, "how many times connecting to a device over SSH is attempted when it fails with a transient error, 1 to disable retries")
+	sshRetryBackoff := flag.Duration("ssh-retry-backoff", 500*time.Millisecond, "the wait before retrying a failed SSH connection, doubled for every retry")
+	sshRetryBudget := flag.Duration("ssh-retry-budget", 30*time.Second, "how long connecting to a device over SSH can take including retries, 0 for no limit")
+	routes := flag.String("routes", "", "a file location with the jump hosts and SOCKS5 proxies to reach devices through in JSON form")
+	windows := flag.String("windows", "", "a file location with the maintenance windows and change freezes to start the change calendar with in JSON form")
+	approvalTags := flag.String("approval-tags", "", "comma separated device tags, such as production, whose item changes must be approved by a second token holder before they are pushed")
+	tokens := flag.String("tokens", "", "a file location with the accepted tokens, each mapped to its namespace, in JSON form; without it any non-empty token is accepted in every namespace")
+	clusterFile := flag.String("cluster", "", "a file location with the ID of this instance, the URLs of the other instances, the secret of the cluster to replicate the items with and the directory to keep the state of the instance in, in JSON form")
 	flag.Parse()
 
+	if !slices.Contains(server.SavePolicies, *savePolicy) {
+		fatal("invalid save policy", fmt.Errorf("%q is not one of %s", *savePolicy, strings.Join(server.SavePolicies, ", ")))
+	}
+	if *webhookAttempts < 1 {
+		fatal("invalid webhook attempts", fmt.Errorf("%d is less than 1", *webhookAttempts))
+	}
+	if *sshRetryAttempts < 1 {
+		fatal("invalid ssh retry attempts", fmt.Errorf("%d is less than 1", *sshRetryAttempts))
+	}
+
 	items := map[string]server.Item{}
 
 	if *seed != "" {
 		seedData, err := ioutil.ReadFile(*seed)
 		if err != nil {
-			log.Fatal(err)
+			fatal("unable to read seed file", err)
 		}
 		err = json.Unmarshal(seedData, &items)
 		if err != nil {
-			log.Fatal(err)
+			fatal("unable to parse seed file", err)
+		}
+	}
+
+	var hooks []server.Webhook
+	if *webhooks != "" {
+		hookData, err := os.ReadFile(*webhooks)
+		if err != nil {
+			fatal("unable to read webhooks file", err)
+		}
+		err = json.Unmarshal(hookData, &hooks)
+		if err != nil {
+			fatal("unable to parse webhooks file", err)
+		}
+		for _, hook := range hooks {
+			if err := server.ValidateWebhook(hook); err != nil {
+				fatal("invalid webhook", err)
+			}
+		}
+	}
+
+	var deviceRoutes []server.Route
+	if *routes != "" {
+		routeData, err := os.ReadFile(*routes)
+		if err != nil {
+			fatal("unable to read routes file", err)
+		}
+		err = json.Unmarshal(routeData, &deviceRoutes)
+		if err != nil {
+			fatal("unable to parse routes file", err)
+		}
+		for _, route := range deviceRoutes {
+			if err := server.ValidateRoute(route); err != nil {
+				fatal("invalid route", err)
+			}
+		}
+	}
+
+	var calendar []server.Window
+	if *windows != "" {
+		windowData, err := os.ReadFile(*windows)
+		if err != nil {
+			fatal("unable to read windows file", err)
+		}
+		err = json.Unmarshal(windowData, &calendar)
+		if err != nil {
+			fatal("unable to parse windows file", err)
+		}
+		for _, window := range calendar {
+			if errs := server.ValidateWindow(window); errs != nil {
+				fatal("invalid window "+window.Name, errs[0])
+			}
 		}
 	}
 
-	itemService := server.NewService("localhost:3001", items)
+	var namespaces map[string]string
+	if *tokens != "" {
+		tokenData, err := os.ReadFile(*tokens)
+		if err != nil {
+			fatal("unable to read tokens file", err)
+		}
+		err = json.Unmarshal(tokenData, &namespaces)
+		if err != nil {
+			fatal("unable to parse tokens file", err)
+		}
+		for _, namespace := range namespaces {
+			if err := server.ValidateNamespace(namespace); err != nil {
+				fatal("invalid token namespace", err)
+			}
+		}
+	}
+
+	var cluster *server.Cluster
+	if *clusterFile != "" {
+		clusterData, err := os.ReadFile(*clusterFile)
+		if err != nil {
+			fatal("unable to read cluster file", err)
+		}
+		err = json.Unmarshal(clusterData, &cluster)
+		if err != nil {
+			fatal("unable to parse cluster file", err)
+		}
+		if err := server.ValidateCluster(*cluster); err != nil {
+			fatal("invalid cluster", err)
+		}
+	}
+
+	var approvals []string
+	for _, tag := range strings.Split(*approvalTags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			approvals = append(approvals, tag)
+		}
+	}
+
+	if len(approvals) > 0 && namespaces == nil {
+		fatal("invalid approval tags", errors.New("approvals need -tokens to tell the submitter and reviewer of a change apart"))
+	}
+	if len(approvals) > 0 && cluster != nil {
+		fatal("invalid approval tags", errors.New("approvals can't be used with -cluster, which doesn't replicate pending changes"))
+	}
+
+	options := []server.Option{
+		server.WithTranscriptRetention(*maxOperations, *maxAge),
+		server.WithRedactPatterns(redactPatterns...),
+		server.WithTemplateDir(*templateDir, *templateReload),
+		server.WithSavePolicy(*savePolicy, *saveIdle),
+		server.WithBackups(*backupVersions),
+		server.WithWebhooks(hooks...),
+		server.WithWebhookRetry(*webhookAttempts, *webhookBackoff),
+		server.WithSSHRetry(*sshRetryAttempts, *sshRetryBackoff, *sshRetryBudget),
+		server.WithRoutes(deviceRoutes...),
+		server.WithWindows(calendar...),
+		server.WithApprovals(approvals...),
+	}
+	if namespaces != nil {
+		options = append(options, server.WithTokens(namespaces))
+	}
+	if cluster != nil {
+		options = append(options, server.WithCluster(*cluster))
+	}
+	if *grpcListen != "" {
+		options = append(options, server.WithGRPC(*grpcListen))
+	}
+	if *grpcCert != "" || *grpcKey != "" {
+		cert, err := tls.LoadX509KeyPair(*grpcCert, *grpcKey)
+		if err != nil {
+			fatal("unable to load grpc certificate", err)
+		}
+		options = append(options, server.WithGRPCTLS(&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}))
+	}
+	if *restconfCA != "" || *restconfInsecure {
+		tlsConfig, err := deviceTLS(*restconfCA, *restconfInsecure)
+		if err != nil {
+			fatal("unable to load restconf CA", err)
+		}
+		options = append(options, server.WithRESTCONFTLS(tlsConfig))
+	}
+	if *gnmiCA != "" || *gnmiInsecure {
+		tlsConfig, err := deviceTLS(*gnmiCA, *gnmiInsecure)
+		if err != nil {
+			fatal("unable to load gnmi CA", err)
+		}
+		options = append(options, server.WithGNMITLS(tlsConfig))
+	}
+
+	itemService := server.NewService(*listen, items, options...)
 	err := itemService.ListenAndServe()
 	if err != nil {
-		log.Fatal(err)
+		fatal("server stopped", err)
+	}
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// deviceTLS returns the TLS configuration verifying device certificates with the CA certificates in the
+// PEM file caFile, or not verifying them at all if insecure
+func deviceTLS(caFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	return config, nil
+}
+
+// patternList collects the regular expressions passed with a repeated flag
+type patternList []*regexp.Regexp
+
+func (p *patternList) String() string {
+	patterns := make([]string, 0, len(*p))
+	for _, pattern := range *p {
+		patterns = append(patterns, pattern.String())
+	}
+	return strings.Join(patterns, ", ")
+}
+
+func (p *patternList) Set(value string) error {
+	pattern, err := regexp.Compile(value)
+	if err != nil {
+		return err
 	}
+	*p = append(*p, pattern)
+	return nil
 }
@@ -0,0 +1,5 @@
+// Package pb is the gRPC API of the server generated from items.proto, with NewItemServiceClient as its Go
+// client. The API is served by server.Service alongside the REST API
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative items.proto
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slices"
+)
+
+// Review is the optional body of an approval or rejection
+type Review struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// errNoTokenHolders refuses the changes needing approval, and their reviews, of a server without tokens,
+// which accepts any token and so can't tell its holders apart
+var errNoTokenHolders = &Error{Code: CodeForbidden, Message: "changes needing approval can only be made and reviewed when the server has tokens"}
+
+// tokenHolder identifies the holder of the configured token r is authorized with, without revealing the
+// token. It returns false if the server has no tokens, or the token isn't one of them
+func (s *Service) tokenHolder(r *http.Request) (string, bool) {
+	token := r.Header.Get("Authorization")
+	if _, ok := s.tokens[token]; !ok {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:8]), true
+}
+
+// needsApproval reports whether changes to a device with tags must be approved before they are pushed
+func (s *Service) needsApproval(tags []string) bool {
+	for _, tag := range s.approvalTags {
+		if slices.Contains(tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// changeApproved checks whether a change to host needs approval. A change that doesn't goes ahead, and so
+// does one being made once approved, as long as stored and the template pushed are still those it was
+// approved against. Otherwise the change is held as a pending change showing the diff from stored to
+// proposed, with secrets redacted, and answered with a 202. pushed is what is pushed to make the change,
+// and a nil proposed is a delete, removing everything rendered for stored. Does not lock access to the
+// itemService, expects this to be done by the calling method
+func (s *Service) changeApproved(w http.ResponseWriter, r *http.Request, host string, tags []string, body []byte, stored *Item, pushed, proposed *push, secrets ...string) bool {
+	var revision int64
+	if stored != nil {
+		revision = stored.Revision
+	}
+	if a, ok := approvalFrom(r.Context()); ok {
+		if a.revision != revision || a.templateVersion != pushed.tmpl.Version {
+			httpError(w, fmt.Sprintf("item %s or its template has been changed since the change was approved", host), http.StatusPreconditionFailed, CodePreconditionFailed)
+			return false
+		}
+		return true
+	}
+	if !s.needsApproval(tags) {
+		return true
+	}
+	if s.cluster != nil {
+		writeError(w, http.StatusForbidden, errApprovalsInCluster)
+		return false
+	}
+	logger := loggerFrom(r.Context())
+	submitter, ok := s.tokenHolder(r)
+	if !ok {
+		writeError(w, http.StatusForbidden, errNoTokenHolders)
+		return false
+	}
+
+	change := newQueuedChange(r, host, tags, body)
+	change.Status = ChangePending
+	change.Diff = s.redactor.redact(s.configDiff(r, stored, proposed), secrets...)
+	change.Submitter = submitter
+	change.Revision = revision
+	change.TemplateVersion = pushed.tmpl.Version
+	s.changes.Lock()
+	s.changes.changes[change.ID] = change
+	pending := *change
+	s.changes.Unlock()
+
+	logger.Info("change waiting for approval", "host", host, "change_id", change.ID, "submitter", change.Submitter)
+	s.changeEvent(EventChangeSubmitted, pending)
+	writeQueuedChange(w, logger, pending)
+	return false
+}
+
+// configDiff returns the diff from the configuration rendered for stored, if there is one, to the one
+// rendered for p
+func (s *Service) configDiff(r *http.Request, stored *Item, p *push) string {
+	var current, proposed string
+	if stored != nil {
+		// a stored item that can no longer be rendered is shown as having no configuration
+		if before, ok := s.preparePush(&changeWriter{header: http.Header{}}, r, *stored, templateInterface); ok {
+			current = before.config
+		}
+	}
+	if p != nil {
+		proposed = p.config
+	}
+	return unifiedDiff("current", "proposed", current, proposed)
+}
+
+// approval is what a change being made was approved as: by which token holder, against which revision of
+// the item, 0 if there was none, and with which version of the template pushed
+type approval struct {
+	reviewer        string
+	revision        int64
+	templateVersion string
+}
+
+// withApproval returns a copy of ctx carrying the approval of the change being made
+func withApproval(ctx context.Context, a approval) context.Context {
+	return context.WithValue(ctx, approverKey, a)
+}
+
+// approvalFrom returns the approval of the change being made stored in ctx, and false if it wasn't approved
+func approvalFrom(ctx context.Context) (approval, bool) {
+	a, ok := ctx.Value(approverKey).(approval)
+	return a, ok
+}
+
+// approverFrom returns the token holder who approved the change being made stored in ctx, or an empty
+// string if it wasn't approved
+func approverFrom(ctx context.Context) string {
+	a, _ := approvalFrom(ctx)
+	return a.reviewer
+}
+
+// changeEvent publishes an event of typ for change
+func (s *Service) changeEvent(typ string, change QueuedChange) {
+	s.events.publish(Event{Type: typ, RequestID: change.RequestID, Namespace: change.Namespace, Host: change.Host, Change: &change})
+}
+
+// ApproveChange approves a change waiting for approval, which is then made as soon as the change calendar
+// allows it. The change can't be approved by the token holder who submitted it
+func (s *Service) ApproveChange(w http.ResponseWriter, r *http.Request) {
+	s.reviewChange(w, r, true)
+}
+
+// RejectChange rejects a change waiting for approval, which is kept with the reason it was rejected for
+func (s *Service) RejectChange(w http.ResponseWriter, r *http.Request) {
+	s.reviewChange(w, r, false)
+}
+
+func (s *Service) reviewChange(w http.ResponseWriter, r *http.Request, approve bool) {
+	logger := loggerFrom(r.Context())
+	var review Review
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil && !errors.Is(err, io.EOF) {
+			httpError(w, err.Error(), http.StatusBadRequest, CodeBadRequest)
+			return
+		}
+	}
+	id := mux.Vars(r)["id"]
+	reviewer, ok := s.tokenHolder(r)
+	if !ok {
+		writeError(w, http.StatusForbidden, errNoTokenHolders)
+		return
+	}
+
+	s.changes.Lock()
+	change, ok := s.changes.changes[id]
+	if !ok || change.Namespace != namespaceFrom(r.Context()) {
+		s.changes.Unlock()
+		httpError(w, fmt.Sprintf("change %s does not exist", id), http.StatusNotFound, CodeNotFound)
+		return
+	}
+	if change.Status != ChangePending {
+		status := change.Status
+		s.changes.Unlock()
+		httpError(w, fmt.Sprintf("change %s is %s and is not waiting for approval", id, status), http.StatusConflict, CodeConflict)
+		return
+	}
+	if change.Submitter == reviewer {
+		s.changes.Unlock()
+		httpError(w, fmt.Sprintf("change %s must be reviewed by a different token holder than the one who submitted it", id), http.StatusForbidden, CodeForbidden)
+		return
+	}
+	now := time.Now()
+	change.Reviewer = reviewer
+	change.Reviewed = &now
+	change.Reason = review.Reason
+	if approve {
+		change.Status = ChangeQueued
+		change.NotBefore = now
+	} else {
+		s.changes.finish(change, ChangeRejected, "")
+	}
+	c := *change
+	s.changes.Unlock()
+
+	if approve {
+		logger.Info("change approved", "change_id", id, "host", c.Host, "reviewer", reviewer)
+		s.changeEvent(EventChangeApproved, c)
+		go s.runQueuedChanges()
+	} else {
+		logger.Info("change rejected", "change_id", id, "host", c.Host, "reviewer", reviewer, "reason", review.Reason)
+		s.changeEvent(EventChangeRejected, c)
+	}
+	err := writeJSON(w, c)
+	if err != nil {
+		logger.Error("error sending response", "error", err)
+	}
+}
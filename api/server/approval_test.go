@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// as sends the request with the token of a different token holder
+func as(token string) http.Header {
+	return http.Header{"Authorization": {token}}
+}
+
+// approvalTokens configures the tokens the tests submit and review changes with, each of a different holder
+func approvalTokens() Option {
+	return WithTokens(map[string]string{"token": DefaultNamespace, "alice": DefaultNamespace, "bob": DefaultNamespace, "carol": DefaultNamespace})
+}
+
+func TestChangeNeedsApproval(t *testing.T) {
+	prod, lab := newFakeDevice(t, "prod", true), newFakeDevice(t, "lab", true)
+	s := newTestService(WithApprovals("production"), approvalTokens())
+
+	rec := serveWithHeader(s, http.MethodPost, "/item", taggedItem(prod.addr, "production"), as("alice"))
+	var change QueuedChange
+	json.Unmarshal(rec.Body.Bytes(), &change)
+	if rec.Code != http.StatusAccepted || rec.Header().Get("Location") != "/change/"+change.ID || change.Status != ChangePending {
+		t.Fatalf("expected the change to wait for approval, got %d %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(change.Diff, "+interface GigabitEthernet 1") || change.Submitter == "" {
+		t.Errorf("expected the pending change to show the diff and its submitter, got %+v", change)
+	}
+	if len(prod.received()) != 0 || s.itemExists(prod.addr) {
+		t.Errorf("expected the pending change not to be made, got %v", prod.received())
+	}
+
+	if rec := serveWithHeader(s, http.MethodPost, "/change/"+change.ID+"/approve", nil, as("alice")); rec.Code != http.StatusForbidden {
+		t.Errorf("expected the submitter not to be able to approve their own change, got %d %s", rec.Code, rec.Body)
+	}
+	rec = serveWithHeader(s, http.MethodPost, "/change/"+change.ID+"/approve", Review{Reason: "CHG-42"}, as("bob"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if !eventually(t, func() bool {
+		json.Unmarshal(serve(s, http.MethodGet, "/change/"+change.ID, nil).Body.Bytes(), &change)
+		return change.Status != ChangeQueued
+	}) {
+		t.Fatal("expected the approved change to be made")
+	}
+	if change.Status != ChangeApplied || change.Reviewer == "" || change.Reviewer == change.Submitter || change.Reason != "CHG-42" {
+		t.Errorf("expected the change to be applied with its review, got %+v", change)
+	}
+	if len(prod.received()) == 0 || !s.itemExists(prod.addr) {
+		t.Error("expected the approved change to configure the device and store the item")
+	}
+	s.operations.RLock()
+	op := s.operations.operations[change.OperationIDs[0]]
+	s.operations.RUnlock()
+	if op == nil || op.Approver != change.Reviewer {
+		t.Errorf("expected the approver to be recorded on the operation, got %+v", op)
+	}
+
+	if rec := serve(s, http.MethodPost, "/item", taggedItem(lab.addr, "lab")); rec.Code != http.StatusOK {
+		t.Errorf("expected a device without approval tags to be changed, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestChangeRejected(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService(WithApprovals("production"), approvalTokens())
+	events, _ := s.events.subscribe([]string{EventChangeSubmitted, EventChangeRejected}, 0)
+
+	var change QueuedChange
+	json.Unmarshal(serveWithHeader(s, http.MethodPost, "/item", taggedItem(d.addr, "production"), as("alice")).Body.Bytes(), &change)
+	rec := serveWithHeader(s, http.MethodPost, "/change/"+change.ID+"/reject", Review{Reason: "wrong MTU"}, as("bob"))
+	json.Unmarshal(rec.Body.Bytes(), &change)
+	if rec.Code != http.StatusOK || change.Status != ChangeRejected || change.Reason != "wrong MTU" || change.Finished == nil {
+		t.Errorf("expected the change to be rejected with its reason, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := serveWithHeader(s, http.MethodPost, "/change/"+change.ID+"/approve", nil, as("carol")); rec.Code != http.StatusConflict {
+		t.Errorf("expected a rejected change not to be approved, got %d %s", rec.Code, rec.Body)
+	}
+	if len(d.received()) != 0 || s.itemExists(d.addr) {
+		t.Errorf("expected the rejected change not to be made, got %v", d.received())
+	}
+
+	for _, typ := range []string{EventChangeSubmitted, EventChangeRejected} {
+		select {
+		case e := <-events:
+			if e.Type != typ || e.Change == nil || e.Change.ID != change.ID {
+				t.Errorf("expected a %s event for the change, got %+v", typ, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected a %s event", typ)
+		}
+	}
+}
+
+func TestChangeApprovalDiff(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService(WithApprovals("production"), approvalTokens())
+	item := taggedItem(d.addr, "production")
+	item.Namespace = DefaultNamespace
+	s.items[item.Host] = item
+
+	update := item
+	update.Mtu = 9000
+	var change QueuedChange
+	json.Unmarshal(serve(s, http.MethodPut, "/item/"+item.Host, update).Body.Bytes(), &change)
+	if !strings.Contains(change.Diff, "\n- no mtu\n") || !strings.Contains(change.Diff, "\n+ mtu 9000\n") {
+		t.Errorf("expected the diff of an update to show the changed lines, got %q", change.Diff)
+	}
+
+	json.Unmarshal(serve(s, http.MethodDelete, "/item/"+item.Host, item).Body.Bytes(), &change)
+	if change.Status != ChangePending || !strings.Contains(change.Diff, "-interface") || strings.Contains(change.Diff, "\n+ ") {
+		t.Errorf("expected the diff of a delete to remove the configuration, got %q", change.Diff)
+	}
+	if rec := serve(s, http.MethodDelete, "/change/"+change.ID, nil); rec.Code != http.StatusOK {
+		t.Errorf("expected a pending change to be cancelled, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestApprovalNeedsTokens(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService(WithApprovals("production"))
+	item := taggedItem(d.addr, "production")
+	item.Namespace = DefaultNamespace
+	s.items[item.Host] = item
+	s.changes.changes["pending"] = &QueuedChange{ID: "pending", Namespace: DefaultNamespace, Host: item.Host, Status: ChangePending, Submitter: "alice"}
+
+	if rec := serveWithHeader(s, http.MethodPost, "/item", taggedItem(newFakeDevice(t, "other", true).addr, "production"), as("alice")); rec.Code != http.StatusForbidden {
+		t.Errorf("expected a change needing approval to be refused without tokens, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := serveWithHeader(s, http.MethodPost, "/change/pending/approve", nil, as("alice2")); rec.Code != http.StatusForbidden {
+		t.Errorf("expected an approval to be refused without tokens, got %d %s", rec.Code, rec.Body)
+	}
+	if got := d.received(); len(got) != 0 {
+		t.Errorf("expected nothing to be pushed, got %q", got)
+	}
+
+	s = newTestService(WithApprovals("production"), approvalTokens())
+	if rec := serveWithHeader(s, http.MethodPost, "/item", taggedItem(d.addr, "production"), as("mallory")); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a token that isn't configured to be refused, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestApprovedChangeOutdated(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		change func(t *testing.T, s *Service, item Item)
+	}{
+		{"item changed", func(t *testing.T, s *Service, item Item) {
+			s.Lock()
+			defer s.Unlock()
+			item.Mtu, item.Revision = 1500, item.Revision+1
+			s.items[item.Host] = item
+		}},
+		{"template reloaded", func(t *testing.T, s *Service, item Item) {
+			dir := t.TempDir()
+			writeFile(t, filepath.Join(dir, "iosxe_interface_ethernet.cfg"), "interface {{.IntfType}} {{.Number}}\n shutdown\n")
+			s.templates.dir = dir
+			if err := s.templates.load(); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDevice(t, "router", true)
+			s := newTestService(WithApprovals("production"), approvalTokens())
+			item := taggedItem(d.addr, "production")
+			item.Namespace, item.Revision = DefaultNamespace, 1
+			s.items[item.Host] = item
+
+			update := item
+			update.Mtu = 9000
+			var change QueuedChange
+			json.Unmarshal(serveWithHeader(s, http.MethodPut, "/item/"+item.Host, update, as("alice")).Body.Bytes(), &change)
+			if change.Status != ChangePending || change.Revision != 1 || change.TemplateVersion == "" {
+				t.Fatalf("expected the change to wait for approval against revision 1 and its template, got %+v", change)
+			}
+			tt.change(t, s, item)
+
+			if rec := serveWithHeader(s, http.MethodPost, "/change/"+change.ID+"/approve", nil, as("bob")); rec.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+			}
+			if !eventually(t, func() bool {
+				json.Unmarshal(serve(s, http.MethodGet, "/change/"+change.ID, nil).Body.Bytes(), &change)
+				return change.Status != ChangeQueued
+			}) {
+				t.Fatal("expected the approved change to be tried")
+			}
+			if change.Status != ChangeFailed || change.StatusCode != http.StatusPreconditionFailed {
+				t.Errorf("expected the change to fail as it isn't what was approved, got %+v", change)
+			}
+			if got := d.received(); len(got) != 0 {
+				t.Errorf("expected nothing to be pushed, got %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Backup is a version of the whole running configuration of a device, captured before or after a change
+// was pushed to it. Its format is that of the transport it was read with: the output of show
+// running-config for the CLI, XML for NETCONF and JSON for RESTCONF and gNMI
+type Backup struct {
+	// Namespace is the namespace of the operation the backup was captured for
+	Namespace string    `json:"namespace"`
+	Host      string    `json:"host"`
+	Version   int       `json:"version"`
+	Taken     time.Time `json:"taken"`
+	// Reason is the point of the operation the backup was captured at, e.g. "before update"
+	Reason      string `json:"reason"`
+	OperationID string `json:"operation_id"`
+	RequestID   string `json:"request_id"`
+	Transport   string `json:"transport"`
+	SHA256      string `json:"sha256"`
+	Config      string `json:"config,omitempty"`
+}
+
+// backupStore keeps the versions of each device's running configuration, numbered from 1 per device. A
+// configuration identical to the latest version is not stored again, so that the backup after one change
+// is also the backup before the next. It has its own lock so that backups can be read while a push holds
+// the Service lock
+type backupStore struct {
+	sync.RWMutex
+	devices map[string][]*Backup
+	// maxVersions is how many versions are kept per device, the oldest being dropped first. Backups are
+	// not captured if it is zero
+	maxVersions int
+}
+
+func newBackupStore() *backupStore {
+	return &backupStore{devices: map[string][]*Backup{}}
+}
+
+func (b *backupStore) enabled() bool {
+	return b.maxVersions > 0
+}
+
+// add stores backup as the next version of its device, returning the version it is stored as and true, or
+// the latest version and false if that has the same configuration
+func (b *backupStore) add(backup *Backup) (*Backup, bool) {
+	sum := sha256.Sum256([]byte(backup.Config))
+	backup.SHA256 = hex.EncodeToString(sum[:])
+
+	b.Lock()
+	defer b.Unlock()
+	versions := b.devices[backup.Host]
+	backup.Version = 1
+	if n := len(versions); n > 0 {
+		if latest := versions[n-1]; latest.SHA256 == backup.SHA256 {
+			return latest, false
+		}
+		backup.Version = versions[n-1].Version + 1
+	}
+	versions = append(versions, backup)
+	if len(versions) > b.maxVersions {
+		versions = versions[len(versions)-b.maxVersions:]
+	}
+	b.devices[backup.Host] = versions
+	return backup, true
+}
+
+// version returns the given version of host's configuration. Does not lock access to the backupStore,
+// expects this to be done by the calling method
+func (b *backupStore) version(host string, version int) (*Backup, bool) {
+	for _, backup := range b.devices[host] {
+		if backup.Version == version {
+			return backup, true
+		}
+	}
+	return nil, false
+}
+
+// backup captures the running configuration of hostname with p at the given point of op, returning the
+// version it is stored as. Backups are best effort: a failure is logged and 0 is returned, and the push
+// goes ahead
+func (s *Service) backup(logger *slog.Logger, p *push, hostname string, op *Operation, point string) int {
+	if !s.backups.enabled() || p.backup == nil {
+		return 0
+	}
+	// the sessions reading the configuration are not part of the operation's transcript
+	config, err := p.backup(logger, newTranscript(s.redactor), hostname)
+	if err != nil {
+		logger.Warn("error backing up configuration", "point", point, "error", err)
+		return 0
+	}
+	backup, added := s.backups.add(&Backup{
+		Namespace:   op.Namespace,
+		Host:        hostname,
+		Taken:       time.Now(),
+		Reason:      point + " " + op.Type,
+		OperationID: op.ID,
+		RequestID:   op.RequestID,
+		Transport:   op.Transport,
+		Config:      config,
+	})
+	logger.Debug("configuration backed up", "point", point, "version", backup.Version)
+	// a change starting from a configuration that isn't the latest backup was preceded by a change made
+	// outside of the server
+	if point == "before" && added && backup.Version > 1 {
+		logger.Warn("configuration drift detected", "version", backup.Version)
+		s.events.publish(Event{
+			Type:      EventDriftDetected,
+			RequestID: op.RequestID,
+			Namespace: op.Namespace,
+			Host:      hostname,
+			Drift:     &Drift{FromVersion: backup.Version - 1, ToVersion: backup.Version},
+		})
+	}
+	return backup.Version
+}
+
+// GetBackups returns the stored versions of a device's running configuration without their content,
+// oldest first
+func (s *Service) GetBackups(w http.ResponseWriter, r *http.Request) {
+	host := mux.Vars(r)["host"]
+	namespace := namespaceFrom(r.Context())
+
+	s.backups.RLock()
+	versions := s.backups.devices[host]
+	summaries := make([]Backup, 0, len(versions))
+	for _, backup := range versions {
+		if backup.Namespace != namespace {
+			continue
+		}
+		summary := *backup
+		summary.Config = ""
+		summaries = append(summaries, summary)
+	}
+	s.backups.RUnlock()
+
+	err := writeJSON(w, summaries)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
+	}
+}
+
+// GetBackup handles retrieving a single version of a device's running configuration, including its content
+func (s *Service) GetBackup(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version, ok := parseVersion(vars["version"])
+	if !ok {
+		writeError(w, http.StatusBadRequest, &Error{Code: CodeInvalidRequest, Message: "must be a version number", Field: "version"})
+		return
+	}
+
+	s.backups.RLock()
+	backup, ok := s.backups.version(vars["host"], version)
+	s.backups.RUnlock()
+	if !ok || backup.Namespace != namespaceFrom(r.Context()) {
+		httpError(w, "not found", http.StatusNotFound, CodeNotFound)
+		return
+	}
+
+	err := writeJSON(w, backup)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
+	}
+}
+
+// GetBackupDiff handles the unified diff between two versions of a device's running configuration. The to
+// query parameter defaults to the latest version and from to the version before to
+func (s *Service) GetBackupDiff(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	host := mux.Vars(r)["host"]
+	query := r.URL.Query()
+
+	s.backups.RLock()
+	from, to, err := s.backups.diffVersions(host, query.Get("from"), query.Get("to"))
+	s.backups.RUnlock()
+	if err == nil && (from.Namespace != namespaceFrom(r.Context()) || to.Namespace != namespaceFrom(r.Context())) {
+		err = &Error{Code: CodeNotFound, Message: fmt.Sprintf("no backups of %s", host)}
+	}
+	if err != nil {
+		status := http.StatusNotFound
+		if err.Code == CodeInvalidRequest {
+			status = http.StatusBadRequest
+		}
+		writeError(w, status, err)
+		return
+	}
+
+	diff := unifiedDiff(backupLabel(from), backupLabel(to), from.Config, to.Config)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, werr := fmt.Fprint(w, diff)
+	if werr != nil {
+		logger.Error("error sending response", "error", werr)
+	}
+}
+
+// diffVersions returns the versions of host named by the from and to query parameters, defaulting to the
+// latest version and the version before it. Does not lock access to the backupStore, expects this to be
+// done by the calling method
+func (b *backupStore) diffVersions(host, fromParam, toParam string) (from, to *Backup, err *Error) {
+	versions := b.devices[host]
+	if len(versions) == 0 {
+		return nil, nil, &Error{Code: CodeNotFound, Message: fmt.Sprintf("no backups of %s", host)}
+	}
+	lookup := func(field, param string, fallback *Backup) (*Backup, *Error) {
+		if param == "" {
+			if fallback == nil {
+				return nil, &Error{Code: CodeNotFound, Message: "no earlier version to compare with", Field: field}
+			}
+			return fallback, nil
+		}
+		version, ok := parseVersion(param)
+		if !ok {
+			return nil, &Error{Code: CodeInvalidRequest, Message: "must be a version number", Field: field}
+		}
+		backup, ok := b.version(host, version)
+		if !ok {
+			return nil, &Error{Code: CodeNotFound, Message: fmt.Sprintf("version %d of %s not found", version, host), Field: field}
+		}
+		return backup, nil
+	}
+
+	to, err = lookup("to", toParam, versions[len(versions)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	var previous *Backup
+	for i, backup := range versions {
+		if backup == to && i > 0 {
+			previous = versions[i-1]
+		}
+	}
+	from, err = lookup("from", fromParam, previous)
+	if err != nil {
+		return nil, nil, err
+	}
+	return from, to, nil
+}
+
+// parseVersion parses a backup version number, which starts at 1
+func parseVersion(value string) (int, bool) {
+	version, err := strconv.Atoi(value)
+	return version, err == nil && version > 0
+}
+
+// backupLabel names a version in the header of a diff
+func backupLabel(backup *Backup) string {
+	return fmt.Sprintf("%s version %d (%s, %s)", backup.Host, backup.Version, backup.Reason, backup.Taken.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBackups(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService(WithBackups(10))
+	item := savedItem(d.addr)
+
+	rec := serve(s, http.MethodPost, "/item", item)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	s.operations.RLock()
+	op := s.operations.operations[rec.Header().Get(OperationIDHeader)]
+	s.operations.RUnlock()
+	if op.BackupBefore != 1 || op.BackupAfter != 2 {
+		t.Fatalf("expected versions 1 and 2 around the change, got %d and %d", op.BackupBefore, op.BackupAfter)
+	}
+	for _, entry := range op.Transcript {
+		if strings.Contains(entry.Data, "show running-config") {
+			t.Errorf("expected the backups to be left out of the transcript, got %q", entry.Data)
+		}
+	}
+
+	item.Description = "uplink"
+	if rec := serve(s, http.MethodPut, "/item/"+item.Host, item); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(s, http.MethodGet, "/device/"+d.addr+"/backup", nil)
+	var versions []Backup
+	if err := json.Unmarshal(rec.Body.Bytes(), &versions); err != nil {
+		t.Fatal(err)
+	}
+	// the backup after the create is also the backup before the update
+	if len(versions) != 3 || versions[1].Reason != "after create" || versions[2].Reason != "after update" {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+	if versions[2].Config != "" || versions[2].SHA256 == "" || versions[2].Transport != TransportCLI {
+		t.Errorf("expected the content to be left out of the list, got %+v", versions[2])
+	}
+
+	rec = serve(s, http.MethodGet, "/device/"+d.addr+"/backup/2", nil)
+	var backup Backup
+	if err := json.Unmarshal(rec.Body.Bytes(), &backup); err != nil {
+		t.Fatal(err)
+	}
+	if backup.Version != 2 || !strings.Contains(backup.Config, "interface GigabitEthernet 1") {
+		t.Errorf("unexpected backup %+v", backup)
+	}
+
+	rec = serve(s, http.MethodGet, "/device/"+d.addr+"/diff", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "+description uplink") {
+		t.Errorf("expected the latest change, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(s, http.MethodGet, "/device/"+d.addr+"/diff?from=1&to=3", nil)
+	if diff := rec.Body.String(); !strings.HasPrefix(diff, "--- "+d.addr+" version 1 (before create") || !strings.Contains(diff, "+interface GigabitEthernet 1") {
+		t.Errorf("expected the diff of both changes, got %s", diff)
+	}
+
+	for path, status := range map[string]int{
+		"/device/" + d.addr + "/backup/4":         http.StatusNotFound,
+		"/device/" + d.addr + "/backup/latest":    http.StatusBadRequest,
+		"/device/" + d.addr + "/diff?from=0":      http.StatusBadRequest,
+		"/device/" + d.addr + "/diff?to=1":        http.StatusNotFound,
+		"/device/192.0.2.1:22/diff":               http.StatusNotFound,
+		"/device/" + d.addr + "/diff?from=3&to=9": http.StatusNotFound,
+	} {
+		if rec := serve(s, http.MethodGet, path, nil); rec.Code != status {
+			t.Errorf("%s: expected %d, got %d: %s", path, status, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestBackupsPruned(t *testing.T) {
+	b := newBackupStore()
+	b.maxVersions = 2
+	for _, config := range []string{"a", "b", "b", "c"} {
+		b.add(&Backup{Host: "router", Config: config})
+	}
+	versions := b.devices["router"]
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 3 {
+		t.Errorf("expected versions 2 and 3 to be kept, got %+v", versions)
+	}
+}
+
+func TestBackupsDisabled(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService()
+
+	serve(s, http.MethodPost, "/item", savedItem(d.addr))
+	for _, cmd := range d.received() {
+		if cmd == "show running-config" {
+			t.Fatalf("expected no backups to be taken, got %q", d.received())
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Statuses of a queued change
+const (
+	// ChangePending is a change waiting for approval
+	ChangePending   = "pending"
+	ChangeQueued    = "queued"
+	ChangeApplied   = "applied"
+	ChangeFailed    = "failed"
+	ChangeCancelled = "cancelled"
+	ChangeRejected  = "rejected"
+)
+
+// maxFinishedChanges is how many applied, failed, cancelled or rejected changes are kept, the oldest being
+// dropped first
+const maxFinishedChanges = 1000
+
+// QueuedChange is a create, update, delete or save that the change calendar didn't allow when it was
+// requested, queued to be made once the calendar allows it, or a change waiting for approval
+type QueuedChange struct {
+	ID        string    `json:"id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Host      string    `json:"host"`
+	RequestID string    `json:"request_id"`
+	Namespace string    `json:"namespace"`
+	Status    string    `json:"status"`
+	Queued    time.Time `json:"queued"`
+	// NotBefore is when the change is next tried, moved on if the calendar changes in the meantime
+	NotBefore time.Time  `json:"not_before"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	// StatusCode is the status the change was answered with when it was made
+	StatusCode   int      `json:"status_code,omitempty"`
+	OperationIDs []string `json:"operation_ids,omitempty"`
+	Error        string   `json:"error,omitempty"`
+	// Diff is the redacted change to the configuration rendered for the device, shown for approval
+	Diff string `json:"diff,omitempty"`
+	// Submitter and Reviewer identify the token holders who requested the change and approved or
+	// rejected it
+	Submitter string     `json:"submitter,omitempty"`
+	Reviewer  string     `json:"reviewer,omitempty"`
+	Reviewed  *time.Time `json:"reviewed,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	// Revision and TemplateVersion are the revision of the item, 0 if there was none, and the version of
+	// the template the change was submitted for approval against. An approved change fails without being
+	// pushed if either has moved on by the time it is made
+	Revision        int64  `json:"revision,omitempty"`
+	TemplateVersion string `json:"template_version,omitempty"`
+
+	// the request is replayed with its headers, which carry its authorization, and body
+	header http.Header
+	body   []byte
+	tags   []string
+}
+
+// changeQueue keeps the queued changes. Changes are made one at a time, in the order they were queued
+type changeQueue struct {
+	sync.RWMutex
+	changes map[string]*QueuedChange
+	run     sync.Mutex
+}
+
+func newChangeQueue() *changeQueue {
+	return &changeQueue{changes: map[string]*QueuedChange{}}
+}
+
+// newQueuedChange returns the change requested by r to host, to be replayed with body
+func newQueuedChange(r *http.Request, host string, tags []string, body []byte) *QueuedChange {
+	header := r.Header.Clone()
+	header.Del("Prefer")
+	now := time.Now()
+	return &QueuedChange{
+		ID:        NewRequestID(),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Host:      host,
+		RequestID: requestIDFrom(r.Context()),
+		Namespace: namespaceFrom(r.Context()),
+		Status:    ChangeQueued,
+		Queued:    now,
+		NotBefore: now,
+		header:    header,
+		body:      body,
+		tags:      tags,
+	}
+}
+
+// queueChange queues the change requested by r to host, to be made at notBefore
+func (s *Service) queueChange(r *http.Request, host string, tags []string, body []byte, notBefore time.Time) QueuedChange {
+	change := newQueuedChange(r, host, tags, body)
+	change.NotBefore = notBefore
+	s.changes.Lock()
+	s.changes.changes[change.ID] = change
+	queued := *change
+	s.changes.Unlock()
+	time.AfterFunc(time.Until(notBefore), s.runQueuedChanges)
+	return queued
+}
+
+// runQueuedChanges makes every queued change that is due, oldest first
+func (s *Service) runQueuedChanges() {
+	s.changes.run.Lock()
+	defer s.changes.run.Unlock()
+
+	now := time.Now()
+	s.changes.RLock()
+	var due []*QueuedChange
+	for _, change := range s.changes.changes {
+		if change.Status == ChangeQueued && !change.NotBefore.After(now) {
+			due = append(due, change)
+		}
+	}
+	s.changes.RUnlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].Queued.Before(due[j].Queued) })
+
+	for _, change := range due {
+		s.makeQueuedChange(change)
+	}
+}
+
+// makeQueuedChange replays the request of change if the calendar allows it, or queues it again until the
+// calendar next allows it
+func (s *Service) makeQueuedChange(change *QueuedChange) {
+	logger := s.logger.With("request_id", change.RequestID, "change_id", change.ID, "host", change.Host)
+	s.RLock()
+	tags := s.deviceTags(change.Host, Item{Tags: change.tags})
+	s.RUnlock()
+
+	s.changes.Lock()
+	if change.Status != ChangeQueued {
+		// cancelled since it was found due
+		s.changes.Unlock()
+		return
+	}
+	now := time.Now()
+	if reason := s.calendar.closed(change.Namespace, tags, now); reason != "" {
+		next, ok := s.calendar.next(change.Namespace, tags, now)
+		if ok {
+			change.NotBefore = next
+			s.changes.Unlock()
+			logger.Info("queued change moved by the change calendar", "closed", reason, "not_before", next)
+			time.AfterFunc(time.Until(next), s.runQueuedChanges)
+			return
+		}
+		s.changes.finish(change, ChangeFailed, reason)
+		s.changes.Unlock()
+		logger.Warn("queued change failed, no window allows it", "closed", reason)
+		return
+	}
+	s.changes.Unlock()
+
+	logger.Info("making queued change", "method", change.Method, "path", change.Path)
+	req, err := http.NewRequest(change.Method, change.Path, bytes.NewReader(change.body))
+	if err != nil {
+		s.changes.Lock()
+		s.changes.finish(change, ChangeFailed, err.Error())
+		s.changes.Unlock()
+		return
+	}
+	req.Header = change.header.Clone()
+	req.Header.Set(RequestIDHeader, change.RequestID)
+	if change.Reviewer != "" {
+		if change.Revision != 0 {
+			req.Header.Set("If-Match", itemETag(Item{Revision: change.Revision}))
+		}
+		req = req.WithContext(withApproval(req.Context(), approval{reviewer: change.Reviewer, revision: change.Revision, templateVersion: change.TemplateVersion}))
+	}
+	resp := &changeWriter{header: http.Header{}, status: http.StatusOK}
+	s.selfHandler().ServeHTTP(resp, req)
+
+	s.changes.Lock()
+	defer s.changes.Unlock()
+	change.StatusCode = resp.status
+	change.OperationIDs = resp.header.Values(OperationIDHeader)
+	if resp.status != http.StatusOK {
+		var body Error
+		if json.Unmarshal(resp.body.Bytes(), &body) != nil || body.Message == "" {
+			body.Message = http.StatusText(resp.status)
+		}
+		s.changes.finish(change, ChangeFailed, body.Message)
+		logger.Warn("queued change failed", "status", resp.status, "error", body.Message)
+		return
+	}
+	// the item handlers answer with a 200 once the item is stored, even if pushing it to the device failed
+	if op, failed := s.operations.failed(change.OperationIDs); failed {
+		message := fmt.Sprintf("operation %s on %s failed: %s", op.ID, op.Host, op.Error)
+		s.changes.finish(change, ChangeFailed, message)
+		logger.Warn("queued change failed", "operation_id", op.ID, "error", op.Error)
+		return
+	}
+	s.changes.finish(change, ChangeApplied, "")
+	logger.Info("queued change made", "operation_ids", change.OperationIDs)
+}
+
+// finish records the outcome of change and drops the oldest finished changes over the limit. Expects the
+// lock to be held
+func (q *changeQueue) finish(change *QueuedChange, status, message string) {
+	now := time.Now()
+	change.Status = status
+	change.Finished = &now
+	change.Error = message
+
+	var finished []*QueuedChange
+	for _, c := range q.changes {
+		if c.Finished != nil {
+			finished = append(finished, c)
+		}
+	}
+	if len(finished) <= maxFinishedChanges {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Finished.Before(*finished[j].Finished) })
+	for _, c := range finished[:len(finished)-maxFinishedChanges] {
+		delete(q.changes, c.ID)
+	}
+}
+
+// writeQueuedChange answers a request with the change it was queued as, with a 202 and its location
+func writeQueuedChange(w http.ResponseWriter, logger *slog.Logger, change QueuedChange) {
+	// the change is followed in the version of the API it was requested in
+	_, prefix := pathVersion(change.Path)
+	w.Header().Set("Location", prefix+"/change/"+change.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(change); err != nil {
+		logger.Error("error sending response", "error", err)
+	}
+}
+
+// changeWriter keeps the response to a request made in process, such as a queued change or an RPC of the
+// gRPC API
+type changeWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *changeWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *changeWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *changeWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// GetChanges returns the queued changes in the namespace of the request, including those already made or
+// cancelled, oldest first
+func (s *Service) GetChanges(w http.ResponseWriter, r *http.Request) {
+	namespace := namespaceFrom(r.Context())
+	s.changes.RLock()
+	changes := make([]QueuedChange, 0, len(s.changes.changes))
+	for _, change := range s.changes.changes {
+		if change.Namespace == namespace {
+			changes = append(changes, *change)
+		}
+	}
+	s.changes.RUnlock()
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Queued.Before(changes[j].Queued) })
+
+	err := writeJSON(w, changes)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
+	}
+}
+
+// GetChange returns a queued change by ID
+func (s *Service) GetChange(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	s.changes.RLock()
+	change, ok := s.changes.changes[id]
+	ok = ok && change.Namespace == namespaceFrom(r.Context())
+	var c QueuedChange
+	if ok {
+		c = *change
+	}
+	s.changes.RUnlock()
+	if !ok {
+		httpError(w, fmt.Sprintf("change %s does not exist", id), http.StatusNotFound, CodeNotFound)
+		return
+	}
+
+	err := writeJSON(w, c)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
+	}
+}
+
+// CancelChange cancels a change that is still queued or waiting for approval, returning it
+func (s *Service) CancelChange(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	id := mux.Vars(r)["id"]
+	s.changes.Lock()
+	change, ok := s.changes.changes[id]
+	if !ok || change.Namespace != namespaceFrom(r.Context()) {
+		s.changes.Unlock()
+		httpError(w, fmt.Sprintf("change %s does not exist", id), http.StatusNotFound, CodeNotFound)
+		return
+	}
+	if change.Status != ChangeQueued && change.Status != ChangePending {
+		status := change.Status
+		s.changes.Unlock()
+		httpError(w, fmt.Sprintf("change %s is %s and can no longer be cancelled", id, status), http.StatusConflict, CodeConflict)
+		return
+	}
+	s.changes.finish(change, ChangeCancelled, "")
+	c := *change
+	s.changes.Unlock()
+
+	logger.Info("queued change cancelled", "change_id", id, "host", c.Host)
+	err := writeJSON(w, c)
+	if err != nil {
+		logger.Error("error sending response", "error", err)
+	}
+}
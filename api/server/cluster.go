@@ -0,0 +1,1029 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Roles of an instance in a cluster
+const (
+	RoleLeader    = "leader"
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+)
+
+// ForwardedHeader is set on a request a follower forwards to the leader of the cluster, naming the follower
+const ForwardedHeader = "X-Forwarded-By"
+
+const (
+	defaultHeartbeat       = 100 * time.Millisecond
+	defaultElectionTimeout = time.Second
+	// defaultCompactAfter is how many applied entries the log keeps before they are compacted into its snapshot
+	defaultCompactAfter = 1000
+	// clusterStateFile is the file in the directory of the cluster the instance keeps its state in
+	clusterStateFile = "cluster.json"
+)
+
+var errNotLeader = errors.New("this instance is not the leader of the cluster")
+
+// errNotStoredInTime is returned for a change a majority of the cluster didn't store in time, which may
+// still be stored afterwards
+var errNotStoredInTime = errors.New("change not stored by a majority of the cluster in time")
+
+// Cluster configures an instance to run in a cluster of instances replicating their items. The instances
+// elect a leader, which makes every change, and the others forward their requests to it
+type Cluster struct {
+	// ID names the instance in the cluster
+	ID string `json:"id"`
+	// Peers are the base URLs of the other instances of the cluster by their ID
+	Peers map[string]string `json:"peers"`
+	// Secret authenticates the instances of the cluster to each other, and seals the passwords of the items
+	// in the log
+	Secret string `json:"secret"`
+	// Dir is the directory the instance keeps its term, vote and log in, which no other instance may use
+	Dir string `json:"dir"`
+}
+
+// ValidateCluster returns an error if c can't be used to join a cluster
+func ValidateCluster(c Cluster) error {
+	if c.ID == "" {
+		return errors.New("an id is required")
+	}
+	if c.Secret == "" {
+		return errors.New("a secret is required to authenticate the instances to each other")
+	}
+	if c.Dir == "" {
+		return errors.New("a dir is required to keep the term, vote and log of the instance in")
+	}
+	for id, peer := range c.Peers {
+		if id == "" || id == c.ID {
+			return fmt.Errorf("peer %q must have an id other than the one of this instance", peer)
+		}
+		u, err := url.Parse(peer)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: must be an http or https URL", peer)
+		}
+	}
+	return nil
+}
+
+// ClusterStatus is what an instance knows about its cluster
+type ClusterStatus struct {
+	ID          string            `json:"id"`
+	Role        string            `json:"role"`
+	Term        uint64            `json:"term"`
+	Leader      string            `json:"leader,omitempty"`
+	CommitIndex uint64            `json:"commit_index"`
+	Peers       map[string]string `json:"peers"`
+}
+
+// itemCommand stores Item as Name, or removes Name if Item is nil. A command without a name changes nothing,
+// and is what a new leader starts its term with. In the log the password of Item is sealed into Password with
+// the secret of the cluster, so that neither the log on disk nor the entries sent between instances hold it
+type itemCommand struct {
+	Name     string `json:"name,omitempty"`
+	Item     *Item  `json:"item,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type logEntry struct {
+	Term    uint64      `json:"term"`
+	Command itemCommand `json:"command"`
+}
+
+// snapshot stands for the entries of the log up to Index, which have been compacted away, with the last
+// command of every item they changed. Applying the commands makes the same changes as applying the entries
+type snapshot struct {
+	Index    uint64                 `json:"index"`
+	Term     uint64                 `json:"term"`
+	Commands map[string]itemCommand `json:"commands"`
+}
+
+type voteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// appendRequest carries the snapshot of the leader when the follower is missing entries the leader has
+// compacted away, followed by the entries after it
+type appendRequest struct {
+	Term         uint64     `json:"term"`
+	Leader       string     `json:"leader"`
+	PrevLogIndex uint64     `json:"prev_log_index"`
+	PrevLogTerm  uint64     `json:"prev_log_term"`
+	Entries      []logEntry `json:"entries"`
+	LeaderCommit uint64     `json:"leader_commit"`
+	Snapshot     *snapshot  `json:"snapshot,omitempty"`
+}
+
+// appendResponse carries the last index of the follower's log, so that a leader that sent entries the
+// follower can't append knows where to start again
+type appendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"last_index"`
+}
+
+// clusterState is what an instance keeps in the directory of the cluster, and reads back when it restarts
+type clusterState struct {
+	Term     uint64     `json:"term"`
+	VotedFor string     `json:"voted_for,omitempty"`
+	Snapshot snapshot   `json:"snapshot"`
+	Log      []logEntry `json:"log"`
+}
+
+// cluster replicates the changes to the items with the Raft consensus algorithm. The term, vote and log are
+// saved to the directory of the cluster before they are acted on, and the applied entries of the log are
+// compacted into a snapshot
+type cluster struct {
+	Cluster
+	heartbeat       time.Duration
+	electionTimeout time.Duration
+	compactAfter    uint64
+	client          *http.Client
+	logger          *slog.Logger
+	apply           func()
+	// key seals the passwords of the items in the log
+	key []byte
+
+	sync.Mutex
+	// changed is signalled whenever the commit index, role or term changes
+	changed  *sync.Cond
+	stopped  bool
+	role     string
+	term     uint64
+	votedFor string
+	votes    int
+	leader   string
+	// snapshot stands for the entries compacted away, and log starts with an empty entry at the index and
+	// term of the snapshot, so that the first entry of a new log has index 1
+	snapshot    snapshot
+	log         []logEntry
+	commitIndex uint64
+	lastApplied uint64
+	// termStart is the index of the entry the leader started its term with
+	termStart  uint64
+	deadline   time.Time
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	contacted  map[string]time.Time
+	sending    map[string]bool
+}
+
+func newCluster(config Cluster) *cluster {
+	mac := hmac.New(sha256.New, []byte(config.Secret))
+	mac.Write([]byte("item passwords"))
+	c := &cluster{
+		Cluster:         config,
+		heartbeat:       defaultHeartbeat,
+		electionTimeout: defaultElectionTimeout,
+		compactAfter:    defaultCompactAfter,
+		key:             mac.Sum(nil),
+		role:            RoleFollower,
+		snapshot:        snapshot{Commands: map[string]itemCommand{}},
+		log:             []logEntry{{}},
+		nextIndex:       map[string]uint64{},
+		matchIndex:      map[string]uint64{},
+		contacted:       map[string]time.Time{},
+		sending:         map[string]bool{},
+	}
+	c.changed = sync.NewCond(&c.Mutex)
+	return c
+}
+
+// start runs the cluster until stop is called, calling apply whenever there are committed changes to apply
+// to the items. An instance that can't read back its state doesn't take part in the cluster, as it could vote
+// twice in a term
+func (c *cluster) start(logger *slog.Logger, apply func()) {
+	c.logger = logger.With("cluster_id", c.ID)
+	c.apply = apply
+	c.client = &http.Client{Timeout: c.electionTimeout}
+	c.Lock()
+	if err := c.load(); err != nil {
+		c.logger.Error("unable to read the state of the instance, not joining the cluster", "dir", c.Dir, "error", err)
+		c.stopped = true
+		c.Unlock()
+		return
+	}
+	c.resetDeadline()
+	c.Unlock()
+	go c.run()
+	go c.applyCommitted()
+}
+
+// load reads back the state saved by an earlier run of the instance, if there is one. The entries up to the
+// snapshot were committed, and are applied first. Expects c to be locked
+func (c *cluster) load() error {
+	if c.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(c.Dir, clusterStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state clusterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if len(state.Log) == 0 {
+		return errors.New("the saved log has no entries")
+	}
+	if state.Snapshot.Commands == nil {
+		state.Snapshot.Commands = map[string]itemCommand{}
+	}
+	c.term, c.votedFor = state.Term, state.VotedFor
+	c.snapshot, c.log = state.Snapshot, state.Log
+	c.commitIndex = c.snapshot.Index
+	return nil
+}
+
+// save writes the term, vote, snapshot and log to the directory of the cluster, replacing what was written
+// before only once it has been written in full. Expects c to be locked
+func (c *cluster) save() error {
+	if c.Dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(clusterState{Term: c.term, VotedFor: c.votedFor, Snapshot: c.snapshot, Log: c.log})
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(c.Dir, clusterStateFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(c.Dir, clusterStateFile))
+}
+
+// stop stops taking part in the cluster, as if the instance had gone away
+func (c *cluster) stop() {
+	c.Lock()
+	c.stopped = true
+	c.role = RoleFollower
+	c.leader = ""
+	c.changed.Broadcast()
+	c.Unlock()
+}
+
+func (c *cluster) run() {
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.Lock()
+		if c.stopped {
+			c.Unlock()
+			return
+		}
+		if c.role == RoleLeader {
+			c.sendHeartbeats()
+		} else if time.Now().After(c.deadline) {
+			c.startElection()
+		}
+		c.Unlock()
+	}
+}
+
+// majority is how many instances, this one included, make a majority of the cluster
+func (c *cluster) majority() int {
+	return (len(c.Peers)+1)/2 + 1
+}
+
+// resetDeadline starts a new random election timeout. Expects c to be locked
+func (c *cluster) resetDeadline() {
+	c.deadline = time.Now().Add(c.electionTimeout + time.Duration(rand.Int63n(int64(c.electionTimeout))))
+}
+
+// entry returns the entry of the log at index, which mustn't have been compacted away. Expects c to be locked
+func (c *cluster) entry(index uint64) logEntry {
+	return c.log[index-c.snapshot.Index]
+}
+
+// lastLog returns the index and term of the last entry of the log. Expects c to be locked
+func (c *cluster) lastLog() (uint64, uint64) {
+	last := c.snapshot.Index + uint64(len(c.log)-1)
+	return last, c.entry(last).Term
+}
+
+// becomeFollower follows leader in term, which is empty until the leader of term is known. Expects c to be
+// locked
+func (c *cluster) becomeFollower(term uint64, leader string) {
+	if term > c.term {
+		c.term = term
+		c.votedFor = ""
+		if err := c.save(); err != nil {
+			c.logger.Error("unable to save the term", "term", c.term, "error", err)
+		}
+	}
+	if c.role == RoleLeader {
+		c.logger.Warn("no longer the leader of the cluster", "term", c.term)
+	}
+	if leader != "" && leader != c.leader {
+		c.logger.Info("following the leader of the cluster", "leader", leader, "term", c.term)
+	}
+	c.role = RoleFollower
+	c.leader = leader
+	c.resetDeadline()
+	c.changed.Broadcast()
+}
+
+// startElection asks the other instances to elect this one for a new term, once it has saved its vote for
+// itself. Expects c to be locked
+func (c *cluster) startElection() {
+	c.term++
+	c.role = RoleCandidate
+	c.votedFor = c.ID
+	c.votes = 1
+	c.leader = ""
+	c.resetDeadline()
+	if err := c.save(); err != nil {
+		c.logger.Error("unable to save the vote, not starting an election", "term", c.term, "error", err)
+		c.role = RoleFollower
+		return
+	}
+	c.logger.Info("starting an election", "term", c.term)
+	if c.votes >= c.majority() {
+		c.becomeLeader()
+		return
+	}
+	last, lastTerm := c.lastLog()
+	req := voteRequest{Term: c.term, Candidate: c.ID, LastLogIndex: last, LastLogTerm: lastTerm}
+	for id := range c.Peers {
+		go c.requestVote(id, req)
+	}
+}
+
+func (c *cluster) requestVote(id string, req voteRequest) {
+	var resp voteResponse
+	if err := c.call(id, "vote", req, &resp); err != nil {
+		c.logger.Debug("unable to request a vote", "peer", id, "error", err)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if resp.Term > c.term {
+		c.becomeFollower(resp.Term, "")
+		return
+	}
+	if c.role != RoleCandidate || c.term != req.Term || !resp.Granted {
+		return
+	}
+	c.votes++
+	if c.votes >= c.majority() {
+		c.becomeLeader()
+	}
+}
+
+// becomeLeader starts the term with an empty entry, committing the entries of earlier terms with it.
+// Expects c to be locked
+func (c *cluster) becomeLeader() {
+	c.log = append(c.log, logEntry{Term: c.term})
+	if err := c.save(); err != nil {
+		c.logger.Error("unable to save the log, not leading the cluster", "term", c.term, "error", err)
+		c.log = c.log[:len(c.log)-1]
+		c.becomeFollower(c.term, "")
+		return
+	}
+	c.logger.Info("elected leader of the cluster", "term", c.term)
+	c.role = RoleLeader
+	c.leader = c.ID
+	c.termStart, _ = c.lastLog()
+	now := time.Now()
+	for id := range c.Peers {
+		c.nextIndex[id] = c.termStart
+		c.matchIndex[id] = 0
+		c.contacted[id] = now
+	}
+	c.advanceCommit()
+	c.sendHeartbeats()
+	c.changed.Broadcast()
+}
+
+// sendHeartbeats sends every instance the entries it is missing, or none to keep its leadership, stepping
+// down if a majority of the cluster hasn't answered for an election timeout. An instance missing entries
+// that have been compacted away is sent the snapshot first. Expects c to be locked
+func (c *cluster) sendHeartbeats() {
+	now := time.Now()
+	answered := 1
+	for id := range c.Peers {
+		if now.Sub(c.contacted[id]) < c.electionTimeout {
+			answered++
+		}
+	}
+	if answered < c.majority() {
+		c.becomeFollower(c.term, "")
+		return
+	}
+	for id := range c.Peers {
+		if c.sending[id] {
+			continue
+		}
+		c.sending[id] = true
+		next := c.nextIndex[id]
+		req := appendRequest{Term: c.term, Leader: c.ID, LeaderCommit: c.commitIndex}
+		if next <= c.snapshot.Index {
+			snap := c.snapshot
+			snap.Commands = make(map[string]itemCommand, len(c.snapshot.Commands))
+			for name, cmd := range c.snapshot.Commands {
+				snap.Commands[name] = cmd
+			}
+			req.Snapshot = &snap
+			next = c.snapshot.Index + 1
+		}
+		req.PrevLogIndex = next - 1
+		req.PrevLogTerm = c.entry(next - 1).Term
+		req.Entries = append([]logEntry{}, c.log[next-c.snapshot.Index:]...)
+		go c.appendEntries(id, req)
+	}
+}
+
+func (c *cluster) appendEntries(id string, req appendRequest) {
+	var resp appendResponse
+	err := c.call(id, "append", req, &resp)
+	c.Lock()
+	defer c.Unlock()
+	c.sending[id] = false
+	if err != nil {
+		c.logger.Debug("unable to append entries", "peer", id, "error", err)
+		return
+	}
+	if resp.Term > c.term {
+		c.becomeFollower(resp.Term, "")
+		return
+	}
+	if c.role != RoleLeader || c.term != req.Term {
+		return
+	}
+	c.contacted[id] = time.Now()
+	if !resp.Success {
+		next := resp.LastIndex + 1
+		if next >= req.PrevLogIndex {
+			next = req.PrevLogIndex
+		}
+		c.nextIndex[id] = max(next, 1)
+		return
+	}
+	match := req.PrevLogIndex + uint64(len(req.Entries))
+	c.matchIndex[id] = max(c.matchIndex[id], match)
+	c.nextIndex[id] = match + 1
+	c.advanceCommit()
+}
+
+// advanceCommit commits the last entry of the term that a majority of the cluster has stored, and every
+// entry before it. Expects c to be locked
+func (c *cluster) advanceCommit() {
+	last, _ := c.lastLog()
+	for n := last; n > c.commitIndex && c.entry(n).Term == c.term; n-- {
+		stored := 1
+		for id := range c.Peers {
+			if c.matchIndex[id] >= n {
+				stored++
+			}
+		}
+		if stored >= c.majority() {
+			c.commitIndex = n
+			c.changed.Broadcast()
+			return
+		}
+	}
+}
+
+// applyCommitted has the committed entries applied to the items whenever there are some, until the cluster
+// is stopped
+func (c *cluster) applyCommitted() {
+	c.Lock()
+	defer c.Unlock()
+	for {
+		for !c.stopped && c.lastApplied >= c.commitIndex {
+			c.changed.Wait()
+		}
+		if c.stopped {
+			return
+		}
+		c.Unlock()
+		c.apply()
+		c.Lock()
+	}
+}
+
+// takeCommitted returns the commands of the entries committed since they were last taken, in order and with
+// the passwords of their items, starting with those of the snapshot if they haven't been taken. Taking them
+// and applying them must be done under the same lock, so that they are applied in order
+func (c *cluster) takeCommitted() []itemCommand {
+	c.Lock()
+	defer c.Unlock()
+	var cmds []itemCommand
+	if c.lastApplied < c.snapshot.Index {
+		names := make([]string, 0, len(c.snapshot.Commands))
+		for name := range c.snapshot.Commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cmds = append(cmds, c.snapshot.Commands[name])
+		}
+		c.lastApplied = c.snapshot.Index
+	}
+	for index := c.lastApplied + 1; index <= c.commitIndex; index++ {
+		if cmd := c.entry(index).Command; cmd.Name != "" {
+			cmds = append(cmds, cmd)
+		}
+	}
+	c.lastApplied = max(c.lastApplied, c.commitIndex)
+	c.compact()
+	c.changed.Broadcast()
+
+	for i, cmd := range cmds {
+		opened, err := c.open(cmd)
+		if err != nil {
+			c.logger.Error("unable to open the password of a replicated item", "host", cmd.Name, "error", err)
+		}
+		cmds[i] = opened
+	}
+	return cmds
+}
+
+// compact folds the applied entries into the snapshot once there are more than compactAfter of them.
+// Expects c to be locked
+func (c *cluster) compact() {
+	if c.lastApplied-c.snapshot.Index <= c.compactAfter {
+		return
+	}
+	for index := c.snapshot.Index + 1; index <= c.lastApplied; index++ {
+		if cmd := c.entry(index).Command; cmd.Name != "" {
+			c.snapshot.Commands[cmd.Name] = cmd
+		}
+	}
+	term := c.entry(c.lastApplied).Term
+	c.log = append([]logEntry{{Term: term}}, c.log[c.lastApplied-c.snapshot.Index+1:]...)
+	c.snapshot.Index, c.snapshot.Term = c.lastApplied, term
+	if err := c.save(); err != nil {
+		c.logger.Error("unable to save the compacted log", "error", err)
+	}
+}
+
+// seal returns cmd with the password of its item sealed with the key of the cluster
+func (c *cluster) seal(cmd itemCommand) (itemCommand, error) {
+	if cmd.Item == nil || cmd.Item.Password == "" {
+		return cmd, nil
+	}
+	gcm, err := c.cipher()
+	if err != nil {
+		return cmd, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return cmd, err
+	}
+	item := *cmd.Item
+	cmd.Password = base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(item.Password), []byte(cmd.Name)))
+	item.Password = ""
+	cmd.Item = &item
+	return cmd, nil
+}
+
+// open returns cmd with the password sealed by seal back in its item
+func (c *cluster) open(cmd itemCommand) (itemCommand, error) {
+	if cmd.Item == nil || cmd.Password == "" {
+		return cmd, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(cmd.Password)
+	if err != nil {
+		return cmd, err
+	}
+	gcm, err := c.cipher()
+	if err != nil {
+		return cmd, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return cmd, errors.New("sealed password is too short")
+	}
+	password, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(cmd.Name))
+	if err != nil {
+		return cmd, err
+	}
+	item := *cmd.Item
+	item.Password = string(password)
+	cmd.Item = &item
+	cmd.Password = ""
+	return cmd, nil
+}
+
+func (c *cluster) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// replicate appends cmd to the log and waits for a majority of the cluster to store it, for at most an
+// election timeout, after which a leader that can't reach a majority steps down anyway, or until ctx is done.
+// A change that isn't stored in time, for which errNotStoredInTime is returned, may still be stored
+// afterwards, if a majority stored it too late
+func (c *cluster) replicate(ctx context.Context, cmd itemCommand) error {
+	cmd, err := c.seal(cmd)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.role != RoleLeader {
+		return errNotLeader
+	}
+	term := c.term
+	c.log = append(c.log, logEntry{Term: term, Command: cmd})
+	if err := c.save(); err != nil {
+		c.log = c.log[:len(c.log)-1]
+		return err
+	}
+	index, _ := c.lastLog()
+	c.advanceCommit()
+	c.sendHeartbeats()
+
+	c.waitFor(ctx, c.electionTimeout, func() bool {
+		return c.commitIndex >= index || c.term != term || c.role != RoleLeader
+	})
+	if c.commitIndex < index || c.term != term {
+		return fmt.Errorf("%w, waited %s", errNotStoredInTime, c.electionTimeout)
+	}
+	return nil
+}
+
+// leading reports whether this instance is the leader of the cluster, once it has applied the changes
+// committed before its term
+func (c *cluster) leading(ctx context.Context) bool {
+	c.Lock()
+	defer c.Unlock()
+	c.waitFor(ctx, c.electionTimeout, func() bool {
+		return c.role != RoleLeader || c.lastApplied >= c.termStart
+	})
+	return c.role == RoleLeader && c.lastApplied >= c.termStart
+}
+
+// waitFor waits until done, timeout has passed or ctx is done. Expects c to be locked
+func (c *cluster) waitFor(ctx context.Context, timeout time.Duration, done func() bool) {
+	timedOut := false
+	wake := func() {
+		c.Lock()
+		timedOut = true
+		c.changed.Broadcast()
+		c.Unlock()
+	}
+	timer := time.AfterFunc(timeout, wake)
+	defer timer.Stop()
+	stop := context.AfterFunc(ctx, wake)
+	defer stop()
+	for !done() && !timedOut {
+		c.changed.Wait()
+	}
+}
+
+// vote answers a candidate asking for this instance's vote
+func (c *cluster) vote(req voteRequest) voteResponse {
+	c.Lock()
+	defer c.Unlock()
+	if req.Term > c.term {
+		c.becomeFollower(req.Term, "")
+	}
+	resp := voteResponse{Term: c.term}
+	if req.Term < c.term || (c.votedFor != "" && c.votedFor != req.Candidate) {
+		return resp
+	}
+	// only a candidate whose log has every entry this instance has can be elected
+	last, lastTerm := c.lastLog()
+	if req.LastLogTerm < lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex < last) {
+		return resp
+	}
+	// the vote is saved before it is granted, so that the instance can't vote for another candidate in the
+	// term once restarted
+	votedFor := c.votedFor
+	c.votedFor = req.Candidate
+	if err := c.save(); err != nil {
+		c.logger.Error("unable to save the vote", "term", c.term, "error", err)
+		c.votedFor = votedFor
+		return resp
+	}
+	c.resetDeadline()
+	resp.Granted = true
+	return resp
+}
+
+// appendLog appends the entries sent by the leader to the log, replacing those conflicting with them, and
+// installs the snapshot sent with them if there is one. The log is saved before the leader is answered
+func (c *cluster) appendLog(req appendRequest) appendResponse {
+	c.Lock()
+	defer c.Unlock()
+	if req.Term < c.term {
+		return appendResponse{Term: c.term}
+	}
+	if req.Term > c.term || c.role != RoleFollower || c.leader != req.Leader {
+		c.becomeFollower(req.Term, req.Leader)
+	} else {
+		c.resetDeadline()
+	}
+	resp := appendResponse{Term: c.term}
+	if req.Snapshot != nil && req.Snapshot.Index > c.snapshot.Index {
+		c.installSnapshot(*req.Snapshot)
+	}
+	last, _ := c.lastLog()
+	if req.PrevLogIndex > last {
+		resp.LastIndex = last
+		return resp
+	}
+	// the entries up to the snapshot are committed, so they match those of the leader
+	if req.PrevLogIndex >= c.snapshot.Index && c.entry(req.PrevLogIndex).Term != req.PrevLogTerm {
+		resp.LastIndex = req.PrevLogIndex - 1
+		return resp
+	}
+	appended := false
+	for i, entry := range req.Entries {
+		index := req.PrevLogIndex + 1 + uint64(i)
+		if index <= c.snapshot.Index {
+			continue
+		}
+		if last, _ := c.lastLog(); index <= last {
+			if c.entry(index).Term == entry.Term {
+				continue
+			}
+			c.log = c.log[:index-c.snapshot.Index]
+		}
+		c.log = append(c.log, entry)
+		appended = true
+	}
+	if appended || req.Snapshot != nil {
+		if err := c.save(); err != nil {
+			c.logger.Error("unable to save the log", "error", err)
+			resp.LastIndex = c.commitIndex
+			return resp
+		}
+	}
+	if commit := min(req.LeaderCommit, req.PrevLogIndex+uint64(len(req.Entries))); commit > c.commitIndex {
+		c.commitIndex = commit
+		c.changed.Broadcast()
+	}
+	resp.Success = true
+	resp.LastIndex, _ = c.lastLog()
+	return resp
+}
+
+// installSnapshot replaces the log up to the snapshot of the leader with it, keeping the entries after it if
+// the log agrees with the leader up to the snapshot. Expects c to be locked
+func (c *cluster) installSnapshot(snap snapshot) {
+	if snap.Commands == nil {
+		snap.Commands = map[string]itemCommand{}
+	}
+	rest := []logEntry{{Term: snap.Term}}
+	if last, _ := c.lastLog(); snap.Index <= last && c.entry(snap.Index).Term == snap.Term {
+		rest = append(rest, c.log[snap.Index-c.snapshot.Index+1:]...)
+	}
+	c.snapshot, c.log = snap, rest
+	c.commitIndex = max(c.commitIndex, snap.Index)
+	// the entries that haven't been applied are replaced by the snapshot, which is applied in full
+	if c.lastApplied < snap.Index {
+		c.lastApplied = 0
+	}
+	c.changed.Broadcast()
+}
+
+// call sends req to the method of the peer called id, decoding its answer into resp
+func (c *cluster) call(id, method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, c.Peers[id]+"/cluster/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", c.Secret)
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned %s", httpResp.Status)
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// status returns what the instance knows about its cluster
+func (c *cluster) status() ClusterStatus {
+	c.Lock()
+	defer c.Unlock()
+	return ClusterStatus{ID: c.ID, Role: c.role, Term: c.term, Leader: c.leader, CommitIndex: c.commitIndex, Peers: c.Peers}
+}
+
+// Only the items are replicated, so an instance of a cluster refuses to keep anything else a new leader
+// would need: the windows added with the API, and the changes queued for a window or held for approval
+var (
+	errWindowsInCluster   = &Error{Code: CodeForbidden, Message: "the windows of a cluster can only be changed in the configuration of every instance"}
+	errApprovalsInCluster = &Error{Code: CodeForbidden, Message: "changes needing approval can't be made in a cluster, as pending changes are not replicated"}
+)
+
+// storeItem stores item as name with the next revision, or removes name if item is nil. In a cluster the
+// change is only made once a majority of the cluster has stored it, and an error is returned if it hasn't,
+// leaving the items unchanged for now: a change that wasn't stored in time may still be made once it is,
+// without being pushed. Does not lock access to the itemService, expects this to be done by the calling
+// method
+func (s *Service) storeItem(ctx context.Context, name string, item *Item) error {
+	cmd := itemCommand{Name: name}
+	if item != nil {
+		s.revision++
+		item.Revision = s.revision
+		stored := *item
+		cmd.Item = &stored
+	}
+	if s.cluster == nil {
+		s.applyItemCommand(cmd)
+		return nil
+	}
+	err := s.cluster.replicate(ctx, cmd)
+	// the change is applied with every other committed change, in the order of the log
+	s.applyCommitted()
+	if err != nil {
+		loggerFrom(ctx).Error("item change not replicated", "host", name, "error", err)
+	}
+	return err
+}
+
+// itemStored answers w with 503 if err, the error storeItem returned, is not nil, and reports whether the
+// change was stored. A change that may still be stored is answered with CodeOutcomeUnknown, as retrying it
+// blindly could make it twice or undo a change made since
+func itemStored(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errNotStoredInTime):
+		httpError(w, fmt.Sprintf("the outcome of the change is unknown, %s: it may still be stored without being pushed, so read the item again, or retry with If-Match, before retrying", err), http.StatusServiceUnavailable, CodeOutcomeUnknown)
+	default:
+		httpError(w, fmt.Sprintf("the change was not stored by the cluster, %s", err), http.StatusServiceUnavailable, CodeUnavailable)
+	}
+	return false
+}
+
+// applyItemCommand applies a change to the items. Expects the Service to be locked
+func (s *Service) applyItemCommand(cmd itemCommand) {
+	if cmd.Item == nil {
+		delete(s.items, cmd.Name)
+	} else {
+		s.items[cmd.Name] = *cmd.Item
+		// the revisions carry on from the last one stored if this instance becomes the leader
+		s.revision = max(s.revision, cmd.Item.Revision)
+	}
+	s.metrics.items.Set(float64(len(s.items)))
+}
+
+// applyCommitted applies the changes committed by the cluster since they were last applied. Expects the
+// Service to be locked
+func (s *Service) applyCommitted() {
+	for _, cmd := range s.cluster.takeCommitted() {
+		s.applyItemCommand(cmd)
+	}
+}
+
+// startCluster joins the cluster if the Service is configured with one
+func (s *Service) startCluster() {
+	if s.cluster != nil {
+		s.cluster.start(s.logger, func() {
+			s.Lock()
+			defer s.Unlock()
+			s.applyCommitted()
+		})
+	}
+}
+
+// toLeader forwards the requests to handlerFunc to the leader of the cluster, unless this instance is the
+// leader or the Service isn't in a cluster. A request that has been forwarded already is not forwarded
+// again, so that instances disagreeing about the leader can't forward it in circles
+func (s *Service) toLeader(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	if s.cluster == nil {
+		return handlerFunc
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cluster.leading(r.Context()) {
+			handlerFunc(w, r)
+			return
+		}
+		status := s.cluster.status()
+		peer, ok := s.cluster.Peers[status.Leader]
+		if !ok || r.Header.Get(ForwardedHeader) != "" {
+			httpError(w, "the cluster has no leader, try again once one is elected", http.StatusServiceUnavailable, CodeUnavailable)
+			return
+		}
+		target, err := url.Parse(peer)
+		if err != nil {
+			httpError(w, err.Error(), http.StatusInternalServerError, CodeInternal)
+			return
+		}
+		logger := loggerFrom(r.Context())
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		// events are streamed as they are sent
+		proxy.FlushInterval = -1
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Warn("unable to forward request to the leader", "leader", status.Leader, "error", err)
+			httpError(w, fmt.Sprintf("unable to reach the leader of the cluster, %s", status.Leader), http.StatusBadGateway, CodeUnavailable)
+		}
+		r.Header.Set(ForwardedHeader, s.cluster.ID)
+		r.Header.Set(RequestIDHeader, requestIDFrom(r.Context()))
+		// the leader answers with the request ID too
+		w.Header().Del(RequestIDHeader)
+		logger.Debug("forwarding request to the leader", "leader", status.Leader)
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// clusterAuth only lets the other instances of the cluster call handlerFunc
+func (s *Service) clusterAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cluster == nil {
+			httpError(w, "server is not in a cluster", http.StatusNotFound, CodeNotFound)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.cluster.Secret)) != 1 {
+			httpError(w, "Authorization is not the secret of the cluster", http.StatusUnauthorized, CodeUnauthorized)
+			return
+		}
+		handlerFunc(w, r)
+	}
+}
+
+// GetCluster returns what the instance knows about its cluster: its role, the term and the leader
+func (s *Service) GetCluster(w http.ResponseWriter, r *http.Request) {
+	if s.cluster == nil {
+		httpError(w, "server is not in a cluster", http.StatusNotFound, CodeNotFound)
+		return
+	}
+	err := writeJSON(w, s.cluster.status())
+	if err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
+	}
+}
+
+// PostClusterVote answers another instance asking for this instance's vote to become leader
+func (s *Service) PostClusterVote(w http.ResponseWriter, r *http.Request) {
+	var req voteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest, CodeBadRequest)
+		return
+	}
+	_ = writeJSON(w, s.cluster.vote(req))
+}
+
+// PostClusterAppend appends the entries sent by the leader of the cluster to this instance's log
+func (s *Service) PostClusterAppend(w http.ResponseWriter, r *http.Request) {
+	var req appendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest, CodeBadRequest)
+		return
+	}
+	_ = writeJSON(w, s.cluster.appendLog(req))
+}
@@ -0,0 +1,381 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type clusterNode struct {
+	*Service
+	server *httptest.Server
+	config Cluster
+	opts   []Option
+}
+
+// stop takes the instance out of the cluster, as if it had crashed
+func (n *clusterNode) stop() {
+	n.cluster.stop()
+	n.server.Close()
+}
+
+// restart starts the stopped instance again on the same address and directory
+func (n *clusterNode) restart(t *testing.T) *clusterNode {
+	t.Helper()
+	ln, err := net.Listen("tcp", n.server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startClusterNode(t, n.config, ln, n.opts...)
+}
+
+// startClusterNode starts an instance of a cluster serving on ln
+func startClusterNode(t *testing.T, config Cluster, ln net.Listener, opts ...Option) *clusterNode {
+	t.Helper()
+	s := newTestService(append([]Option{
+		WithCluster(config),
+		WithClusterTimeouts(10*time.Millisecond, 100*time.Millisecond),
+	}, opts...)...)
+	ts := httptest.NewUnstartedServer(s.Handler())
+	ts.Listener.Close()
+	ts.Listener = ln
+	ts.Start()
+	node := &clusterNode{Service: s, server: ts, config: config, opts: opts}
+	t.Cleanup(node.stop)
+	return node
+}
+
+// newTestCluster starts a cluster of n instances listening on localhost, configured with opts as well
+func newTestCluster(t *testing.T, n int, opts ...Option) []*clusterNode {
+	t.Helper()
+	listeners := map[string]net.Listener{}
+	urls := map[string]string{}
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := fmt.Sprintf("api-%d", i)
+		listeners[id] = ln
+		urls[id] = "http://" + ln.Addr().String()
+	}
+
+	var nodes []*clusterNode
+	for id, ln := range listeners {
+		peers := map[string]string{}
+		for peer, u := range urls {
+			if peer != id {
+				peers[peer] = u
+			}
+		}
+		config := Cluster{ID: id, Peers: peers, Secret: "s3cret", Dir: t.TempDir()}
+		nodes = append(nodes, startClusterNode(t, config, ln, opts...))
+	}
+	return nodes
+}
+
+// clusterLeader waits for one of nodes to lead the others, returning it and a follower
+func clusterLeader(t *testing.T, nodes ...*clusterNode) (*clusterNode, *clusterNode) {
+	t.Helper()
+	var leader, follower *clusterNode
+	if !eventually(t, func() bool {
+		leader, follower = nil, nil
+		for _, n := range nodes {
+			status := n.cluster.status()
+			switch {
+			case status.Role == RoleLeader && leader == nil:
+				leader = n
+			case status.Role == RoleFollower && status.Leader != "":
+				follower = n
+			default:
+				return false
+			}
+		}
+		return leader != nil && (follower != nil || len(nodes) == 1)
+	}) {
+		t.Fatal("expected the cluster to elect a leader")
+	}
+	return leader, follower
+}
+
+// itemEverywhere waits for every one of nodes to have the item on host, or for none to have it
+func itemEverywhere(t *testing.T, host string, stored bool, nodes ...*clusterNode) bool {
+	t.Helper()
+	return eventually(t, func() bool {
+		for _, n := range nodes {
+			if (serve(n.Service, http.MethodGet, "/item/"+host, nil).Code == http.StatusOK) != stored {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestClusterReplicatesItems(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	nodes := newTestCluster(t, 3)
+	leader, follower := clusterLeader(t, nodes...)
+
+	rec := serve(follower.Service, http.MethodPost, "/item", savedItem(d.addr))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the follower to forward the change to the leader, got %d %s", rec.Code, rec.Body)
+	}
+	leader.operations.RLock()
+	_, pushed := leader.operations.operations[rec.Header().Get(OperationIDHeader)]
+	leader.operations.RUnlock()
+	if !pushed || len(d.received()) == 0 {
+		t.Error("expected the leader to push the change to the device")
+	}
+	if !itemEverywhere(t, d.addr, true, nodes...) {
+		t.Error("expected the item to be replicated to every instance")
+	}
+
+	var status ClusterStatus
+	json.Unmarshal(serve(follower.Service, http.MethodGet, "/cluster", nil).Body.Bytes(), &status)
+	if status.Role != RoleFollower || status.Leader != leader.cluster.ID || status.CommitIndex == 0 {
+		t.Errorf("expected the follower to know the leader, got %+v", status)
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	nodes := newTestCluster(t, 3)
+	leader, _ := clusterLeader(t, nodes...)
+	if rec := serve(leader.Service, http.MethodPost, "/item", savedItem(d.addr)); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if !itemEverywhere(t, d.addr, true, nodes...) {
+		t.Fatal("expected the item to be replicated to every instance")
+	}
+
+	leader.stop()
+	var rest []*clusterNode
+	for _, n := range nodes {
+		if n != leader {
+			rest = append(rest, n)
+		}
+	}
+	newLeader, follower := clusterLeader(t, rest...)
+	if rec := serve(follower.Service, http.MethodDelete, "/item/"+d.addr, savedItem(d.addr)); rec.Code != http.StatusOK {
+		t.Fatalf("expected the change to be made by the new leader, got %d %s", rec.Code, rec.Body)
+	}
+	if !itemEverywhere(t, d.addr, false, rest...) {
+		t.Error("expected the delete to be replicated to the remaining instances")
+	}
+
+	// a single instance is not a majority of the cluster, so it can't make changes
+	follower.stop()
+	if !eventually(t, func() bool { return newLeader.cluster.status().Role != RoleLeader }) {
+		t.Fatal("expected the leader to step down without a majority")
+	}
+	if rec := serve(newLeader.Service, http.MethodPost, "/item", savedItem(d.addr)); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected changes to be refused without a leader, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestClusterRefusesUnreplicatedChanges(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	nodes := newTestCluster(t, 3)
+	leader, _ := clusterLeader(t, nodes...)
+	for _, n := range nodes {
+		if n != leader {
+			n.stop()
+		}
+	}
+
+	rec := serve(leader.Service, http.MethodPost, "/item", savedItem(d.addr))
+	var body Error
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusServiceUnavailable || body.Code != CodeOutcomeUnknown {
+		t.Errorf("expected a change the cluster can't store in time to have an unknown outcome, got %d %s", rec.Code, rec.Body)
+	}
+	leader.Lock()
+	_, stored := leader.items[d.addr]
+	leader.Unlock()
+	if stored || len(d.received()) != 0 {
+		t.Error("expected the refused change not to be stored or pushed")
+	}
+}
+
+func TestClusterRefusesUnreplicatedState(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	start := time.Now().Add(time.Hour)
+	nodes := newTestCluster(t, 3,
+		WithWindows(Window{Name: "later", Kind: WindowMaintenance, Start: start, End: start.Add(time.Hour), Tags: []string{"edge"}}),
+		WithApprovals("core"))
+	_, follower := clusterLeader(t, nodes...)
+
+	window := Window{Name: "core-weekly", Kind: WindowMaintenance, Start: start, End: start.Add(time.Hour)}
+	if rec := serve(follower.Service, http.MethodPost, "/window", window); rec.Code != http.StatusForbidden {
+		t.Errorf("expected a window added with the API to be refused, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(follower.Service, http.MethodDelete, "/window/later", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("expected a window removed with the API to be refused, got %d %s", rec.Code, rec.Body)
+	}
+
+	edge := taggedItem(d.addr, "edge")
+	rec := serveWithHeader(follower.Service, http.MethodPost, "/item", edge, http.Header{"Prefer": {"respond-async"}})
+	if rec.Code != http.StatusLocked {
+		t.Errorf("expected a change the calendar doesn't allow to be rejected rather than queued, got %d %s", rec.Code, rec.Body)
+	}
+	core := taggedItem(d.addr, "core")
+	if rec := serve(follower.Service, http.MethodPost, "/item", core); rec.Code != http.StatusForbidden {
+		t.Errorf("expected a change needing approval to be refused, got %d %s", rec.Code, rec.Body)
+	}
+	for _, n := range nodes {
+		n.changes.RLock()
+		queued := len(n.changes.changes)
+		n.changes.RUnlock()
+		if queued != 0 {
+			t.Errorf("expected no changes to be kept by %s, got %d", n.cluster.ID, queued)
+		}
+	}
+	if len(d.received()) != 0 {
+		t.Error("expected the refused changes not to be pushed")
+	}
+}
+
+func TestClusterRestart(t *testing.T) {
+	devices := []*fakeDevice{newFakeDevice(t, "router", true), newFakeDevice(t, "router", true), newFakeDevice(t, "router", true)}
+	nodes := newTestCluster(t, 3, func(s *Service) { s.cluster.compactAfter = 1 })
+	leader, _ := clusterLeader(t, nodes...)
+	for _, d := range devices {
+		if rec := serve(leader.Service, http.MethodPost, "/item", savedItem(d.addr)); rec.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+		}
+	}
+	if !itemEverywhere(t, devices[2].addr, true, nodes...) {
+		t.Fatal("expected the items to be replicated to every instance")
+	}
+	term := leader.cluster.status().Term
+
+	for _, n := range nodes {
+		n.stop()
+	}
+	for _, n := range nodes {
+		state, err := os.ReadFile(filepath.Join(n.config.Dir, clusterStateFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(state), `"password":"admin"`) {
+			t.Errorf("expected the passwords to be sealed in the state of the instance, got %s", state)
+		}
+		n.cluster.Lock()
+		compacted := n.cluster.snapshot.Index > 0
+		n.cluster.Unlock()
+		if !compacted {
+			t.Errorf("expected the log of %s to have been compacted", n.config.ID)
+		}
+	}
+
+	var restarted []*clusterNode
+	for _, n := range nodes {
+		restarted = append(restarted, n.restart(t))
+	}
+	leader, _ = clusterLeader(t, restarted...)
+	if leader.cluster.status().Term <= term {
+		t.Errorf("expected the term to carry on from %d, got %d", term, leader.cluster.status().Term)
+	}
+	for _, d := range devices {
+		if !itemEverywhere(t, d.addr, true, restarted...) {
+			t.Fatalf("expected %s to be recovered by every instance", d.addr)
+		}
+	}
+	for _, n := range restarted {
+		n.Lock()
+		item := n.items[devices[0].addr]
+		n.Unlock()
+		if item.Password != "admin" || item.Revision == 0 {
+			t.Errorf("expected the item to be recovered with its password and revision, got %+v", item)
+		}
+	}
+}
+
+func TestClusterVoteSurvivesRestart(t *testing.T) {
+	config := Cluster{ID: "api-0", Peers: map[string]string{"api-1": "http://127.0.0.1:1", "api-2": "http://127.0.0.1:2"}, Secret: "s3cret", Dir: t.TempDir()}
+	c := newCluster(config)
+	c.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if resp := c.vote(voteRequest{Term: 5, Candidate: "api-1"}); !resp.Granted {
+		t.Fatalf("expected the vote to be granted, got %+v", resp)
+	}
+
+	restarted := newCluster(config)
+	restarted.logger = c.logger
+	restarted.Lock()
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Unlock()
+	if resp := restarted.vote(voteRequest{Term: 5, Candidate: "api-2"}); resp.Granted || resp.Term != 5 {
+		t.Errorf("expected a second vote in the term to be refused, got %+v", resp)
+	}
+	if resp := restarted.vote(voteRequest{Term: 5, Candidate: "api-1"}); !resp.Granted {
+		t.Errorf("expected the vote to be granted again to the same candidate, got %+v", resp)
+	}
+}
+
+func TestClusterInstallSnapshot(t *testing.T) {
+	leader := newCluster(Cluster{ID: "api-1", Secret: "s3cret"})
+	item := deviceItem("router:22")
+	cmd, err := leader.seal(itemCommand{Name: item.Host, Item: &item})
+	if err != nil || cmd.Item.Password != "" || cmd.Password == "" {
+		t.Fatalf("expected the password to be sealed, got %+v %v", cmd, err)
+	}
+
+	c := newCluster(Cluster{ID: "api-0", Secret: "s3cret", Dir: t.TempDir()})
+	c.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	resp := c.appendLog(appendRequest{
+		Term: 2, Leader: "api-1", PrevLogIndex: 7, PrevLogTerm: 2, LeaderCommit: 8,
+		Snapshot: &snapshot{Index: 7, Term: 2, Commands: map[string]itemCommand{item.Host: cmd}},
+		Entries:  []logEntry{{Term: 2, Command: itemCommand{Name: "switch:22"}}},
+	})
+	if !resp.Success || resp.LastIndex != 8 {
+		t.Fatalf("expected the snapshot and entries to be appended, got %+v", resp)
+	}
+	cmds := c.takeCommitted()
+	if len(cmds) != 2 || cmds[0].Item == nil || cmds[0].Item.Password != "admin" || cmds[1].Name != "switch:22" {
+		t.Errorf("expected the snapshot to be applied before the entries, got %+v", cmds)
+	}
+}
+
+func TestClusterAuth(t *testing.T) {
+	nodes := newTestCluster(t, 1)
+	clusterLeader(t, nodes...)
+
+	rec := serveWithHeader(nodes[0].Service, http.MethodPost, "/cluster/vote", voteRequest{Term: 99, Candidate: "intruder"}, as("token"))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a call without the secret of the cluster to be rejected, got %d %s", rec.Code, rec.Body)
+	}
+	if status := nodes[0].cluster.status(); status.Role != RoleLeader || status.Term == 99 {
+		t.Errorf("expected the rejected call not to change the cluster, got %+v", status)
+	}
+}
+
+func TestValidateCluster(t *testing.T) {
+	tests := []struct {
+		cluster Cluster
+		valid   bool
+	}{
+		{Cluster{ID: "api-0", Secret: "s3cret", Dir: "data", Peers: map[string]string{"api-1": "http://127.0.0.1:3002"}}, true},
+		{Cluster{ID: "api-0", Secret: "s3cret", Dir: "data"}, true},
+		{Cluster{Secret: "s3cret", Dir: "data"}, false},
+		{Cluster{ID: "api-0", Dir: "data"}, false},
+		{Cluster{ID: "api-0", Secret: "s3cret"}, false},
+		{Cluster{ID: "api-0", Secret: "s3cret", Dir: "data", Peers: map[string]string{"api-0": "http://127.0.0.1:3002"}}, false},
+		{Cluster{ID: "api-0", Secret: "s3cret", Dir: "data", Peers: map[string]string{"api-1": "127.0.0.1:3002"}}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateCluster(tt.cluster); (err == nil) != tt.valid {
+			t.Errorf("%+v: got %v, want valid %t", tt.cluster, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package server_test
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meirizal/terraform-experiment/api/client"
+	"github.com/meirizal/terraform-experiment/api/server"
+	"golang.org/x/exp/slices"
+)
+
+func newTestService(t *testing.T) *server.Service {
+	t.Helper()
+	return server.NewService("", map[string]server.Item{}, server.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+}
+
+func newTestClient(t *testing.T, handler http.Handler) *client.Client {
+	t.Helper()
+	return newTestClientAs(t, handler, "token")
+}
+
+// newTestClientAs returns a client authenticating with token, for tests needing several token holders
+func newTestClientAs(t *testing.T, handler http.Handler, token string) *client.Client {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.NewClient("http://"+u.Hostname(), port, token)
+}
+
+func TestRoutesMatchSpec(t *testing.T) {
+	spec := server.SpecOperations()
+	// the unversioned routes are those of v1, for the clients from before the API had versions
+	for _, version := range append([]string{""}, server.APIVersions...) {
+		routes := server.RouteOperations(t, newTestService(t), version)
+		sort.Strings(routes)
+		if !slices.Equal(routes, spec) {
+			t.Errorf("routes of version %q and OpenAPI document differ\nroutes: %v\nspec:   %v", version, routes, spec)
+		}
+	}
+}
+
+// TestClientContract exercises every client method against the server, checking each request and
+// response against the OpenAPI document
+func TestClientContract(t *testing.T) {
+	s := newTestService(t)
+	c := newTestClient(t, server.ValidatingHandler(t, s))
+
+	// Nothing listens on port 1, so pushes fail quickly and are recorded as failed operations
+	item := &server.Item{
+		Host:     "127.0.0.1:1",
+		IntfType: "GigabitEthernet",
+		Number:   "1",
+		Mtu:      1500,
+		Username: "admin",
+		Password: "admin",
+	}
+	if err := c.NewItem(item); err != nil {
+		t.Fatalf("NewItem: %s", err)
+	}
+	got, err := c.GetItem(item.Host)
+	if err != nil {
+		t.Fatalf("GetItem: %s", err)
+	}
+	if got.Mtu != item.Mtu {
+		t.Errorf("GetItem: got mtu %d, want %d", got.Mtu, item.Mtu)
+	}
+	item.Description = "updated"
+	if err := c.UpdateItem(item); err != nil {
+		t.Fatalf("UpdateItem: %s", err)
+	}
+	all, err := c.GetAll()
+	if err != nil {
+		t.Fatalf("GetAll: %s", err)
+	}
+	if (*all)[item.Host].Description != "updated" {
+		t.Errorf("GetAll: item was not updated")
+	}
+
+	ops, err := c.GetOperations(item.Host)
+	if err != nil {
+		t.Fatalf("GetOperations: %s", err)
+	}
+	if len(ops) != 2 {
+		t.Fatalf("GetOperations: got %d operations, want 2", len(ops))
+	}
+	op, err := c.GetOperation(ops[0].ID)
+	if err != nil {
+		t.Fatalf("GetOperation: %s", err)
+	}
+	if op.Template != "iosxe_interface_ethernet" || op.TemplateVersion == "" || op.Platform != server.DefaultPlatform {
+		t.Errorf("GetOperation: got template %s version %s on %s", op.Template, op.TemplateVersion, op.Platform)
+	}
+
+	_, err = c.GetItemConfig(item.Host)
+	if apiErr, ok := err.(*client.APIError); !ok || apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != server.CodeDeviceError {
+		t.Errorf("GetItemConfig: expected a device error, got %v", err)
+	}
+
+	_, err = c.SaveDevice(item.Host)
+	if apiErr, ok := err.(*client.APIError); !ok || apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != server.CodeDeviceError {
+		t.Errorf("SaveDevice: expected a device error, got %v", err)
+	}
+
+	backups, err := c.GetBackups(item.Host)
+	if err != nil {
+		t.Fatalf("GetBackups: %s", err)
+	}
+	if len(backups) != 0 {
+		t.Errorf("GetBackups: got %d backups with backups disabled", len(backups))
+	}
+	if _, err := c.GetBackup(item.Host, 1); !client.IsNotFound(err) {
+		t.Errorf("GetBackup: expected not found, got %v", err)
+	}
+	if _, err := c.GetBackupDiff(item.Host, 1, 2); !client.IsNotFound(err) {
+		t.Errorf("GetBackupDiff: expected not found, got %v", err)
+	}
+
+	letters, err := c.GetDeadLetters()
+	if err != nil {
+		t.Fatalf("GetDeadLetters: %s", err)
+	}
+	if len(letters) != 0 {
+		t.Errorf("GetDeadLetters: got %d dead letters without webhooks", len(letters))
+	}
+
+	start := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	window := &server.Window{Name: "core-weekly", Kind: server.WindowMaintenance, Start: start, End: start.Add(time.Hour), Tags: []string{"core"}}
+	if err := c.NewWindow(window); err != nil {
+		t.Fatalf("NewWindow: %s", err)
+	}
+	windows, err := c.GetWindows()
+	if err != nil {
+		t.Fatalf("GetWindows: %s", err)
+	}
+	if len(windows) != 1 || !windows[0].Start.Equal(start) {
+		t.Errorf("GetWindows: got %+v", windows)
+	}
+	item.Tags = []string{"core"}
+	err = c.UpdateItem(item)
+	if apiErr, ok := err.(*client.APIError); !ok || apiErr.StatusCode != http.StatusLocked || apiErr.Code != server.CodeChangeWindow {
+		t.Errorf("UpdateItem: expected the change window to reject the change, got %v", err)
+	}
+	c.SetEmergencyOverride("contract test")
+	if err := c.UpdateItem(item); err != nil {
+		t.Errorf("UpdateItem: expected the override to let the change through, got %s", err)
+	}
+	c.SetEmergencyOverride("")
+	if err := c.DeleteWindow(window.Name); err != nil {
+		t.Fatalf("DeleteWindow: %s", err)
+	}
+
+	templates, err := c.GetTemplates()
+	if err != nil {
+		t.Fatalf("GetTemplates: %s", err)
+	}
+	if len(templates) != 2*len(server.Platforms()) {
+		t.Errorf("GetTemplates: got %d templates, want %d", len(templates), 2*len(server.Platforms()))
+	}
+
+	if err := c.DeleteItem(item); err != nil {
+		t.Fatalf("DeleteItem: %s", err)
+	}
+	_, err = c.GetItem(item.Host)
+	if !client.IsNotFound(err) {
+		t.Fatalf("GetItem after delete: expected not found, got %v", err)
+	}
+}
+
+// TestClientApproval checks that the client waits for a change held for approval, and fails with the
+// change when it is rejected or not approved in time
+func TestClientApproval(t *testing.T) {
+	s := server.NewService("", map[string]server.Item{},
+		server.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		server.WithApprovals("production"),
+		server.WithTokens(map[string]string{"alice": server.DefaultNamespace, "bob": server.DefaultNamespace}),
+	)
+	handler := server.ValidatingHandler(t, s)
+	submitter := newTestClientAs(t, handler, "alice").WithChangeTimeout(5 * time.Second)
+	reviewer := newTestClientAs(t, handler, "bob")
+
+	// pending waits for the change in the server to wait for approval
+	pending := func() server.QueuedChange {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			changes, err := reviewer.GetChanges()
+			if err != nil {
+				t.Fatalf("GetChanges: %s", err)
+			}
+			for _, change := range changes {
+				if change.Status == server.ChangePending {
+					return change
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("GetChanges: expected a change waiting for approval")
+		return server.QueuedChange{}
+	}
+
+	item := &server.Item{Host: server.FakeDevice(t), IntfType: "GigabitEthernet", Number: "1", Username: "admin", Password: "admin", Tags: []string{"production"}}
+	errc := make(chan error)
+	go func() { errc <- submitter.NewItem(item) }()
+	change := pending()
+	if change.Diff == "" {
+		t.Errorf("GetChanges: expected the pending change to show its diff")
+	}
+	if _, err := submitter.ApproveChange(change.ID, ""); err == nil {
+		t.Errorf("ApproveChange: expected the submitter not to approve their own change")
+	}
+	if _, err := reviewer.ApproveChange(change.ID, "looks good"); err != nil {
+		t.Fatalf("ApproveChange: %s", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("NewItem: expected the approved change to be made, got %s", err)
+	}
+	if _, err := submitter.GetItem(item.Host); err != nil {
+		t.Fatalf("GetItem: %s", err)
+	}
+
+	item.Mtu = 9000
+	go func() { errc <- submitter.UpdateItem(item) }()
+	change = pending()
+	if _, err := reviewer.RejectChange(change.ID, "wrong MTU"); err != nil {
+		t.Fatalf("RejectChange: %s", err)
+	}
+	changeErr, ok := (<-errc).(*client.ChangeError)
+	if !ok || changeErr.ChangeID != change.ID || changeErr.Status != server.ChangeRejected || changeErr.Message != "wrong MTU" {
+		t.Errorf("UpdateItem: expected the rejected change, got %v", changeErr)
+	}
+
+	err := submitter.WithChangeTimeout(200 * time.Millisecond).DeleteItem(item)
+	changeErr, ok = err.(*client.ChangeError)
+	if !ok || changeErr.Status != server.ChangePending {
+		t.Fatalf("DeleteItem: expected the change to time out waiting for approval, got %v", err)
+	}
+	if change, err := submitter.GetChange(changeErr.ChangeID); err != nil || change.Status != server.ChangePending {
+		t.Errorf("GetChange: expected the change to still be pending, got %+v, %v", change, err)
+	}
+}
+
+// TestClientNamespace checks that a client in a namespace only sees the items of its namespace
+func TestClientNamespace(t *testing.T) {
+	handler := server.ValidatingHandler(t, newTestService(t))
+	teamA := newTestClient(t, handler)
+	teamA.SetNamespace("team-a")
+	defaultClient := newTestClient(t, handler)
+
+	item := &server.Item{Host: "127.0.0.1:1", IntfType: "GigabitEthernet", Number: "1", Username: "admin", Password: "admin"}
+	if err := teamA.NewItem(item); err != nil {
+		t.Fatalf("NewItem: %s", err)
+	}
+	got, err := teamA.GetItem(item.Host)
+	if err != nil || got.Namespace != "team-a" {
+		t.Fatalf("GetItem: expected the item in team-a, got %+v, %v", got, err)
+	}
+	if ops, err := teamA.GetOperations(item.Host); err != nil || len(ops) != 1 {
+		t.Errorf("GetOperations: expected the create operation, got %v, %v", ops, err)
+	}
+	all, err := defaultClient.GetAll()
+	if err != nil || len(*all) != 0 {
+		t.Errorf("GetAll: expected no items in the default namespace, got %v, %v", all, err)
+	}
+	if _, err := defaultClient.GetItem(item.Host); !client.IsNotFound(err) {
+		t.Errorf("GetItem: expected the item not to be found in the default namespace, got %v", err)
+	}
+	if err := teamA.DeleteItem(item); err != nil {
+		t.Fatalf("DeleteItem: %s", err)
+	}
+}
+
+func TestClientItemQuery(t *testing.T) {
+	c := newTestClient(t, server.ValidatingHandler(t, newTestService(t)))
+
+	items := []*server.Item{
+		{Host: "127.0.0.1:1", IntfType: "GigabitEthernet", Number: "1", Mtu: 1500, Tags: []string{"core"}},
+		{Host: "127.0.0.2:1", IntfType: "GigabitEthernet", Number: "2", Mtu: 9000, Tags: []string{"core"}, Shutdown: true},
+		{Host: "127.0.0.3:1", IntfType: "TenGigabitEthernet", Number: "0", Mtu: 1514, ServicePolicyInput: "guest-in"},
+		{Host: "127.0.0.4:1", IntfType: "GigabitEthernet", Number: "4", Mtu: 4000, Tags: []string{"edge"}},
+	}
+	for _, item := range items {
+		item.Username, item.Password = "admin", "admin"
+		if err := c.NewItem(item); err != nil {
+			t.Fatalf("NewItem: %s", err)
+		}
+	}
+
+	tests := []struct {
+		opts  []client.ItemOption
+		hosts []string
+	}{
+		{[]client.ItemOption{client.ItemType("GigabitEthernet"), client.ItemTag("core")}, []string{"127.0.0.1:1", "127.0.0.2:1"}},
+		{[]client.ItemOption{client.ItemShutdown(true)}, []string{"127.0.0.2:1"}},
+		{[]client.ItemOption{client.ItemPolicy("guest-in")}, []string{"127.0.0.3:1"}},
+		{[]client.ItemOption{client.ItemHost("127.0.0.[34]:*"), client.ItemLimit(1)}, []string{"127.0.0.3:1", "127.0.0.4:1"}},
+	}
+	for _, tt := range tests {
+		all, err := c.GetAll(tt.opts...)
+		if err != nil {
+			t.Fatalf("GetAll: %s", err)
+		}
+		var hosts []string
+		for host := range *all {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		if !slices.Equal(hosts, tt.hosts) {
+			t.Errorf("GetAll: got %v, want %v", hosts, tt.hosts)
+		}
+	}
+
+	var mtus []int
+	cursor := ""
+	for pages := 0; pages == 0 || cursor != ""; pages++ {
+		page, err := c.GetItemPage(cursor, client.ItemSort("-mtu"), client.ItemLimit(3), client.ItemFields("mtu"))
+		if err != nil {
+			t.Fatalf("GetItemPage: %s", err)
+		}
+		for _, item := range page.Items {
+			if item.Host == "" || item.Username != "" {
+				t.Errorf("GetItemPage: expected only the host and mtu, got %+v", item)
+			}
+			mtus = append(mtus, item.Mtu)
+		}
+		cursor = page.NextCursor
+	}
+	if !slices.Equal(mtus, []int{9000, 4000, 1514, 1500}) {
+		t.Errorf("GetItemPage: got mtus %v in order", mtus)
+	}
+}
+
+func TestClientConcurrentChanges(t *testing.T) {
+	handler := server.ValidatingHandler(t, newTestService(t))
+	alice, bob := newTestClient(t, handler), newTestClient(t, handler)
+
+	item := &server.Item{Host: "127.0.0.1:1", IntfType: "GigabitEthernet", Number: "1", Username: "admin", Password: "admin"}
+	if err := alice.NewItem(item); err != nil {
+		t.Fatalf("NewItem: %s", err)
+	}
+	read, err := alice.GetItem(item.Host)
+	if err != nil || read.Revision == 0 {
+		t.Fatalf("GetItem: expected the item with its revision, got %+v, %v", read, err)
+	}
+	changed, err := bob.GetItem(item.Host)
+	if err != nil {
+		t.Fatalf("GetItem: %s", err)
+	}
+	changed.Description = "changed by bob"
+	if err := bob.UpdateItem(changed); err != nil {
+		t.Fatalf("UpdateItem: %s", err)
+	}
+
+	read.Description = "changed by alice"
+	if err := alice.UpdateItem(read); !client.IsPreconditionFailed(err) {
+		t.Errorf("UpdateItem: expected the change from a stale read to be refused, got %v", err)
+	}
+	if err := alice.DeleteItem(read); !client.IsPreconditionFailed(err) {
+		t.Errorf("DeleteItem: expected the delete from a stale read to be refused, got %v", err)
+	}
+	// an item without a revision is changed whatever its revision on the server
+	read.Revision = 0
+	if err := alice.UpdateItem(read); err != nil {
+		t.Errorf("UpdateItem: %s", err)
+	}
+}
+
+func TestClientPatchItem(t *testing.T) {
+	c := newTestClient(t, server.ValidatingHandler(t, newTestService(t)))
+
+	item := &server.Item{Host: "127.0.0.1:1", IntfType: "GigabitEthernet", Number: "1", Mtu: 1500, Username: "admin", Password: "admin"}
+	if err := c.NewItem(item); err != nil {
+		t.Fatalf("NewItem: %s", err)
+	}
+	patched, err := c.PatchItem(item.Host, 0, map[string]interface{}{"description": "uplink", "mtu": nil})
+	if err != nil || patched.Description != "uplink" || patched.Mtu != 0 || patched.Password != "admin" {
+		t.Fatalf("PatchItem: expected the merge patch to be applied, got %+v, %v", patched, err)
+	}
+	patched, err = c.PatchItem(item.Host, patched.Revision, []server.PatchOperation{
+		{Op: "add", Path: "/tags/-", Value: json.RawMessage(`"core"`)},
+	})
+	if err != nil || !slices.Equal(patched.Tags, []string{"core"}) {
+		t.Fatalf("PatchItem: expected the JSON patch to be applied, got %+v, %v", patched, err)
+	}
+	if _, err := c.PatchItem(item.Host, patched.Revision-1, map[string]interface{}{"shutdown": true}); !client.IsPreconditionFailed(err) {
+		t.Errorf("PatchItem: expected the patch of a stale revision to be refused, got %v", err)
+	}
+}
+
+func TestClientAPIVersion(t *testing.T) {
+	handler := server.ValidatingHandler(t, newTestService(t))
+	current, legacy := newTestClient(t, handler), newTestClient(t, handler)
+	if err := legacy.SetAPIVersion(""); err != nil {
+		t.Fatalf("SetAPIVersion: %s", err)
+	}
+
+	item := &server.Item{Host: "127.0.0.1:1", IntfType: "GigabitEthernet", Number: "1", Username: "admin", Password: "admin"}
+	if err := legacy.NewItem(item); err != nil {
+		t.Fatalf("NewItem: %s", err)
+	}
+	// the unversioned routes are served as v1, so both clients see the same items
+	if got, err := current.GetItem(item.Host); err != nil || got.Host != item.Host {
+		t.Errorf("GetItem: expected the item created on the unversioned routes, got %+v, %v", got, err)
+	}
+	if err := current.SetAPIVersion("2"); err == nil {
+		t.Error("SetAPIVersion: expected a version the server doesn't serve to be refused")
+	}
+}
+
+func TestInvalidRequestBody(t *testing.T) {
+	c := newTestClient(t, newTestService(t).Handler())
+
+	err := c.NewItem(&server.Item{Host: "has whitespace"})
+	apiErr, ok := err.(*client.APIError)
+	if !ok {
+		t.Fatalf("expected an APIError, got %v", err)
+	}
+	if apiErr.StatusCode != 400 || apiErr.Code != server.CodeInvalidRequest || apiErr.Field != "host" {
+		t.Errorf("unexpected error %+v", apiErr)
+	}
+}
+
+func TestRequestBodyTooLarge(t *testing.T) {
+	c := newTestClient(t, newTestService(t).Handler())
+
+	err := c.NewItem(&server.Item{Host: "127.0.0.1:1", IntfType: "GigabitEthernet", Number: "1", Description: strings.Repeat("a", 1<<20)})
+	apiErr, ok := err.(*client.APIError)
+	if !ok {
+		t.Fatalf("expected an APIError, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusRequestEntityTooLarge || apiErr.Code != server.CodeRequestTooLarge {
+		t.Errorf("unexpected error %+v", apiErr)
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	c := newTestClient(t, server.ValidatingHandler(t, newTestService(t)))
+
+	err := c.NewItem(&server.Item{
+		Host:            "127.0.0.1:1",
+		IntfType:        "GigabitEthernetX",
+		Number:          "1",
+		Ipv4Address:     "banana",
+		Ipv4AddressMask: "255.255.255.0",
+		Mtu:             -5,
+	})
+	fieldErrors := client.ValidationErrors(err)
+	var fields []string
+	for _, fe := range fieldErrors {
+		fields = append(fields, fe.Field)
+	}
+	want := []string{"type", "ipv4_address", "mtu"}
+	if !slices.Equal(fields, want) {
+		t.Errorf("got field errors %v, want %v", fields, want)
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeDevice is an SSH server emulating enough of a Cisco CLI to exercise the drivers. It tracks the
+// EXEC and configuration modes to show the right prompt, answers commands from outputs and errors, and
+// accepts everything else silently. Unless outputs has one, show running-config lists the commands
+// accepted in configuration mode
+type fakeDevice struct {
+	addr string
+	// hostname is shown at the start of every prompt
+	hostname string
+	// privileged devices log in straight to privileged EXEC, others need enable
+	privileged bool
+	outputs    map[string]string
+	errors     map[string]string
+	// holds are closed to answer the commands they are for, which wait until then
+	holds map[string]chan struct{}
+
+	mu       sync.Mutex
+	commands []string
+	config   []string
+}
+
+// newFakeDevice starts a device accepting the username and password admin, stopped when the test ends
+func newFakeDevice(t *testing.T, hostname string, privileged bool) *fakeDevice {
+	t.Helper()
+	d := &fakeDevice{
+		hostname:   hostname,
+		privileged: privileged,
+		outputs:    map[string]string{},
+		errors:     map[string]string{},
+		holds:      map[string]chan struct{}{},
+	}
+	d.addr = startSSHServer(t, func(channel ssh.Channel, req *ssh.Request) bool {
+		if req.Type != "shell" {
+			return false
+		}
+		go d.shell(channel)
+		return true
+	})
+	return d
+}
+
+// startSSHServer starts an SSH server accepting the username and password admin, stopped when the test
+// ends, and returns its address. Terminal requests are accepted and start is called with every other
+// session request, returning whether it was accepted
+func startSSHServer(t *testing.T, start func(channel ssh.Channel, req *ssh.Request) bool) string {
+	t.Helper()
+	signer := newHostKey(t)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "admin" && string(password) == "admin" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", c.User())
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config, start)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newHostKey generates an ed25519 host key
+func newHostKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig, start func(channel ssh.Channel, req *ssh.Request) bool) {
+	sconn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range reqs {
+				if req.Type == "pty-req" {
+					req.Reply(true, nil)
+					continue
+				}
+				req.Reply(start(channel, req), nil)
+			}
+		}()
+	}
+}
+
+// shell runs the CLI until the client closes the channel
+func (d *fakeDevice) shell(channel ssh.Channel) {
+	defer channel.Close()
+	privileged := d.privileged
+	mode := ""
+	prompt := func() string {
+		if privileged {
+			return d.hostname + mode + "#"
+		}
+		return d.hostname + mode + ">"
+	}
+
+	io.WriteString(channel, "\r\n"+prompt())
+	in := bufio.NewReader(channel)
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		output, failed := d.errors[cmd]
+		d.mu.Lock()
+		d.commands = append(d.commands, cmd)
+		if !failed && mode != "" && cmd != "end" && cmd != "abort" && cmd != "exit" {
+			d.config = append(d.config, cmd)
+		}
+		if _, ok := d.outputs[cmd]; !ok && cmd == "show running-config" {
+			output = "Building configuration...\n\n" + strings.Join(d.config, "\n") + "\nend"
+		}
+		d.mu.Unlock()
+		if hold, ok := d.holds[cmd]; ok {
+			<-hold
+		}
+
+		if !failed {
+			if o, ok := d.outputs[cmd]; ok {
+				output = o
+			}
+			switch {
+			case cmd == "enable":
+				privileged = true
+			case cmd == "configure terminal":
+				mode = "(config)"
+			case strings.HasPrefix(cmd, "interface "):
+				mode = "(config-if)"
+			case cmd == "end" || cmd == "abort":
+				mode = ""
+			case cmd == "exit" && mode == "(config-if)":
+				mode = "(config)"
+			case cmd == "exit":
+				mode = ""
+			}
+		}
+		if output != "" {
+			output = strings.ReplaceAll(output, "\n", "\r\n") + "\r\n"
+		}
+		io.WriteString(channel, "\r\n"+output+prompt())
+	}
+}
+
+// received returns the commands the device has received
+func (d *fakeDevice) received() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.commands...)
+}
+
+// newTestService returns a service with no items and a discarded log, configured with opts
+func newTestService(opts ...Option) *Service {
+	return NewService("", map[string]Item{}, append([]Option{WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, opts...)...)
+}
+
+// deviceItem returns an item for the test server at addr, with the credentials it accepts
+func deviceItem(addr string) Item {
+	return Item{Host: addr, Username: "admin", Password: "admin"}
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around each change of a unified diff
+	diffContext = 3
+	// maxDiffEdits bounds the work of finding the shortest edit script. Configurations that differ by more
+	// edits than this are diffed as every line of one replaced by every line of the other
+	maxDiffEdits = 1000
+)
+
+// diffEdit is a line of a diff, unchanged (' '), removed ('-') or added ('+')
+type diffEdit struct {
+	op   byte
+	line string
+}
+
+// unifiedDiff returns the unified diff turning a into b, labelled fromName and toName, or an empty string if
+// they are the same
+func unifiedDiff(fromName, toName, a, b string) string {
+	edits := diffLines(splitLines(a), splitLines(b))
+	hunks := diffHunks(edits)
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for _, h := range hunks {
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(h.fromLine, h.fromCount), hunkRange(h.toLine, h.toCount))
+		for _, e := range edits[h.start:h.end] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			out.WriteByte('\n')
+		}
+	}
+	return out.String()
+}
+
+// splitLines splits s into lines, without a trailing empty line for a final newline
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the edits turning a into b. The lines common to the start and end of both are trimmed
+// before the shortest edit script of the rest is found with Myers' algorithm
+func diffLines(a, b []string) []diffEdit {
+	var prefix, suffix []diffEdit
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, diffEdit{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append(suffix, diffEdit{' ', a[len(a)-1]})
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	edits := append(prefix, myers(a, b)...)
+	for i := len(suffix) - 1; i >= 0; i-- {
+		edits = append(edits, suffix[i])
+	}
+	return edits
+}
+
+// myers returns the shortest edit script turning a into b, or a replacement of all of a by all of b if it
+// takes more than maxDiffEdits edits
+func myers(a, b []string) []diffEdit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxDiffEdits {
+		max = maxDiffEdits
+	}
+	// v holds the furthest x reached on each diagonal k = x - y, offset by max. trace keeps a copy of v
+	// before each round so that the path can be walked back
+	v := make([]int, 2*max+2)
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, max)
+			}
+		}
+	}
+
+	edits := make([]diffEdit, 0, n+m)
+	for _, line := range a {
+		edits = append(edits, diffEdit{'-', line})
+	}
+	for _, line := range b {
+		edits = append(edits, diffEdit{'+', line})
+	}
+	return edits
+}
+
+// backtrack walks the rounds recorded by myers back from the end of a and b, returning the edits in order
+func backtrack(a, b []string, trace [][]int, offset int) []diffEdit {
+	var reversed []diffEdit
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			reversed = append(reversed, diffEdit{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			reversed = append(reversed, diffEdit{'+', b[y-1]})
+		} else {
+			reversed = append(reversed, diffEdit{'-', a[x-1]})
+		}
+		x, y = prevX, prevY
+	}
+
+	edits := make([]diffEdit, len(reversed))
+	for i, e := range reversed {
+		edits[len(reversed)-1-i] = e
+	}
+	return edits
+}
+
+// diffHunk is a run of edits[start:end] holding changes and their context, starting at fromLine of the old
+// text and toLine of the new one
+type diffHunk struct {
+	start, end          int
+	fromLine, fromCount int
+	toLine, toCount     int
+}
+
+// diffHunks groups the changes in edits into hunks with diffContext lines of context, merging changes whose
+// context would overlap
+func diffHunks(edits []diffEdit) []diffHunk {
+	var hunks []diffHunk
+	for i := 0; i < len(edits); i++ {
+		if edits[i].op == ' ' {
+			continue
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		if n := len(hunks); n > 0 && start <= hunks[n-1].end {
+			start = hunks[n-1].start
+			hunks = hunks[:n-1]
+		}
+		// the hunk ends diffContext unchanged lines after the last change
+		end := i + 1
+		for end < len(edits) && edits[end].op != ' ' {
+			end++
+		}
+		i = end - 1
+		end += diffContext
+		if end > len(edits) {
+			end = len(edits)
+		}
+		hunks = append(hunks, diffHunk{start: start, end: end})
+	}
+
+	// number the lines of each hunk by counting those of both texts before it
+	from, to, next := 1, 1, 0
+	for h := range hunks {
+		for ; next < hunks[h].start; next++ {
+			from, to = from+1, to+1
+		}
+		hunks[h].fromLine, hunks[h].toLine = from, to
+		for ; next < hunks[h].end; next++ {
+			switch edits[next].op {
+			case ' ':
+				from, to = from+1, to+1
+				hunks[h].fromCount++
+				hunks[h].toCount++
+			case '-':
+				from++
+				hunks[h].fromCount++
+			case '+':
+				to++
+				hunks[h].toCount++
+			}
+		}
+	}
+	return hunks
+}
+
+// hunkRange formats the range of a hunk header. A hunk holding no lines of a text is numbered by the line
+// before it, as diff does
+func hunkRange(line, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", line-1)
+	case 1:
+		return fmt.Sprintf("%d", line)
+	default:
+		return fmt.Sprintf("%d,%d", line, count)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"same", "a\nb\n", "a\nb\n", ""},
+		{
+			"changed line",
+			"1\n2\n3\n4\n5\n6\n7\n8\n",
+			"1\n2\n3\n4\nfive\n6\n7\n8\n",
+			"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			"added at end",
+			"1\n2\n",
+			"1\n2\n3\n",
+			"@@ -1,2 +1,3 @@\n 1\n 2\n+3\n",
+		},
+		{
+			"into empty",
+			"",
+			"1\n",
+			"@@ -0,0 +1 @@\n+1\n",
+		},
+		{
+			"separate hunks",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			"one\n2\n3\n4\n5\n6\n7\n8\n9\nten\n",
+			"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+ten\n",
+		},
+		{
+			"moved line",
+			"a\nb\nc\n",
+			"b\nc\na\n",
+			"@@ -1,3 +1,3 @@\n-a\n b\n c\n+a\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unifiedDiff("old", "new", tt.a, tt.b)
+			if tt.want != "" {
+				tt.want = "--- old\n+++ new\n" + tt.want
+			}
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiffTooManyEdits(t *testing.T) {
+	var a, b []string
+	for i := 0; i < maxDiffEdits; i++ {
+		a = append(a, "a")
+		b = append(b, "b")
+	}
+	got := unifiedDiff("old", "new", strings.Join(a, "\n"), strings.Join(b, "\n"))
+	if strings.Count(got, "\n-a") != maxDiffEdits || strings.Count(got, "\n+b") != maxDiffEdits {
+		t.Errorf("expected every line to be replaced, got %d lines", strings.Count(got, "\n"))
+	}
+}
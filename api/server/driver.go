@@ -0,0 +1,324 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slices"
+)
+
+// DefaultPlatform is the platform of an item that does not set one
+const DefaultPlatform = "iosxe"
+
+// Driver knows how one device platform is configured over its CLI: the prompts it shows, how to get into
+// configuration mode, how a change is committed or abandoned and what its errors look like
+type Driver interface {
+	// Platform is the name items use to select the driver, which also prefixes its template names
+	Platform() string
+	// InterfaceTypes are the interface types an item on the platform can configure
+	InterfaceTypes() []string
+	// Connect dials the device and prepares the session for sending commands
+	Connect(dial dialFunc) (*cliSession, error)
+	// EnterConfig enters configuration mode
+	EnterConfig(cli *cliSession) error
+	// SendConfig sends configuration commands, failing on the first one the device rejects
+	SendConfig(cli *cliSession, commands []string) error
+	// Commit applies the configuration sent and leaves configuration mode
+	Commit(cli *cliSession) error
+	// Abort leaves configuration mode after a failure, discarding the change where the platform allows it
+	Abort(cli *cliSession) error
+	// ReadConfig returns the running configuration of the item's interface
+	ReadConfig(cli *cliSession, item Item) (string, error)
+	// ParseErrors returns an error describing any error the device reported in output
+	ParseErrors(output string) error
+	// Save copies the running configuration to the startup configuration so that it survives a reload
+	Save(cli *cliSession) error
+	// RunningConfig returns the whole running configuration
+	RunningConfig(cli *cliSession) (string, error)
+}
+
+// dialFunc opens a CLI session on the device, reading until prompt is shown
+type dialFunc func(prompt *regexp.Regexp) (*cliSession, error)
+
+// drivers are the supported platforms keyed by name
+var drivers = driverMap(iosxeDriver, nxosDriver, iosxrDriver)
+
+func driverMap(list ...Driver) map[string]Driver {
+	m := make(map[string]Driver, len(list))
+	for _, d := range list {
+		m[d.Platform()] = d
+	}
+	return m
+}
+
+// Platforms returns the names of the supported platforms, sorted
+func Platforms() []string {
+	platforms := make([]string, 0, len(drivers))
+	for name := range drivers {
+		platforms = append(platforms, name)
+	}
+	sort.Strings(platforms)
+	return platforms
+}
+
+// PlatformInterfaceTypes returns the interface types an item on platform can configure, or nil if the
+// platform is not supported
+func PlatformInterfaceTypes(platform string) []string {
+	if d, ok := drivers[platform]; ok {
+		return d.InterfaceTypes()
+	}
+	return nil
+}
+
+// allInterfaceTypes returns the interface types of every platform, sorted and without duplicates
+func allInterfaceTypes() []string {
+	var types []string
+	for _, d := range drivers {
+		for _, t := range d.InterfaceTypes() {
+			if !slices.Contains(types, t) {
+				types = append(types, t)
+			}
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// driverFor returns the driver for platform, where an empty platform is the DefaultPlatform
+func driverFor(platform string) (Driver, error) {
+	if platform == "" {
+		platform = DefaultPlatform
+	}
+	d, ok := drivers[platform]
+	if !ok {
+		return nil, fmt.Errorf("unsupported platform %s", platform)
+	}
+	return d, nil
+}
+
+// devicePrompt matches the end of the output once a Cisco style prompt such as router>, router(config-if)#
+// or RP/0/RSP0/CPU0:router# is shown
+var devicePrompt = regexp.MustCompile(`(?:^|[\r\n])[\w.\-:/@()]+[>#] ?$`)
+
+// cliDriver implements the parts of Driver that are the same across the Cisco CLIs. The platform drivers
+// embed it and override what differs
+type cliDriver struct {
+	platform       string
+	interfaceTypes []string
+	// errors matches the lines of output that report an error
+	errors *regexp.Regexp
+	// setup is sent once the session is privileged, typically to turn off paging
+	setup []string
+	// showInterface is the command showing the running configuration of an interface
+	showInterface string
+	// save is the command copying the running configuration to the startup configuration, empty on
+	// platforms that persist every commit
+	save string
+}
+
+func (d *cliDriver) Platform() string {
+	return d.platform
+}
+
+func (d *cliDriver) InterfaceTypes() []string {
+	return d.interfaceTypes
+}
+
+func (d *cliDriver) Connect(dial dialFunc) (*cliSession, error) {
+	cli, err := dial(devicePrompt)
+	if err != nil {
+		return nil, err
+	}
+	if !cli.privileged() {
+		if err := d.run(cli, "enable"); err != nil {
+			cli.close()
+			return nil, err
+		}
+	}
+	for _, cmd := range d.setup {
+		if err := d.run(cli, cmd); err != nil {
+			cli.close()
+			return nil, err
+		}
+	}
+	return cli, nil
+}
+
+func (d *cliDriver) EnterConfig(cli *cliSession) error {
+	return d.run(cli, "configure terminal")
+}
+
+func (d *cliDriver) SendConfig(cli *cliSession, commands []string) error {
+	for _, cmd := range commands {
+		if err := d.run(cli, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit leaves configuration mode, as the platforms without a candidate configuration have applied every
+// command as it was sent
+func (d *cliDriver) Commit(cli *cliSession) error {
+	return d.run(cli, "end")
+}
+
+// Abort leaves configuration mode. Commands that were accepted before the failure stay applied
+func (d *cliDriver) Abort(cli *cliSession) error {
+	return d.run(cli, "end")
+}
+
+func (d *cliDriver) ReadConfig(cli *cliSession, item Item) (string, error) {
+	cmd := fmt.Sprintf(d.showInterface, item.IntfType, item.Number)
+	output, err := cli.send(cmd)
+	if err != nil {
+		return "", err
+	}
+	if err := d.ParseErrors(output); err != nil {
+		return "", fmt.Errorf("%s: %w", cmd, err)
+	}
+	return cleanOutput(cmd, output), nil
+}
+
+// Save sends the save command, which can take a while on a large configuration
+func (d *cliDriver) Save(cli *cliSession) error {
+	if d.save == "" {
+		return nil
+	}
+	output, err := cli.sendTimeout(d.save, saveTimeout)
+	if err != nil {
+		return err
+	}
+	if err := d.ParseErrors(output); err != nil {
+		return fmt.Errorf("%s: %w", d.save, err)
+	}
+	return nil
+}
+
+func (d *cliDriver) RunningConfig(cli *cliSession) (string, error) {
+	const cmd = "show running-config"
+	output, err := cli.sendTimeout(cmd, showTimeout)
+	if err != nil {
+		return "", err
+	}
+	if err := d.ParseErrors(output); err != nil {
+		return "", fmt.Errorf("%s: %w", cmd, err)
+	}
+	return cleanOutput(cmd, output), nil
+}
+
+func (d *cliDriver) ParseErrors(output string) error {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if d.errors.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return &commandError{lines: lines}
+}
+
+// commandError holds the error lines a device printed after a command it rejected
+type commandError struct {
+	lines []string
+}
+
+func (e *commandError) Error() string {
+	return "device reported: " + strings.Join(e.lines, "; ")
+}
+
+// run sends cmd and checks its output for errors
+func (d *cliDriver) run(cli *cliSession, cmd string) error {
+	output, err := cli.send(cmd)
+	if err != nil {
+		return err
+	}
+	if err := d.ParseErrors(output); err != nil {
+		return fmt.Errorf("%s: %w", cmd, err)
+	}
+	return nil
+}
+
+// cleanOutput removes the echoed command and the trailing prompt from the output of cmd, along with the
+// surrounding blank lines
+func cleanOutput(cmd, output string) string {
+	output = strings.ReplaceAll(output, "\r\n", "\n")
+	if i := strings.LastIndexByte(output, '\n'); i >= 0 {
+		output = output[:i]
+	} else {
+		output = ""
+	}
+	output = strings.TrimLeft(output, "\n")
+	output = strings.TrimPrefix(output, cmd)
+	return strings.Trim(output, "\n")
+}
+
+// applyConfig connects to hostname with d and applies commands in configuration mode, abandoning the
+// change if the device rejects any of them
+func (s *Service) applyConfig(logger *slog.Logger, rec *transcript, d Driver, hostname string, commands []string, config *ssh.ClientConfig) error {
+	cli, err := d.Connect(func(prompt *regexp.Regexp) (*cliSession, error) {
+		return s.dialCLI(logger, rec, hostname, config, prompt)
+	})
+	if err != nil {
+		return err
+	}
+	defer cli.close()
+
+	if err := d.EnterConfig(cli); err != nil {
+		return err
+	}
+	err = d.SendConfig(cli, commands)
+	if err == nil {
+		err = d.Commit(cli)
+	}
+	if err != nil {
+		if abortErr := d.Abort(cli); abortErr != nil {
+			logger.Error("unable to abort configuration", "error", abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// saveConfig connects to hostname with d and saves its running configuration
+func (s *Service) saveConfig(logger *slog.Logger, rec *transcript, d Driver, hostname string, config *ssh.ClientConfig) error {
+	cli, err := d.Connect(func(prompt *regexp.Regexp) (*cliSession, error) {
+		return s.dialCLI(logger, rec, hostname, config, prompt)
+	})
+	if err != nil {
+		return err
+	}
+	defer cli.close()
+	return d.Save(cli)
+}
+
+// readRunningConfig connects to hostname with d and returns its whole running configuration
+func (s *Service) readRunningConfig(logger *slog.Logger, rec *transcript, d Driver, hostname string, config *ssh.ClientConfig) (string, error) {
+	cli, err := d.Connect(func(prompt *regexp.Regexp) (*cliSession, error) {
+		return s.dialCLI(logger, rec, hostname, config, prompt)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer cli.close()
+	return d.RunningConfig(cli)
+}
+
+// readConfig connects to hostname with d and returns the running configuration of item's interface
+func (s *Service) readConfig(logger *slog.Logger, rec *transcript, d Driver, hostname string, item Item, config *ssh.ClientConfig) (string, error) {
+	cli, err := d.Connect(func(prompt *regexp.Regexp) (*cliSession, error) {
+		return s.dialCLI(logger, rec, hostname, config, prompt)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer cli.close()
+	return d.ReadConfig(cli, item)
+}
@@ -0,0 +1,26 @@
+package server
+
+import "regexp"
+
+// iosxeDriver configures IOS-XE devices such as the Catalyst 9000 and ASR 1000. Each command is applied as
+// soon as it is sent, so there is nothing to commit
+var iosxeDriver = &cliDriver{
+	platform: "iosxe",
+	interfaceTypes: []string{
+		"GigabitEthernet",
+		"TwoGigabitEthernet",
+		"FiveGigabitEthernet",
+		"TenGigabitEthernet",
+		"TwentyFiveGigE",
+		"FortyGigabitEthernet",
+		"HundredGigE",
+		"TwoHundredGigE",
+		"FourHundredGigE",
+	},
+	// e.g. "% Invalid input detected at '^' marker." or "% Incomplete command."
+	errors:        regexp.MustCompile(`^% `),
+	setup:         []string{"terminal length 0", "terminal width 0"},
+	showInterface: "show running-config interface %s%s",
+	// copy running-config startup-config asks for the destination, write memory doesn't
+	save: "write memory",
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// commitTimeout is how long an IOS-XR commit can take, as the whole candidate configuration is verified
+// and applied at once
+const commitTimeout = 2 * time.Minute
+
+// commitDriver is a cliDriver for platforms that stage commands in a candidate configuration that is only
+// applied by commit, so a failed change leaves the device untouched
+type commitDriver struct {
+	cliDriver
+}
+
+// iosxrDriver configures IOS-XR devices such as the ASR 9000. Every commit is persisted, so there is no
+// save command
+var iosxrDriver = &commitDriver{cliDriver{
+	platform: "iosxr",
+	interfaceTypes: []string{
+		"GigabitEthernet",
+		"TenGigE",
+		"TwentyFiveGigE",
+		"FortyGigE",
+		"FiftyGigE",
+		"HundredGigE",
+		"TwoHundredGigE",
+		"FourHundredGigE",
+	},
+	// e.g. "% Invalid input detected at '^' marker." or "% Failed to commit one or more configuration items"
+	errors:        regexp.MustCompile(`^% `),
+	setup:         []string{"terminal length 0", "terminal width 0"},
+	showInterface: "show running-config interface %s%s",
+}}
+
+// Commit applies the candidate configuration. When the commit is rejected the reasons are only shown by
+// "show configuration failed", so they are added to the error
+func (d *commitDriver) Commit(cli *cliSession) error {
+	output, err := cli.sendTimeout("commit", commitTimeout)
+	if err != nil {
+		return err
+	}
+	if err := d.ParseErrors(output); err != nil {
+		if failed, showErr := cli.send("show configuration failed"); showErr == nil {
+			if reason := cleanOutput("show configuration failed", failed); reason != "" {
+				return fmt.Errorf("commit: %w: %s", err, reason)
+			}
+		}
+		return fmt.Errorf("commit: %w", err)
+	}
+	return d.run(cli, "end")
+}
+
+// Abort discards the candidate configuration and leaves configuration mode
+func (d *commitDriver) Abort(cli *cliSession) error {
+	return d.run(cli, "abort")
+}
@@ -0,0 +1,15 @@
+package server
+
+import "regexp"
+
+// nxosDriver configures Nexus switches running NX-OS. Like IOS-XE each command is applied as soon as it is
+// sent, but errors are reported either with a leading '%' or as "ERROR:"
+var nxosDriver = &cliDriver{
+	platform:       "nxos",
+	interfaceTypes: []string{"Ethernet"},
+	// e.g. "% Invalid command at '^' marker." or "ERROR: Incorrect MTU value"
+	errors:        regexp.MustCompile(`^(% |ERROR: |Error: )`),
+	setup:         []string{"terminal length 0", "terminal width 511"},
+	showInterface: "show running-config interface %s%s",
+	save:          "copy running-config startup-config",
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func applyTo(t *testing.T, d *fakeDevice, driver Driver, commands ...string) error {
+	t.Helper()
+	s := newTestService()
+	rec := newTranscript(s.redactor)
+	return s.applyConfig(s.logger, rec, driver, d.addr, commands, loadSshConfig(deviceItem(d.addr)))
+}
+
+func TestIOSXEDriverApply(t *testing.T) {
+	d := newFakeDevice(t, "router", false)
+	err := applyTo(t, d, iosxeDriver, "interface GigabitEthernet 1", " description uplink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"enable", "terminal length 0", "terminal width 0",
+		"configure terminal", "interface GigabitEthernet 1", "description uplink", "end",
+	}
+	if got := d.received(); !slices.Equal(got, want) {
+		t.Errorf("got commands %q, want %q", got, want)
+	}
+}
+
+func TestDriverRejectedCommand(t *testing.T) {
+	tests := []struct {
+		driver   Driver
+		hostname string
+		reply    string
+		abort    string
+	}{
+		{iosxeDriver, "router", "% Invalid input detected at '^' marker.", "end"},
+		{nxosDriver, "switch", "ERROR: Incorrect MTU value", "end"},
+		{iosxrDriver, "RP/0/RSP0/CPU0:router", "% Invalid input detected at '^' marker.", "abort"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.driver.Platform(), func(t *testing.T) {
+			d := newFakeDevice(t, tt.hostname, true)
+			d.errors["mtu 1"] = "       ^\n" + tt.reply
+			err := applyTo(t, d, tt.driver, "interface Ethernet1/1", " mtu 1", " shutdown")
+			if err == nil || !strings.Contains(err.Error(), "mtu 1") || !strings.Contains(err.Error(), tt.reply) {
+				t.Fatalf("expected the rejected command to be reported, got %v", err)
+			}
+			got := d.received()
+			if slices.Contains(got, "shutdown") {
+				t.Errorf("expected no commands after the rejected one, got %q", got)
+			}
+			if got[len(got)-1] != tt.abort {
+				t.Errorf("expected the change to be abandoned with %s, got %q", tt.abort, got)
+			}
+		})
+	}
+}
+
+func TestIOSXRDriverCommit(t *testing.T) {
+	d := newFakeDevice(t, "RP/0/RSP0/CPU0:router", true)
+	if err := applyTo(t, d, iosxrDriver, "interface GigabitEthernet0/0/0/0", " shutdown"); err != nil {
+		t.Fatal(err)
+	}
+	got := d.received()
+	if want := []string{"shutdown", "commit", "end"}; !slices.Equal(got[len(got)-3:], want) {
+		t.Errorf("expected the change to be committed, got %q", got)
+	}
+
+	d = newFakeDevice(t, "RP/0/RSP0/CPU0:router", true)
+	d.errors["commit"] = "% Failed to commit one or more configuration items during a pseudo-atomic operation."
+	d.outputs["show configuration failed"] = "!! SEMANTIC ERRORS: This configuration was rejected by the system.\n" +
+		"interface GigabitEthernet0/0/0/0\n mtu 64\n!!% 'pm' detected the 'warning' condition 'MTU too small'"
+	err := applyTo(t, d, iosxrDriver, "interface GigabitEthernet0/0/0/0", " mtu 64")
+	if err == nil || !strings.Contains(err.Error(), "MTU too small") {
+		t.Fatalf("expected the commit failure reasons in the error, got %v", err)
+	}
+	got = d.received()
+	if want := []string{"commit", "show configuration failed", "abort"}; !slices.Equal(got[len(got)-3:], want) {
+		t.Errorf("expected the failed commit to be aborted, got %q", got)
+	}
+}
+
+func TestDriverReadConfig(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	d.outputs["show running-config interface GigabitEthernet1"] = "Building configuration...\n\n" +
+		"Current configuration : 60 bytes\n!\ninterface GigabitEthernet1\n description uplink\nend"
+
+	s := newTestService()
+	item := deviceItem(d.addr)
+	item.IntfType, item.Number = "GigabitEthernet", "1"
+	config, err := s.readConfig(s.logger, newTranscript(s.redactor), iosxeDriver, d.addr, item, loadSshConfig(item))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "interface GigabitEthernet1\n description uplink") || strings.Contains(config, "router#") {
+		t.Errorf("unexpected configuration %q", config)
+	}
+}
+
+func TestPushConfigRecordsPlatform(t *testing.T) {
+	d := newFakeDevice(t, "switch", true)
+	s := newTestService()
+	item := deviceItem(d.addr)
+	item.Platform, item.IntfType, item.Number = "nxos", "Ethernet", "1/1"
+	commands, tmpl, err := s.templates.render(templateName(item.Platform, templateInterface), item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &push{platform: "nxos", transport: TransportCLI, tmpl: tmpl, apply: func(logger *slog.Logger, rec *transcript, hostname string) error {
+		return s.applyConfig(logger, rec, nxosDriver, hostname, commands, loadSshConfig(item))
+	}}
+
+	ids, err := s.pushConfig(context.Background(), "create", p, []string{d.addr}, item.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := s.operations.operations[ids[0]]
+	if op == nil || !op.Success || op.Platform != "nxos" || op.Template != "nxos_interface_ethernet" {
+		t.Errorf("unexpected operation %+v", op)
+	}
+	if !slices.Contains(d.received(), "interface Ethernet1/1") {
+		t.Errorf("expected the NX-OS template to be pushed, got %q", d.received())
+	}
+}
+
+func TestNXOSServicePolicyClear(t *testing.T) {
+	d := newFakeDevice(t, "switch", true)
+	s := newTestService()
+	item := deviceItem(d.addr)
+	item.Platform, item.IntfType, item.Number, item.ServicePolicyInput = "nxos", "Ethernet", "1/1", "QOS-IN"
+	if rec := serve(s, http.MethodPost, "/item", item); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	pushed := len(d.received())
+
+	item.ServicePolicyInput = ""
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		path := "/item"
+		if method == http.MethodPut {
+			path += "/" + d.addr
+		}
+		rec := serve(s, method, path, item)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"service_policy_input"`) {
+			t.Errorf("%s: expected clearing the service policy to be refused, got %d %s", method, rec.Code, rec.Body)
+		}
+	}
+	rec := serveWithHeader(s, http.MethodPatch, "/item/"+d.addr, map[string]interface{}{"service_policy_input": ""}, patchType(MergePatchType))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a patch clearing the service policy to be refused, got %d %s", rec.Code, rec.Body)
+	}
+	if len(d.received()) != pushed || s.items[d.addr].ServicePolicyInput != "QOS-IN" {
+		t.Errorf("expected the refused changes not to be pushed or stored, got %q", d.received()[pushed:])
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		driver Driver
+		output string
+		failed bool
+	}{
+		{iosxeDriver, "\r\nrouter(config-if)#", false},
+		{iosxeDriver, "           ^\r\n% Invalid input detected at '^' marker.\r\n\r\nrouter(config-if)#", true},
+		{iosxeDriver, "% Incomplete command.\r\n", true},
+		// syslog messages also start with '%' but are not errors
+		{iosxeDriver, "%LINK-3-UPDOWN: Interface GigabitEthernet1, changed state to up\r\n", false},
+		{nxosDriver, "ERROR: Incorrect MTU value\r\nswitch(config-if)#", true},
+		{nxosDriver, "% Invalid command at '^' marker.\r\n", true},
+		{iosxrDriver, "% Failed to commit one or more configuration items\r\n", true},
+	}
+	for _, tt := range tests {
+		err := tt.driver.ParseErrors(tt.output)
+		if (err != nil) != tt.failed {
+			t.Errorf("%s: ParseErrors(%q) = %v", tt.driver.Platform(), tt.output, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes returned in the code field of an Error
+const (
+	CodeBadRequest       = "bad_request"
+	CodeInvalidRequest   = "invalid_request"
+	CodeValidationFailed = "validation_failed"
+	CodeInvalidField     = "invalid_field"
+	CodeUnauthorized     = "unauthorized"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeDeviceError      = "device_error"
+	CodeInternal         = "internal"
+	// CodeChangeWindow is returned when the change calendar doesn't allow a change to a device
+	CodeChangeWindow = "change_window"
+	// CodeForbidden is returned when the token holder isn't allowed to do what they asked, such as approving
+	// their own change
+	CodeForbidden = "forbidden"
+	// CodeUnavailable is returned when an instance of a cluster can't reach a leader to make the change
+	CodeUnavailable = "unavailable"
+	// CodeOutcomeUnknown is returned when a majority of a cluster didn't store a change in time, which may
+	// still be stored afterwards, so the item must be read again before the change is retried
+	CodeOutcomeUnknown = "outcome_unknown"
+	// CodePreconditionFailed is returned when the If-Match header of a change isn't the ETag of the item,
+	// because it was changed since it was read
+	CodePreconditionFailed = "precondition_failed"
+	// CodeUnsupportedMediaType is returned when the Content-Type of a patch isn't a patch format the server
+	// can apply
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	// CodeUnsupportedVersion is returned when a request asks for a version of the API the server doesn't
+	// serve, or for another than the version of its route
+	CodeUnsupportedVersion = "unsupported_version"
+	// CodeRequestTooLarge is returned when a request body is longer than the server accepts
+	CodeRequestTooLarge = "request_too_large"
+)
+
+// Error is the JSON body sent with every error response. When several fields are invalid each of them is
+// listed in Errors
+type Error struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Field   string   `json:"field,omitempty"`
+	Errors  []*Error `json:"errors,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Field != "" {
+		return e.Field + ": " + e.Message
+	}
+	return e.Message
+}
+
+// writeError sends e as a JSON body with the given status code
+func writeError(w http.ResponseWriter, status int, e *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(e)
+}
+
+// httpError sends an error with no related field, in the same way as http.Error
+func httpError(w http.ResponseWriter, message string, status int, code string) {
+	writeError(w, status, &Error{Code: code, Message: message})
+}
+
+// writeJSON sends v as a JSON body
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// itemETag returns the entity tag of the revision of item
+func itemETag(item Item) string {
+	return strconv.Quote(strconv.FormatInt(item.Revision, 10))
+}
+
+// itemMatches sends a 412 if r has an If-Match header that isn't *, and none of whose entity tags is the
+// ETag of stored, reporting whether the request can change stored. Weak entity tags never match
+func itemMatches(w http.ResponseWriter, r *http.Request, stored Item) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+	etag := itemETag(stored)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	w.Header().Set("ETag", etag)
+	httpError(w, fmt.Sprintf("item %s has been changed since it was read, it is now at revision %d", stored.Host, stored.Revision), http.StatusPreconditionFailed, CodePreconditionFailed)
+	return false
+}
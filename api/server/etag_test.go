@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func ifMatch(tag string) http.Header {
+	return http.Header{"If-Match": {tag}}
+}
+
+func TestItemETag(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService()
+	item := savedItem(d.addr)
+
+	rec := serve(s, http.MethodPost, "/item", item)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"1"` {
+		t.Fatalf("expected the new item to be at revision 1, got %d %q %s", rec.Code, rec.Header().Get("ETag"), rec.Body)
+	}
+	if etag := serve(s, http.MethodGet, "/item/"+d.addr, nil).Header().Get("ETag"); etag != `"1"` {
+		t.Errorf("expected the item to be read with its ETag, got %q", etag)
+	}
+
+	item.Description = "uplink"
+	rec = serveWithHeader(s, http.MethodPut, "/item/"+d.addr, item, ifMatch(`"1"`))
+	var updated Item
+	json.Unmarshal(rec.Body.Bytes(), &updated)
+	if rec.Code != http.StatusOK || updated.Revision != 2 || rec.Header().Get("ETag") != `"2"` {
+		t.Fatalf("expected the update to be made at revision 2, got %d %s", rec.Code, rec.Body)
+	}
+
+	// a change made from what was read before the update would undo it
+	item.Description = "stale"
+	rec = serveWithHeader(s, http.MethodPut, "/item/"+d.addr, item, ifMatch(`"1"`))
+	var e Error
+	json.Unmarshal(rec.Body.Bytes(), &e)
+	if rec.Code != http.StatusPreconditionFailed || e.Code != CodePreconditionFailed || rec.Header().Get("ETag") != `"2"` {
+		t.Errorf("expected the stale update to be refused, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := serveWithHeader(s, http.MethodDelete, "/item/"+d.addr, item, ifMatch(`W/"2"`)); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected a weak ETag not to match, got %d %s", rec.Code, rec.Body)
+	}
+	if s.items[d.addr].Description != "uplink" {
+		t.Errorf("expected the refused changes not to be made, got %+v", s.items[d.addr])
+	}
+
+	if rec := serveWithHeader(s, http.MethodPut, "/item/"+d.addr, item, ifMatch(`"7", "2"`)); rec.Code != http.StatusOK {
+		t.Errorf("expected one of the ETags to match, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := serveWithHeader(s, http.MethodDelete, "/item/"+d.addr, item, ifMatch("*")); rec.Code != http.StatusOK {
+		t.Errorf("expected * to match the item, got %d %s", rec.Code, rec.Body)
+	}
+
+	// the item created again doesn't reuse the revision of the deleted one
+	rec = serve(s, http.MethodPost, "/item", savedItem(d.addr))
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"4"` {
+		t.Errorf("expected the recreated item to be at revision 4, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestSeededItemRevisions(t *testing.T) {
+	s := NewService("", map[string]Item{"b": {Host: "b"}, "a": {Host: "a"}})
+	if s.items["a"].Revision != 1 || s.items["b"].Revision != 2 {
+		t.Errorf("expected seeded items to be given revisions in order of name, got %+v", s.items)
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Event types emitted by the server
+const (
+	EventItemCreated   = "item.created"
+	EventItemUpdated   = "item.updated"
+	EventItemDeleted   = "item.deleted"
+	EventPushStarted   = "push.started"
+	EventPushSucceeded = "push.succeeded"
+	EventPushFailed    = "push.failed"
+	// EventDriftDetected is emitted when the configuration backed up before a change differs from the
+	// configuration backed up after the previous one, as the device was changed by something else in
+	// between. It needs backups to be enabled
+	EventDriftDetected = "drift.detected"
+	// Change events follow a change to a device that needs approval
+	EventChangeSubmitted = "change.submitted"
+	EventChangeApproved  = "change.approved"
+	EventChangeRejected  = "change.rejected"
+)
+
+// EventTypes are the types of every event the server emits
+var EventTypes = []string{
+	EventItemCreated, EventItemUpdated, EventItemDeleted,
+	EventPushStarted, EventPushSucceeded, EventPushFailed,
+	EventDriftDetected,
+	EventChangeSubmitted, EventChangeApproved, EventChangeRejected,
+}
+
+const (
+	// recentEvents is how many events are kept for clients resuming the event stream with Last-Event-ID
+	recentEvents = 1000
+	// subscriberBuffer is how many events can wait for a slow event stream client before it is
+	// disconnected, to resume with Last-Event-ID
+	subscriberBuffer = 100
+	// keepaliveInterval is how often a comment is sent on an idle event stream, so that proxies keep it open
+	keepaliveInterval = 15 * time.Second
+)
+
+// Event is a change to an item, a push to a device or the review of a change. IDs increase by one with every event
+type Event struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	// Namespace is the namespace of the item, operation or change, and event streams are only sent the
+	// events of their namespace
+	Namespace string `json:"namespace"`
+	Host      string `json:"host"`
+	// Item is set for item events, without its password
+	Item *Item `json:"item,omitempty"`
+	// Operation is set for push events, without its transcript
+	Operation *Operation `json:"operation,omitempty"`
+	// Drift is set for drift events
+	Drift *Drift `json:"drift,omitempty"`
+	// Change is set for change events
+	Change *QueuedChange `json:"change,omitempty"`
+}
+
+// Drift names the backups showing a device was changed outside of the server
+type Drift struct {
+	FromVersion int `json:"from_version"`
+	ToVersion   int `json:"to_version"`
+}
+
+// eventBus numbers events and hands them to the event stream clients and the webhooks
+type eventBus struct {
+	sync.Mutex
+	next        int64
+	recent      []Event
+	subscribers map[chan Event][]string
+	webhooks    []*webhookSender
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: map[chan Event][]string{}}
+}
+
+// publish sends e to every subscriber and webhook interested in its type. A subscriber whose buffer is full
+// is dropped, closing its channel
+func (b *eventBus) publish(e Event) {
+	b.Lock()
+	b.next++
+	e.ID = b.next
+	e.Time = time.Now()
+	b.recent = append(b.recent, e)
+	if len(b.recent) > recentEvents {
+		b.recent = b.recent[len(b.recent)-recentEvents:]
+	}
+	for ch, types := range b.subscribers {
+		if !wantsEvent(types, e.Type) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	b.Unlock()
+
+	for _, h := range b.webhooks {
+		if wantsEvent(h.Events, e.Type) {
+			h.enqueue(e)
+		}
+	}
+}
+
+// subscribe returns a channel receiving the events of types, or of every type if types is empty, and the
+// recent events after lastID to send first
+func (b *eventBus) subscribe(types []string, lastID int64) (chan Event, []Event) {
+	b.Lock()
+	defer b.Unlock()
+	var missed []Event
+	for _, e := range b.recent {
+		if e.ID > lastID && wantsEvent(types, e.Type) {
+			missed = append(missed, e)
+		}
+	}
+	ch := make(chan Event, subscriberBuffer)
+	b.subscribers[ch] = types
+	return ch, missed
+}
+
+// unsubscribe stops sending events to ch, unless it has already been dropped
+func (b *eventBus) unsubscribe(ch chan Event) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// wantsEvent reports whether an event of typ matches the types of a subscription, an empty list matching
+// every type
+func wantsEvent(types []string, typ string) bool {
+	return len(types) == 0 || slices.Contains(types, typ)
+}
+
+// itemEvent publishes an event of typ for item, leaving out its password
+func (s *Service) itemEvent(ctx context.Context, typ string, item Item) {
+	item.Password = ""
+	s.events.publish(Event{Type: typ, RequestID: requestIDFrom(ctx), Namespace: item.Namespace, Host: item.Host, Item: &item})
+}
+
+// pushEvent publishes an event of typ for op, leaving out its transcript
+func (s *Service) pushEvent(typ string, op Operation) {
+	op.Transcript = nil
+	s.events.publish(Event{Type: typ, RequestID: op.RequestID, Namespace: op.Namespace, Host: op.Host, Operation: &op})
+}
+
+// GetEvents streams the events of the request's namespace as Server-Sent Events until the client
+// disconnects. The stream can be limited
+// to some types with the repeated type query parameter, and a client reconnecting with Last-Event-ID is
+// first sent the recent events it missed
+func (s *Service) GetEvents(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	types := r.URL.Query()["type"]
+	for _, typ := range types {
+		if !slices.Contains(EventTypes, typ) {
+			writeError(w, http.StatusBadRequest, &Error{Code: CodeInvalidRequest, Message: fmt.Sprintf("must be one of %v", EventTypes), Field: "type"})
+			return
+		}
+	}
+	var lastID int64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseInt(header, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, &Error{Code: CodeInvalidRequest, Message: "must be an event ID", Field: "Last-Event-ID"})
+			return
+		}
+		lastID = id
+	}
+
+	namespace := namespaceFrom(r.Context())
+	ch, missed := s.events.subscribe(types, lastID)
+	defer s.events.unsubscribe(ch)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range missed {
+		if e.Namespace != namespace {
+			continue
+		}
+		if err := writeEvent(w, e); err != nil {
+			logger.Error("error sending event", "error", err)
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		logger.Error("event stream can't be flushed", "error", err)
+		return
+	}
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				logger.Warn("event stream client too slow, disconnecting")
+				return
+			}
+			if e.Namespace != namespace {
+				continue
+			}
+			err = writeEvent(w, e)
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			logger.Info("event stream closed", "error", err)
+			return
+		}
+	}
+}
+
+// writeEvent writes e in the Server-Sent Events format, with its JSON on a single data line
+func writeEvent(w http.ResponseWriter, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
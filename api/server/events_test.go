@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamEvent reads the next event from a Server-Sent Events stream, skipping comments
+func streamEvent(t *testing.T, r *bufio.Reader) (string, Event) {
+	t.Helper()
+	var name string
+	var e Event
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return name, e
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// openStream connects to the event stream of the server at url
+func openStream(t *testing.T, url, lastEventID string) *bufio.Reader {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"/event", nil)
+	req.Header.Set("Authorization", "token")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got status %d with %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+func TestEventStream(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService()
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	stream := openStream(t, ts.URL, "")
+
+	if rec := serve(s, http.MethodPost, "/item", savedItem(d.addr)); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	want := []string{EventItemCreated, EventPushStarted, EventPushSucceeded}
+	var events []Event
+	for _, typ := range want {
+		name, e := streamEvent(t, stream)
+		if name != typ || e.Type != typ || e.Host != d.addr {
+			t.Fatalf("expected %s for %s, got %s %+v", typ, d.addr, name, e)
+		}
+		events = append(events, e)
+	}
+	if events[0].Item == nil || events[0].Item.Password != "" || events[0].Item.Username != "admin" {
+		t.Errorf("expected the item without its password, got %+v", events[0].Item)
+	}
+	if op := events[2].Operation; op == nil || !op.Success || op.Transcript != nil || events[1].Operation.ID != op.ID {
+		t.Errorf("expected the operation without its transcript, got %+v", op)
+	}
+
+	// a client resuming after the first event is sent the two it missed
+	resumed := openStream(t, ts.URL, "1")
+	for _, typ := range want[1:] {
+		if name, _ := streamEvent(t, resumed); name != typ {
+			t.Errorf("expected %s to be replayed, got %s", typ, name)
+		}
+	}
+
+	if rec := serve(s, http.MethodGet, "/event?type=item.renamed", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown type to be rejected, got %d", rec.Code)
+	}
+}
+
+// webhookReceiver records the deliveries with a valid signature, failing the first failures of them
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	events   []Event
+	invalid  int
+}
+
+func newWebhookReceiver(t *testing.T, secret string, failures int) *webhookReceiver {
+	t.Helper()
+	h := &webhookReceiver{failures: failures}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(Sign(secret, body))) {
+			h.invalid++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if h.failures > 0 {
+			h.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		json.Unmarshal(body, &e)
+		if r.Header.Get(EventTypeHeader) != e.Type {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		h.events = append(h.events, e)
+	}))
+	t.Cleanup(h.Close)
+	return h
+}
+
+func (h *webhookReceiver) received() []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Event(nil), h.events...)
+}
+
+// eventually polls check until it returns true or a second has passed
+func eventually(t *testing.T, check func() bool) bool {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if check() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	h := newWebhookReceiver(t, "s3cret", 2)
+	s := newTestService(WithWebhooks(Webhook{URL: h.URL, Secret: "s3cret", Events: []string{EventItemCreated, EventItemDeleted}}), WithWebhookRetry(3, time.Millisecond))
+
+	s.events.publish(Event{Type: EventPushStarted, Host: "router"})
+	s.events.publish(Event{Type: EventItemCreated, Host: "router"})
+	s.events.publish(Event{Type: EventItemDeleted, Host: "router"})
+
+	if !eventually(t, func() bool { return len(h.received()) == 2 }) {
+		t.Fatalf("expected both item events after the retries, got %+v", h.received())
+	}
+	if got := h.received(); got[0].Type != EventItemCreated || got[1].Type != EventItemDeleted {
+		t.Errorf("expected the events in order, got %+v", got)
+	}
+	s.deadLetters.RLock()
+	defer s.deadLetters.RUnlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(s.deadLetters.letters) != 0 || h.invalid != 0 {
+		t.Errorf("expected no dead letters or invalid signatures, got %+v and %d", s.deadLetters.letters, h.invalid)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	h := newWebhookReceiver(t, "s3cret", 100)
+	s := newTestService(WithWebhooks(Webhook{URL: h.URL, Secret: "s3cret"}), WithWebhookRetry(2, time.Millisecond))
+	s.events.publish(Event{Type: EventItemCreated, Namespace: DefaultNamespace, Host: "router"})
+	s.events.publish(Event{Type: EventItemCreated, Namespace: "team-b", Host: "switch"})
+
+	var letters []DeadLetter
+	if !eventually(t, func() bool {
+		json.Unmarshal(serve(s, http.MethodGet, "/webhook/dead-letter", nil).Body.Bytes(), &letters)
+		return len(letters) == 1
+	}) {
+		t.Fatalf("expected the event to be dead-lettered, got %+v", letters)
+	}
+	if l := letters[0]; l.Webhook != h.URL || l.Attempts != 2 || l.Event.Type != EventItemCreated || l.Event.Host != "router" || !strings.Contains(l.Error, "503") {
+		t.Errorf("unexpected dead letter %+v", l)
+	}
+	// the events are delivered independently, so the other namespace's may be dead-lettered later
+	if !eventually(t, func() bool {
+		letters = nil
+		json.Unmarshal(serve(s, http.MethodGet, "/namespace/team-b/webhook/dead-letter", nil).Body.Bytes(), &letters)
+		return len(letters) > 0
+	}) || len(letters) != 1 || letters[0].Event.Host != "switch" {
+		t.Errorf("expected only the dead letters of the namespace, got %+v", letters)
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	tests := []struct {
+		hook  Webhook
+		valid bool
+	}{
+		{Webhook{URL: "https://hooks.example.com/iosxe", Secret: "s3cret"}, true},
+		{Webhook{URL: "https://hooks.example.com/iosxe", Secret: "s3cret", Events: []string{EventDriftDetected}}, true},
+		{Webhook{URL: "ftp://hooks.example.com", Secret: "s3cret"}, false},
+		{Webhook{URL: "https://hooks.example.com/iosxe"}, false},
+		{Webhook{URL: "https://hooks.example.com/iosxe", Secret: "s3cret", Events: []string{"item.renamed"}}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateWebhook(tt.hook); (err == nil) != tt.valid {
+			t.Errorf("%+v: got %v", tt.hook, err)
+		}
+	}
+}
+
+func TestDriftDetected(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService(WithBackups(10))
+	ch, _ := s.events.subscribe([]string{EventDriftDetected}, 0)
+	item := savedItem(d.addr)
+	serve(s, http.MethodPost, "/item", item)
+
+	// someone configures the device by hand
+	d.mu.Lock()
+	d.config = append(d.config, "snmp-server community public RO")
+	d.mu.Unlock()
+
+	serve(s, http.MethodPut, "/item/"+item.Host, item)
+	select {
+	case e := <-ch:
+		if e.Host != d.addr || e.Drift == nil || e.Drift.FromVersion != 2 || e.Drift.ToVersion != 3 {
+			t.Errorf("unexpected drift event %+v", e)
+		}
+	default:
+		t.Fatal("expected drift to be detected")
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// RouteOperations returns "METHOD path" for every route registered by the Service in version of the API,
+// without the prefix of the version, or for every unversioned route if version is empty
+func RouteOperations(t *testing.T, s *Service, version string) []string {
+	var ops []string
+	err := s.Handler().(*mux.Router).Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// the prefix of a version has no methods, only the routes under it do
+			return nil
+		}
+		if routeVersion, prefix := pathVersion(path); routeVersion == version {
+			for _, method := range methods {
+				ops = append(ops, method+" "+strings.TrimPrefix(path, prefix))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ops
+}
+
+// SpecOperations returns "METHOD path" for every operation in the OpenAPI document
+func SpecOperations() []string {
+	return mustOpenAPI().operations()
+}
+
+// ValidatingHandler serves requests with the Service, failing t for any request or response that does not
+// match the OpenAPI document
+func ValidatingHandler(t *testing.T, s *Service) http.Handler {
+	spec := mustOpenAPI()
+	router := s.Handler().(*mux.Router)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var match mux.RouteMatch
+		if !router.Match(r, &match) {
+			t.Errorf("%s %s: no route matches", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		path, _ := match.Route.GetPathTemplate()
+		if spec.operation(path, r.Method) == nil {
+			t.Errorf("%s %s: operation is not described", r.Method, path)
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if schema, required := spec.requestSchema(path, r.Method, r.Header.Get("Content-Type")); schema != nil {
+			if len(body) == 0 && required {
+				t.Errorf("%s %s: request body is required", r.Method, path)
+			}
+			if len(body) > 0 {
+				value, err := decodeJSON(body)
+				if err != nil {
+					t.Errorf("%s %s: request body is not valid JSON: %s", r.Method, path, err)
+				} else if e := spec.validate(schema, value, ""); e != nil {
+					t.Errorf("%s %s: request body does not match schema: %s", r.Method, path, e)
+				}
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+		if err := spec.validateResponse(path, r.Method, rec.Code, rec.Header().Get("Content-Type"), rec.Body.Bytes()); err != nil {
+			t.Error(err)
+		}
+
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+	})
+}
+
+// FakeDevice starts an IOS-XE device accepting the admin/admin credentials, returning its address
+func FakeDevice(t *testing.T) string {
+	return newFakeDevice(t, "router", true).addr
+}
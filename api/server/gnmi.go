@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+// gnmiTimeout limits how long a single gNMI RPC can take
+const gnmiTimeout = 2 * time.Minute
+
+// gnmiSession is a gRPC connection to the gNMI server of one device, sending the item's credentials with
+// every RPC
+type gnmiSession struct {
+	logger   *slog.Logger
+	rec      *transcript
+	conn     *grpc.ClientConn
+	client   gnmi.GNMIClient
+	username string
+	password string
+}
+
+// dialGNMI connects to the gNMI server on item's host over TLS, verifying the device certificate with
+// tlsConfig or the system roots if it is nil. The connection is made lazily, so failing to connect is
+// reported by the first RPC
+func dialGNMI(logger *slog.Logger, rec *transcript, item Item, tlsConfig *tls.Config) (*gnmiSession, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	logger.Debug("dialing device")
+	conn, err := grpc.Dial(item.Host, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		logger.Error("gnmi dial failed", "error", err)
+		return nil, err
+	}
+	return &gnmiSession{
+		logger:   logger,
+		rec:      rec,
+		conn:     conn,
+		client:   gnmi.NewGNMIClient(conn),
+		username: item.Username,
+		password: item.Password,
+	}, nil
+}
+
+// context returns the context of an RPC, carrying the credentials and limited to gnmiTimeout
+func (c *gnmiSession) context() (context.Context, context.CancelFunc) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "username", c.username, "password", c.password)
+	return context.WithTimeout(ctx, gnmiTimeout)
+}
+
+func (c *gnmiSession) set(req *gnmi.SetRequest) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	c.logger.Debug("sending gnmi set", "deletes", len(req.Delete), "replaces", len(req.Replace), "updates", len(req.Update))
+	c.rec.sent(prototext.Format(req))
+	resp, err := c.client.Set(ctx, req)
+	c.record(resp, err)
+	return err
+}
+
+func (c *gnmiSession) get(req *gnmi.GetRequest) (*gnmi.GetResponse, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	c.logger.Debug("sending gnmi get")
+	c.rec.sent(prototext.Format(req))
+	resp, err := c.client.Get(ctx, req)
+	c.record(resp, err)
+	return resp, err
+}
+
+// record adds the response to an RPC, or its error, to the transcript
+func (c *gnmiSession) record(resp proto.Message, err error) {
+	if err != nil {
+		c.logger.Error("gnmi rpc failed", "error", err)
+		c.rec.received(err.Error())
+		return
+	}
+	c.rec.received(prototext.Format(resp))
+}
+
+func (c *gnmiSession) close() {
+	c.conn.Close()
+}
+
+// applyGNMI sends req to item's device
+func (s *Service) applyGNMI(logger *slog.Logger, rec *transcript, item Item, req *gnmi.SetRequest) error {
+	c, err := dialGNMI(logger, rec, item, s.gnmiTLS)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	return c.set(req)
+}
+
+// readGNMI returns the configuration of item's interface as indented JSON, one document per update
+func (s *Service) readGNMI(logger *slog.Logger, rec *transcript, item Item) (string, error) {
+	return s.readGNMIRequest(logger, rec, item, openconfigInterfaceGet(item))
+}
+
+// readGNMIRequest returns the configuration read by req from item's device as indented JSON, one document
+// per update
+func (s *Service) readGNMIRequest(logger *slog.Logger, rec *transcript, item Item, req *gnmi.GetRequest) (string, error) {
+	c, err := dialGNMI(logger, rec, item, s.gnmiTLS)
+	if err != nil {
+		return "", err
+	}
+	defer c.close()
+	resp, err := c.get(req)
+	if err != nil {
+		return "", err
+	}
+
+	var docs []string
+	for _, notification := range resp.Notification {
+		for _, update := range notification.Update {
+			value := update.Val.GetJsonIetfVal()
+			if value == nil {
+				value = update.Val.GetJsonVal()
+			}
+			var indented bytes.Buffer
+			if err := json.Indent(&indented, value, "", "  "); err != nil {
+				return "", fmt.Errorf("invalid response: %w", err)
+			}
+			docs = append(docs, indented.String())
+		}
+	}
+	return strings.Join(docs, "\n"), nil
+}
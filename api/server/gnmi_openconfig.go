@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+)
+
+// ethernetType is the iana-if-type identity of every interface type an item can configure
+const ethernetType = "iana-if-type:ethernetCsmacd"
+
+// openconfigInterface locates item's interface in openconfig-interfaces. A number with a subinterface, e.g.
+// 1/0/1.100, is subinterface 100 of GigabitEthernet1/0/1, anything else is the interface itself, whose
+// addresses are held by subinterface 0
+type openconfigInterface struct {
+	name  string
+	index uint32
+	sub   bool
+}
+
+func openconfigInterfaceOf(item Item) openconfigInterface {
+	number, sub, found := strings.Cut(item.Number, ".")
+	intf := openconfigInterface{name: item.IntfType + number}
+	if found {
+		index, _ := strconv.ParseUint(sub, 10, 32)
+		intf.index, intf.sub = uint32(index), true
+	}
+	return intf
+}
+
+// path returns the path of the interface with elems appended
+func (o openconfigInterface) path(elems ...string) *gnmi.Path {
+	path := &gnmi.Path{Elem: []*gnmi.PathElem{
+		{Name: "openconfig-interfaces:interfaces"},
+		{Name: "interface", Key: map[string]string{"name": o.name}},
+	}}
+	for _, elem := range elems {
+		path.Elem = append(path.Elem, &gnmi.PathElem{Name: elem})
+	}
+	return path
+}
+
+// subinterfacePath returns the path of the subinterface with elems appended
+func (o openconfigInterface) subinterfacePath(elems ...string) *gnmi.Path {
+	path := o.path("subinterfaces")
+	path.Elem = append(path.Elem, &gnmi.PathElem{
+		Name: "subinterface",
+		Key:  map[string]string{"index": strconv.FormatUint(uint64(o.index), 10)},
+	})
+	for _, elem := range elems {
+		path.Elem = append(path.Elem, &gnmi.PathElem{Name: elem})
+	}
+	return path
+}
+
+// configPath returns the path of the config container of the interface, or of the subinterface
+func (o openconfigInterface) configPath() *gnmi.Path {
+	if o.sub {
+		return o.subinterfacePath("config")
+	}
+	return o.path("config")
+}
+
+// openconfigInterfaceSet returns the Set request configuring every field of item's interface, the gNMI
+// equivalent of the iosxe_interface_ethernet template. The config container is replaced, so the leaves of
+// the fields that are not set return to their defaults, and the addresses are replaced or deleted. A Set is
+// applied as a single transaction, so nothing is changed if any of it fails
+func openconfigInterfaceSet(item Item) (*gnmi.SetRequest, error) {
+	intf := openconfigInterfaceOf(item)
+	config := map[string]interface{}{"enabled": !item.Shutdown}
+	if intf.sub {
+		config["index"] = intf.index
+	} else {
+		config["name"] = intf.name
+		config["type"] = ethernetType
+	}
+	if item.Description != "" {
+		config["description"] = item.Description
+	}
+	req := &gnmi.SetRequest{}
+
+	// the MTU of a subinterface is an openconfig-if-ip leaf, the MTU of an interface is in its config
+	mtuPath := intf.subinterfacePath("openconfig-if-ip:ipv4", "config", "mtu")
+	switch {
+	case !intf.sub && item.Mtu != 0:
+		config["mtu"] = item.Mtu
+	case intf.sub && item.Mtu != 0:
+		update, err := jsonUpdate(mtuPath, item.Mtu)
+		if err != nil {
+			return nil, err
+		}
+		req.Update = append(req.Update, update)
+	case intf.sub:
+		req.Delete = append(req.Delete, mtuPath)
+	}
+
+	replace, err := jsonUpdate(intf.configPath(), config)
+	if err != nil {
+		return nil, err
+	}
+	req.Replace = append(req.Replace, replace)
+
+	addresses := intf.subinterfacePath("openconfig-if-ip:ipv4", "addresses")
+	if item.Ipv4Address == "" || item.Ipv4AddressMask == "" {
+		req.Delete = append(req.Delete, addresses)
+		return req, nil
+	}
+	prefix, err := maskToPrefix(item.Ipv4AddressMask)
+	if err != nil {
+		return nil, err
+	}
+	replace, err = jsonUpdate(addresses, map[string]interface{}{
+		"address": []interface{}{map[string]interface{}{
+			"ip":     item.Ipv4Address,
+			"config": map[string]interface{}{"ip": item.Ipv4Address, "prefix-length": prefix},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req.Replace = append(req.Replace, replace)
+	return req, nil
+}
+
+// openconfigInterfaceDeleteSet returns the Set request returning item's interface to its defaults, the gNMI
+// equivalent of default interface
+func openconfigInterfaceDeleteSet(item Item) (*gnmi.SetRequest, error) {
+	intf := openconfigInterfaceOf(item)
+	config := map[string]interface{}{"name": intf.name, "type": ethernetType}
+	req := &gnmi.SetRequest{Delete: []*gnmi.Path{intf.subinterfacePath("openconfig-if-ip:ipv4", "addresses")}}
+	if intf.sub {
+		config = map[string]interface{}{"index": intf.index}
+		req.Delete = append(req.Delete, intf.subinterfacePath("openconfig-if-ip:ipv4", "config", "mtu"))
+	}
+	replace, err := jsonUpdate(intf.configPath(), config)
+	if err != nil {
+		return nil, err
+	}
+	req.Replace = []*gnmi.Update{replace}
+	return req, nil
+}
+
+// openconfigInterfaceGet returns the Get request reading the configuration of item's interface
+func openconfigInterfaceGet(item Item) *gnmi.GetRequest {
+	return &gnmi.GetRequest{
+		Path:     []*gnmi.Path{openconfigInterfaceOf(item).path()},
+		Type:     gnmi.GetRequest_CONFIG,
+		Encoding: gnmi.Encoding_JSON_IETF,
+	}
+}
+
+// jsonUpdate returns an update setting path to value encoded as RFC 7951 JSON
+func jsonUpdate(path *gnmi.Path, value interface{}) (*gnmi.Update, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return &gnmi.Update{Path: path, Val: &gnmi.TypedValue{Value: &gnmi.TypedValue_JsonIetfVal{JsonIetfVal: encoded}}}, nil
+}
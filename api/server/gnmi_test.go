@@ -0,0 +1,339 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeGNMI is a gNMI server standing in for a device. It keeps the JSON value set at each path, deleting
+// everything under a deleted path, and fails the Set requests touching a path named in errors without
+// changing anything, as a Set is a transaction
+type fakeGNMI struct {
+	gnmi.UnimplementedGNMIServer
+	addr   string
+	roots  *x509.CertPool
+	errors map[string]string
+
+	mu         sync.Mutex
+	operations []string
+	values     map[string]json.RawMessage
+}
+
+func newFakeGNMI(t *testing.T) *fakeGNMI {
+	t.Helper()
+	cert, roots := selfSignedCert(t)
+	f := &fakeGNMI{roots: roots, errors: map[string]string{}, values: map[string]json.RawMessage{}}
+	server := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	gnmi.RegisterGNMIServer(server, f)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+	f.addr = l.Addr().String()
+	return f
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1 and a pool trusting it
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, public, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: private}, roots
+}
+
+func (f *fakeGNMI) authenticate(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if !slices.Equal(md.Get("username"), []string{"admin"}) || !slices.Equal(md.Get("password"), []string{"admin"}) {
+		return status.Error(codes.Unauthenticated, "invalid credentials")
+	}
+	return nil
+}
+
+func (f *fakeGNMI) Set(ctx context.Context, req *gnmi.SetRequest) (*gnmi.SetResponse, error) {
+	if err := f.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var ops []string
+	for _, path := range req.Delete {
+		ops = append(ops, "delete "+gnmiPath(path))
+	}
+	for _, update := range req.Replace {
+		ops = append(ops, "replace "+gnmiPath(update.Path))
+	}
+	for _, update := range req.Update {
+		ops = append(ops, "update "+gnmiPath(update.Path))
+	}
+	f.operations = append(f.operations, ops...)
+	for _, op := range ops {
+		if msg, ok := f.errors[op[strings.Index(op, " ")+1:]]; ok {
+			return nil, status.Error(codes.InvalidArgument, msg)
+		}
+	}
+
+	for _, path := range req.Delete {
+		f.delete(gnmiPath(path))
+	}
+	for _, update := range append(req.Replace, req.Update...) {
+		f.values[gnmiPath(update.Path)] = update.Val.GetJsonIetfVal()
+	}
+	return &gnmi.SetResponse{}, nil
+}
+
+func (f *fakeGNMI) delete(path string) {
+	for p := range f.values {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			delete(f.values, p)
+		}
+	}
+}
+
+// Get returns an update for each value under the requested path
+func (f *fakeGNMI) Get(ctx context.Context, req *gnmi.GetRequest) (*gnmi.GetResponse, error) {
+	if err := f.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	if req.Type != gnmi.GetRequest_CONFIG || req.Encoding != gnmi.Encoding_JSON_IETF {
+		return nil, status.Error(codes.Unimplemented, "only JSON_IETF config is supported")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	notification := &gnmi.Notification{}
+	for _, requested := range req.Path {
+		prefix := gnmiPath(requested)
+		var paths []string
+		for p := range f.values {
+			if strings.HasPrefix(p, prefix+"/") {
+				paths = append(paths, p)
+			}
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			notification.Update = append(notification.Update, &gnmi.Update{
+				Val: &gnmi.TypedValue{Value: &gnmi.TypedValue_JsonIetfVal{JsonIetfVal: f.values[p]}},
+			})
+		}
+	}
+	if len(notification.Update) == 0 {
+		return nil, status.Error(codes.NotFound, "no data")
+	}
+	return &gnmi.GetResponse{Notification: []*gnmi.Notification{notification}}, nil
+}
+
+func (f *fakeGNMI) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.operations...)
+}
+
+func (f *fakeGNMI) value(t *testing.T, path string) map[string]interface{} {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var value map[string]interface{}
+	if raw, ok := f.values[path]; ok {
+		if err := json.Unmarshal(raw, &value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return value
+}
+
+// gnmiPath formats path like the gNMI path strings, e.g. interfaces/interface[name=GigabitEthernet1]
+func gnmiPath(path *gnmi.Path) string {
+	elems := make([]string, 0, len(path.Elem))
+	for _, elem := range path.Elem {
+		keys := make([]string, 0, len(elem.Key))
+		for k, v := range elem.Key {
+			keys = append(keys, "["+k+"="+v+"]")
+		}
+		sort.Strings(keys)
+		elems = append(elems, elem.Name+strings.Join(keys, ""))
+	}
+	return strings.Join(elems, "/")
+}
+
+func (f *fakeGNMI) item() Item {
+	item := deviceItem(f.addr)
+	item.Transport = TransportGNMI
+	item.IntfType, item.Number, item.Description, item.Mtu = "GigabitEthernet", "1/0/1", "uplink", 9000
+	return item
+}
+
+// service returns a service trusting the certificate of the stand-in
+func (f *fakeGNMI) service() *Service {
+	s := newTestService()
+	WithGNMITLS(&tls.Config{RootCAs: f.roots})(s)
+	return s
+}
+
+func applyGNMITo(t *testing.T, s *Service, item Item, build func(Item) (*gnmi.SetRequest, error)) (*transcript, error) {
+	t.Helper()
+	req, err := build(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := newTranscript(s.redactor)
+	return rec, s.applyGNMI(s.logger, rec, item, req)
+}
+
+const (
+	gnmiInterface    = "openconfig-interfaces:interfaces/interface[name=GigabitEthernet1/0/1]"
+	gnmiSubinterface = gnmiInterface + "/subinterfaces/subinterface[index=0]"
+)
+
+func TestGNMISet(t *testing.T) {
+	f := newFakeGNMI(t)
+	item := f.item()
+	item.Ipv4Address, item.Ipv4AddressMask = "192.0.2.1", "255.255.255.0"
+	rec, err := applyGNMITo(t, f.service(), item, openconfigInterfaceSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"replace " + gnmiInterface + "/config", "replace " + gnmiSubinterface + "/openconfig-if-ip:ipv4/addresses"}
+	if got := f.received(); !slices.Equal(got, want) {
+		t.Errorf("got operations %q, want %q", got, want)
+	}
+	config := f.value(t, gnmiInterface+"/config")
+	if config["description"] != "uplink" || config["mtu"] != float64(9000) || config["enabled"] != true || config["type"] != ethernetType {
+		t.Errorf("unexpected config %v", config)
+	}
+	addresses := f.value(t, gnmiSubinterface+"/openconfig-if-ip:ipv4/addresses")
+	address := addresses["address"].([]interface{})[0].(map[string]interface{})
+	if address["ip"] != "192.0.2.1" || address["config"].(map[string]interface{})["prefix-length"] != float64(24) {
+		t.Errorf("unexpected addresses %v", addresses)
+	}
+	if entries := rec.snapshot(); len(entries) != 2 || !strings.Contains(entries[0].Data, "GigabitEthernet1/0/1") {
+		t.Errorf("expected the Set to be recorded, got %v", entries)
+	}
+}
+
+func TestGNMISubinterface(t *testing.T) {
+	f := newFakeGNMI(t)
+	item := f.item()
+	item.Number, item.Shutdown = "1/0/1.100", true
+	if _, err := applyGNMITo(t, f.service(), item, openconfigInterfaceSet); err != nil {
+		t.Fatal(err)
+	}
+	sub := gnmiInterface + "/subinterfaces/subinterface[index=100]"
+	want := []string{
+		"delete " + sub + "/openconfig-if-ip:ipv4/addresses",
+		"replace " + sub + "/config",
+		"update " + sub + "/openconfig-if-ip:ipv4/config/mtu",
+	}
+	if got := f.received(); !slices.Equal(got, want) {
+		t.Errorf("got operations %q, want %q", got, want)
+	}
+	if config := f.value(t, sub+"/config"); config["index"] != float64(100) || config["enabled"] != false {
+		t.Errorf("unexpected config %v", config)
+	}
+}
+
+func TestGNMIDelete(t *testing.T) {
+	f := newFakeGNMI(t)
+	s := f.service()
+	item := f.item()
+	item.Ipv4Address, item.Ipv4AddressMask = "192.0.2.1", "255.255.255.0"
+	if _, err := applyGNMITo(t, s, item, openconfigInterfaceSet); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyGNMITo(t, s, item, openconfigInterfaceDeleteSet); err != nil {
+		t.Fatal(err)
+	}
+	if config := f.value(t, gnmiInterface+"/config"); len(config) != 2 || config["name"] != "GigabitEthernet1/0/1" {
+		t.Errorf("expected the interface to be returned to its defaults, got %v", config)
+	}
+	if addresses := f.value(t, gnmiSubinterface+"/openconfig-if-ip:ipv4/addresses"); addresses != nil {
+		t.Errorf("expected the addresses to be deleted, got %v", addresses)
+	}
+}
+
+func TestGNMIError(t *testing.T) {
+	f := newFakeGNMI(t)
+	f.errors[gnmiSubinterface+"/openconfig-if-ip:ipv4/addresses"] = "address overlaps with GigabitEthernet2"
+	item := f.item()
+	item.Ipv4Address, item.Ipv4AddressMask = "192.0.2.1", "255.255.255.0"
+	_, err := applyGNMITo(t, f.service(), item, openconfigInterfaceSet)
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "address overlaps") {
+		t.Fatalf("expected the device's error, got %v", err)
+	}
+	if config := f.value(t, gnmiInterface+"/config"); config != nil {
+		t.Errorf("expected nothing to be changed, got %v", config)
+	}
+
+	item.Password = "wrong"
+	if _, err := applyGNMITo(t, f.service(), item, openconfigInterfaceSet); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected the credentials to be rejected, got %v", err)
+	}
+}
+
+func TestGNMIReadConfig(t *testing.T) {
+	f := newFakeGNMI(t)
+	s := f.service()
+	item := f.item()
+	if _, err := applyGNMITo(t, s, item, openconfigInterfaceSet); err != nil {
+		t.Fatal(err)
+	}
+	config, err := s.readItemConfig(s.logger, newTranscript(s.redactor), iosxeDriver, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, `"description": "uplink"`) {
+		t.Errorf("unexpected configuration %s", config)
+	}
+}
+
+func TestGNMIUntrustedCertificate(t *testing.T) {
+	f := newFakeGNMI(t)
+	_, err := applyGNMITo(t, newTestService(), f.item(), openconfigInterfaceSet)
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected the device certificate to be rejected, got %v", err)
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Errorf("expected no requests to reach the device, got %q", got)
+	}
+}
@@ -0,0 +1,434 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/meirizal/terraform-experiment/api/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcErrorDomain is the domain of the ErrorInfo detail of the errors of the gRPC API
+const grpcErrorDomain = "terraform-experiment"
+
+// grpcHeaders are the headers of the REST API sent as gRPC metadata, keyed by metadata key
+var grpcHeaders = map[string]string{
+	"authorization":        "Authorization",
+	"x-request-id":         RequestIDHeader,
+	"x-emergency-override": OverrideHeader,
+}
+
+// grpcCodes are the gRPC codes of the statuses of the REST API
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:           codes.InvalidArgument,
+	http.StatusUnauthorized:         codes.Unauthenticated,
+	http.StatusForbidden:            codes.PermissionDenied,
+	http.StatusNotFound:             codes.NotFound,
+	http.StatusConflict:             codes.Aborted,
+	http.StatusPreconditionFailed:   codes.FailedPrecondition,
+	http.StatusUnsupportedMediaType: codes.InvalidArgument,
+	http.StatusUnprocessableEntity:  codes.InvalidArgument,
+	http.StatusLocked:               codes.FailedPrecondition,
+	http.StatusInternalServerError:  codes.Internal,
+	http.StatusBadGateway:           codes.Unavailable,
+	http.StatusServiceUnavailable:   codes.Unavailable,
+}
+
+// GRPCServer returns a gRPC server serving the ItemService of package pb, over TLS if the Service is
+// configured with WithGRPCTLS. Every RPC is made as the request of the REST API it corresponds to, through
+// the handlers of Handler, so that the gRPC API authenticates, validates, logs, forwards to the leader of a
+// cluster and answers like the REST API
+func (s *Service) GRPCServer() *grpc.Server {
+	var opts []grpc.ServerOption
+	if s.grpcTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.grpcTLS)))
+	}
+	server := grpc.NewServer(opts...)
+	pb.RegisterItemServiceServer(server, &grpcService{s: s, handler: s.selfHandler()})
+	return server
+}
+
+// loopback reports whether address, a host:port, only accepts connections from the host itself
+func loopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// grpcService implements pb.ItemServiceServer on a Service
+type grpcService struct {
+	pb.UnimplementedItemServiceServer
+	s *Service
+	// handler serves the requests the RPCs are made as
+	handler http.Handler
+}
+
+// grpcHeader returns the headers of the REST API sent in the metadata of ctx
+func grpcHeader(ctx context.Context) http.Header {
+	header := http.Header{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, name := range grpcHeaders {
+		if values := md.Get(key); len(values) > 0 {
+			header.Set(name, values[0])
+		}
+	}
+	return header
+}
+
+// call makes the request of the REST API at path in the namespace, or in that of the token if namespace is
+// empty, sending body as JSON
+func (g *grpcService) call(ctx context.Context, header http.Header, method, namespace, path string, body interface{}) (*changeWriter, error) {
+	if namespace != "" {
+		path = "/namespace/" + url.PathEscape(namespace) + path
+	}
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "/v"+APIVersion1+path, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	req.Header = header.Clone()
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp := &changeWriter{header: http.Header{}, status: http.StatusOK}
+	g.handler.ServeHTTP(resp, req)
+	return resp, nil
+}
+
+// grpcError returns the gRPC error of an error of the REST API, with the code of e as the reason of an
+// ErrorInfo detail and its field, if any, in the metadata of the detail
+func grpcError(httpStatus int, e *Error) error {
+	code, ok := grpcCodes[httpStatus]
+	if !ok {
+		code = codes.Unknown
+	}
+	st := status.New(code, e.Message)
+	info := &errdetails.ErrorInfo{Reason: e.Code, Domain: grpcErrorDomain}
+	if e.Field != "" {
+		info.Metadata = map[string]string{"field": e.Field}
+	}
+	if detailed, err := st.WithDetails(info); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// responseError returns the Error of a response of the REST API that isn't a success
+func responseError(resp *changeWriter) *Error {
+	var e Error
+	if json.Unmarshal(resp.body.Bytes(), &e) != nil || e.Message == "" {
+		e.Message = http.StatusText(resp.status)
+	}
+	return &e
+}
+
+// itemResponse returns the ItemResponse of the response of the REST API to a change to an item
+func itemResponse(resp *changeWriter) (*pb.ItemResponse, error) {
+	switch resp.status {
+	case http.StatusOK:
+		response := &pb.ItemResponse{OperationIds: resp.header.Values(OperationIDHeader)}
+		if resp.header.Get("Content-Type") == "application/json" {
+			var item Item
+			if err := json.Unmarshal(resp.body.Bytes(), &item); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			response.Item = protoItem(item)
+		}
+		return response, nil
+	case http.StatusAccepted:
+		var change QueuedChange
+		if err := json.Unmarshal(resp.body.Bytes(), &change); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &pb.ItemResponse{ChangeId: change.ID}, nil
+	default:
+		return nil, grpcError(resp.status, responseError(resp))
+	}
+}
+
+// ifMatchRevision returns the headers of ctx, with an If-Match header for revision unless it is zero
+func ifMatchRevision(ctx context.Context, revision int64) http.Header {
+	header := grpcHeader(ctx)
+	if revision != 0 {
+		header.Set("If-Match", itemETag(Item{Revision: revision}))
+	}
+	return header
+}
+
+func (g *grpcService) ListItems(ctx context.Context, req *pb.ListItemsRequest) (*pb.ListItemsResponse, error) {
+	resp, err := g.call(ctx, grpcHeader(ctx), http.MethodGet, req.Namespace, "/item", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != http.StatusOK {
+		return nil, grpcError(resp.status, responseError(resp))
+	}
+	var items map[string]Item
+	if err := json.Unmarshal(resp.body.Bytes(), &items); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := &pb.ListItemsResponse{}
+	for _, name := range names {
+		list.Items = append(list.Items, protoItem(items[name]))
+	}
+	return list, nil
+}
+
+func (g *grpcService) GetItem(ctx context.Context, req *pb.GetItemRequest) (*pb.Item, error) {
+	resp, err := g.call(ctx, grpcHeader(ctx), http.MethodGet, req.Namespace, "/item/"+url.PathEscape(req.Name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != http.StatusOK {
+		return nil, grpcError(resp.status, responseError(resp))
+	}
+	var item Item
+	if err := json.Unmarshal(resp.body.Bytes(), &item); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return protoItem(item), nil
+}
+
+func (g *grpcService) CreateItem(ctx context.Context, req *pb.CreateItemRequest) (*pb.ItemResponse, error) {
+	resp, err := g.call(ctx, grpcHeader(ctx), http.MethodPost, req.Namespace, "/item", itemFromProto(req.Item))
+	if err != nil {
+		return nil, err
+	}
+	return itemResponse(resp)
+}
+
+func (g *grpcService) UpdateItem(ctx context.Context, req *pb.UpdateItemRequest) (*pb.ItemResponse, error) {
+	resp, err := g.call(ctx, ifMatchRevision(ctx, req.Revision), http.MethodPut, req.Namespace, "/item/"+url.PathEscape(req.Name), itemFromProto(req.Item))
+	if err != nil {
+		return nil, err
+	}
+	return itemResponse(resp)
+}
+
+func (g *grpcService) DeleteItem(ctx context.Context, req *pb.DeleteItemRequest) (*pb.ItemResponse, error) {
+	resp, err := g.call(ctx, ifMatchRevision(ctx, req.Revision), http.MethodDelete, req.Namespace, "/item/"+url.PathEscape(req.Name), itemFromProto(req.Item))
+	if err != nil {
+		return nil, err
+	}
+	return itemResponse(resp)
+}
+
+func (g *grpcService) ApplyItems(ctx context.Context, req *pb.ApplyItemsRequest) (*pb.Job, error) {
+	header := grpcHeader(ctx)
+	namespace, httpStatus, e := g.s.tokenNamespace(header.Get("Authorization"), req.Namespace)
+	if e != nil {
+		return nil, grpcError(httpStatus, e)
+	}
+	if header.Get(RequestIDHeader) == "" {
+		header.Set(RequestIDHeader, NewRequestID())
+	}
+	items := make([]Item, 0, len(req.Items))
+	for _, item := range req.Items {
+		items = append(items, itemFromProto(item))
+	}
+	j := g.s.jobs.start(namespace)
+	go g.apply(j, header, req.Namespace, items)
+	return g.s.jobs.snapshot(j), nil
+}
+
+// apply creates or replaces items one after another for the job j, recording the result of each item and
+// the transcripts of its pushes. The transcripts of the pushes made by this instance are added to the job
+// as they are recorded, and those of the pushes made by the leader of a cluster once the item is applied.
+// The job outlives the RPC that started it, so the requests aren't made with its context
+func (g *grpcService) apply(j *job, header http.Header, namespace string, items []Item) {
+	ctx := withPushOutput(context.Background(), func(host, operationID string, entry TranscriptEntry) {
+		g.s.jobs.addOutput(j, protoPushOutput(host, operationID, entry))
+	})
+	for _, item := range items {
+		result := &pb.JobResult{Host: item.Host}
+		var output []*pb.PushOutput
+		resp, err := g.call(ctx, header, http.MethodPost, namespace, "/item", item)
+		if err == nil {
+			result.StatusCode = int32(resp.status)
+			result.Response, err = itemResponse(resp)
+			if err == nil {
+				for _, op := range g.operations(header, namespace, result.Response.OperationIds) {
+					// the REST API answers once the item is stored, even if pushing it failed
+					if !op.Success && result.Code == "" {
+						result.Code = CodeDeviceError
+						result.Message = fmt.Sprintf("operation %s on %s failed: %s", op.ID, op.Host, op.Error)
+					}
+					if !g.s.jobs.hasOutput(j, op.ID) {
+						output = append(output, pushOutput(op)...)
+					}
+				}
+			}
+		}
+		if err != nil {
+			st := status.Convert(err)
+			result.Message = st.Message()
+			for _, detail := range st.Details() {
+				if info, ok := detail.(*errdetails.ErrorInfo); ok {
+					result.Code = info.Reason
+				}
+			}
+		}
+		g.s.jobs.record(j, result, output)
+	}
+	g.s.jobs.finish(j)
+}
+
+// operations returns the operations with operationIDs, read from the REST API so that the operations of
+// the leader of a cluster are read from the leader
+func (g *grpcService) operations(header http.Header, namespace string, operationIDs []string) []Operation {
+	var ops []Operation
+	for _, id := range operationIDs {
+		resp, err := g.call(context.Background(), header, http.MethodGet, namespace, "/operation/"+url.PathEscape(id), nil)
+		if err != nil || resp.status != http.StatusOK {
+			g.s.logger.Warn("unable to read a job's operation", "operation_id", id)
+			continue
+		}
+		var op Operation
+		if err := json.Unmarshal(resp.body.Bytes(), &op); err != nil {
+			continue
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// pushOutput returns the transcript of op
+func pushOutput(op Operation) []*pb.PushOutput {
+	output := make([]*pb.PushOutput, 0, len(op.Transcript))
+	for _, entry := range op.Transcript {
+		output = append(output, protoPushOutput(op.Host, op.ID, entry))
+	}
+	return output
+}
+
+// protoPushOutput returns an entry of the transcript of the operation with operationID on host as a
+// pb.PushOutput
+func protoPushOutput(host, operationID string, entry TranscriptEntry) *pb.PushOutput {
+	return &pb.PushOutput{
+		Host:        host,
+		OperationId: operationID,
+		Time:        timestamppb.New(entry.Time),
+		Direction:   entry.Direction,
+		Data:        entry.Data,
+	}
+}
+
+// authorizedJob returns the job with id if the token in the metadata of ctx can read it
+func (g *grpcService) authorizedJob(ctx context.Context, id string) (*job, error) {
+	j, ok := g.s.jobs.get(id)
+	if !ok {
+		return nil, grpcError(http.StatusNotFound, &Error{Code: CodeNotFound, Message: "job " + id + " does not exist"})
+	}
+	if _, httpStatus, e := g.s.tokenNamespace(grpcHeader(ctx).Get("Authorization"), j.Namespace); e != nil {
+		return nil, grpcError(httpStatus, e)
+	}
+	return j, nil
+}
+
+func (g *grpcService) GetJob(ctx context.Context, req *pb.GetJobRequest) (*pb.Job, error) {
+	j, err := g.authorizedJob(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return g.s.jobs.snapshot(j), nil
+}
+
+func (g *grpcService) StreamPushOutput(req *pb.StreamPushOutputRequest, stream pb.ItemService_StreamPushOutputServer) error {
+	j, err := g.authorizedJob(stream.Context(), req.JobId)
+	if err != nil {
+		return err
+	}
+	sent := 0
+	for {
+		output, changed, finished := g.s.jobs.outputSince(j, sent)
+		for _, o := range output {
+			if err := stream.Send(o); err != nil {
+				return err
+			}
+		}
+		sent += len(output)
+		if finished {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// protoItem returns item as a pb.Item
+func protoItem(item Item) *pb.Item {
+	return &pb.Item{
+		Host:                item.Host,
+		Description:         item.Description,
+		Username:            item.Username,
+		Password:            item.Password,
+		Platform:            item.Platform,
+		Transport:           item.Transport,
+		Type:                item.IntfType,
+		Number:              item.Number,
+		Ipv4Address:         item.Ipv4Address,
+		Ipv4AddressMask:     item.Ipv4AddressMask,
+		Mtu:                 int32(item.Mtu),
+		Shutdown:            item.Shutdown,
+		ServicePolicyInput:  item.ServicePolicyInput,
+		ServicePolicyOutput: item.ServicePolicyOutput,
+		Tags:                item.Tags,
+		Namespace:           item.Namespace,
+		Revision:            item.Revision,
+	}
+}
+
+// itemFromProto returns the Item of item, which is the empty Item if item is nil
+func itemFromProto(item *pb.Item) Item {
+	return Item{
+		Host:                item.GetHost(),
+		Description:         item.GetDescription(),
+		Username:            item.GetUsername(),
+		Password:            item.GetPassword(),
+		Platform:            item.GetPlatform(),
+		Transport:           item.GetTransport(),
+		IntfType:            item.GetType(),
+		Number:              item.GetNumber(),
+		Ipv4Address:         item.GetIpv4Address(),
+		Ipv4AddressMask:     item.GetIpv4AddressMask(),
+		Mtu:                 int(item.GetMtu()),
+		Shutdown:            item.GetShutdown(),
+		ServicePolicyInput:  item.GetServicePolicyInput(),
+		ServicePolicyOutput: item.GetServicePolicyOutput(),
+		Tags:                item.GetTags(),
+		Namespace:           item.GetNamespace(),
+		Revision:            item.GetRevision(),
+	}
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meirizal/terraform-experiment/api/pb"
+	"golang.org/x/exp/slices"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// newGRPCTestClient serves the gRPC API of s in memory and returns a client of it, connecting with creds or
+// without TLS if there are none
+func newGRPCTestClient(t *testing.T, s *Service, creds ...credentials.TransportCredentials) pb.ItemServiceClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := s.GRPCServer()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	creds = append(creds, insecure.NewCredentials())
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(creds[0]),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewItemServiceClient(conn)
+}
+
+// withToken returns a context sending token as the authorization metadata
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
+}
+
+// restItem returns the item in the body of a REST response as a pb.Item on host, so that it can be compared
+// to the item of another device
+func restItem(t *testing.T, body []byte, host string) *pb.Item {
+	t.Helper()
+	var item Item
+	if err := json.Unmarshal(body, &item); err != nil {
+		t.Fatalf("unable to decode item %s: %v", body, err)
+	}
+	item.Host = host
+	return protoItem(item)
+}
+
+// errorReason returns the code of a gRPC error and the reason of its ErrorInfo
+func errorReason(err error) (codes.Code, string) {
+	st := status.Convert(err)
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return st.Code(), info.Reason
+		}
+	}
+	return st.Code(), ""
+}
+
+func TestGRPCItemParity(t *testing.T) {
+	restDevice, grpcDevice := newFakeDevice(t, "router", true), newFakeDevice(t, "router", true)
+	restService, grpcService := newTestService(), newTestService()
+	client := newGRPCTestClient(t, grpcService)
+	ctx := withToken("token")
+
+	item := savedItem(grpcDevice.addr)
+	rec := serve(restService, http.MethodPost, "/item", savedItem(restDevice.addr))
+	created, err := client.CreateItem(ctx, &pb.CreateItemRequest{Item: protoItem(item)})
+	if err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("expected the item to be created over both APIs, got %v and %d %s", err, rec.Code, rec.Body)
+	}
+	if want := restItem(t, rec.Body.Bytes(), grpcDevice.addr); !proto.Equal(created.Item, want) || len(created.OperationIds) != len(rec.Header().Values(OperationIDHeader)) {
+		t.Errorf("expected the created items to match, got %v, want %v", created, want)
+	}
+
+	item.Description = "uplink"
+	restUpdate := savedItem(restDevice.addr)
+	restUpdate.Description = "uplink"
+	rec = serveWithHeader(restService, http.MethodPut, "/item/"+restDevice.addr, restUpdate, ifMatch(`"1"`))
+	updated, err := client.UpdateItem(ctx, &pb.UpdateItemRequest{Name: grpcDevice.addr, Item: protoItem(item), Revision: 1})
+	if err != nil || rec.Code != http.StatusOK || !proto.Equal(updated.Item, restItem(t, rec.Body.Bytes(), grpcDevice.addr)) || updated.Item.Revision != 2 {
+		t.Fatalf("expected the updated items to match, got %v %v and %d %s", updated, err, rec.Code, rec.Body)
+	}
+
+	rec = serve(restService, http.MethodGet, "/item/"+restDevice.addr, nil)
+	got, err := client.GetItem(ctx, &pb.GetItemRequest{Name: grpcDevice.addr})
+	if err != nil || !proto.Equal(got, restItem(t, rec.Body.Bytes(), grpcDevice.addr)) {
+		t.Errorf("expected the items read to match, got %v %v and %s", got, err, rec.Body)
+	}
+	list, err := client.ListItems(ctx, &pb.ListItemsRequest{})
+	if err != nil || len(list.Items) != 1 || !proto.Equal(list.Items[0], got) {
+		t.Errorf("expected the item to be listed, got %v %v", list, err)
+	}
+
+	rec = serve(restService, http.MethodDelete, "/item/"+restDevice.addr, restUpdate)
+	deleted, err := client.DeleteItem(ctx, &pb.DeleteItemRequest{Name: grpcDevice.addr, Item: protoItem(item)})
+	if err != nil || rec.Code != http.StatusOK || deleted.Item != nil || len(deleted.OperationIds) != len(rec.Header().Values(OperationIDHeader)) {
+		t.Errorf("expected the item to be deleted over both APIs, got %v %v and %d %s", deleted, err, rec.Code, rec.Body)
+	}
+
+	if !slices.Equal(grpcDevice.received(), restDevice.received()) {
+		t.Errorf("expected the same commands to be pushed, got %q, want %q", grpcDevice.received(), restDevice.received())
+	}
+}
+
+func TestGRPCErrorParity(t *testing.T) {
+	s := newTestService(WithTokens(map[string]string{"token": DefaultNamespace, "team-b": "team-b"}))
+	stored := savedItem("router:22")
+	stored.Namespace, stored.Revision = DefaultNamespace, 1
+	s.items["router:22"] = stored
+	client := newGRPCTestClient(t, s)
+	invalid := stored
+	invalid.Mtu = 10
+
+	tests := []struct {
+		name string
+		rest func() *http.Response
+		grpc func() error
+		code codes.Code
+	}{
+		{"unauthenticated", func() *http.Response {
+			return serveWithHeader(s, http.MethodGet, "/item", nil, as("other")).Result()
+		}, func() error {
+			_, err := client.ListItems(withToken("other"), &pb.ListItemsRequest{})
+			return err
+		}, codes.Unauthenticated},
+		{"forbidden namespace", func() *http.Response {
+			return serve(s, http.MethodGet, "/namespace/team-b/item", nil).Result()
+		}, func() error {
+			_, err := client.ListItems(withToken("token"), &pb.ListItemsRequest{Namespace: "team-b"})
+			return err
+		}, codes.PermissionDenied},
+		{"not found", func() *http.Response {
+			return serve(s, http.MethodGet, "/item/switch", nil).Result()
+		}, func() error {
+			_, err := client.GetItem(withToken("token"), &pb.GetItemRequest{Name: "switch"})
+			return err
+		}, codes.NotFound},
+		{"invalid item", func() *http.Response {
+			return serve(s, http.MethodPost, "/item", invalid).Result()
+		}, func() error {
+			_, err := client.CreateItem(withToken("token"), &pb.CreateItemRequest{Item: protoItem(invalid)})
+			return err
+		}, codes.InvalidArgument},
+		{"stale revision", func() *http.Response {
+			return serveWithHeader(s, http.MethodPut, "/item/router:22", stored, http.Header{"Authorization": {"token"}, "If-Match": {`"7"`}}).Result()
+		}, func() error {
+			_, err := client.UpdateItem(withToken("token"), &pb.UpdateItemRequest{Name: "router:22", Item: protoItem(stored), Revision: 7})
+			return err
+		}, codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		resp := tt.rest()
+		var e Error
+		json.NewDecoder(resp.Body).Decode(&e)
+		code, reason := errorReason(tt.grpc())
+		if code != tt.code || reason != e.Code || grpcCodes[resp.StatusCode] != code {
+			t.Errorf("%s: expected %s %s, got %s %s", tt.name, tt.code, e.Code, code, reason)
+		}
+	}
+}
+
+func TestGRPCApplyItems(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService()
+	client := newGRPCTestClient(t, s)
+	invalid := savedItem("switch")
+	invalid.Mtu = 10
+
+	job, err := client.ApplyItems(withToken("token"), &pb.ApplyItemsRequest{Items: []*pb.Item{protoItem(savedItem(d.addr)), protoItem(invalid)}})
+	if err != nil || job.Id == "" || job.Namespace != DefaultNamespace {
+		t.Fatalf("expected the job to be started, got %v %v", job, err)
+	}
+
+	stream, err := client.StreamPushOutput(withToken("token"), &pb.StreamPushOutputRequest{JobId: job.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []string
+	for {
+		output, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.Host != d.addr || output.OperationId == "" {
+			t.Errorf("expected the output of the push to the device, got %v", output)
+		}
+		if output.Direction == directionSent {
+			sent = append(sent, output.Data)
+		}
+	}
+	if !slices.Contains(sent, "interface GigabitEthernet 1") {
+		t.Errorf("expected the pushed commands to be streamed, got %q", sent)
+	}
+
+	job, err = client.GetJob(withToken("token"), &pb.GetJobRequest{Id: job.Id})
+	if err != nil || job.Status != pb.JobStatus_JOB_STATUS_FAILED || len(job.Results) != 2 || job.Finished == nil {
+		t.Fatalf("expected the job to have failed on an item, got %v %v", job, err)
+	}
+	if ok := job.Results[0]; ok.StatusCode != http.StatusOK || ok.Response.Item.Revision != 1 || len(ok.Response.OperationIds) == 0 {
+		t.Errorf("expected the first item to be applied, got %v", ok)
+	}
+	if failed := job.Results[1]; failed.StatusCode != http.StatusUnprocessableEntity || failed.Code != CodeValidationFailed || failed.Response != nil {
+		t.Errorf("expected the second item to fail validation, got %v", failed)
+	}
+	if _, ok := s.items[d.addr]; !ok {
+		t.Errorf("expected the applied item to be stored")
+	}
+
+	if _, err := client.GetJob(withToken("token"), &pb.GetJobRequest{Id: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected an unknown job not to be found, got %v", err)
+	}
+}
+
+func TestGRPCJobFailsOnPush(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	d.errors["mtu 1500"] = "% Invalid input detected at '^' marker."
+	s := newTestService()
+	client := newGRPCTestClient(t, s)
+
+	// finished starts a job applying item and returns it once it has finished
+	finished := func(item Item) *pb.Job {
+		t.Helper()
+		job, err := client.ApplyItems(withToken("token"), &pb.ApplyItemsRequest{Items: []*pb.Item{protoItem(item)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !eventually(t, func() bool {
+			job, err = client.GetJob(withToken("token"), &pb.GetJobRequest{Id: job.Id})
+			return err == nil && job.Finished != nil
+		}) {
+			t.Fatalf("expected the job to finish, got %v %v", job, err)
+		}
+		return job
+	}
+
+	item := savedItem(d.addr)
+	if job := finished(item); job.Status != pb.JobStatus_JOB_STATUS_SUCCEEDED || job.Results[0].Code != "" {
+		t.Errorf("expected the job to succeed, got %v", job)
+	}
+	item.Mtu = 1500
+	job := finished(item)
+	result := job.Results[0]
+	if job.Status != pb.JobStatus_JOB_STATUS_FAILED || result.StatusCode != http.StatusOK || result.Code != CodeDeviceError || !strings.Contains(result.Message, "Invalid input") {
+		t.Errorf("expected the job whose push failed to fail, got %v", job)
+	}
+}
+
+func TestGRPCStreamsOutputDuringPush(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	release := make(chan struct{})
+	d.holds["end"] = release
+	defer func() {
+		if release != nil {
+			close(release)
+		}
+	}()
+	s := newTestService()
+	client := newGRPCTestClient(t, s)
+
+	job, err := client.ApplyItems(withToken("token"), &pb.ApplyItemsRequest{Items: []*pb.Item{protoItem(savedItem(d.addr))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.StreamPushOutput(withToken("token"), &pb.StreamPushOutputRequest{JobId: job.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []string
+	for !slices.Contains(sent, "interface GigabitEthernet 1") {
+		output, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("expected the output of the push before it finished, got %v", err)
+		}
+		if output.Direction == directionSent {
+			sent = append(sent, output.Data)
+		}
+	}
+	if running, err := client.GetJob(withToken("token"), &pb.GetJobRequest{Id: job.Id}); err != nil || running.Status != pb.JobStatus_JOB_STATUS_RUNNING || len(running.Results) != 0 {
+		t.Errorf("expected the push to still be running, got %v %v", running, err)
+	}
+
+	close(release)
+	release = nil
+	for {
+		output, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.Direction == directionSent {
+			sent = append(sent, output.Data)
+		}
+	}
+	if count(sent, "interface GigabitEthernet 1") != 1 || !slices.Contains(sent, "end") {
+		t.Errorf("expected the whole transcript to be streamed once, got %q", sent)
+	}
+}
+
+func TestGRPCJobNamespace(t *testing.T) {
+	s := newTestService(WithTokens(map[string]string{"token": DefaultNamespace, "team-b": "team-b"}))
+	client := newGRPCTestClient(t, s)
+
+	job, err := client.ApplyItems(withToken("token"), &pb.ApplyItemsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetJob(withToken("team-b"), &pb.GetJobRequest{Id: job.Id}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected the job of another namespace to be refused, got %v", err)
+	}
+	if _, err := client.ApplyItems(withToken("team-b"), &pb.ApplyItemsRequest{Namespace: DefaultNamespace}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected a job in another namespace to be refused, got %v", err)
+	}
+}
+
+// newTestCertificate returns a self-signed certificate for localhost and a pool trusting it
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestGRPCTLS(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	s := newTestService(WithGRPCTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+
+	client := newGRPCTestClient(t, s, credentials.NewTLS(&tls.Config{RootCAs: pool, ServerName: "localhost"}))
+	if _, err := client.ListItems(withToken("token"), &pb.ListItemsRequest{}); err != nil {
+		t.Errorf("expected the API to be served over TLS, got %v", err)
+	}
+	plain := newGRPCTestClient(t, s)
+	if _, err := plain.ListItems(withToken("token"), &pb.ListItemsRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected a connection without TLS to be refused, got %v", err)
+	}
+}
+
+func TestGRPCListenerRequiresTLS(t *testing.T) {
+	s := newTestService(WithGRPC("0.0.0.0:0"))
+	if err := s.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "loopback") {
+		t.Errorf("expected serving the gRPC API without TLS on every address to be refused, got %v", err)
+	}
+
+	for address, want := range map[string]bool{"localhost:3002": true, "127.0.0.1:3002": true, "[::1]:3002": true, ":3002": false, "0.0.0.0:3002": false, "192.0.2.1:3002": false} {
+		if got := loopback(address); got != want {
+			t.Errorf("%s: got loopback %t, want %t", address, got, want)
+		}
+	}
+}
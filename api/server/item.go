@@ -1,19 +1,15 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
-	"regexp"
 	"strings"
 	"time"
 
-	"html/template"
-
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/ssh"
 )
 
 type Item struct {
@@ -21,6 +17,8 @@ type Item struct {
 	Description         string `json:"description"`
 	Username            string `json:"username"`
 	Password            string `json:"password"`
+	Platform            string `json:"platform,omitempty"`
+	Transport           string `json:"transport,omitempty"`
 	IntfType            string `json:"type"`
 	Number              string `json:"number"`
 	Ipv4Address         string `json:"ipv4_address"`
@@ -29,176 +27,400 @@ type Item struct {
 	Shutdown            bool   `json:"shutdown"`
 	ServicePolicyInput  string `json:"service_policy_input"`
 	ServicePolicyOutput string `json:"service_policy_output"`
+	// Tags are labels of the item's device, such as its role or site, that maintenance windows and change
+	// freezes are scoped by
+	Tags []string `json:"tags,omitempty"`
+	// Namespace is the namespace the item and its device belong to, that of the request creating it
+	Namespace string `json:"namespace,omitempty"`
+	// Revision is set by the server every time the item is stored, and is sent as its ETag. It is never the
+	// revision of another item, or of the item before it was deleted
+	Revision int64 `json:"revision,omitempty"`
 }
 
-const templateFile = "api/template/iosxe_interface_ethernet.cfg"
-const templateFileDelete = "api/template/iosxe_interface_ethernet_delete.cfg"
-
-// GetItems returns all of the Items that exist in the server
+// GetItems returns all of the Items that exist in the namespace of the request keyed by host. With query
+// parameters it returns a page of the items matching them instead, sorted and with the fields asked for
 func (s *Service) GetItems(w http.ResponseWriter, r *http.Request) {
+	namespace := namespaceFrom(r.Context())
+	values := r.URL.Query()
+	if len(values) == 0 {
+		s.RLock()
+		items := map[string]Item{}
+		for name, item := range s.items {
+			if item.Namespace == namespace {
+				items[name] = item
+			}
+		}
+		s.RUnlock()
+		if err := writeJSON(w, items); err != nil {
+			loggerFrom(r.Context()).Error("error sending response", "error", err)
+		}
+		return
+	}
+
+	query, qerr := parseItemQuery(values)
+	if qerr != nil {
+		writeError(w, http.StatusBadRequest, qerr)
+		return
+	}
 	s.RLock()
-	defer s.RUnlock()
-	err := json.NewEncoder(w).Encode(s.items)
-	if err != nil {
-		log.Println(err)
+	var items []Item
+	for _, item := range s.items {
+		if item.Namespace == namespace && query.matches(item) {
+			items = append(items, item)
+		}
+	}
+	s.RUnlock()
+
+	if err := writeJSON(w, query.page(items)); err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
 	}
 }
 
 // PostItem handles adding a new Item
 func (s *Service) PostItem(w http.ResponseWriter, r *http.Request) {
-	defer TimeTrack(time.Now(), "Operations")
+	logger := loggerFrom(r.Context())
 
 	var item Item
 	if r.Body == nil {
-		http.Error(w, "Please send a request body", http.StatusBadRequest)
+		httpError(w, "Please send a request body", http.StatusBadRequest, CodeBadRequest)
 		return
 	}
 	err := json.NewDecoder(r.Body).Decode(&item)
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		httpError(w, err.Error(), http.StatusBadRequest, CodeBadRequest)
 		return
 	}
+	if item.Namespace == "" {
+		item.Namespace = namespaceFrom(r.Context())
+	}
+	item = itemDefaults(item)
 
-	whiteSpace := regexp.MustCompile(`\s+`)
-	if whiteSpace.Match([]byte(item.Host)) {
-		http.Error(w, "item names cannot contain whitespace", 400)
+	if !validItem(w, item) || !itemInNamespace(w, r, item) {
 		return
 	}
 
 	s.Lock()
 	defer s.Unlock()
 
+	if s.deviceTaken(w, r, item.Host) {
+		return
+	}
+
 	// if s.itemExists(item.Host) {
 	// 	http.Error(w, fmt.Sprintf("item %s already exists", item.Host), http.StatusBadRequest)
 	// 	return
 	// }
 
-	s.items[item.Host] = item
-	log.Printf("added item: %s", item.Host)
-	err = json.NewEncoder(w).Encode(item)
-	if err != nil {
-		log.Printf("error sending response - %s", err)
+	// Load config with template
+	p, ok := s.preparePush(w, r, item, templateInterface)
+	if !ok {
+		return
 	}
 
-	// Load config with template
-	commands := loadConfig(item, templateFile)
+	body, _ := json.Marshal(item)
+	tags := s.deviceTags(item.Host, item)
+	var stored *Item
+	if existing, ok := s.items[item.Host]; ok {
+		stored = &existing
+		if !validChange(w, existing, item) {
+			return
+		}
+	}
+	if !s.changeApproved(w, r, item.Host, tags, body, stored, p, p, item.Password) {
+		return
+	}
+	r, allowed := s.changeAllowed(w, r, item.Host, tags, body)
+	if !allowed {
+		return
+	}
 
-	// Load SSH config credential
-	config := loadSshConfig(item)
+	if !itemStored(w, s.storeItem(r.Context(), item.Host, &item)) {
+		return
+	}
+	logger.Info("added item", "host", item.Host)
+	s.itemEvent(r.Context(), EventItemCreated, item)
 
 	hosts := []string{item.Host}
 
 	// Run the config command
-	pushConfig(hosts, commands, config)
+	operationIDs, err := s.pushConfig(r.Context(), "create", p, hosts, item.Password)
 
 	if err != nil {
-		log.Printf("error when running command - %s", err)
+		logger.Error("error when running command", "error", err)
+	} else {
+		operationIDs = s.saveAfterChange(r.Context(), item, operationIDs)
 	}
 
-	return
+	setOperationIDs(w, operationIDs)
+	w.Header().Set("ETag", itemETag(item))
+	err = writeJSON(w, item)
+	if err != nil {
+		logger.Error("error sending response", "error", err)
+	}
 }
 
 // PutItem handles updating an Item with a specific name
 func (s *Service) PutItem(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
 	vars := mux.Vars(r)
 	itemName := vars["name"]
 	if itemName == "" {
-		http.Error(w, "not found", http.StatusNotFound)
+		httpError(w, "not found", http.StatusNotFound, CodeNotFound)
 		return
 	}
 
 	var item Item
 	if r.Body == nil {
-		http.Error(w, "Please send a request body", http.StatusBadRequest)
+		httpError(w, "Please send a request body", http.StatusBadRequest, CodeBadRequest)
 		return
 	}
 	err := json.NewDecoder(r.Body).Decode(&item)
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		httpError(w, err.Error(), http.StatusBadRequest, CodeBadRequest)
+		return
+	}
+	if item.Namespace == "" {
+		item.Namespace = namespaceFrom(r.Context())
+	}
+	item = itemDefaults(item)
+
+	if !validItem(w, item) || !itemInNamespace(w, r, item) {
 		return
 	}
 
 	s.Lock()
 	defer s.Unlock()
 
-	if !s.itemExists(itemName) {
-		log.Printf("item %s does not exist", itemName)
-		http.Error(w, fmt.Sprintf("item %v does not exist", itemName), http.StatusBadRequest)
+	stored, ok := s.namespacedItem(r.Context(), itemName)
+	if !ok {
+		logger.Warn("item does not exist", "host", itemName)
+		httpError(w, fmt.Sprintf("item %v does not exist", itemName), http.StatusBadRequest, CodeBadRequest)
+		return
+	}
+	if !itemMatches(w, r, stored) || !validChange(w, stored, item) {
+		return
+	}
+	if s.deviceTaken(w, r, item.Host) {
 		return
 	}
 
-	defer TimeTrack(time.Now(), "Operations")
 	// Load config with template
-	commands := loadConfig(item, templateFile)
+	p, ok := s.preparePush(w, r, item, templateInterface)
+	if !ok {
+		return
+	}
 
-	// Load SSH config credential
-	config := loadSshConfig(item)
+	body, _ := json.Marshal(item)
+	tags := s.deviceTags(item.Host, item, stored)
+	if !s.changeApproved(w, r, item.Host, tags, body, &stored, p, p, item.Password, stored.Password) {
+		return
+	}
+	r, allowed := s.changeAllowed(w, r, item.Host, tags, body)
+	if !allowed {
+		return
+	}
+
+	if !itemStored(w, s.storeItem(r.Context(), itemName, &item)) {
+		return
+	}
 
 	hosts := []string{item.Host}
 
 	// Run the config command
-	pushConfig(hosts, commands, config)
+	operationIDs, err := s.pushConfig(r.Context(), "update", p, hosts, item.Password)
 
 	if err != nil {
-		log.Printf("error when running command - %s", err)
+		logger.Error("error when running command", "error", err)
+	} else {
+		operationIDs = s.saveAfterChange(r.Context(), item, operationIDs)
+	}
+
+	logger.Info("updated item", "host", item.Host)
+	s.itemEvent(r.Context(), EventItemUpdated, item)
+	setOperationIDs(w, operationIDs)
+	w.Header().Set("ETag", itemETag(item))
+	err = writeJSON(w, item)
+	if err != nil {
+		logger.Error("error sending response", "error", err)
+	}
+}
+
+// PatchItem handles changing some of the fields of an Item with a specific name, with a JSON Merge Patch or
+// a JSON Patch of the stored item. Only the sections of the configuration that refer to the changed fields
+// are pushed, and nothing is if none do
+func (s *Service) PatchItem(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	vars := mux.Vars(r)
+	itemName := vars["name"]
+	if itemName == "" {
+		httpError(w, "not found", http.StatusNotFound, CodeNotFound)
+		return
+	}
+
+	if r.Body == nil {
+		httpError(w, "Please send a request body", http.StatusBadRequest, CodeBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest, CodeBadRequest)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	stored, ok := s.namespacedItem(r.Context(), itemName)
+	if !ok {
+		httpError(w, fmt.Sprintf("item %s does not exist", itemName), http.StatusNotFound, CodeNotFound)
+		return
+	}
+	if !itemMatches(w, r, stored) {
+		return
+	}
+	item, status, e := s.openAPI.patchItem(stored, r.Header.Get("Content-Type"), body)
+	if e != nil {
+		writeError(w, status, e)
+		return
+	}
+	item = itemDefaults(item)
+	if item.Host != stored.Host {
+		writeError(w, http.StatusUnprocessableEntity, &Error{
+			Code:    CodeValidationFailed,
+			Message: "item is invalid",
+			Errors:  []*Error{{Code: CodeInvalidField, Message: "can't be changed, it names the item", Field: "host"}},
+		})
+		return
+	}
+	if !validItem(w, item) || !itemInNamespace(w, r, item) || !validChange(w, stored, item) {
+		return
+	}
+
+	// the revision is the server's, a patch to it changes nothing
+	item.Revision = stored.Revision
+	fields := changedFields(stored, item)
+
+	// Load config with template, only the sections the patch changes for the device and the whole
+	// configuration for the diff shown for approval
+	p, ok := s.preparePartialPush(w, r, item, templateInterface, fields)
+	if !ok {
+		return
+	}
+	full, ok := s.preparePush(w, r, item, templateInterface)
+	if !ok {
+		return
+	}
+
+	tags := s.deviceTags(item.Host, item, stored)
+	if !s.changeApproved(w, r, item.Host, tags, body, &stored, p, full, item.Password, stored.Password) {
+		return
+	}
+	r, allowed := s.changeAllowed(w, r, item.Host, tags, body)
+	if !allowed {
+		return
+	}
+
+	if !itemStored(w, s.storeItem(r.Context(), itemName, &item)) {
+		return
+	}
+
+	var operationIDs []string
+	if p.config != "" {
+		// Run the config command
+		operationIDs, err = s.pushConfig(r.Context(), "update", p, []string{item.Host}, item.Password)
+		if err != nil {
+			logger.Error("error when running command", "error", err)
+		} else {
+			operationIDs = s.saveAfterChange(r.Context(), item, operationIDs)
+		}
 	}
 
-	s.items[itemName] = item
-	log.Printf("updated item: %s", item.Host)
-	err = json.NewEncoder(w).Encode(item)
+	logger.Info("patched item", "host", item.Host, "fields", fields)
+	s.itemEvent(r.Context(), EventItemUpdated, item)
+	setOperationIDs(w, operationIDs)
+	w.Header().Set("ETag", itemETag(item))
+	err = writeJSON(w, item)
 	if err != nil {
-		log.Printf("error sending response - %s", err)
+		logger.Error("error sending response", "error", err)
 	}
 }
 
 // DeleteItem handles removing an Item with a specific name
 func (s *Service) DeleteItem(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
 	vars := mux.Vars(r)
 	itemName := vars["name"]
 	if itemName == "" {
-		http.Error(w, "not found", http.StatusNotFound)
+		httpError(w, "not found", http.StatusNotFound, CodeNotFound)
 		return
 	}
 
 	var item Item
 	if r.Body == nil {
-		http.Error(w, "Please send a request body", http.StatusBadRequest)
+		httpError(w, "Please send a request body", http.StatusBadRequest, CodeBadRequest)
 		return
 	}
 	err := json.NewDecoder(r.Body).Decode(&item)
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		httpError(w, err.Error(), http.StatusBadRequest, CodeBadRequest)
 		return
 	}
 	s.Lock()
 	defer s.Unlock()
 
-	if !s.itemExists(itemName) {
-		http.Error(w, fmt.Sprintf("item %s does not exists", itemName), http.StatusNotFound)
+	stored, ok := s.namespacedItem(r.Context(), itemName)
+	if !ok {
+		httpError(w, fmt.Sprintf("item %s does not exists", itemName), http.StatusNotFound, CodeNotFound)
+		return
+	}
+	if !itemMatches(w, r, stored) {
 		return
 	}
 
-	defer TimeTrack(time.Now(), "Operations")
+	// the item removed from the device is the one that was stored, so it is always on the stored platform
+	// and removed with the stored transport, in the stored namespace
+	item.Platform = stored.Platform
+	item.Transport = stored.Transport
+	item.Namespace = stored.Namespace
+
 	// Load config with template
-	commands := loadConfig(item, templateFileDelete)
+	p, ok := s.preparePush(w, r, item, templateInterfaceDelete)
+	if !ok {
+		return
+	}
 
-	// Load SSH config credential
-	config := loadSshConfig(item)
+	body, _ := json.Marshal(item)
+	tags := s.deviceTags(item.Host, stored)
+	if !s.changeApproved(w, r, item.Host, tags, body, &stored, p, nil, item.Password, stored.Password) {
+		return
+	}
+	r, allowed := s.changeAllowed(w, r, item.Host, tags, body)
+	if !allowed {
+		return
+	}
+
+	if !itemStored(w, s.storeItem(r.Context(), itemName, nil)) {
+		return
+	}
 
 	hosts := []string{item.Host}
 
 	// Run the config command
-	pushConfig(hosts, commands, config)
+	operationIDs, err := s.pushConfig(r.Context(), "delete", p, hosts, item.Password)
 
 	if err != nil {
-		log.Printf("error when running command - %s", err)
+		logger.Error("error when running command", "error", err)
+	} else {
+		operationIDs = s.saveAfterChange(r.Context(), item, operationIDs)
 	}
 
-	delete(s.items, itemName)
+	logger.Info("deleted item", "host", itemName)
+	s.itemEvent(r.Context(), EventItemDeleted, item)
+	setOperationIDs(w, operationIDs)
 
 	_, err = fmt.Fprintf(w, "Deleted item with name %s", itemName)
 	if err != nil {
-		log.Println(err)
+		logger.Error("error sending response", "error", err)
 	}
 }
 
@@ -207,154 +429,204 @@ func (s *Service) GetItem(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	itemName := vars["name"]
 	if itemName == "" {
-		http.Error(w, "not found", http.StatusNotFound)
+		httpError(w, "not found", http.StatusNotFound, CodeNotFound)
 		return
 	}
 
 	s.RLock()
 	defer s.RUnlock()
-	if !s.itemExists(itemName) {
-		http.Error(w, "not found", http.StatusNotFound)
+	item, ok := s.namespacedItem(r.Context(), itemName)
+	if !ok {
+		httpError(w, "not found", http.StatusNotFound, CodeNotFound)
 		return
 	}
 
-	err := json.NewEncoder(w).Encode(s.items[itemName])
+	w.Header().Set("ETag", itemETag(item))
+	err := writeJSON(w, item)
 	if err != nil {
-		log.Println(err)
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
 		return
 	}
 }
 
-// itemExists checks if an item exists in or not. Does not lock access to the itemService, expects this to
-// be done by the calling method
-func (s *Service) itemExists(itemName string) bool {
-	if _, ok := s.items[itemName]; ok {
-		return true
-	}
-	return false
-}
+// GetItemConfig reads the running configuration of an Item's interface from its device
+func (s *Service) GetItemConfig(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	itemName := mux.Vars(r)["name"]
 
-func loadConfig(item Item, templateFile string) []string {
-	commands := []string{}
-	t := template.Must(template.ParseFiles(templateFile))
+	s.RLock()
+	item, ok := s.namespacedItem(r.Context(), itemName)
+	s.RUnlock()
+	if !ok {
+		httpError(w, "not found", http.StatusNotFound, CodeNotFound)
+		return
+	}
+	driver, ok := itemDriver(w, item)
+	if !ok {
+		return
+	}
 
-	// 'buf' is an io.Writter to capture the template execution output
-	buf := new(bytes.Buffer)
-	err := t.Execute(buf, item)
+	rec := newTranscript(s.redactor, item.Password)
+	config, err := s.readItemConfig(logger.With("host", item.Host), rec, driver, item)
 	if err != nil {
-		log.Println(err)
-		return commands
+		logger.Error("error reading configuration", "host", item.Host, "error", err)
+		httpError(w, fmt.Sprintf("unable to read configuration from %s: %s", item.Host, err), http.StatusBadGateway, CodeDeviceError)
+		return
 	}
-	commands = strings.Split(buf.String(), "\n")
-	commands = removeEmptyStrings(commands)
-	// fmt.Println(commands)
-	return commands
-}
-
-func loadSshConfig(item Item) *ssh.ClientConfig {
-	sshConf := ssh.Config{}
-	sshConf.SetDefaults()
-	sshConf.KeyExchanges = append(
-		sshConf.KeyExchanges,
-		"diffie-hellman-group-exchange-sha256",
-		"diffie-hellman-group-exchange-sha1",
-	)
-
-	config := &ssh.ClientConfig{
-		User: item.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(item.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Config:          sshConf,
-	}
-	return config
-}
-
-func pushConfig(hosts, commands []string, config *ssh.ClientConfig) error {
-
-	outStrings := make(map[string]string)
-	results := make(chan string, 100)
-
-	for _, hostname := range hosts {
-		go func(hostname string) {
-			results <- executeCmd(hostname, commands, config)
-		}(hostname)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = fmt.Fprintln(w, config)
+	if err != nil {
+		logger.Error("error sending response", "error", err)
 	}
+}
 
-	for i := 0; i < len(hosts); i++ {
-		res := <-results
-		outStrings[hosts[i]] = res
+// validItem checks item with ValidateItem, sending a 422 listing the invalid fields if there are any
+func validItem(w http.ResponseWriter, item Item) bool {
+	errs := ValidateItem(item)
+	if errs == nil {
+		return true
 	}
+	writeError(w, http.StatusUnprocessableEntity, &Error{
+		Code:    CodeValidationFailed,
+		Message: "item is invalid",
+		Errors:  errs,
+	})
+	return false
+}
 
-	for _, device_output := range outStrings {
-		fmt.Printf("%s", device_output)
-		fmt.Printf("\n================================\n\n")
+// validChange sends a 400 listing every field of item whose change from stored can't be pushed, reporting
+// whether the change can be made
+func validChange(w http.ResponseWriter, stored, item Item) bool {
+	errs := ValidateChange(stored, item)
+	if errs == nil {
+		return true
 	}
-	return nil
+	writeError(w, http.StatusBadRequest, &Error{
+		Code:    CodeBadRequest,
+		Message: "change can't be pushed",
+		Errors:  errs,
+	})
+	return false
 }
 
-func TimeTrack(start time.Time, name string) {
-	elapsed := time.Since(start)
-	log.Printf("%s took %s", name, elapsed)
+// itemExists checks if an item exists in or not. Does not lock access to the itemService, expects this to
+// be done by the calling method
+func (s *Service) itemExists(itemName string) bool {
+	if _, ok := s.items[itemName]; ok {
+		return true
+	}
+	return false
 }
 
-func executeCmd(hostname string, cmds []string, config *ssh.ClientConfig) string {
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          0,     // disable echoing
-		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
-	}
-	conn, err := ssh.Dial("tcp", hostname, config)
+// itemDriver returns the driver for item's platform, sending a 422 if the platform is not supported
+func itemDriver(w http.ResponseWriter, item Item) (Driver, bool) {
+	driver, err := driverFor(item.Platform)
 	if err != nil {
-		log.Println(err)
-	}
-	session, err := conn.NewSession()
-	if err != nil {
-		log.Fatal(err)
+		writeError(w, http.StatusUnprocessableEntity, &Error{Code: CodeInvalidField, Message: err.Error(), Field: "platform"})
+		return nil, false
 	}
+	return driver, true
+}
 
-	// You can use session.Run() here but that only works
-	// if you need a run a single command or you commands
-	// are independent of each other.
-	err = session.RequestPty("xterm", 80, 40, modes)
-	if err != nil {
-		log.Fatalf("request for pseudo terminal failed: %s", err)
-	}
-	stdBuf, err := session.StdoutPipe()
-	if err != nil {
-		log.Fatalf("request for stdout pipe failed: %s", err)
+// renderConfig renders the named template of driver's platform for item, sending a 500 if the template
+// can't be rendered. If fields isn't nil only the sections of the template affected by a change to them
+// are rendered
+func (s *Service) renderConfig(w http.ResponseWriter, r *http.Request, driver Driver, name string, item Item, fields []string) ([]string, TemplateInfo, bool) {
+	name = templateName(driver.Platform(), name)
+	var commands []string
+	var tmpl TemplateInfo
+	var err error
+	if fields != nil {
+		commands, tmpl, err = s.templates.renderSections(name, item, fields)
+	} else {
+		commands, tmpl, err = s.templates.render(name, item)
 	}
-	stdinBuf, err := session.StdinPipe()
 	if err != nil {
-		log.Fatalf("request for stdin pipe failed: %s", err)
-	}
-	err = session.Shell()
-	if err != nil {
-		log.Fatalf("failed to start shell: %s", err)
+		loggerFrom(r.Context()).Error("error rendering template", "template", name, "error", err)
+		httpError(w, fmt.Sprintf("unable to render template %s: %s", name, err), http.StatusInternalServerError, CodeInternal)
+		return nil, tmpl, false
 	}
+	return commands, tmpl, true
+}
 
-	var cmd_output string
+// pushConfig applies p on every host concurrently, recording an Operation with the redacted session
+// transcript for each host and the push duration against operation. secrets are redacted from the
+// transcripts in addition to the configured patterns. The IDs of the recorded operations are returned,
+// along with an error naming every host the push failed on
+func (s *Service) pushConfig(ctx context.Context, operation string, p *push, hosts []string, secrets ...string) ([]string, error) {
+	logger := loggerFrom(ctx).With("operation", operation)
+	results := make(chan *Operation, len(hosts))
 
-	for _, cmd := range cmds {
-		stdinBuf.Write([]byte(cmd + "\n"))
-		for {
-			stdoutBuf := make([]byte, 1000000)
-			time.Sleep(time.Millisecond * 100)
-			byteCount, err := stdBuf.Read(stdoutBuf)
+	for _, hostname := range hosts {
+		go func(hostname string) {
+			op := &Operation{
+				ID:        NewRequestID(),
+				RequestID: requestIDFrom(ctx),
+				Namespace: namespaceFrom(ctx),
+				Host:      hostname,
+				Type:      operation,
+				Platform:  p.platform,
+				Transport: p.transport,
+
+				Template:        p.tmpl.Name,
+				TemplateVersion: p.tmpl.Version,
+				Override:        overrideFrom(ctx),
+				Approver:        approverFrom(ctx),
+			}
+			hostLogger := logger.With("host", hostname, "operation_id", op.ID)
+			op.BackupBefore = s.backup(hostLogger, p, hostname, op, "before")
+
+			op.Started = time.Now()
+			s.pushEvent(EventPushStarted, *op)
+			rec := newTranscript(s.redactor, secrets...)
+			if output := pushOutputFrom(ctx); output != nil {
+				rec.output = func(entry TranscriptEntry) { output(hostname, op.ID, entry) }
+			}
+			err := p.apply(hostLogger, rec, hostname)
+			s.metrics.observePush(hostname, operation, op.Started, err)
+
+			op.Finished = time.Now()
+			op.Success = err == nil
 			if err != nil {
-				log.Fatal(err)
+				op.Error = err.Error()
+				op.ErrorClass = classifyError(err)
 			}
-			cmd_output += string(stdoutBuf[:byteCount])
-			if !(strings.Contains(string(stdoutBuf[:byteCount]), "More")) {
-				break
+			op.Attempts = rec.connectAttempts()
+			op.Transcript = rec.snapshot()
+			// without a backup from before the change there is nothing to compare the device with
+			if op.BackupBefore != 0 {
+				op.BackupAfter = s.backup(hostLogger, p, hostname, op, "after")
 			}
-			stdinBuf.Write([]byte(" "))
+			s.operations.add(op)
+			if op.Success {
+				s.pushEvent(EventPushSucceeded, *op)
+			} else {
+				s.pushEvent(EventPushFailed, *op)
+			}
+			logger.Info("push finished", "host", hostname, "operation_id", op.ID, "duration", op.Finished.Sub(op.Started), "success", op.Success)
+			results <- op
+		}(hostname)
+	}
 
+	var operationIDs, failed []string
+	for i := 0; i < len(hosts); i++ {
+		op := <-results
+		operationIDs = append(operationIDs, op.ID)
+		if !op.Success {
+			failed = append(failed, fmt.Sprintf("%s (%s)", op.Host, op.Error))
 		}
 	}
+	if len(failed) > 0 {
+		return operationIDs, fmt.Errorf("push failed on %s", strings.Join(failed, ", "))
+	}
+	return operationIDs, nil
+}
 
-	return cmd_output
+// setOperationIDs adds the IDs of the operations performed for a request to the response headers
+func setOperationIDs(w http.ResponseWriter, operationIDs []string) {
+	for _, id := range operationIDs {
+		w.Header().Add(OperationIDHeader, id)
+	}
 }
 
 func removeEmptyStrings(s []string) []string {
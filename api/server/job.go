@@ -0,0 +1,131 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/meirizal/terraform-experiment/api/pb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxJobs is how many jobs are kept, the oldest finished jobs being dropped first
+const maxJobs = 1000
+
+// job is a batch of items applied in the background by the ApplyItems RPC. Jobs are kept by the instance
+// of a cluster that started them
+type job struct {
+	*pb.Job
+	// output is the transcripts of the pushes of the job so far
+	output []*pb.PushOutput
+	// changed is closed and replaced whenever the job changes, waking up the streams of its output
+	changed chan struct{}
+}
+
+// jobStore keeps the jobs started by the gRPC API. Its lock guards the jobs as well
+type jobStore struct {
+	sync.Mutex
+	jobs  map[string]*job
+	order []string
+}
+
+func newJobStore() *jobStore {
+	return &jobStore{jobs: map[string]*job{}}
+}
+
+// start adds a running job in namespace, dropping the oldest finished jobs over maxJobs
+func (s *jobStore) start(namespace string) *job {
+	s.Lock()
+	defer s.Unlock()
+	j := &job{
+		Job: &pb.Job{
+			Id:        NewRequestID(),
+			Namespace: namespace,
+			Status:    pb.JobStatus_JOB_STATUS_RUNNING,
+			Started:   timestamppb.Now(),
+		},
+		changed: make(chan struct{}),
+	}
+	s.jobs[j.Id] = j
+	s.order = append(s.order, j.Id)
+	for i := 0; len(s.jobs) > maxJobs && i < len(s.order); {
+		if id := s.order[i]; s.jobs[id].Finished != nil {
+			delete(s.jobs, id)
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			continue
+		}
+		i++
+	}
+	return j
+}
+
+func (s *jobStore) get(id string) (*job, bool) {
+	s.Lock()
+	defer s.Unlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+// snapshot returns a copy of j that doesn't change with it
+func (s *jobStore) snapshot(j *job) *pb.Job {
+	s.Lock()
+	defer s.Unlock()
+	return proto.Clone(j.Job).(*pb.Job)
+}
+
+// addOutput adds an entry of the transcript of a push of j as it is recorded
+func (s *jobStore) addOutput(j *job, output *pb.PushOutput) {
+	s.Lock()
+	defer s.Unlock()
+	j.output = append(j.output, output)
+	s.changed(j)
+}
+
+// hasOutput reports whether output of the operation with operationID has been added to j
+func (s *jobStore) hasOutput(j *job, operationID string) bool {
+	s.Lock()
+	defer s.Unlock()
+	for _, output := range j.output {
+		if output.OperationId == operationID {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds the result of an item of j and the output of its pushes that wasn't added as it was recorded
+func (s *jobStore) record(j *job, result *pb.JobResult, output []*pb.PushOutput) {
+	s.Lock()
+	defer s.Unlock()
+	j.Results = append(j.Results, result)
+	j.output = append(j.output, output...)
+	s.changed(j)
+}
+
+// finish ends j, which failed if any of its items couldn't be applied or queued, or any of their pushes
+// failed
+func (s *jobStore) finish(j *job) {
+	s.Lock()
+	defer s.Unlock()
+	j.Status = pb.JobStatus_JOB_STATUS_SUCCEEDED
+	for _, result := range j.Results {
+		if result.Response == nil || result.Code != "" {
+			j.Status = pb.JobStatus_JOB_STATUS_FAILED
+		}
+	}
+	j.Finished = timestamppb.Now()
+	s.changed(j)
+}
+
+// changed wakes up the streams of the output of j. Expects the lock to be held
+func (s *jobStore) changed(j *job) {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// outputSince returns the output of j after the first sent entries, the channel closed when j next changes
+// and whether j has finished, in which case there is no more output
+func (s *jobStore) outputSince(j *job, sent int) ([]*pb.PushOutput, chan struct{}, bool) {
+	s.Lock()
+	defer s.Unlock()
+	return j.output[sent:], j.changed, j.Finished != nil
+}
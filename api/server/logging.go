@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// RequestIDHeader is the header used to carry a request ID between the client and the server. The server
+// takes the ID from the request if a valid one is sent, otherwise it generates one, and echoes it in the
+// response
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the length of the longest request ID taken from a request
+const maxRequestIDLength = 128
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+	overrideKey
+	approverKey
+	namespaceKey
+	pushOutputKey
+)
+
+// newLogger returns the JSON logger the server writes to stdout
+func newLogger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(os.Stdout, nil))
+}
+
+// NewRequestID returns a random 16 byte hex encoded request ID
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether id can be taken from a request: 1 to maxRequestIDLength letters, digits
+// and the characters . _ : -, so that it can't forge log lines or blow up the size of what records it
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// loggerFrom returns the request scoped logger stored in ctx, falling back to the default logger when
+// ctx did not come through logs()
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// requestIDFrom returns the request ID stored in ctx, or an empty string if there is none
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// logs assigns the request an ID, generating one unless the request has a valid one, returns it in the
+// X-Request-ID response header and stores a logger tagged with it in the request context, then logs the
+// method, path, status and duration of the request
+func (s *Service) logs(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		logger := s.logger.With("request_id", requestID)
+		ctx := context.WithValue(r.Context(), loggerKey, logger)
+		ctx = context.WithValue(ctx, requestIDKey, requestID)
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handlerFunc(sw, r.WithContext(ctx))
+		logger.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"duration", time.Since(start),
+		)
+	}
+}
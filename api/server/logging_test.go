@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	s := newTestService()
+	for _, tt := range []struct {
+		name, sent string
+		echoed     bool
+	}{
+		{"missing", "", false},
+		{"valid", "provider-run:42.a_b", true},
+		{"longest", strings.Repeat("a", maxRequestIDLength), true},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"log injection", "abc\n{\"level\":\"ERROR\"}", false},
+		{"whitespace", "abc def", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.sent != "" {
+				header.Set(RequestIDHeader, tt.sent)
+			}
+			got := serveWithHeader(s, http.MethodGet, "/item", nil, header).Header().Get(RequestIDHeader)
+			if tt.echoed && got != tt.sent {
+				t.Errorf("got request ID %q, want it echoed as %q", got, tt.sent)
+			}
+			if !tt.echoed && (got == tt.sent || len(got) != 32 || !validRequestID(got)) {
+				t.Errorf("expected a generated request ID, got %q", got)
+			}
+		})
+	}
+}
+
+func TestRequestIDOfOperation(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService()
+	header := http.Header{}
+	header.Set(RequestIDHeader, "provider-run-42")
+	rec := serveWithHeader(s, http.MethodPost, "/item", savedItem(d.addr), header)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	s.operations.RLock()
+	defer s.operations.RUnlock()
+	op, ok := s.operations.operations[rec.Header().Get(OperationIDHeader)]
+	if !ok || op.RequestID != "provider-run-42" {
+		t.Errorf("expected the operation to carry the request ID, got %+v", op)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors exposed on /metrics. Each Service gets its own registry so that
+// several services can live in one process (e.g. in tests) without colliding on registration
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	pushDuration    *prometheus.HistogramVec
+	pushFailures    *prometheus.CounterVec
+	sshFailures     *prometheus.CounterVec
+	sshRetries      *prometheus.CounterVec
+	sshSessions     prometheus.Gauge
+	items           prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "iosxe_api_http_requests_total",
+			Help: "Number of HTTP requests handled, by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "iosxe_api_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests, by route, method and status code.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, []string{"route", "method", "status"}),
+		pushDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "iosxe_device_push_duration_seconds",
+			Help:    "Time taken to push configuration to a device, by host and operation.",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+		}, []string{"host", "operation"}),
+		pushFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "iosxe_device_push_failures_total",
+			Help: "Number of configuration pushes that failed, by host and operation.",
+		}, []string{"host", "operation"}),
+		sshFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "iosxe_ssh_failures_total",
+			Help: "Number of SSH connection failures, by host and reason (refused, timeout, closed, auth, dial, session).",
+		}, []string{"host", "reason"}),
+		sshRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "iosxe_ssh_retries_total",
+			Help: "Number of SSH connections retried after a transient failure, by host and reason (refused, timeout, closed).",
+		}, []string{"host", "reason"}),
+		sshSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "iosxe_ssh_active_sessions",
+			Help: "Number of SSH sessions currently open to devices.",
+		}),
+		items: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "iosxe_store_items",
+			Help: "Number of items held in the store.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.pushDuration,
+		m.pushFailures,
+		m.sshFailures,
+		m.sshRetries,
+		m.sshSessions,
+		m.items,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// handler serves the collected metrics in the Prometheus exposition format
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrument records the count and latency of requests handled by handlerFunc. The route label is the
+// path template of the matched route rather than the raw path, so item names do not blow up cardinality
+func (m *metrics) instrument(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handlerFunc(sw, r)
+
+		route := routeTemplate(r)
+		status := strconv.Itoa(sw.status)
+		m.requests.WithLabelValues(route, r.Method, status).Inc()
+		m.requestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observePush records how long a push to host took and whether it failed
+func (m *metrics) observePush(host, operation string, start time.Time, err error) {
+	m.pushDuration.WithLabelValues(host, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.pushFailures.WithLabelValues(host, operation).Inc()
+	}
+}
+
+// sshFailure counts a failed SSH dial by its class, counting failures that can't be classified as dial
+func (m *metrics) sshFailure(host string, err error) {
+	reason := classifyError(err)
+	if reason == ErrorOther {
+		reason = "dial"
+	}
+	m.sshFailures.WithLabelValues(host, reason).Inc()
+}
+
+// statusWriter remembers the status code written by a handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the wrapped writer, so that http.ResponseController can flush streamed responses
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// scrape returns the metrics the service exposes in the Prometheus exposition format
+func scrape(t *testing.T, s *Service) string {
+	t.Helper()
+	rec := serve(s, http.MethodGet, "/metrics", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+func TestInstrumentLabels(t *testing.T) {
+	s := newTestService()
+	serve(s, http.MethodGet, "/item/missing", nil)
+	serve(s, http.MethodGet, "/item/other", nil)
+	serve(s, http.MethodGet, "/namespace/team-a/item/missing", nil)
+	serve(s, http.MethodGet, "/item", nil)
+
+	for _, tt := range []struct {
+		route, status string
+		want          float64
+	}{
+		{"/item/{name}", "404", 2},
+		{"/namespace/{namespace}/item/{name}", "404", 1},
+		{"/item", "200", 1},
+	} {
+		if got := testutil.ToFloat64(s.metrics.requests.WithLabelValues(tt.route, http.MethodGet, tt.status)); got != tt.want {
+			t.Errorf("%s %s: got %v requests, want %v", tt.route, tt.status, got, tt.want)
+		}
+	}
+	// the raw paths of items must not become routes
+	if metrics := scrape(t, s); strings.Contains(metrics, `route="/item/missing"`) {
+		t.Errorf("expected route labels to be path templates, got\n%s", metrics)
+	}
+}
+
+func TestObservePush(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	d.errors["mtu 1500"] = "% Invalid input detected at '^' marker."
+	s := newTestService(WithSSHRetry(1, 0, 0))
+
+	item := savedItem(d.addr)
+	if rec := serve(s, http.MethodPost, "/item", item); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	item.Mtu = 1500
+	serve(s, http.MethodPut, "/item/"+item.Host, item)
+
+	metrics := scrape(t, s)
+	for _, want := range []string{
+		fmt.Sprintf(`iosxe_device_push_duration_seconds_count{host=%q,operation="create"} 1`, d.addr),
+		fmt.Sprintf(`iosxe_device_push_duration_seconds_count{host=%q,operation="update"} 1`, d.addr),
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("expected %s in\n%s", want, metrics)
+		}
+	}
+	if got := testutil.ToFloat64(s.metrics.pushFailures.WithLabelValues(d.addr, "create")); got != 0 {
+		t.Errorf("got %v create failures, want 0", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.pushFailures.WithLabelValues(d.addr, "update")); got != 1 {
+		t.Errorf("got %v update failures, want 1", got)
+	}
+
+	m := newMetrics()
+	m.observePush("router", "delete", time.Now(), errors.New("unsupported platform"))
+	if got := testutil.ToFloat64(m.pushFailures.WithLabelValues("router", "delete")); got != 1 {
+		t.Errorf("got %v delete failures, want 1", got)
+	}
+}
+
+func TestSSHFailureReasons(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+	s := newTestService(WithSSHRetry(1, 0, 0))
+
+	wrongPassword := savedItem(d.addr)
+	wrongPassword.Password = "wrong"
+	if op := pushedOperation(t, s, wrongPassword); op.ErrorClass != ErrorAuth {
+		t.Errorf("expected the rejected password to fail with %s, got %+v", ErrorAuth, op)
+	}
+	pushedOperation(t, s, savedItem(closed))
+	s.metrics.sshFailure("router", errors.New("unsupported platform"))
+
+	for _, tt := range []struct{ host, reason string }{
+		{d.addr, "auth"},
+		{closed, "refused"},
+		{"router", "dial"},
+	} {
+		if got := testutil.ToFloat64(s.metrics.sshFailures.WithLabelValues(tt.host, tt.reason)); got != 1 {
+			t.Errorf("%s: got %v %s failures, want 1", tt.host, got, tt.reason)
+		}
+	}
+}
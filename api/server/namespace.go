@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+// DefaultNamespace is the namespace of items created without one, and of requests to the routes without a
+// namespace when the server has no tokens
+const DefaultNamespace = "default"
+
+// namespaceName is what a namespace is called, so that it can be used in a route
+var namespaceName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// ValidateNamespace returns an error if namespace can't be used as a namespace
+func ValidateNamespace(namespace string) error {
+	if !namespaceName.MatchString(namespace) {
+		return fmt.Errorf("namespace %q must be up to 63 lowercase letters, digits or '-'", namespace)
+	}
+	return nil
+}
+
+// auth checks that a non-empty authorization header has been sent with the request and resolves the
+// namespace of the request. When the server has tokens the header must be one of them, and the request is
+// in the token's namespace: a route naming another namespace is forbidden. Otherwise the request is in the
+// namespace of its route, or the default namespace
+func (s *Service) auth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace, status, err := s.tokenNamespace(r.Header.Get("Authorization"), mux.Vars(r)["namespace"])
+		if err != nil {
+			writeError(w, status, err)
+			return
+		}
+		handlerFunc(w, r.WithContext(withNamespace(r.Context(), namespace)))
+	}
+}
+
+// tokenNamespace resolves the namespace of a request made with token to namespace, which is empty for the
+// routes without a namespace, as auth does. If the request isn't allowed it returns the status and error
+// to refuse it with
+func (s *Service) tokenNamespace(token, namespace string) (string, int, *Error) {
+	if token == "" {
+		return "", http.StatusUnauthorized, &Error{Code: CodeUnauthorized, Message: "Please supply and Authorization token"}
+	}
+	if namespace != "" {
+		if err := ValidateNamespace(namespace); err != nil {
+			return "", http.StatusBadRequest, &Error{Code: CodeInvalidRequest, Message: err.Error(), Field: "namespace"}
+		}
+	}
+	if s.tokens != nil {
+		tokenNamespace, ok := s.tokens[token]
+		if !ok {
+			return "", http.StatusUnauthorized, &Error{Code: CodeUnauthorized, Message: "Authorization token is not valid"}
+		}
+		if namespace != "" && namespace != tokenNamespace {
+			return "", http.StatusForbidden, &Error{Code: CodeForbidden, Message: fmt.Sprintf("token does not belong to namespace %s", namespace)}
+		}
+		namespace = tokenNamespace
+	}
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return namespace, 0, nil
+}
+
+// withNamespace returns a copy of ctx in namespace
+func withNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey, namespace)
+}
+
+// namespaceFrom returns the namespace stored in ctx, or the default namespace if there is none
+func namespaceFrom(ctx context.Context) string {
+	if namespace, ok := ctx.Value(namespaceKey).(string); ok {
+		return namespace
+	}
+	return DefaultNamespace
+}
+
+// namespacedItem returns the item called name if it is in the namespace of ctx. Does not lock access to the
+// itemService, expects this to be done by the calling method
+func (s *Service) namespacedItem(ctx context.Context, name string) (Item, bool) {
+	item, ok := s.items[name]
+	if !ok || item.Namespace != namespaceFrom(ctx) {
+		return Item{}, false
+	}
+	return item, true
+}
+
+// itemInNamespace sends a 422 if item is in another namespace than the one of r, reporting whether it is in
+// the namespace of r
+func itemInNamespace(w http.ResponseWriter, r *http.Request, item Item) bool {
+	namespace := namespaceFrom(r.Context())
+	if item.Namespace == namespace {
+		return true
+	}
+	writeError(w, http.StatusUnprocessableEntity, &Error{
+		Code:    CodeValidationFailed,
+		Message: "item is invalid",
+		Errors:  []*Error{{Code: CodeInvalidField, Message: "must be the namespace of the request, " + namespace, Field: "namespace"}},
+	})
+	return false
+}
+
+// deviceNamespace returns the namespace of the items on host, and false if there are none. A device
+// belongs to the namespace its first item was created in until every item on it is deleted. Does not lock
+// access to the itemService, expects this to be done by the calling method
+func (s *Service) deviceNamespace(host string) (string, bool) {
+	item, ok := s.itemOnHost(host)
+	return item.Namespace, ok
+}
+
+// deviceTaken sends a 403 if host belongs to another namespace than the one of r, reporting whether it did.
+// Does not lock access to the itemService, expects this to be done by the calling method
+func (s *Service) deviceTaken(w http.ResponseWriter, r *http.Request, host string) bool {
+	namespace, ok := s.deviceNamespace(host)
+	if !ok || namespace == namespaceFrom(r.Context()) {
+		return false
+	}
+	httpError(w, fmt.Sprintf("device %s belongs to another namespace", host), http.StatusForbidden, CodeForbidden)
+	return true
+}
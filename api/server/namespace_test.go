@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNamespaceIsolation(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService()
+	item := savedItem(d.addr)
+
+	rec := serve(s, http.MethodPost, "/namespace/team-a/item", item)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"namespace":"team-a"`) {
+		t.Fatalf("expected the item to be created in the namespace of the route, got %d %s", rec.Code, rec.Body)
+	}
+	operationID := rec.Header().Get(OperationIDHeader)
+
+	var items map[string]Item
+	json.Unmarshal(serve(s, http.MethodGet, "/namespace/team-a/item", nil).Body.Bytes(), &items)
+	if len(items) != 1 {
+		t.Errorf("expected the item to be listed in its namespace, got %v", items)
+	}
+	for _, path := range []string{"/item", "/namespace/team-b/item"} {
+		items = nil
+		json.Unmarshal(serve(s, http.MethodGet, path, nil).Body.Bytes(), &items)
+		if len(items) != 0 {
+			t.Errorf("%s: expected the item not to be listed in another namespace, got %v", path, items)
+		}
+	}
+
+	tests := []struct {
+		method, path string
+		body         interface{}
+		status       int
+	}{
+		{http.MethodGet, "/namespace/team-b/item/" + d.addr, nil, http.StatusNotFound},
+		{http.MethodGet, "/item/" + d.addr, nil, http.StatusNotFound},
+		{http.MethodPost, "/namespace/team-b/item", savedItem(d.addr), http.StatusForbidden},
+		{http.MethodPut, "/namespace/team-b/item/" + d.addr, savedItem(d.addr), http.StatusBadRequest},
+		{http.MethodDelete, "/namespace/team-b/item/" + d.addr, savedItem(d.addr), http.StatusNotFound},
+		{http.MethodPost, "/namespace/team-b/device/" + d.addr + "/save", nil, http.StatusNotFound},
+		{http.MethodGet, "/namespace/team-b/operation/" + operationID, nil, http.StatusNotFound},
+		{http.MethodGet, "/namespace/team-a/operation/" + operationID, nil, http.StatusOK},
+		{http.MethodGet, "/namespace/Team_A/item", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := serve(s, tt.method, tt.path, tt.body); rec.Code != tt.status {
+			t.Errorf("%s %s: got %d %s, want %d", tt.method, tt.path, rec.Code, rec.Body, tt.status)
+		}
+	}
+
+	var ops []Operation
+	json.Unmarshal(serve(s, http.MethodGet, "/namespace/team-b/operation", nil).Body.Bytes(), &ops)
+	if len(ops) != 0 {
+		t.Errorf("expected no operations in another namespace, got %d", len(ops))
+	}
+}
+
+func TestNamespaceInBody(t *testing.T) {
+	s := newTestService()
+	item := savedItem("127.0.0.1:1")
+	item.Namespace = "team-b"
+
+	rec := serve(s, http.MethodPost, "/namespace/team-a/item", item)
+	var e Error
+	json.Unmarshal(rec.Body.Bytes(), &e)
+	if rec.Code != http.StatusUnprocessableEntity || len(e.Errors) != 1 || e.Errors[0].Field != "namespace" {
+		t.Errorf("expected an item in another namespace than the route to be rejected, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestTokenNamespaces(t *testing.T) {
+	s := newTestService(WithTokens(map[string]string{"a-token": "team-a", "b-token": "team-b"}))
+	item := savedItem("127.0.0.1:1")
+
+	if rec := serveWithHeader(s, http.MethodGet, "/item", nil, as("unknown")); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unknown token to be rejected, got %d %s", rec.Code, rec.Body)
+	}
+	rec := serveWithHeader(s, http.MethodGet, "/namespace/team-a/item", nil, as("b-token"))
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), CodeForbidden) {
+		t.Errorf("expected a token to be denied another namespace, got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = serveWithHeader(s, http.MethodPost, "/item", item, as("a-token"))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"namespace":"team-a"`) {
+		t.Fatalf("expected the item to be created in the token's namespace, got %d %s", rec.Code, rec.Body)
+	}
+	var items map[string]Item
+	json.Unmarshal(serveWithHeader(s, http.MethodGet, "/namespace/team-a/item", nil, as("a-token")).Body.Bytes(), &items)
+	if len(items) != 1 {
+		t.Errorf("expected the item to be listed under its namespace, got %v", items)
+	}
+	items = nil
+	json.Unmarshal(serveWithHeader(s, http.MethodGet, "/item", nil, as("b-token")).Body.Bytes(), &items)
+	if len(items) != 0 {
+		t.Errorf("expected another namespace's token not to see the item, got %v", items)
+	}
+	if rec := serveWithHeader(s, http.MethodPut, "/item/"+item.Host, item, as("b-token")); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected another namespace's token not to overwrite the item, got %d %s", rec.Code, rec.Body)
+	}
+}
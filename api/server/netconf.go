@@ -0,0 +1,452 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// NETCONF namespaces and the capabilities the client uses
+const (
+	netconfNamespace = "urn:ietf:params:xml:ns:netconf:base:1.0"
+	// ciscoIANamespace is the Cisco model holding the save-config RPC
+	ciscoIANamespace = "http://cisco.com/yang/cisco-ia"
+
+	capabilityBase10     = "urn:ietf:params:netconf:base:1.0"
+	capabilityBase11     = "urn:ietf:params:netconf:base:1.1"
+	capabilityCandidate  = "urn:ietf:params:netconf:capability:candidate:1.0"
+	capabilityValidate10 = "urn:ietf:params:netconf:capability:validate:1.0"
+	capabilityValidate11 = "urn:ietf:params:netconf:capability:validate:1.1"
+	capabilityRollback   = "urn:ietf:params:netconf:capability:rollback-on-error:1.0"
+)
+
+const (
+	// netconfSubsystem is the SSH subsystem NETCONF runs on
+	netconfSubsystem = "netconf"
+	// endOfMessage ends every message with the NETCONF 1.0 framing
+	endOfMessage = "]]>]]>"
+	// rpcTimeout is how long to wait for the reply to an RPC. Validating and committing a candidate can
+	// take a while on a loaded device
+	rpcTimeout = 2 * time.Minute
+	// closeTimeout is how long to wait for the reply to close-session before closing the connection anyway
+	closeTimeout = 5 * time.Second
+)
+
+// netconfSession is a NETCONF session over SSH. Messages are framed with the end of message marker until
+// both sides have said they support NETCONF 1.1, and with chunked framing after that
+type netconfSession struct {
+	logger       *slog.Logger
+	rec          *transcript
+	conn         *ssh.Client
+	session      *ssh.Session
+	stdin        io.Writer
+	stdout       *bufio.Reader
+	chunked      bool
+	capabilities []string
+	sessionID    string
+	messageID    int
+	// open is set once hellos have been exchanged and RPCs can be sent
+	open bool
+	// broken is set once a read has failed or timed out, leaving a reader on the closed session and no
+	// way to tell where the next message starts
+	broken bool
+	closed func()
+}
+
+type netconfHello struct {
+	XMLName      xml.Name `xml:"urn:ietf:params:xml:ns:netconf:base:1.0 hello"`
+	Capabilities []string `xml:"capabilities>capability"`
+	SessionID    string   `xml:"session-id,omitempty"`
+}
+
+// rpcReply is the reply to an RPC. Data is only set for RPCs that return data such as get-config
+type rpcReply struct {
+	XMLName   xml.Name    `xml:"rpc-reply"`
+	MessageID string      `xml:"message-id,attr"`
+	OK        *struct{}   `xml:"ok"`
+	Errors    []*RPCError `xml:"rpc-error"`
+	Data      *struct {
+		Inner []byte `xml:",innerxml"`
+	} `xml:"data"`
+}
+
+// RPCError is an error reported by a NETCONF server in an rpc-reply, or by a RESTCONF server in an error
+// response
+type RPCError struct {
+	Type     string `xml:"error-type" json:"error-type"`
+	Tag      string `xml:"error-tag" json:"error-tag"`
+	Severity string `xml:"error-severity" json:"error-severity"`
+	Path     string `xml:"error-path" json:"error-path"`
+	Message  string `xml:"error-message" json:"error-message"`
+}
+
+func (e *RPCError) Error() string {
+	msg := strings.TrimSpace(e.Message)
+	if msg == "" {
+		msg = e.Tag
+	}
+	if path := strings.TrimSpace(e.Path); path != "" {
+		return fmt.Sprintf("%s %s: %s", e.Type, path, msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Type, msg)
+}
+
+// err returns the errors in the reply, ignoring warnings, or nil if the RPC succeeded
+func (r *rpcReply) err() error {
+	var errs []error
+	for _, e := range r.Errors {
+		if e.Severity != "warning" {
+			errs = append(errs, e)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dialNETCONF opens a NETCONF session on hostname and exchanges hellos. The caller must close the session
+func (s *Service) dialNETCONF(logger *slog.Logger, rec *transcript, hostname string, config *ssh.ClientConfig) (*netconfSession, error) {
+	conn, session, err := s.dialSSH(logger, rec, hostname, config)
+	if err != nil {
+		return nil, err
+	}
+	n := &netconfSession{
+		logger:  logger,
+		rec:     rec,
+		conn:    conn,
+		session: session,
+		closed:  s.metrics.sshSessions.Dec,
+	}
+	if err := n.start(); err != nil {
+		n.close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// start requests the NETCONF subsystem and exchanges hellos with the server
+func (n *netconfSession) start() error {
+	stdout, err := n.session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("request for stdout pipe failed: %s", err)
+	}
+	n.stdout = bufio.NewReader(stdout)
+	n.stdin, err = n.session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("request for stdin pipe failed: %s", err)
+	}
+	if err := n.session.RequestSubsystem(netconfSubsystem); err != nil {
+		return fmt.Errorf("request for netconf subsystem failed: %s", err)
+	}
+
+	hello, err := xml.Marshal(netconfHello{Capabilities: []string{capabilityBase10, capabilityBase11}})
+	if err != nil {
+		return err
+	}
+	if err := n.write(hello); err != nil {
+		return err
+	}
+	msg, err := n.readTimeout(rpcTimeout)
+	if err != nil {
+		return fmt.Errorf("waiting for hello: %w", err)
+	}
+	var server netconfHello
+	if err := xml.Unmarshal(msg, &server); err != nil {
+		return fmt.Errorf("invalid hello: %w", err)
+	}
+	n.capabilities = server.Capabilities
+	n.sessionID = server.SessionID
+	n.chunked = n.hasCapability(capabilityBase11)
+	n.open = true
+	n.logger.Debug("netconf session opened", "session_id", n.sessionID, "chunked", n.chunked)
+	return nil
+}
+
+// hasCapability reports whether the server advertised capability, ignoring any parameters
+func (n *netconfSession) hasCapability(capability string) bool {
+	for _, c := range n.capabilities {
+		c, _, _ = strings.Cut(strings.TrimSpace(c), "?")
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// write sends a message with the framing in use
+func (n *netconfSession) write(msg []byte) error {
+	n.rec.sent(string(msg))
+	var buf bytes.Buffer
+	if n.chunked {
+		fmt.Fprintf(&buf, "\n#%d\n", len(msg))
+		buf.Write(msg)
+		buf.WriteString("\n##\n")
+	} else {
+		buf.Write(msg)
+		buf.WriteString(endOfMessage)
+	}
+	_, err := n.stdin.Write(buf.Bytes())
+	return err
+}
+
+// readTimeout reads the next message, closing the session and marking it broken if none arrives within
+// timeout as the SSH session can't otherwise be interrupted
+func (n *netconfSession) readTimeout(timeout time.Duration) ([]byte, error) {
+	type result struct {
+		msg []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		msg, err := n.read()
+		done <- result{msg, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			n.broken = true
+			return nil, r.err
+		}
+		n.rec.received(string(r.msg))
+		return r.msg, nil
+	case <-time.After(timeout):
+		// the reader is left blocked until closing the session ends it
+		n.broken = true
+		n.session.Close()
+		return nil, fmt.Errorf("timed out after %s waiting for a reply", timeout)
+	}
+}
+
+// read reads the next message with the framing in use
+func (n *netconfSession) read() ([]byte, error) {
+	if !n.chunked {
+		var msg []byte
+		for {
+			line, err := n.stdout.ReadBytes('>')
+			msg = append(msg, line...)
+			if bytes.HasSuffix(msg, []byte(endOfMessage)) {
+				return bytes.TrimSpace(msg[:len(msg)-len(endOfMessage)]), nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var msg []byte
+	for {
+		// every chunk starts with "\n#<size>\n" and the message ends with "\n##\n"
+		if _, err := n.stdout.Discard(len("\n#")); err != nil {
+			return nil, err
+		}
+		header, err := n.stdout.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		header = strings.TrimSuffix(header, "\n")
+		if header == "#" {
+			return msg, nil
+		}
+		size, err := strconv.Atoi(header)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid chunk header %q", header)
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(n.stdout, chunk); err != nil {
+			return nil, err
+		}
+		msg = append(msg, chunk...)
+	}
+}
+
+// rpc sends operation, the XML of a single RPC operation, and returns the reply. An rpc-error in the
+// reply is returned as the error
+func (n *netconfSession) rpc(operation string) (*rpcReply, error) {
+	return n.rpcTimeout(operation, rpcTimeout)
+}
+
+// rpcTimeout is rpc waiting at most timeout for the reply
+func (n *netconfSession) rpcTimeout(operation string, timeout time.Duration) (*rpcReply, error) {
+	if n.broken {
+		return nil, errors.New("session is broken by an earlier failed read")
+	}
+	n.messageID++
+	id := strconv.Itoa(n.messageID)
+	msg := fmt.Sprintf(`<rpc xmlns="%s" message-id="%s">%s</rpc>`, netconfNamespace, id, operation)
+	n.logger.Debug("sending rpc", "message_id", id)
+	if err := n.write([]byte(msg)); err != nil {
+		return nil, err
+	}
+	data, err := n.readTimeout(timeout)
+	if err != nil {
+		return nil, err
+	}
+	reply := &rpcReply{}
+	if err := xml.Unmarshal(data, reply); err != nil {
+		return nil, fmt.Errorf("invalid rpc-reply: %w", err)
+	}
+	if reply.MessageID != id {
+		return nil, fmt.Errorf("got a reply to message %s, want %s", reply.MessageID, id)
+	}
+	return reply, reply.err()
+}
+
+// The NETCONF operations used to configure a device
+func (n *netconfSession) lock(target string) error {
+	_, err := n.rpc(fmt.Sprintf("<lock><target><%s/></target></lock>", target))
+	return wrapRPC("lock "+target, err)
+}
+
+func (n *netconfSession) unlock(target string) error {
+	_, err := n.rpc(fmt.Sprintf("<unlock><target><%s/></target></unlock>", target))
+	return wrapRPC("unlock "+target, err)
+}
+
+func (n *netconfSession) editConfig(target string, config []byte) error {
+	errorOption := ""
+	if n.hasCapability(capabilityRollback) {
+		errorOption = "<error-option>rollback-on-error</error-option>"
+	}
+	_, err := n.rpc(fmt.Sprintf("<edit-config><target><%s/></target>%s%s</edit-config>", target, errorOption, config))
+	return wrapRPC("edit-config", err)
+}
+
+func (n *netconfSession) validate(source string) error {
+	_, err := n.rpc(fmt.Sprintf("<validate><source><%s/></source></validate>", source))
+	return wrapRPC("validate", err)
+}
+
+func (n *netconfSession) commit() error {
+	_, err := n.rpc("<commit/>")
+	return wrapRPC("commit", err)
+}
+
+func (n *netconfSession) discardChanges() error {
+	_, err := n.rpc("<discard-changes/>")
+	return wrapRPC("discard-changes", err)
+}
+
+// getConfig returns the configuration in source matching the subtree filter, or all of it if filter is nil
+func (n *netconfSession) getConfig(source string, filter []byte) ([]byte, error) {
+	subtree := ""
+	if filter != nil {
+		subtree = fmt.Sprintf(`<filter type="subtree">%s</filter>`, filter)
+	}
+	reply, err := n.rpc(fmt.Sprintf(`<get-config><source><%s/></source>%s</get-config>`, source, subtree))
+	if err != nil {
+		return nil, wrapRPC("get-config", err)
+	}
+	if reply.Data == nil {
+		return nil, nil
+	}
+	return bytes.TrimSpace(reply.Data.Inner), nil
+}
+
+// saveConfig copies the running configuration to the startup configuration with the Cisco save-config
+// RPC, as IOS-XE has no startup datastore
+func (n *netconfSession) saveConfig() error {
+	_, err := n.rpc(fmt.Sprintf(`<save-config xmlns="%s"/>`, ciscoIANamespace))
+	return wrapRPC("save-config", err)
+}
+
+func wrapRPC(operation string, err error) error {
+	if err != nil {
+		return fmt.Errorf("%s: %w", operation, err)
+	}
+	return nil
+}
+
+// close ends the session politely before closing the connection, unless it is broken and can't carry the
+// close-session RPC
+func (n *netconfSession) close() {
+	if n.open && !n.broken {
+		if _, err := n.rpcTimeout("<close-session/>", closeTimeout); err != nil {
+			n.logger.Debug("close-session failed", "error", err)
+		}
+	}
+	n.session.Close()
+	n.conn.Close()
+	n.closed()
+}
+
+// applyNETCONF applies config to hostname over NETCONF. When the device has a candidate datastore the
+// change is made there, validated and committed while both datastores are locked, and discarded if any
+// step fails. Otherwise the running datastore is edited directly while it is locked
+func (s *Service) applyNETCONF(logger *slog.Logger, rec *transcript, hostname string, config []byte, sshConfig *ssh.ClientConfig) error {
+	n, err := s.dialNETCONF(logger, rec, hostname, sshConfig)
+	if err != nil {
+		return err
+	}
+	defer n.close()
+
+	if !n.hasCapability(capabilityCandidate) {
+		if err := n.lock("running"); err != nil {
+			return err
+		}
+		err := n.editConfig("running", config)
+		if unlockErr := n.unlock("running"); unlockErr != nil {
+			logger.Error("unable to unlock the running datastore", "error", unlockErr)
+		}
+		return err
+	}
+
+	if err := n.lock("running"); err != nil {
+		return err
+	}
+	defer func() {
+		if err := n.unlock("running"); err != nil {
+			logger.Error("unable to unlock the running datastore", "error", err)
+		}
+	}()
+	if err := n.lock("candidate"); err != nil {
+		return err
+	}
+	defer func() {
+		if err := n.unlock("candidate"); err != nil {
+			logger.Error("unable to unlock the candidate datastore", "error", err)
+		}
+	}()
+
+	err = n.editConfig("candidate", config)
+	if err == nil && (n.hasCapability(capabilityValidate10) || n.hasCapability(capabilityValidate11)) {
+		err = n.validate("candidate")
+	}
+	if err == nil {
+		err = n.commit()
+	}
+	if err != nil {
+		if discardErr := n.discardChanges(); discardErr != nil {
+			logger.Error("unable to discard the candidate changes", "error", discardErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// saveNETCONF saves the running configuration of hostname over NETCONF
+func (s *Service) saveNETCONF(logger *slog.Logger, rec *transcript, hostname string, sshConfig *ssh.ClientConfig) error {
+	n, err := s.dialNETCONF(logger, rec, hostname, sshConfig)
+	if err != nil {
+		return err
+	}
+	defer n.close()
+	return n.saveConfig()
+}
+
+// readNETCONF returns the running configuration of hostname matching the subtree filter, or all of it if
+// filter is nil
+func (s *Service) readNETCONF(logger *slog.Logger, rec *transcript, hostname string, filter []byte, sshConfig *ssh.ClientConfig) ([]byte, error) {
+	n, err := s.dialNETCONF(logger, rec, hostname, sshConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer n.close()
+	return n.getConfig("running", filter)
+}
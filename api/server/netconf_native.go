@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/xml"
+	"strconv"
+)
+
+// Namespaces of the Cisco-IOS-XE-native YANG model and the policy augmentation holding service-policy
+const (
+	nativeNamespace = "http://cisco.com/ns/yang/Cisco-IOS-XE-native"
+	policyNamespace = "http://cisco.com/ns/yang/Cisco-IOS-XE-policy"
+)
+
+// edit-config operations set on the elements of the configuration
+const (
+	operationRemove  = "remove"
+	operationReplace = "replace"
+)
+
+// nativeConfig is the config element of an edit-config, declaring the nc prefix the operation attributes
+// use
+type nativeConfig struct {
+	XMLName xml.Name `xml:"config"`
+	NC      string   `xml:"xmlns:nc,attr"`
+	Native  nativeRoot
+}
+
+type nativeRoot struct {
+	XMLName   xml.Name `xml:"http://cisco.com/ns/yang/Cisco-IOS-XE-native native"`
+	Interface struct {
+		Interface nativeInterface
+	} `xml:"interface"`
+}
+
+// nativeInterface is an interface list entry, named after the interface type, e.g. GigabitEthernet
+type nativeInterface struct {
+	XMLName       xml.Name
+	Operation     string               `xml:"nc:operation,attr,omitempty"`
+	Name          string               `xml:"name"`
+	Description   *nativeLeaf          `xml:"description"`
+	IP            *nativeIP            `xml:"ip"`
+	Mtu           *nativeLeaf          `xml:"mtu"`
+	Shutdown      *nativeLeaf          `xml:"shutdown"`
+	ServicePolicy *nativeServicePolicy `xml:"http://cisco.com/ns/yang/Cisco-IOS-XE-policy service-policy"`
+}
+
+// nativeLeaf is a leaf that is either set to Value or removed with the remove operation
+type nativeLeaf struct {
+	Operation string `xml:"nc:operation,attr,omitempty"`
+	Value     string `xml:",chardata"`
+}
+
+type nativeIP struct {
+	Address struct {
+		Operation string `xml:"nc:operation,attr,omitempty"`
+		Primary   *struct {
+			Address string `xml:"address"`
+			Mask    string `xml:"mask"`
+		} `xml:"primary"`
+	} `xml:"address"`
+}
+
+type nativeServicePolicy struct {
+	Input  *nativeLeaf `xml:"input"`
+	Output *nativeLeaf `xml:"output"`
+}
+
+// leaf returns a leaf set to value, or removing the leaf if value is empty
+func leaf(value string) *nativeLeaf {
+	if value == "" {
+		return &nativeLeaf{Operation: operationRemove}
+	}
+	return &nativeLeaf{Value: value}
+}
+
+// nativeInterfaceConfig returns the edit-config configuration setting every field of item's interface, the
+// NETCONF equivalent of the iosxe_interface_ethernet template. Fields that are not set are removed
+func nativeInterfaceConfig(item Item) ([]byte, error) {
+	intf := nativeInterface{
+		XMLName:     xml.Name{Local: item.IntfType},
+		Name:        item.Number,
+		Description: leaf(item.Description),
+		IP:          &nativeIP{},
+		Mtu:         &nativeLeaf{Operation: operationRemove},
+		Shutdown:    &nativeLeaf{Operation: operationRemove},
+		ServicePolicy: &nativeServicePolicy{
+			Input:  leaf(item.ServicePolicyInput),
+			Output: leaf(item.ServicePolicyOutput),
+		},
+	}
+	if item.Ipv4Address != "" && item.Ipv4AddressMask != "" {
+		intf.IP.Address.Primary = &struct {
+			Address string `xml:"address"`
+			Mask    string `xml:"mask"`
+		}{item.Ipv4Address, item.Ipv4AddressMask}
+	} else {
+		intf.IP.Address.Operation = operationRemove
+	}
+	if item.Mtu != 0 {
+		intf.Mtu = leaf(strconv.Itoa(item.Mtu))
+	}
+	if item.Shutdown {
+		intf.Shutdown = &nativeLeaf{}
+	}
+	return marshalNative(intf)
+}
+
+// nativeInterfaceDeleteConfig returns the edit-config configuration returning item's interface to its
+// defaults, the NETCONF equivalent of default interface
+func nativeInterfaceDeleteConfig(item Item) ([]byte, error) {
+	return marshalNative(nativeInterface{
+		XMLName:   xml.Name{Local: item.IntfType},
+		Operation: operationReplace,
+		Name:      item.Number,
+	})
+}
+
+// nativeInterfaceFilter returns the subtree filter selecting item's interface
+func nativeInterfaceFilter(item Item) ([]byte, error) {
+	root := nativeRoot{}
+	root.Interface.Interface = nativeInterface{XMLName: xml.Name{Local: item.IntfType}, Name: item.Number}
+	return xml.Marshal(root)
+}
+
+func marshalNative(intf nativeInterface) ([]byte, error) {
+	config := nativeConfig{NC: netconfNamespace}
+	config.Native.Interface.Interface = intf
+	return xml.Marshal(config)
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slices"
+)
+
+// fakeNETCONF is a NETCONF server over SSH standing in for an IOS-XE device. It keeps the configuration of
+// the last edit-config in the candidate or running datastore, answers get-config from running, fails
+// the operations named in errors and never replies to those in silent
+type fakeNETCONF struct {
+	addr         string
+	capabilities []string
+	errors       map[string]string
+	silent       map[string]bool
+
+	mu         sync.Mutex
+	operations []string
+	candidate  string
+	running    string
+}
+
+func newFakeNETCONF(t *testing.T, capabilities ...string) *fakeNETCONF {
+	t.Helper()
+	f := &fakeNETCONF{capabilities: capabilities, errors: map[string]string{}, silent: map[string]bool{}}
+	f.addr = startSSHServer(t, func(channel ssh.Channel, req *ssh.Request) bool {
+		var subsystem struct{ Name string }
+		if req.Type != "subsystem" || ssh.Unmarshal(req.Payload, &subsystem) != nil || subsystem.Name != netconfSubsystem {
+			return false
+		}
+		go f.serve(channel)
+		return true
+	})
+	return f
+}
+
+// serve runs the session, reusing the client's framing as the server side frames messages the same way
+func (f *fakeNETCONF) serve(channel ssh.Channel) {
+	defer channel.Close()
+	n := &netconfSession{stdin: channel, stdout: bufio.NewReader(channel)}
+
+	hello, _ := xml.Marshal(netconfHello{Capabilities: f.capabilities, SessionID: "42"})
+	if n.write(hello) != nil {
+		return
+	}
+	msg, err := n.read()
+	if err != nil {
+		return
+	}
+	var client netconfHello
+	if xml.Unmarshal(msg, &client) != nil {
+		return
+	}
+	n.capabilities = client.Capabilities
+	n.chunked = n.hasCapability(capabilityBase11) && slices.Contains(f.capabilities, capabilityBase11)
+
+	for {
+		msg, err := n.read()
+		if err != nil {
+			return
+		}
+		var rpc struct {
+			MessageID string `xml:"message-id,attr"`
+			Operation struct {
+				XMLName xml.Name
+				Target  struct {
+					Datastore struct {
+						XMLName xml.Name
+					} `xml:",any"`
+				} `xml:"target"`
+				Config struct {
+					Inner string `xml:",innerxml"`
+				} `xml:"config"`
+			} `xml:",any"`
+		}
+		if xml.Unmarshal(msg, &rpc) != nil {
+			return
+		}
+		op := rpc.Operation.XMLName.Local
+		if target := rpc.Operation.Target.Datastore.XMLName.Local; target != "" {
+			op += " " + target
+		}
+		reply := f.handle(op, rpc.Operation.Config.Inner)
+		if f.silent[op] {
+			continue
+		}
+		n.write([]byte(fmt.Sprintf(`<rpc-reply xmlns="%s" message-id="%s">%s</rpc-reply>`, netconfNamespace, rpc.MessageID, reply)))
+		if op == "close-session" {
+			return
+		}
+	}
+}
+
+// handle performs op and returns the content of its reply
+func (f *fakeNETCONF) handle(op, config string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.operations = append(f.operations, op)
+	if msg, ok := f.errors[op]; ok {
+		return "<rpc-error><error-type>application</error-type><error-tag>operation-failed</error-tag>" +
+			"<error-severity>error</error-severity><error-message>" + msg + "</error-message></rpc-error>"
+	}
+	switch op {
+	case "edit-config candidate":
+		f.candidate = config
+	case "edit-config running":
+		f.running = config
+	case "commit":
+		f.running = f.candidate
+	case "discard-changes":
+		f.candidate = f.running
+	case "get-config":
+		return "<data>" + f.running + "</data>"
+	}
+	return "<ok/>"
+}
+
+func (f *fakeNETCONF) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.operations...)
+}
+
+func netconfItem(addr string) Item {
+	item := deviceItem(addr)
+	item.Transport = TransportNETCONF
+	item.IntfType, item.Number, item.Description, item.Mtu = "GigabitEthernet", "1/0/1", "uplink", 9000
+	return item
+}
+
+func applyNETCONFTo(t *testing.T, f *fakeNETCONF, item Item) (*transcript, error) {
+	t.Helper()
+	config, err := nativeInterfaceConfig(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService()
+	rec := newTranscript(s.redactor)
+	return rec, s.applyNETCONF(s.logger, rec, f.addr, config, loadSshConfig(item))
+}
+
+func TestNETCONFCandidateCommit(t *testing.T) {
+	f := newFakeNETCONF(t, capabilityBase10, capabilityBase11, capabilityCandidate, capabilityValidate11)
+	rec, err := applyNETCONFTo(t, f, netconfItem(f.addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"lock running", "lock candidate", "edit-config candidate", "validate", "commit",
+		"unlock candidate", "unlock running", "close-session",
+	}
+	if got := f.received(); !slices.Equal(got, want) {
+		t.Errorf("got operations %q, want %q", got, want)
+	}
+	if !strings.Contains(f.running, "<description>uplink</description>") || !strings.Contains(f.running, "<mtu>9000</mtu>") {
+		t.Errorf("unexpected running configuration %s", f.running)
+	}
+	if entries := rec.snapshot(); len(entries) == 0 || !strings.Contains(entries[0].Data, "<hello") {
+		t.Errorf("expected the session to be recorded, got %v", entries)
+	}
+}
+
+func TestNETCONFDiscardsOnError(t *testing.T) {
+	f := newFakeNETCONF(t, capabilityBase10, capabilityBase11, capabilityCandidate, capabilityValidate11)
+	f.errors["validate"] = "mtu 9000 is out of range"
+	_, err := applyNETCONFTo(t, f, netconfItem(f.addr))
+	if err == nil || !strings.Contains(err.Error(), "mtu 9000 is out of range") {
+		t.Fatalf("expected the validate error, got %v", err)
+	}
+	got := f.received()
+	if slices.Contains(got, "commit") || !slices.Contains(got, "discard-changes") {
+		t.Errorf("expected the candidate to be discarded without a commit, got %q", got)
+	}
+	if f.running != "" {
+		t.Errorf("expected running to be untouched, got %s", f.running)
+	}
+}
+
+func TestNETCONFValidate10(t *testing.T) {
+	f := newFakeNETCONF(t, capabilityBase10, capabilityBase11, capabilityCandidate, capabilityValidate10)
+	if _, err := applyNETCONFTo(t, f, netconfItem(f.addr)); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.received(); !slices.Contains(got, "validate") {
+		t.Errorf("expected the candidate to be validated, got operations %q", got)
+	}
+}
+
+func TestNETCONFTimeoutBreaksSession(t *testing.T) {
+	f := newFakeNETCONF(t, capabilityBase10, capabilityBase11, capabilityCandidate)
+	f.silent["lock running"] = true
+	item := netconfItem(f.addr)
+	s := newTestService()
+	n, err := s.dialNETCONF(s.logger, newTranscript(s.redactor), f.addr, loadSshConfig(item))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.rpcTimeout("<lock><target><running/></target></lock>", 100*time.Millisecond); err == nil {
+		t.Fatal("expected the lock to time out")
+	}
+	if _, err := n.rpc("<unlock><target><running/></target></unlock>"); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected the broken session to refuse further RPCs, got %v", err)
+	}
+	start := time.Now()
+	n.close()
+	if elapsed := time.Since(start); elapsed >= closeTimeout {
+		t.Errorf("close waited %s for a close-session reply on a broken session", elapsed)
+	}
+	if got := f.received(); slices.Contains(got, "close-session") || slices.Contains(got, "unlock running") {
+		t.Errorf("expected nothing to be sent after the timeout, got operations %q", got)
+	}
+}
+
+func TestNETCONFRunningOnly(t *testing.T) {
+	// a NETCONF 1.0 server without a candidate datastore, which keeps the end of message framing
+	f := newFakeNETCONF(t, capabilityBase10)
+	if _, err := applyNETCONFTo(t, f, netconfItem(f.addr)); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"lock running", "edit-config running", "unlock running", "close-session"}
+	if got := f.received(); !slices.Equal(got, want) {
+		t.Errorf("got operations %q, want %q", got, want)
+	}
+}
+
+func TestNETCONFReadConfig(t *testing.T) {
+	f := newFakeNETCONF(t, capabilityBase10, capabilityBase11, capabilityCandidate)
+	item := netconfItem(f.addr)
+	if _, err := applyNETCONFTo(t, f, item); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestService()
+	config, err := s.readItemConfig(s.logger, newTranscript(s.redactor), iosxeDriver, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, `<native xmlns="`+nativeNamespace+`">`) || !strings.Contains(config, "<name>1/0/1</name>") {
+		t.Errorf("unexpected configuration %s", config)
+	}
+}
+
+func TestNativeInterfaceConfig(t *testing.T) {
+	item := validItemForTest()
+	item.Description = "R&D <uplink>"
+	item.Mtu = 0
+	config, err := nativeInterfaceConfig(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<native xmlns="` + nativeNamespace + `"><interface><GigabitEthernet><name>1/0/1</name>`,
+		`<description>R&amp;D &lt;uplink&gt;</description>`,
+		`<primary><address>192.0.2.1</address><mask>255.255.255.0</mask></primary>`,
+		`<mtu nc:operation="remove"></mtu>`,
+		`<shutdown nc:operation="remove"></shutdown>`,
+		`<service-policy xmlns="` + policyNamespace + `"><input>IN_POLICY</input><output>out-policy.v2</output>`,
+	} {
+		if !strings.Contains(string(config), want) {
+			t.Errorf("expected %s in %s", want, config)
+		}
+	}
+
+	config, err = nativeInterfaceDeleteConfig(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), `<GigabitEthernet nc:operation="replace"><name>1/0/1</name></GigabitEthernet>`) {
+		t.Errorf("expected the interface to be replaced with its defaults, got %s", config)
+	}
+}
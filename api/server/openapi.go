@@ -0,0 +1,437 @@
+package server
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// OpenAPI returns the OpenAPI 3 document describing the server routes
+func OpenAPI() []byte {
+	return openAPIDocument
+}
+
+// openAPI validates requests and responses against the schemas in the OpenAPI document. Only the parts
+// of JSON schema used by the document are supported: $ref, type, required, properties,
+// additionalProperties, items, enum, pattern, format date-time, minimum, maximum, minLength and maxLength
+type openAPI struct {
+	doc      map[string]interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+func newOpenAPI(document []byte) (*openAPI, error) {
+	o := &openAPI{patterns: map[string]*regexp.Regexp{}}
+	if err := json.Unmarshal(document, &o.doc); err != nil {
+		return nil, fmt.Errorf("unable to parse OpenAPI document: %w", err)
+	}
+	if err := o.compilePatterns(o.doc); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// compilePatterns compiles every pattern in the document up front, so that validation never compiles
+// and the patterns map is only read once requests are being served
+func (o *openAPI) compilePatterns(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if pattern, ok := v["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern in OpenAPI document: %w", err)
+			}
+			o.patterns[pattern] = re
+		}
+		for _, child := range v {
+			if err := o.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if err := o.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mustOpenAPI parses the embedded document, which is checked by the tests so can't fail at runtime
+func mustOpenAPI() *openAPI {
+	o, err := newOpenAPI(openAPIDocument)
+	if err != nil {
+		panic(err)
+	}
+	return o
+}
+
+// operation returns the operation object for a path template and method, of any version of the API, or
+// nil if the document does not describe it
+func (o *openAPI) operation(path, method string) map[string]interface{} {
+	// the document describes every version of the API, which so far have the same routes
+	_, prefix := pathVersion(path)
+	path = strings.TrimPrefix(path, prefix)
+	paths, _ := o.doc["paths"].(map[string]interface{})
+	item, _ := paths[path].(map[string]interface{})
+	op, _ := item[strings.ToLower(method)].(map[string]interface{})
+	return op
+}
+
+// operations returns "METHOD path" for every operation in the document, sorted
+func (o *openAPI) operations() []string {
+	var ops []string
+	paths, _ := o.doc["paths"].(map[string]interface{})
+	for path, item := range paths {
+		for method := range item.(map[string]interface{}) {
+			if method == "parameters" {
+				continue
+			}
+			ops = append(ops, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// requestSchema returns the JSON schema of the request body of contentType for an operation and whether a
+// body is required, or a nil schema if the operation takes no JSON body. Bodies of a media type the
+// operation doesn't describe are taken to be application/json
+func (o *openAPI) requestSchema(path, method, contentType string) (map[string]interface{}, bool) {
+	op := o.operation(path, method)
+	body, _ := o.resolve(op["requestBody"])["content"].(map[string]interface{})
+	media, found := body[strings.TrimSpace(strings.Split(contentType, ";")[0])].(map[string]interface{})
+	if !found {
+		media, _ = body["application/json"].(map[string]interface{})
+	}
+	schema, _ := media["schema"].(map[string]interface{})
+	required, _ := o.resolve(op["requestBody"])["required"].(bool)
+	return schema, required
+}
+
+// responseSchema returns the schema for a response, falling back to the default response when the status
+// is not described. ok is false if the response is not described at all
+func (o *openAPI) responseSchema(path, method string, status int, contentType string) (schema map[string]interface{}, ok bool) {
+	op := o.operation(path, method)
+	responses, _ := op["responses"].(map[string]interface{})
+	response, found := responses[strconv.Itoa(status)]
+	if !found {
+		response, found = responses["default"]
+	}
+	if !found {
+		return nil, false
+	}
+	content, _ := o.resolve(response)["content"].(map[string]interface{})
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	media, found := content[mediaType].(map[string]interface{})
+	if !found {
+		return nil, false
+	}
+	schema, _ = media["schema"].(map[string]interface{})
+	return schema, true
+}
+
+// resolve follows $ref until it reaches a concrete object
+func (o *openAPI) resolve(v interface{}) map[string]interface{} {
+	obj, _ := v.(map[string]interface{})
+	for obj != nil {
+		ref, ok := obj["$ref"].(string)
+		if !ok {
+			return obj
+		}
+		var target interface{} = o.doc
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			m, _ := target.(map[string]interface{})
+			target = m[part]
+		}
+		obj, _ = target.(map[string]interface{})
+	}
+	return obj
+}
+
+// validate checks value against schema, returning an Error naming the first offending field
+func (o *openAPI) validate(schema map[string]interface{}, value interface{}, field string) *Error {
+	schema = o.resolve(schema)
+	if schema == nil {
+		return nil
+	}
+	invalid := func(format string, args ...interface{}) *Error {
+		return &Error{Code: CodeInvalidRequest, Message: fmt.Sprintf(format, args...), Field: field}
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, option := range oneOf {
+			if option, ok := option.(map[string]interface{}); ok && o.validate(option, value, field) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return invalid("must match exactly one of %d schemas, matches %d", len(oneOf), matched)
+		}
+		return nil
+	}
+	if typ, ok := schema["type"].(string); ok && !hasType(value, typ) {
+		return invalid("must be of type %s", typ)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+			}
+		}
+		if !found {
+			return invalid("must be one of %v", enum)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := v[name.(string)]; !ok {
+				return &Error{Code: CodeInvalidRequest, Message: "is required", Field: joinField(field, name.(string))}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := joinField(field, name)
+			if propSchema, ok := properties[name].(map[string]interface{}); ok {
+				if err := o.validate(propSchema, v[name], child); err != nil {
+					return err
+				}
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return &Error{Code: CodeInvalidRequest, Message: "is not a known field", Field: child}
+				}
+			case map[string]interface{}:
+				if err := o.validate(additional, v[name], child); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := o.validate(items, item, fmt.Sprintf("%s[%d]", field, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		if min, ok := schema["minLength"].(float64); ok && float64(len(v)) < min {
+			return invalid("must be at least %v characters", min)
+		}
+		if max, ok := schema["maxLength"].(float64); ok && float64(len(v)) > max {
+			return invalid("must be at most %v characters", max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !o.patterns[pattern].MatchString(v) {
+			return invalid("must match %s", pattern)
+		}
+		if format, _ := schema["format"].(string); format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, v); err != nil {
+				return invalid("must be an RFC 3339 date-time")
+			}
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if min, ok := schema["minimum"].(float64); ok && n < min {
+			return invalid("must be at least %v", min)
+		}
+		if max, ok := schema["maximum"].(float64); ok && n > max {
+			return invalid("must be at most %v", max)
+		}
+	}
+	return nil
+}
+
+func hasType(value interface{}, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		return err == nil && f == math.Trunc(f)
+	}
+	return true
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// decodeJSON decodes body keeping numbers as json.Number so that integers can be told apart
+func decodeJSON(body []byte) (interface{}, error) {
+	var value interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// validateResponse checks a response against the document, returning an error if the response is not
+// described or its body does not match the schema
+func (o *openAPI) validateResponse(path, method string, status int, contentType string, body []byte) error {
+	schema, ok := o.responseSchema(path, method, status, contentType)
+	if !ok {
+		return fmt.Errorf("%s %s: response %d with content type %q is not described", method, path, status, contentType)
+	}
+	if schema == nil || !strings.HasPrefix(contentType, "application/json") {
+		return nil
+	}
+	value, err := decodeJSON(body)
+	if err != nil {
+		return fmt.Errorf("%s %s: response %d is not valid JSON: %w", method, path, status, err)
+	}
+	if e := o.validate(schema, value, ""); e != nil {
+		return fmt.Errorf("%s %s: response %d does not match schema: %w", method, path, status, e)
+	}
+	return nil
+}
+
+// routeTemplate returns the path template of the route matched for r
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tpl, err := current.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return r.URL.Path
+}
+
+// maxRequestBody is the length of the longest request body validateRequest reads
+const maxRequestBody = 1 << 20
+
+// validateRequest rejects request bodies that do not match the schema the document gives for the route,
+// with a 400 naming the offending field, and those longer than maxRequestBody with a 413
+func (s *Service) validateRequest(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		schema, required := s.openAPI.requestSchema(routeTemplate(r), r.Method, r.Header.Get("Content-Type"))
+		if schema == nil {
+			handlerFunc(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				httpError(w, fmt.Sprintf("request body is longer than %d bytes", maxRequestBody), http.StatusRequestEntityTooLarge, CodeRequestTooLarge)
+				return
+			}
+			if err != nil {
+				httpError(w, err.Error(), http.StatusBadRequest, CodeBadRequest)
+				return
+			}
+		}
+		if len(bytes.TrimSpace(body)) == 0 {
+			if required {
+				httpError(w, "Please send a request body", http.StatusBadRequest, CodeBadRequest)
+				return
+			}
+		} else {
+			value, err := decodeJSON(body)
+			if err != nil {
+				httpError(w, fmt.Sprintf("request body is not valid JSON: %s", err), http.StatusBadRequest, CodeBadRequest)
+				return
+			}
+			if e := s.openAPI.validate(schema, value, ""); e != nil {
+				writeError(w, http.StatusBadRequest, e)
+				return
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		handlerFunc(w, r)
+	}
+}
+
+// validateResponses logs responses that do not match the document. The response is copied as it is
+// written rather than buffered, so clients see no difference
+func (s *Service) validateResponses(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		handlerFunc(rec, r)
+		err := s.openAPI.validateResponse(routeTemplate(r), r.Method, rec.status, w.Header().Get("Content-Type"), rec.body.Bytes())
+		if err != nil {
+			loggerFrom(r.Context()).Error("response does not match OpenAPI document", "error", err)
+		}
+	}
+}
+
+// recordingWriter keeps a copy of the status and body written by a handler
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// GetOpenAPI serves the OpenAPI document
+func (s *Service) GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write(openAPIDocument)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
+	}
+}
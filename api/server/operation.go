@@ -0,0 +1,163 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OperationIDHeader is set on responses to mutating item requests with the IDs of the device operations
+// the request performed, so that their transcripts can be fetched afterwards
+const OperationIDHeader = "X-Operation-ID"
+
+// Operation records a single push of configuration to a device, including the redacted CLI session
+type Operation struct {
+	ID        string    `json:"id"`
+	RequestID string    `json:"request_id"`
+	Namespace string    `json:"namespace"`
+	Host      string    `json:"host"`
+	Type      string    `json:"type"`
+	Platform  string    `json:"platform"`
+	Transport string    `json:"transport"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	// ErrorClass is the class of Error, one of refused, timeout, closed, auth, rejected or other
+	ErrorClass string `json:"error_class,omitempty"`
+	// Attempts is the number of SSH connections made, including those retried after a transient failure,
+	// and is zero for transports that don't use SSH
+	Attempts int `json:"attempts,omitempty"`
+	// Template and TemplateVersion identify the template the pushed configuration was rendered from, and
+	// are empty for model driven transports that don't use templates
+	Template        string `json:"template,omitempty"`
+	TemplateVersion string `json:"template_version,omitempty"`
+	// BackupBefore and BackupAfter are the versions of the device's running configuration backed up
+	// around the change, and are zero when backups are disabled or failed
+	BackupBefore int `json:"backup_before,omitempty"`
+	BackupAfter  int `json:"backup_after,omitempty"`
+	// Override is the reason given for an emergency change the change calendar didn't allow
+	Override string `json:"override,omitempty"`
+	// Approver identifies the token holder who approved the change, when it needed approval
+	Approver   string            `json:"approver,omitempty"`
+	Transcript []TranscriptEntry `json:"transcript,omitempty"`
+}
+
+// The transcript retention of a Service unless WithTranscriptRetention changes it
+const (
+	DefaultTranscriptMaxOperations = 1000
+	DefaultTranscriptMaxAge        = 7 * 24 * time.Hour
+)
+
+// operationStore keeps finished operations, pruning them by count and age. It has its own lock so that
+// operations can be read while a push holds the Service lock
+type operationStore struct {
+	sync.RWMutex
+	operations    map[string]*Operation
+	maxOperations int
+	maxAge        time.Duration
+}
+
+func newOperationStore() *operationStore {
+	return &operationStore{
+		operations:    map[string]*Operation{},
+		maxOperations: DefaultTranscriptMaxOperations,
+		maxAge:        DefaultTranscriptMaxAge,
+	}
+}
+
+func (o *operationStore) add(op *Operation) {
+	o.Lock()
+	defer o.Unlock()
+	o.operations[op.ID] = op
+	o.prune(time.Now())
+}
+
+// failed returns the first of the operations with ids that failed, and false if none of them did
+func (o *operationStore) failed(ids []string) (Operation, bool) {
+	o.RLock()
+	defer o.RUnlock()
+	for _, id := range ids {
+		if op, ok := o.operations[id]; ok && !op.Success {
+			return *op, true
+		}
+	}
+	return Operation{}, false
+}
+
+// prune drops operations older than maxAge and then the oldest operations above maxOperations. Expects
+// the caller to hold the lock
+func (o *operationStore) prune(now time.Time) {
+	if o.maxAge > 0 {
+		for id, op := range o.operations {
+			if now.Sub(op.Finished) > o.maxAge {
+				delete(o.operations, id)
+			}
+		}
+	}
+	if o.maxOperations > 0 && len(o.operations) > o.maxOperations {
+		ops := o.sorted("")
+		for _, op := range ops[:len(ops)-o.maxOperations] {
+			delete(o.operations, op.ID)
+		}
+	}
+}
+
+// sorted returns the operations for host, or all operations if host is empty, oldest first. Expects the
+// caller to hold the lock
+func (o *operationStore) sorted(host string) []*Operation {
+	ops := make([]*Operation, 0, len(o.operations))
+	for _, op := range o.operations {
+		if host == "" || op.Host == host {
+			ops = append(ops, op)
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Started.Before(ops[j].Started)
+	})
+	return ops
+}
+
+// GetOperations returns the operations the server has recorded in the namespace of the request, without
+// their transcripts. The list can be filtered to a single device with the host query parameter
+func (s *Service) GetOperations(w http.ResponseWriter, r *http.Request) {
+	namespace := namespaceFrom(r.Context())
+	s.operations.RLock()
+	ops := s.operations.sorted(r.URL.Query().Get("host"))
+	summaries := make([]Operation, 0, len(ops))
+	for _, op := range ops {
+		if op.Namespace != namespace {
+			continue
+		}
+		summary := *op
+		summary.Transcript = nil
+		summaries = append(summaries, summary)
+	}
+	s.operations.RUnlock()
+
+	err := writeJSON(w, summaries)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
+	}
+}
+
+// GetOperation handles retrieving a single operation, including its transcript
+func (s *Service) GetOperation(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	s.operations.RLock()
+	op, ok := s.operations.operations[id]
+	s.operations.RUnlock()
+	if !ok || op.Namespace != namespaceFrom(r.Context()) {
+		httpError(w, "not found", http.StatusNotFound, CodeNotFound)
+		return
+	}
+
+	err := writeJSON(w, op)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"regexp"
+	"time"
+)
+
+// Option configures optional behaviour of a Service
+type Option func(*Service)
+
+// WithLogger replaces the default JSON logger writing to stdout
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Service) {
+		s.logger = logger
+	}
+}
+
+// WithTranscriptRetention limits how many operations, and for how long, session transcripts are kept.
+// A zero value for either leaves that limit disabled
+func WithTranscriptRetention(maxOperations int, maxAge time.Duration) Option {
+	return func(s *Service) {
+		s.operations.maxOperations = maxOperations
+		s.operations.maxAge = maxAge
+	}
+}
+
+// WithRedactPatterns adds patterns whose matches are redacted from session transcripts, in addition to the
+// item credentials and the default patterns. If a pattern has capture groups only the groups are redacted,
+// otherwise the whole match is
+func WithRedactPatterns(patterns ...*regexp.Regexp) Option {
+	return func(s *Service) {
+		s.redactor.patterns = append(s.redactor.patterns, patterns...)
+	}
+}
+
+// WithResponseValidation checks every response against the OpenAPI document and logs those that do not
+// match. Intended for development and tests, as it keeps a copy of every response body
+func WithResponseValidation() Option {
+	return func(s *Service) {
+		s.checkResponses = true
+	}
+}
+
+// WithTemplateDir loads templates from dir in addition to the embedded defaults, replacing any default with
+// the same name. If reload is not zero the directory is checked for changes at that interval and the
+// templates are reloaded when it changes
+func WithTemplateDir(dir string, reload time.Duration) Option {
+	return func(s *Service) {
+		s.templates.dir = dir
+		s.templateReload = reload
+	}
+}
+
+// WithRESTCONFTLS verifies the certificates of devices reached over RESTCONF with config, e.g. to trust
+// the CA that issued the device certificates, instead of the system roots
+func WithRESTCONFTLS(config *tls.Config) Option {
+	return func(s *Service) {
+		s.restconf = newRESTCONFClient(config)
+	}
+}
+
+// WithGNMITLS verifies the certificates of devices reached over gNMI with config instead of the system roots
+func WithGNMITLS(config *tls.Config) Option {
+	return func(s *Service) {
+		s.gnmiTLS = config
+	}
+}
+
+// WithSavePolicy sets when the running configuration of a device is saved after a change, one of
+// SavePolicies. With SaveIdle a device is saved once it has not been changed for idle
+func WithSavePolicy(policy string, idle time.Duration) Option {
+	return func(s *Service) {
+		s.saves.policy = policy
+		s.saves.idle = idle
+	}
+}
+
+// WithBackups captures the whole running configuration of a device before and after every change pushed to
+// it, keeping up to maxVersions versions per device. Backups are disabled if maxVersions is zero
+func WithBackups(maxVersions int) Option {
+	return func(s *Service) {
+		s.backups.maxVersions = maxVersions
+	}
+}
+
+// WithWebhooks delivers events to hooks, which are expected to have been checked with ValidateWebhook
+func WithWebhooks(hooks ...Webhook) Option {
+	return func(s *Service) {
+		s.webhooks.hooks = append(s.webhooks.hooks, hooks...)
+	}
+}
+
+// WithWebhookRetry attempts each webhook delivery up to attempts times, waiting backoff before the first
+// retry and doubling the wait for every retry after it. Deliveries failing every attempt are dead-lettered
+func WithWebhookRetry(attempts int, backoff time.Duration) Option {
+	return func(s *Service) {
+		s.webhooks.attempts = attempts
+		s.webhooks.backoff = backoff
+	}
+}
+
+// WithSSHRetry retries connecting to a device over SSH after a transient failure, the device refusing the
+// connection, not answering or closing it before the session starts, making up to attempts connections.
+// The wait before the first retry is backoff, doubled for every retry after it with half of each wait
+// random. Retrying stops once the next wait would take the time spent connecting over budget, unless it
+// is zero. Failures after the session has started are never retried, as the change may have been applied
+func WithSSHRetry(attempts int, backoff, budget time.Duration) Option {
+	return func(s *Service) {
+		s.retry = retryPolicy{attempts: attempts, backoff: backoff, budget: budget}
+	}
+}
+
+// WithRoutes reaches the devices matching a route through its SOCKS5 proxy and chain of jump hosts instead
+// of dialing them directly, for the CLI and NETCONF. The first route matching a device is used, so a route
+// without hosts should come last, as the default. Routes should be checked with ValidateRoute
+func WithRoutes(routes ...Route) Option {
+	return func(s *Service) {
+		s.routes = routes
+	}
+}
+
+// WithWindows adds maintenance windows and change freezes to the change calendar. Windows should be checked
+// with ValidateWindow
+func WithWindows(windows ...Window) Option {
+	return func(s *Service) {
+		for _, window := range windows {
+			s.calendar.add(window)
+		}
+	}
+}
+
+// WithApprovals holds the creates, updates and deletes of items on devices with one of tags as pending
+// changes, pushed only once a different token holder approves them. Token holders are told apart by the
+// tokens of WithTokens, without which those changes are refused. They are refused in a cluster too, which
+// doesn't replicate pending changes
+func WithApprovals(tags ...string) Option {
+	return func(s *Service) {
+		s.approvalTags = tags
+	}
+}
+
+// WithTokens only accepts the tokens in tokens, each in the namespace it maps to. Without tokens any
+// non-empty token is accepted, in every namespace. Namespaces should be checked with ValidateNamespace
+func WithTokens(tokens map[string]string) Option {
+	return func(s *Service) {
+		s.tokens = tokens
+	}
+}
+
+// WithCluster runs the Service as an instance of cluster, replicating the items to the other instances.
+// The windows are not replicated and can't be changed with the API, so every instance should be given the
+// same WithWindows. The cluster should be checked with ValidateCluster
+func WithCluster(cluster Cluster) Option {
+	return func(s *Service) {
+		s.cluster = newCluster(cluster)
+	}
+}
+
+// WithClusterTimeouts makes the leader of the cluster contact the other instances every heartbeat, and an
+// instance start an election when it hasn't heard from the leader for between election and twice election.
+// It must come after WithCluster
+func WithClusterTimeouts(heartbeat, election time.Duration) Option {
+	return func(s *Service) {
+		s.cluster.heartbeat = heartbeat
+		s.cluster.electionTimeout = election
+	}
+}
+
+// WithGRPC serves the gRPC API on address as well as the REST API, when the Service is started with
+// ListenAndServe. Without WithGRPCTLS the address must be a loopback address
+func WithGRPC(address string) Option {
+	return func(s *Service) {
+		s.grpcAddress = address
+	}
+}
+
+// WithGRPCTLS serves the gRPC API over TLS with config, which holds the certificate of the server
+func WithGRPCTLS(config *tls.Config) Option {
+	return func(s *Service) {
+		s.grpcTLS = config
+	}
+}
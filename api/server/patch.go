@@ -0,0 +1,363 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The media types of the patches PATCH /item/{name} accepts
+const (
+	// MergePatchType is a JSON Merge Patch (RFC 7396), an object of the fields to change where null removes
+	// a field
+	MergePatchType = "application/merge-patch+json"
+	// JSONPatchType is a JSON Patch (RFC 6902), a list of operations on the item
+	JSONPatchType = "application/json-patch+json"
+)
+
+// PatchOperation is an operation of a JSON Patch. Value is the JSON value of add, replace and test, and
+// From is where move and copy take their value from
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// patchItem applies the patch in body, of the media type contentType, to stored, returning the patched
+// item. The patched item is checked against the schema of an item, but not validated. A patch that
+// can't be applied is returned as an Error with the status to send it with
+func (o *openAPI) patchItem(stored Item, contentType string, body []byte) (Item, int, *Error) {
+	data, _ := json.Marshal(stored)
+	doc, _ := decodeJSON(data)
+	// an item without tags has an empty list of them that a JSON Patch can add to
+	if _, ok := doc.(map[string]interface{})["tags"]; !ok {
+		doc.(map[string]interface{})["tags"] = []interface{}{}
+	}
+
+	var err *Error
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case MergePatchType:
+		patch, decodeErr := decodeJSON(body)
+		if decodeErr != nil {
+			return Item{}, http.StatusBadRequest, &Error{Code: CodeBadRequest, Message: fmt.Sprintf("patch is not valid JSON: %s", decodeErr)}
+		}
+		doc = mergePatch(doc, patch)
+	case JSONPatchType:
+		var ops []PatchOperation
+		if decodeErr := json.Unmarshal(body, &ops); decodeErr != nil {
+			return Item{}, http.StatusBadRequest, &Error{Code: CodeBadRequest, Message: fmt.Sprintf("patch is not a list of operations: %s", decodeErr)}
+		}
+		for i, op := range ops {
+			if doc, err = applyPatchOperation(doc, op); err != nil {
+				err.Message = fmt.Sprintf("%s %s: %s", op.Op, op.Path, err.Message)
+				err.Field = joinField(fmt.Sprintf("[%d]", i), err.Field)
+				// an operation that isn't valid is a bad request, one that doesn't fit the item a conflict
+				if err.Code == CodeConflict {
+					return Item{}, http.StatusConflict, err
+				}
+				return Item{}, http.StatusBadRequest, err
+			}
+		}
+	default:
+		return Item{}, http.StatusUnsupportedMediaType, &Error{Code: CodeUnsupportedMediaType, Message: fmt.Sprintf("Content-Type must be %s or %s", MergePatchType, JSONPatchType)}
+	}
+
+	if err := o.validate(o.resolve(map[string]interface{}{"$ref": "#/components/schemas/Item"}), doc, ""); err != nil {
+		return Item{}, http.StatusBadRequest, err
+	}
+	var item Item
+	data, _ = json.Marshal(doc)
+	if decodeErr := json.Unmarshal(data, &item); decodeErr != nil {
+		return Item{}, http.StatusBadRequest, &Error{Code: CodeBadRequest, Message: decodeErr.Error()}
+	}
+	if len(item.Tags) == 0 {
+		item.Tags = nil
+	}
+	return item, http.StatusOK, nil
+}
+
+// mergePatch applies the JSON Merge Patch patch to doc
+func mergePatch(doc, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	target, ok := doc.(map[string]interface{})
+	if !ok {
+		target = map[string]interface{}{}
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(target, name)
+		} else {
+			target[name] = mergePatch(target[name], value)
+		}
+	}
+	return target
+}
+
+// applyPatchOperation applies op of a JSON Patch to doc, returning an Error naming the path that doesn't
+// exist or the value a test found instead
+func applyPatchOperation(doc interface{}, op PatchOperation) (interface{}, *Error) {
+	value := func() (interface{}, *Error) {
+		if op.Value == nil {
+			return nil, &Error{Code: CodeInvalidRequest, Message: "needs a value", Field: "value"}
+		}
+		v, err := decodeJSON(op.Value)
+		if err != nil {
+			return nil, &Error{Code: CodeInvalidRequest, Message: err.Error(), Field: "value"}
+		}
+		return v, nil
+	}
+
+	switch op.Op {
+	case "add", "replace":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "replace" && op.Path != "" {
+			if _, err := pointerGet(doc, op.Path); err != nil {
+				return nil, err
+			}
+			if doc, err = pointerRemove(doc, op.Path); err != nil {
+				return nil, err
+			}
+		}
+		return pointerAdd(doc, op.Path, v)
+	case "remove":
+		return pointerRemove(doc, op.Path)
+	case "move", "copy":
+		v, err := pointerGet(doc, op.From)
+		if err != nil {
+			err.Field = "from"
+			return nil, err
+		}
+		if op.Op == "move" {
+			if op.Path == op.From {
+				return doc, nil
+			}
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, &Error{Code: CodeInvalidRequest, Message: "can't move a value into itself", Field: "path"}
+			}
+			if doc, err = pointerRemove(doc, op.From); err != nil {
+				return nil, err
+			}
+		} else {
+			// the copy mustn't share arrays or objects with the original
+			data, _ := json.Marshal(v)
+			v, _ = decodeJSON(data)
+		}
+		return pointerAdd(doc, op.Path, v)
+	case "test":
+		want, err := value()
+		if err != nil {
+			return nil, err
+		}
+		got, err := pointerGet(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(got, want) {
+			got, _ := json.Marshal(got)
+			return nil, &Error{Code: CodeConflict, Message: fmt.Sprintf("failed, the value is %s", got), Field: "path"}
+		}
+		return doc, nil
+	}
+	return nil, &Error{Code: CodeInvalidRequest, Message: "must be one of add, remove, replace, move, copy or test", Field: "op"}
+}
+
+// jsonEqual reports whether a and b are the same JSON value, comparing numbers by value
+func jsonEqual(a, b interface{}) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if aok && bok {
+		af, _ := an.Float64()
+		bf, _ := bn.Float64()
+		return af == bf
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for name, v := range a {
+			if w, ok := b[name]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// splitPointer returns the reference tokens of the JSON pointer path
+func splitPointer(path string) ([]string, *Error) {
+	if path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "must be a JSON pointer starting with /", Field: "path"}
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// pointerGet returns the value at path in doc
+func pointerGet(doc interface{}, path string) (interface{}, *Error) {
+	tokens, err := splitPointer(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = v[token]; !ok {
+				return nil, &Error{Code: CodeConflict, Message: "does not exist", Field: "path"}
+			}
+		case []interface{}:
+			i, err := arrayIndex(token, len(v)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[i]
+		default:
+			return nil, &Error{Code: CodeConflict, Message: "does not exist", Field: "path"}
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd returns doc with value added at path, replacing a field of an object or inserted in an array
+func pointerAdd(doc interface{}, path string, value interface{}) (interface{}, *Error) {
+	tokens, err := splitPointer(path)
+	if err != nil {
+		return nil, err
+	}
+	return pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, *Error) {
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			v[token] = value
+			return v, nil
+		case []interface{}:
+			i := len(v)
+			if token != "-" {
+				var err *Error
+				if i, err = arrayIndex(token, len(v)); err != nil {
+					return nil, err
+				}
+			}
+			v = append(v[:i], append([]interface{}{value}, v[i:]...)...)
+			return v, nil
+		}
+		return nil, &Error{Code: CodeConflict, Message: "does not exist", Field: "path"}
+	}, value)
+}
+
+// pointerRemove returns doc without the value at path
+func pointerRemove(doc interface{}, path string) (interface{}, *Error) {
+	tokens, err := splitPointer(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "can't remove the whole item", Field: "path"}
+	}
+	return pointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, *Error) {
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := v[token]; !ok {
+				return nil, &Error{Code: CodeConflict, Message: "does not exist", Field: "path"}
+			}
+			delete(v, token)
+			return v, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(v)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(v[:i], v[i+1:]...), nil
+		}
+		return nil, &Error{Code: CodeConflict, Message: "does not exist", Field: "path"}
+	}, nil)
+}
+
+// pointerUpdate returns doc with the parent of the value at tokens replaced by what change returns for it
+// and the last token. root is what doc is replaced by if tokens is empty
+func pointerUpdate(doc interface{}, tokens []string, change func(parent interface{}, token string) (interface{}, *Error), root interface{}) (interface{}, *Error) {
+	if len(tokens) == 0 {
+		return root, nil
+	}
+	if len(tokens) == 1 {
+		return change(doc, tokens[0])
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		child, ok := v[tokens[0]]
+		if !ok {
+			return nil, &Error{Code: CodeConflict, Message: "does not exist", Field: "path"}
+		}
+		updated, err := pointerUpdate(child, tokens[1:], change, root)
+		if err != nil {
+			return nil, err
+		}
+		v[tokens[0]] = updated
+		return v, nil
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(v)-1)
+		if err != nil {
+			return nil, err
+		}
+		if v[i], err = pointerUpdate(v[i], tokens[1:], change, root); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	return nil, &Error{Code: CodeConflict, Message: "does not exist", Field: "path"}
+}
+
+// arrayIndex parses token as an index of an array, which is at most max
+func arrayIndex(token string, max int) (int, *Error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, &Error{Code: CodeInvalidRequest, Message: fmt.Sprintf("%q is not an array index", token), Field: "path"}
+	}
+	if i > max {
+		return 0, &Error{Code: CodeConflict, Message: fmt.Sprintf("index %d is out of range", i), Field: "path"}
+	}
+	return i, nil
+}
+
+// changedFields returns the names of the fields of Item that differ between a and b
+func changedFields(a, b Item) []string {
+	fields := []string{}
+	av, bv := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < av.NumField(); i++ {
+		if !reflect.DeepEqual(av.Field(i).Interface(), bv.Field(i).Interface()) {
+			fields = append(fields, av.Type().Field(i).Name)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func patchType(contentType string) http.Header {
+	return http.Header{"Content-Type": {contentType}}
+}
+
+func TestPatchItem(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService()
+	if rec := serve(s, http.MethodPost, "/item", savedItem(d.addr)); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	// only the section of the template the description is in is pushed
+	sent := len(d.received())
+	rec := serveWithHeader(s, http.MethodPatch, "/item/"+d.addr, map[string]interface{}{"description": "uplink"}, patchType(MergePatchType))
+	var item Item
+	json.Unmarshal(rec.Body.Bytes(), &item)
+	if rec.Code != http.StatusOK || item.Description != "uplink" || item.Password != "admin" || item.Number != "1" {
+		t.Fatalf("expected the description to be merged with the stored item, got %d %s", rec.Code, rec.Body)
+	}
+	pushed := d.received()[sent:]
+	if !slices.Contains(pushed, "interface GigabitEthernet 1") || !slices.Contains(pushed, "description uplink") || slices.Contains(pushed, "no mtu") || slices.Contains(pushed, "no shutdown") {
+		t.Errorf("expected only the description to be configured, got %q", pushed)
+	}
+
+	// a change to the interface configures all of it
+	sent = len(d.received())
+	ops := []PatchOperation{
+		{Op: "test", Path: "/description", Value: json.RawMessage(`"uplink"`)},
+		{Op: "replace", Path: "/number", Value: json.RawMessage(`"2"`)},
+		{Op: "add", Path: "/tags/-", Value: json.RawMessage(`"core"`)},
+	}
+	rec = serveWithHeader(s, http.MethodPatch, "/item/"+d.addr, ops, patchType(JSONPatchType))
+	json.Unmarshal(rec.Body.Bytes(), &item)
+	if rec.Code != http.StatusOK || item.Number != "2" || !slices.Equal(item.Tags, []string{"core"}) {
+		t.Fatalf("expected the operations to be applied, got %d %s", rec.Code, rec.Body)
+	}
+	if pushed := d.received()[sent:]; !slices.Contains(pushed, "interface GigabitEthernet 2") || !slices.Contains(pushed, "no mtu") {
+		t.Errorf("expected the whole interface to be configured, got %q", pushed)
+	}
+
+	// nothing on the device refers to the tags or credentials
+	sent = len(d.received())
+	rec = serveWithHeader(s, http.MethodPatch, "/item/"+d.addr, map[string]interface{}{"tags": nil}, patchType(MergePatchType))
+	if rec.Code != http.StatusOK || rec.Header().Get(OperationIDHeader) != "" || len(d.received()) != sent {
+		t.Errorf("expected the tags to be changed without a push, got %d %s", rec.Code, rec.Body)
+	}
+	if s.items[d.addr].Tags != nil || s.items[d.addr].Revision != 4 {
+		t.Errorf("expected the patched item to be stored, got %+v", s.items[d.addr])
+	}
+}
+
+func TestPatchItemRejected(t *testing.T) {
+	s := newTestService()
+	s.items["router"] = Item{Host: "router", Username: "admin", Password: "admin", IntfType: "GigabitEthernet", Number: "1", Platform: DefaultPlatform, Transport: DefaultTransport, Namespace: DefaultNamespace, Revision: 1}
+
+	tests := []struct {
+		name        string
+		contentType string
+		patch       interface{}
+		status      int
+		code, field string
+	}{
+		{"unsupported media type", "application/json", map[string]interface{}{"mtu": 1500}, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, ""},
+		{"wrong type", MergePatchType, map[string]interface{}{"mtu": "big"}, http.StatusBadRequest, CodeInvalidRequest, "mtu"},
+		{"unknown field", MergePatchType, map[string]interface{}{"speed": 10}, http.StatusBadRequest, CodeInvalidRequest, "speed"},
+		{"invalid item", MergePatchType, map[string]interface{}{"mtu": 10}, http.StatusUnprocessableEntity, CodeValidationFailed, ""},
+		{"host", MergePatchType, map[string]interface{}{"host": "other"}, http.StatusUnprocessableEntity, CodeValidationFailed, ""},
+		{"unknown op", JSONPatchType, []PatchOperation{{Op: "merge", Path: "/mtu"}}, http.StatusBadRequest, CodeInvalidRequest, "[0].op"},
+		{"missing path", JSONPatchType, []PatchOperation{{Op: "remove", Path: "/tags/0"}}, http.StatusConflict, CodeConflict, "[0].path"},
+		{"failed test", JSONPatchType, []PatchOperation{
+			{Op: "replace", Path: "/mtu", Value: json.RawMessage(`1500`)},
+			{Op: "test", Path: "/number", Value: json.RawMessage(`"2"`)},
+		}, http.StatusConflict, CodeConflict, "[1].path"},
+	}
+	for _, tt := range tests {
+		rec := serveWithHeader(s, http.MethodPatch, "/item/router", tt.patch, patchType(tt.contentType))
+		var e Error
+		json.Unmarshal(rec.Body.Bytes(), &e)
+		if rec.Code != tt.status || e.Code != tt.code || e.Field != tt.field {
+			t.Errorf("%s: expected %d %s %q, got %d %s", tt.name, tt.status, tt.code, tt.field, rec.Code, rec.Body)
+		}
+	}
+	if s.items["router"].Revision != 1 {
+		t.Errorf("expected no patch to change the item, got %+v", s.items["router"])
+	}
+}
+
+func TestRenderSections(t *testing.T) {
+	r := newTemplateRegistry()
+	item := exampleItem
+	tests := []struct {
+		fields []string
+		want   []string
+	}{
+		{[]string{"Mtu"}, []string{"interface GigabitEthernet 1", " mtu 1500"}},
+		{[]string{"Ipv4AddressMask", "Shutdown"}, []string{"interface GigabitEthernet 1", " ip address 192.0.2.1 255.255.255.0", " shutdown"}},
+		{[]string{"Password"}, nil},
+	}
+	for _, tt := range tests {
+		commands, _, err := r.renderSections(templateName(DefaultPlatform, templateInterface), item, tt.fields)
+		if err != nil || !slices.Equal(commands, tt.want) {
+			t.Errorf("%v: got %q, %v, want %q", tt.fields, commands, err, tt.want)
+		}
+	}
+	all, _, _ := r.render(templateName(DefaultPlatform, templateInterface), item)
+	if commands, _, _ := r.renderSections(templateName(DefaultPlatform, templateInterface), item, []string{"Number"}); !slices.Equal(commands, all) {
+		t.Errorf("expected a change to the interface to render the whole template, got %q", commands)
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// DefaultPageSize is how many items a page has when the query doesn't set a limit
+	DefaultPageSize = 100
+	// MaxPageSize is the most items a page can have
+	MaxPageSize = 1000
+)
+
+// ItemPage is a page of the items matching a query, in the order asked for. NextCursor is set when there are
+// more items, and fetches the next page when sent as the cursor with the same query. Items only have the
+// fields asked for, if the query selects fields
+type ItemPage struct {
+	Items      []Item `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// itemFields are the names of the fields of an Item in its JSON form
+var itemFields = jsonFields(reflect.TypeOf(Item{}))
+
+// itemSorts compare two items by the fields items can be sorted by
+var itemSorts = map[string]func(a, b Item) int{
+	"host":         func(a, b Item) int { return strings.Compare(a.Host, b.Host) },
+	"description":  func(a, b Item) int { return strings.Compare(a.Description, b.Description) },
+	"type":         func(a, b Item) int { return strings.Compare(a.IntfType, b.IntfType) },
+	"number":       func(a, b Item) int { return strings.Compare(a.Number, b.Number) },
+	"ipv4_address": func(a, b Item) int { return strings.Compare(a.Ipv4Address, b.Ipv4Address) },
+	"mtu":          func(a, b Item) int { return a.Mtu - b.Mtu },
+}
+
+// itemQuery is what GetItems is asked for with its query parameters
+type itemQuery struct {
+	host     string
+	typ      string
+	shutdown *bool
+	policy   string
+	tags     []string
+	sort     string
+	fields   []string
+	limit    int
+	after    *Item
+}
+
+// itemCursor is the last item of a page, with only the fields it is sorted by, and the sort it is the last
+// item of
+type itemCursor struct {
+	Sort string `json:"sort"`
+	Last Item   `json:"last"`
+}
+
+// parseItemQuery reads an itemQuery from the query parameters of a request, returning an Error naming the
+// first invalid parameter
+func parseItemQuery(values url.Values) (*itemQuery, *Error) {
+	invalid := func(field, format string, args ...interface{}) *Error {
+		return &Error{Code: CodeInvalidRequest, Message: fmt.Sprintf(format, args...), Field: field}
+	}
+	q := &itemQuery{
+		host:   values.Get("host"),
+		typ:    values.Get("type"),
+		policy: values.Get("policy"),
+		tags:   values["tag"],
+		sort:   "host",
+		limit:  DefaultPageSize,
+	}
+	if _, err := path.Match(q.host, ""); err != nil {
+		return nil, invalid("host", "must be a host or a pattern of hosts, %s", err)
+	}
+	if v := values.Get("shutdown"); v != "" {
+		shutdown, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, invalid("shutdown", "must be true or false")
+		}
+		q.shutdown = &shutdown
+	}
+	if v := values.Get("sort"); v != "" {
+		if _, ok := itemSorts[strings.TrimPrefix(v, "-")]; !ok {
+			return nil, invalid("sort", "must be one of %s, or one of them prefixed with - to sort in descending order", strings.Join(sortNames(), ", "))
+		}
+		q.sort = v
+	}
+	if v := values.Get("fields"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			if !slices.Contains(itemFields, field) {
+				return nil, invalid("fields", "%s is not a field of an item", field)
+			}
+			q.fields = append(q.fields, field)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			return nil, invalid("limit", "must be a number from 1 to %d", MaxPageSize)
+		}
+		q.limit = limit
+	}
+	if v := values.Get("cursor"); v != "" {
+		var cursor itemCursor
+		data, err := base64.RawURLEncoding.DecodeString(v)
+		if err == nil {
+			err = json.Unmarshal(data, &cursor)
+		}
+		if err != nil || cursor.Last.Host == "" {
+			return nil, invalid("cursor", "is not a cursor returned by the server")
+		}
+		if cursor.Sort != q.sort {
+			return nil, invalid("cursor", "is for items sorted by %s, not %s", cursor.Sort, q.sort)
+		}
+		q.after = &cursor.Last
+	}
+	return q, nil
+}
+
+func sortNames() []string {
+	names := make([]string, 0, len(itemSorts))
+	for name := range itemSorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matches reports whether item passes the filters of the query
+func (q *itemQuery) matches(item Item) bool {
+	if q.host != "" {
+		if ok, _ := path.Match(q.host, item.Host); !ok {
+			return false
+		}
+	}
+	if q.typ != "" && item.IntfType != q.typ {
+		return false
+	}
+	if q.shutdown != nil && item.Shutdown != *q.shutdown {
+		return false
+	}
+	if q.policy != "" && item.ServicePolicyInput != q.policy && item.ServicePolicyOutput != q.policy {
+		return false
+	}
+	for _, tag := range q.tags {
+		if !slices.Contains(item.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// compare orders a before b in the sort of the query, breaking ties by host so that every item has its place
+func (q *itemQuery) compare(a, b Item) int {
+	c := itemSorts[strings.TrimPrefix(q.sort, "-")](a, b)
+	if c == 0 {
+		c = strings.Compare(a.Host, b.Host)
+	}
+	if strings.HasPrefix(q.sort, "-") {
+		return -c
+	}
+	return c
+}
+
+// partialItemPage is an ItemPage of items with only the fields a query selects
+type partialItemPage struct {
+	Items      []map[string]interface{} `json:"items"`
+	NextCursor string                   `json:"next_cursor,omitempty"`
+}
+
+// page returns the page of items answering the query, an ItemPage or, if the query selects fields, a
+// partialItemPage
+func (q *itemQuery) page(items []Item) interface{} {
+	sort.Slice(items, func(i, j int) bool { return q.compare(items[i], items[j]) < 0 })
+	if q.after != nil {
+		first := sort.Search(len(items), func(i int) bool { return q.compare(items[i], *q.after) > 0 })
+		items = items[first:]
+	}
+	var next string
+	if len(items) > q.limit {
+		items = items[:q.limit]
+		cursor := itemCursor{Sort: q.sort}
+		// the cursor carries only what the last item is sorted by, not its credentials
+		data, _ := json.Marshal(selectFields(items[len(items)-1], []string{strings.TrimPrefix(q.sort, "-")}))
+		_ = json.Unmarshal(data, &cursor.Last)
+		data, _ = json.Marshal(cursor)
+		next = base64.RawURLEncoding.EncodeToString(data)
+	}
+	if q.fields == nil {
+		return ItemPage{Items: append([]Item{}, items...), NextCursor: next}
+	}
+	page := partialItemPage{Items: []map[string]interface{}{}, NextCursor: next}
+	for _, item := range items {
+		page.Items = append(page.Items, selectFields(item, q.fields))
+	}
+	return page
+}
+
+// selectFields returns the JSON form of item with only fields, and always its host
+func selectFields(item Item, fields []string) map[string]interface{} {
+	data, _ := json.Marshal(item)
+	var all map[string]interface{}
+	_ = json.Unmarshal(data, &all)
+	selected := map[string]interface{}{"host": item.Host}
+	for _, field := range fields {
+		if v, ok := all[field]; ok {
+			selected[field] = v
+		}
+	}
+	return selected
+}
+
+// jsonFields returns the names of the fields of the struct t in its JSON form
+func jsonFields(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
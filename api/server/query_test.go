@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestItemQueryInvalid(t *testing.T) {
+	s := newTestService()
+	tests := []struct {
+		query, field string
+	}{
+		{"shutdown=maybe", "shutdown"},
+		{"sort=password", "sort"},
+		{"fields=host,secret", "fields"},
+		{"limit=0", "limit"},
+		{"limit=1001", "limit"},
+		{"host=[", "host"},
+		{"cursor=not-a-cursor", "cursor"},
+	}
+	for _, tt := range tests {
+		rec := serve(s, http.MethodGet, "/item?"+tt.query, nil)
+		var e Error
+		json.Unmarshal(rec.Body.Bytes(), &e)
+		if rec.Code != http.StatusBadRequest || e.Code != CodeInvalidRequest || e.Field != tt.field {
+			t.Errorf("%s: expected the %s parameter to be rejected, got %d %s", tt.query, tt.field, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestItemQueryPages(t *testing.T) {
+	s := newTestService()
+	for _, host := range []string{"a", "b", "c", "d", "e"} {
+		item := savedItem(host)
+		item.Mtu = 1500
+		item.Namespace = DefaultNamespace
+		s.items[host] = item
+	}
+	s.items["other"] = Item{Host: "other", Namespace: "team-b"}
+
+	var hosts []string
+	query := "/item?sort=-mtu&limit=2"
+	for {
+		var page ItemPage
+		rec := serve(s, http.MethodGet, query, nil)
+		json.Unmarshal(rec.Body.Bytes(), &page)
+		if rec.Code != http.StatusOK || len(page.Items) > 2 {
+			t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+		}
+		for _, item := range page.Items {
+			hosts = append(hosts, item.Host)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query = "/item?sort=-mtu&limit=2&cursor=" + page.NextCursor
+	}
+	// items with the same mtu are sorted by host, in descending order with the rest of the sort
+	if got := len(hosts); got != 5 || hosts[0] != "e" || hosts[4] != "a" {
+		t.Errorf("expected every item of the namespace once in order, got %v", hosts)
+	}
+
+	rec := serve(s, http.MethodGet, "/item?sort=host&limit=2&cursor="+cursorAfter(t, s, "sort=-mtu&limit=2"), nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a cursor of another sort to be rejected, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+// cursorAfter returns the cursor of the first page of the query
+func cursorAfter(t *testing.T, s *Service, query string) string {
+	t.Helper()
+	var page ItemPage
+	json.Unmarshal(serve(s, http.MethodGet, "/item?"+query, nil).Body.Bytes(), &page)
+	if page.NextCursor == "" {
+		t.Fatalf("expected a next page for %s", query)
+	}
+	return page.NextCursor
+}
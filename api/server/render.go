@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"math/bits"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode"
+
+	"golang.org/x/exp/slices"
+)
+
+// cliEscaper is the name of the function appended to every action in a template, so that no value can
+// break out of the line it is rendered on
+const cliEscaper = "_cli"
+
+// templateFuncs are the helper functions available to templates
+var templateFuncs = template.FuncMap{
+	cliEscaper:     cliValue,
+	"cidrToMask":   cidrToMask,
+	"maskToPrefix": maskToPrefix,
+	"abbreviate":   abbreviate,
+	"quote":        quote,
+}
+
+// interfaceAbbreviations are the short interface names IOS-XE uses in show output
+var interfaceAbbreviations = map[string]string{
+	"GigabitEthernet":      "Gi",
+	"TwoGigabitEthernet":   "Tw",
+	"FiveGigabitEthernet":  "Fi",
+	"TenGigabitEthernet":   "Te",
+	"TwentyFiveGigE":       "Twe",
+	"FortyGigabitEthernet": "Fo",
+	"HundredGigE":          "Hu",
+	"TwoHundredGigE":       "TH",
+	"FourHundredGigE":      "FH",
+}
+
+// newCLITemplate parses source as a text template with the helper functions, then rewrites every action
+// to pass its value through the CLI escaper. Unlike html/template nothing is HTML escaped, but a value
+// containing a newline or other control character fails to render instead of injecting extra commands
+func newCLITemplate(name, source string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			escapeNode(tmpl.Tree, tmpl.Tree.Root)
+		}
+	}
+	return t, nil
+}
+
+// escapeNode appends the CLI escaper to every action under node that prints a value
+func escapeNode(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			escapeNode(tree, child)
+		}
+	case *parse.ActionNode:
+		// actions that only declare or assign variables print nothing
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+		cmds := n.Pipe.Cmds
+		if len(cmds) > 0 {
+			if id, ok := cmds[len(cmds)-1].Args[0].(*parse.IdentifierNode); ok && id.Ident == cliEscaper {
+				return
+			}
+		}
+		escaper := parse.NewIdentifier(cliEscaper).SetTree(tree).SetPos(n.Pos)
+		n.Pipe.Cmds = append(cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{escaper}})
+	case *parse.IfNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.RangeNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.WithNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	}
+}
+
+// refersTo reports whether node refers to any of fields, the names of fields of the item it is rendered
+// for. A node that passes the whole item on, with {{.}} or by calling another template, may refer to any of
+// them
+func refersTo(node parse.Node, fields []string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if refersTo(child, fields) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return refersTo(n.Pipe, fields)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if refersTo(cmd, fields) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if refersTo(arg, fields) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return refersTo(n.Node, fields)
+	case *parse.FieldNode:
+		return slices.Contains(fields, n.Ident[0])
+	case *parse.VariableNode:
+		// $ is the item, other variables are declared from what the template refers to
+		return n.Ident[0] == "$" && (len(n.Ident) == 1 || slices.Contains(fields, n.Ident[1]))
+	case *parse.DotNode, *parse.TemplateNode:
+		return len(fields) > 0
+	case *parse.IfNode:
+		return refersTo(n.Pipe, fields) || refersTo(n.List, fields) || refersTo(n.ElseList, fields)
+	case *parse.RangeNode:
+		return refersTo(n.Pipe, fields) || refersTo(n.List, fields) || refersTo(n.ElseList, fields)
+	case *parse.WithNode:
+		return refersTo(n.Pipe, fields) || refersTo(n.List, fields) || refersTo(n.ElseList, fields)
+	}
+	return false
+}
+
+// cliValue formats v for the CLI, failing if it contains anything that would end the line it is on or
+// be interpreted by the device's shell
+func cliValue(v interface{}) (string, error) {
+	s := fmt.Sprint(v)
+	if err := checkCLIValue(s); err != "" {
+		return "", fmt.Errorf("value %q %s", s, err)
+	}
+	return s, nil
+}
+
+// checkCLIValue returns a description of why s can't be sent on a CLI line, or an empty string if it can.
+// Newlines and other control characters would start a new command, and '?' asks the shell for help
+func checkCLIValue(s string) string {
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return "cannot contain control characters such as newlines"
+		}
+		if r == '?' {
+			return "cannot contain '?'"
+		}
+	}
+	return ""
+}
+
+// cidrToMask returns the dotted decimal netmask for a prefix, given as a length (24) or in CIDR
+// notation (192.0.2.0/24)
+func cidrToMask(cidr string) (string, error) {
+	length := cidr
+	if i := strings.IndexByte(cidr, '/'); i >= 0 {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return "", err
+		}
+		length = cidr[i+1:]
+	}
+	n, err := strconv.Atoi(length)
+	if err != nil || n < 0 || n > 32 {
+		return "", fmt.Errorf("invalid prefix length %q", length)
+	}
+	return net.IP(net.CIDRMask(n, 32)).String(), nil
+}
+
+// maskToPrefix returns the prefix length of a dotted decimal netmask
+func maskToPrefix(mask string) (int, error) {
+	if err := validateMask(mask); err != "" {
+		return 0, fmt.Errorf("netmask %q %s", mask, err)
+	}
+	ip := net.ParseIP(mask).To4()
+	return bits.OnesCount32(uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])), nil
+}
+
+// abbreviate returns the short name of an interface, e.g. Gi1/0/1 for GigabitEthernet 1/0/1. Unknown
+// types are returned in full
+func abbreviate(intfType, number string) string {
+	if short, ok := interfaceAbbreviations[intfType]; ok {
+		return short + number
+	}
+	return intfType + number
+}
+
+// quote wraps s in double quotes for commands that take a quoted string
+func quote(s string) (string, error) {
+	if strings.ContainsRune(s, '"') {
+		return "", fmt.Errorf("value %q cannot be quoted as it contains a double quote", s)
+	}
+	return `"` + s + `"`, nil
+}
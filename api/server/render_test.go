@@ -0,0 +1,99 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestRenderDoesNotHTMLEscape(t *testing.T) {
+	r := newTemplateRegistry()
+	item := exampleItem
+	item.Description = `R&D <uplink> "core"`
+
+	commands, _, err := r.render(templateName(DefaultPlatform, templateInterface), item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(commands, ` description R&D <uplink> "core"`) {
+		t.Errorf("expected the description to be rendered as is, got %q", commands)
+	}
+}
+
+func TestRenderRejectsInjection(t *testing.T) {
+	r := newTemplateRegistry()
+	attempts := map[string]func(*Item){
+		"newline in description": func(i *Item) { i.Description = "uplink\nusername x privilege 15 secret x" },
+		"carriage return":        func(i *Item) { i.Description = "uplink\rusername x privilege 15" },
+		"newline in number":      func(i *Item) { i.Number = "1\n exit\nusername x privilege 15" },
+		"newline in policy":      func(i *Item) { i.ServicePolicyInput = "IN\nenable secret x" },
+		"escape character":       func(i *Item) { i.Description = "uplink\x1b[A" },
+		"context help":           func(i *Item) { i.Description = "uplink ?" },
+	}
+	for name, modify := range attempts {
+		t.Run(name, func(t *testing.T) {
+			item := exampleItem
+			modify(&item)
+
+			// the server validates items before rendering, and rendering refuses them as well in case a
+			// value reaches a template without being validated
+			if errs := ValidateItem(item); errs == nil {
+				t.Error("expected ValidateItem to reject the item")
+			}
+			commands, _, err := r.render(templateName(DefaultPlatform, templateInterface), item)
+			if err == nil {
+				t.Errorf("expected render to fail, got %q", commands)
+			}
+			for _, cmd := range commands {
+				if strings.Contains(cmd, "username") || strings.Contains(cmd, "secret") {
+					t.Errorf("injected command rendered: %q", cmd)
+				}
+			}
+		})
+	}
+}
+
+func TestCLITemplateEscapesEveryAction(t *testing.T) {
+	tmpl, err := newCLITemplate("test", `{{define "sub"}}{{.}}{{end}}`+
+		`{{range .}}{{template "sub" .}}{{end}}{{with $x := "a"}}{{$x}}{{end}}{{_cli "b"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, []string{"ok"}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "okab" {
+		t.Errorf("got %q", out.String())
+	}
+	if err := tmpl.Execute(&out, []string{"bad\n"}); err == nil {
+		t.Error("expected a value in a sub template to be escaped")
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	tmpl, err := newCLITemplate("test", `{{cidrToMask "24"}} {{cidrToMask "10.0.0.0/30"}} {{maskToPrefix .Ipv4AddressMask}} `+
+		`{{abbreviate .IntfType .Number}} {{abbreviate "Loopback" "0"}} {{quote .Description}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, exampleItem); err != nil {
+		t.Fatal(err)
+	}
+	want := `255.255.255.0 255.255.255.252 24 Gi1 Loopback0 "example"`
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	for _, src := range []string{`{{cidrToMask "33"}}`, `{{maskToPrefix "255.0.255.0"}}`, `{{quote "a\"b"}}`} {
+		tmpl, err := newCLITemplate("test", src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tmpl.Execute(&strings.Builder{}, nil); err == nil {
+			t.Errorf("expected %s to fail", src)
+		}
+	}
+}
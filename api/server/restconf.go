@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// restconfMediaType is the YANG JSON encoding requests are sent and replies are accepted in
+	restconfMediaType = "application/yang-data+json"
+	// restconfRoot is where devices serve the RESTCONF datastore
+	restconfRoot = "/restconf/data/"
+	// restconfOperations is where devices serve the RPCs of their models
+	restconfOperations = "/restconf/operations/"
+	// restconfTimeout limits how long a single RESTCONF request can take
+	restconfTimeout = 2 * time.Minute
+)
+
+// newRESTCONFClient returns the HTTP client used to reach devices over RESTCONF, verifying device
+// certificates with tlsConfig or the system roots if it is nil
+func newRESTCONFClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: transport, Timeout: restconfTimeout}
+}
+
+// restconfRequest is a single request making part of a change. A request with ignoreNotFound removes data
+// that may not exist, so a 404 is not an error. The path of a request with operation is an RPC rather than
+// data in the datastore
+type restconfRequest struct {
+	method         string
+	path           string
+	body           interface{}
+	ignoreNotFound bool
+	operation      bool
+}
+
+// restconfErrors is the body of a RESTCONF error response. Each error has the same fields as a NETCONF
+// rpc-error
+type restconfErrors struct {
+	Errors struct {
+		Error []*RPCError `json:"error"`
+	} `json:"ietf-restconf:errors"`
+}
+
+// restconfSession sends requests to one device with the item's credentials
+type restconfSession struct {
+	logger   *slog.Logger
+	rec      *transcript
+	client   *http.Client
+	base     string
+	username string
+	password string
+}
+
+func (s *Service) restconfSession(logger *slog.Logger, rec *transcript, item Item) *restconfSession {
+	return &restconfSession{
+		logger:   logger,
+		rec:      rec,
+		client:   s.restconf,
+		base:     "https://" + item.Host,
+		username: item.Username,
+		password: item.Password,
+	}
+}
+
+// do sends req and returns the response body, or an error describing the RESTCONF errors in the response
+func (c *restconfSession) do(req restconfRequest) ([]byte, error) {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return nil, err
+		}
+	}
+	root := restconfRoot
+	if req.operation {
+		root = restconfOperations
+	}
+	httpReq, err := http.NewRequest(req.method, c.base+root+req.path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.SetBasicAuth(c.username, c.password)
+	httpReq.Header.Set("Accept", restconfMediaType)
+	if body != nil {
+		httpReq.Header.Set("Content-Type", restconfMediaType)
+	}
+
+	c.logger.Debug("sending restconf request", "method", req.method, "path", req.path)
+	c.rec.sent(fmt.Sprintf("%s %s\n%s", req.method, req.path, body))
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", req.method, req.path, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.rec.received(fmt.Sprintf("%s\n%s", resp.Status, respBody))
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && req.ignoreNotFound:
+		return nil, nil
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("%s %s: %w", req.method, req.path, restconfError(resp.Status, respBody))
+	}
+	return respBody, nil
+}
+
+// restconfError returns the errors in a RESTCONF error body, or the status if it has none
+func restconfError(status string, body []byte) error {
+	var parsed restconfErrors
+	if json.Unmarshal(body, &parsed) != nil || len(parsed.Errors.Error) == 0 {
+		return errors.New(status)
+	}
+	errs := make([]error, 0, len(parsed.Errors.Error))
+	for _, e := range parsed.Errors.Error {
+		errs = append(errs, e)
+	}
+	return fmt.Errorf("%s: %w", status, errors.Join(errs...))
+}
+
+// restconfInterfacePath returns the path of item's interface in the Cisco-IOS-XE-native model, with the
+// number escaped as a list key, e.g. Cisco-IOS-XE-native:native/interface/GigabitEthernet=1%2F0%2F1
+func restconfInterfacePath(item Item) string {
+	return "Cisco-IOS-XE-native:native/interface/" + item.IntfType + "=" + url.PathEscape(item.Number)
+}
+
+// restconfInterfaceRequests returns the requests setting every field of item's interface, the RESTCONF
+// equivalent of the iosxe_interface_ethernet template. The fields that are set are merged with a PATCH,
+// and the fields that are not are deleted
+func restconfInterfaceRequests(item Item) []restconfRequest {
+	path := restconfInterfacePath(item)
+	intf := map[string]interface{}{"name": item.Number}
+	var remove []string
+	policy := map[string]interface{}{}
+
+	if item.Description != "" {
+		intf["description"] = item.Description
+	} else {
+		remove = append(remove, "description")
+	}
+	if item.Ipv4Address != "" && item.Ipv4AddressMask != "" {
+		intf["ip"] = map[string]interface{}{
+			"address": map[string]interface{}{
+				"primary": map[string]interface{}{"address": item.Ipv4Address, "mask": item.Ipv4AddressMask},
+			},
+		}
+	} else {
+		remove = append(remove, "ip/address")
+	}
+	if item.Mtu != 0 {
+		intf["mtu"] = item.Mtu
+	} else {
+		remove = append(remove, "mtu")
+	}
+	if item.Shutdown {
+		// an empty leaf is encoded as [null] in YANG JSON
+		intf["shutdown"] = []interface{}{nil}
+	} else {
+		remove = append(remove, "shutdown")
+	}
+	if item.ServicePolicyInput != "" {
+		policy["input"] = item.ServicePolicyInput
+	} else {
+		remove = append(remove, "Cisco-IOS-XE-policy:service-policy/input")
+	}
+	if item.ServicePolicyOutput != "" {
+		policy["output"] = item.ServicePolicyOutput
+	} else {
+		remove = append(remove, "Cisco-IOS-XE-policy:service-policy/output")
+	}
+	if len(policy) > 0 {
+		intf["Cisco-IOS-XE-policy:service-policy"] = policy
+	}
+
+	requests := []restconfRequest{{
+		method: http.MethodPatch,
+		path:   path,
+		body:   map[string]interface{}{"Cisco-IOS-XE-native:" + item.IntfType: []interface{}{intf}},
+	}}
+	for _, leaf := range remove {
+		requests = append(requests, restconfRequest{method: http.MethodDelete, path: path + "/" + leaf, ignoreNotFound: true})
+	}
+	return requests
+}
+
+// restconfInterfaceDeleteRequests returns the request returning item's interface to its defaults, the
+// RESTCONF equivalent of default interface, by replacing it with an entry holding only its name
+func restconfInterfaceDeleteRequests(item Item) []restconfRequest {
+	return []restconfRequest{{
+		method: http.MethodPut,
+		path:   restconfInterfacePath(item),
+		body: map[string]interface{}{
+			"Cisco-IOS-XE-native:" + item.IntfType: []interface{}{map[string]interface{}{"name": item.Number}},
+		},
+	}}
+}
+
+// restconfConfig returns requests as they are sent, each method and path followed by its indented body
+func restconfConfig(requests []restconfRequest) string {
+	var config strings.Builder
+	for _, req := range requests {
+		fmt.Fprintf(&config, "%s %s\n", req.method, req.path)
+		if req.body != nil {
+			body, _ := json.MarshalIndent(req.body, "", "  ")
+			config.Write(body)
+			config.WriteString("\n")
+		}
+	}
+	return config.String()
+}
+
+// applyRESTCONF sends requests to item's device in order, stopping at the first that fails. RESTCONF has
+// no candidate datastore, so the requests that were sent before a failure stay applied
+func (s *Service) applyRESTCONF(logger *slog.Logger, rec *transcript, item Item, requests []restconfRequest) error {
+	c := s.restconfSession(logger, rec, item)
+	for _, req := range requests {
+		if _, err := c.do(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveRESTCONF saves the running configuration of item's device with the Cisco save-config RPC
+func (s *Service) saveRESTCONF(logger *slog.Logger, rec *transcript, item Item) error {
+	c := s.restconfSession(logger, rec, item)
+	_, err := c.do(restconfRequest{method: http.MethodPost, path: "cisco-ia:save-config", operation: true})
+	return err
+}
+
+// readRESTCONF returns the running configuration of item's interface as indented YANG JSON
+func (s *Service) readRESTCONF(logger *slog.Logger, rec *transcript, item Item) (string, error) {
+	return s.readRESTCONFPath(logger, rec, item, restconfInterfacePath(item))
+}
+
+// readRESTCONFPath returns the data at path on item's device as indented YANG JSON
+func (s *Service) readRESTCONFPath(logger *slog.Logger, rec *transcript, item Item, path string) (string, error) {
+	c := s.restconfSession(logger, rec, item)
+	body, err := c.do(restconfRequest{method: http.MethodGet, path: path})
+	if err != nil {
+		return "", err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return "", fmt.Errorf("invalid response: %w", err)
+	}
+	return indented.String(), nil
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+// fakeRESTCONF is an HTTPS server standing in for the RESTCONF API of an IOS-XE device. It implements the
+// Cisco-IOS-XE-native interface list entries and their leaves and the save-config RPC, and fails the requests named in errors,
+// keyed by method and path
+type fakeRESTCONF struct {
+	*httptest.Server
+	errors map[string]string
+
+	mu         sync.Mutex
+	requests   []string
+	interfaces map[string]map[string]interface{}
+}
+
+func newFakeRESTCONF(t *testing.T) *fakeRESTCONF {
+	t.Helper()
+	f := &fakeRESTCONF{errors: map[string]string{}, interfaces: map[string]map[string]interface{}{}}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeRESTCONF) serve(w http.ResponseWriter, r *http.Request) {
+	if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "admin" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// the escaped path keeps the slashes of the list key apart from the path separators
+	path := strings.TrimPrefix(r.URL.EscapedPath(), restconfRoot+"Cisco-IOS-XE-native:native/interface/")
+	key, leaf, _ := strings.Cut(path, "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+path)
+	if msg, ok := f.errors[r.Method+" "+path]; ok {
+		f.fail(w, http.StatusBadRequest, "invalid-value", msg)
+		return
+	}
+
+	var body map[string][]map[string]interface{}
+	if r.Method == http.MethodPatch || r.Method == http.MethodPut {
+		if r.Header.Get("Content-Type") != restconfMediaType || json.NewDecoder(r.Body).Decode(&body) != nil {
+			f.fail(w, http.StatusBadRequest, "malformed-message", "invalid body")
+			return
+		}
+	}
+	intf, exists := f.interfaces[key]
+	switch {
+	case r.Method == http.MethodPost && path == restconfOperations+"cisco-ia:save-config":
+	case r.Method == http.MethodPatch && leaf == "":
+		if !exists {
+			intf = map[string]interface{}{}
+			f.interfaces[key] = intf
+		}
+		for _, entry := range body {
+			merge(intf, entry[0])
+		}
+	case r.Method == http.MethodPut && leaf == "":
+		for _, entry := range body {
+			f.interfaces[key] = entry[0]
+		}
+	case r.Method == http.MethodDelete && exists:
+		if !remove(intf, strings.Split(leaf, "/")) {
+			f.fail(w, http.StatusNotFound, "data-missing", "uri keypath not found")
+			return
+		}
+	case r.Method == http.MethodGet && exists && leaf == "":
+		w.Header().Set("Content-Type", restconfMediaType)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Cisco-IOS-XE-native:" + strings.Split(key, "=")[0]: intf})
+		return
+	default:
+		f.fail(w, http.StatusNotFound, "invalid-value", "uri keypath not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeRESTCONF) fail(w http.ResponseWriter, status int, tag, msg string) {
+	w.Header().Set("Content-Type", restconfMediaType)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"ietf-restconf:errors":{"error":[{"error-type":"application","error-tag":%q,"error-message":%q}]}}`, tag, msg)
+}
+
+// merge merges the values of from into to, recursing into containers
+func merge(to, from map[string]interface{}) {
+	for k, v := range from {
+		if child, ok := v.(map[string]interface{}); ok {
+			if existing, ok := to[k].(map[string]interface{}); ok {
+				merge(existing, child)
+				continue
+			}
+		}
+		to[k] = v
+	}
+}
+
+// remove deletes the node at path under data, returning false if it doesn't exist
+func remove(data map[string]interface{}, path []string) bool {
+	if _, ok := data[path[0]]; !ok {
+		return false
+	}
+	if len(path) == 1 {
+		delete(data, path[0])
+		return true
+	}
+	child, ok := data[path[0]].(map[string]interface{})
+	return ok && remove(child, path[1:])
+}
+
+func (f *fakeRESTCONF) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeRESTCONF) item() Item {
+	item := deviceItem(f.Listener.Addr().String())
+	item.Transport = TransportRESTCONF
+	item.IntfType, item.Number, item.Description, item.Mtu = "GigabitEthernet", "1/0/1", "uplink", 9000
+	return item
+}
+
+// service returns a service trusting the certificate of the stand-in
+func (f *fakeRESTCONF) service() *Service {
+	roots := x509.NewCertPool()
+	roots.AddCert(f.Certificate())
+	s := newTestService()
+	WithRESTCONFTLS(&tls.Config{RootCAs: roots})(s)
+	return s
+}
+
+func applyRESTCONFTo(s *Service, item Item, requests []restconfRequest) (*transcript, error) {
+	rec := newTranscript(s.redactor)
+	return rec, s.applyRESTCONF(s.logger, rec, item, requests)
+}
+
+func TestRESTCONFApply(t *testing.T) {
+	f := newFakeRESTCONF(t)
+	item := f.item()
+	item.Ipv4Address, item.Ipv4AddressMask, item.ServicePolicyInput = "192.0.2.1", "255.255.255.0", "IN_POLICY"
+	rec, err := applyRESTCONFTo(f.service(), item, restconfInterfaceRequests(item))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := f.received()
+	if len(got) == 0 || got[0] != "PATCH GigabitEthernet=1%2F0%2F1" {
+		t.Fatalf("expected the interface to be patched first, got %q", got)
+	}
+	want := []string{"shutdown", "Cisco-IOS-XE-policy:service-policy/output"}
+	for _, leaf := range want {
+		if !slices.Contains(got, "DELETE GigabitEthernet=1%2F0%2F1/"+leaf) {
+			t.Errorf("expected %s to be deleted, got %q", leaf, got)
+		}
+	}
+	intf := f.interfaces["GigabitEthernet=1%2F0%2F1"]
+	if intf["description"] != "uplink" || intf["mtu"] != float64(9000) || intf["name"] != "1/0/1" {
+		t.Errorf("unexpected interface %v", intf)
+	}
+	if policy, _ := intf["Cisco-IOS-XE-policy:service-policy"].(map[string]interface{}); policy["input"] != "IN_POLICY" {
+		t.Errorf("expected the input policy to be set, got %v", intf)
+	}
+	if entries := rec.snapshot(); len(entries) == 0 || !strings.Contains(entries[0].Data, `"description":"uplink"`) {
+		t.Errorf("expected the requests to be recorded, got %v", entries)
+	}
+}
+
+func TestRESTCONFRemovesUnsetFields(t *testing.T) {
+	f := newFakeRESTCONF(t)
+	s := f.service()
+	item := f.item()
+	item.Shutdown = true
+	if _, err := applyRESTCONFTo(s, item, restconfInterfaceRequests(item)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.interfaces["GigabitEthernet=1%2F0%2F1"]["shutdown"]; !ok {
+		t.Fatalf("expected the interface to be shut down, got %v", f.interfaces)
+	}
+
+	item.Shutdown, item.Description = false, ""
+	if _, err := applyRESTCONFTo(s, item, restconfInterfaceRequests(item)); err != nil {
+		t.Fatal(err)
+	}
+	intf := f.interfaces["GigabitEthernet=1%2F0%2F1"]
+	if _, ok := intf["shutdown"]; ok {
+		t.Errorf("expected shutdown to be removed, got %v", intf)
+	}
+	if _, ok := intf["description"]; ok {
+		t.Errorf("expected the description to be removed, got %v", intf)
+	}
+
+	if _, err := applyRESTCONFTo(s, item, restconfInterfaceDeleteRequests(item)); err != nil {
+		t.Fatal(err)
+	}
+	if intf := f.interfaces["GigabitEthernet=1%2F0%2F1"]; len(intf) != 1 || intf["name"] != "1/0/1" {
+		t.Errorf("expected the interface to be returned to its defaults, got %v", intf)
+	}
+}
+
+func TestRESTCONFError(t *testing.T) {
+	f := newFakeRESTCONF(t)
+	f.errors["PATCH GigabitEthernet=1%2F0%2F1"] = "mtu 9000 is out of range"
+	item := f.item()
+	_, err := applyRESTCONFTo(f.service(), item, restconfInterfaceRequests(item))
+	if err == nil || !strings.Contains(err.Error(), "mtu 9000 is out of range") || !strings.Contains(err.Error(), "400 Bad Request") {
+		t.Fatalf("expected the device's error, got %v", err)
+	}
+	if got := f.received(); len(got) != 1 {
+		t.Errorf("expected no requests after the failure, got %q", got)
+	}
+}
+
+func TestRESTCONFReadConfig(t *testing.T) {
+	f := newFakeRESTCONF(t)
+	s := f.service()
+	item := f.item()
+	if _, err := applyRESTCONFTo(s, item, restconfInterfaceRequests(item)); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := s.readItemConfig(s.logger, newTranscript(s.redactor), iosxeDriver, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed map[string]map[string]interface{}
+	if err := json.Unmarshal([]byte(config), &parsed); err != nil {
+		t.Fatalf("expected JSON, got %s", config)
+	}
+	if intf := parsed["Cisco-IOS-XE-native:GigabitEthernet"]; intf["description"] != "uplink" {
+		t.Errorf("unexpected configuration %s", config)
+	}
+}
+
+func TestRESTCONFUntrustedCertificate(t *testing.T) {
+	f := newFakeRESTCONF(t)
+	item := f.item()
+	_, err := applyRESTCONFTo(newTestService(), item, restconfInterfaceRequests(item))
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected the device certificate to be rejected, got %v", err)
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Errorf("expected no requests to reach the device, got %q", got)
+	}
+}
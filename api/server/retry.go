@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error classes of a failed push, reported in the operation's error_class. Connecting to a device is
+// retried for the transient classes only
+const (
+	// ErrorRefused is a device refusing the TCP connection
+	ErrorRefused = "refused"
+	// ErrorTimeout is a device not answering in time, while connecting or after a command
+	ErrorTimeout = "timeout"
+	// ErrorClosed is a device closing the connection before the SSH session started, as IOS does when
+	// every VTY line is busy
+	ErrorClosed = "closed"
+	// ErrorAuth is a device rejecting the item's credentials
+	ErrorAuth = "auth"
+	// ErrorRejected is a device rejecting a command or RPC
+	ErrorRejected = "rejected"
+	ErrorOther    = "other"
+)
+
+// errPromptTimeout is returned when a device doesn't show its prompt in time after a command
+var errPromptTimeout = errors.New("timed out waiting for the prompt")
+
+// authError is returned when a device or jump host rejects the credentials of an SSH handshake
+type authError struct {
+	err error
+}
+
+func (e *authError) Error() string {
+	return e.err.Error()
+}
+
+func (e *authError) Unwrap() error {
+	return e.err
+}
+
+// classifyError returns the class of an error returned by a push, or an empty string if err is nil
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+	var cmdErr *commandError
+	var rpcErr *RPCError
+	var netErr net.Error
+	var chanErr *ssh.OpenChannelError
+	var authErr *authError
+	msg := err.Error()
+	switch {
+	case errors.As(err, &cmdErr), errors.As(err, &rpcErr):
+		return ErrorRejected
+	// a jump host that can't reach the device rejects the tunnel instead
+	case errors.Is(err, syscall.ECONNREFUSED), errors.As(err, &chanErr) && chanErr.Reason == ssh.ConnectionFailed:
+		return ErrorRefused
+	case errors.Is(err, errPromptTimeout), errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case errors.As(err, &authErr):
+		return ErrorAuth
+	// the ssh package doesn't wrap handshake errors, so a closed connection can only be told apart by its message
+	case strings.Contains(msg, "handshake failed: EOF"), strings.Contains(msg, "connection reset by peer"),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF):
+		return ErrorClosed
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return ErrorAuth
+		case codes.DeadlineExceeded:
+			return ErrorTimeout
+		case codes.InvalidArgument, codes.FailedPrecondition, codes.Aborted:
+			return ErrorRejected
+		}
+	}
+	return ErrorOther
+}
+
+// transientError reports whether an error of class can go away by itself, so connecting is worth retrying
+func transientError(class string) bool {
+	return class == ErrorRefused || class == ErrorTimeout || class == ErrorClosed
+}
+
+// retryPolicy is how connecting to a device over SSH is retried after a transient failure
+type retryPolicy struct {
+	// attempts is the most connections made for a session, 1 disabling retries
+	attempts int
+	// backoff is the wait before the first retry, doubled for every retry after it
+	backoff time.Duration
+	// budget limits the time spent connecting, including the waits, 0 leaving it unlimited
+	budget time.Duration
+}
+
+// delay returns the wait before the given retry, the first being 1. Half of the wait is random so that
+// the pushes retrying on a busy device don't all come back at once
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := p.backoff << (retry - 1)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// dialSSH opens an SSH session on hostname, retrying transient failures as set by the retry policy and
+// counting the attempts in rec. The caller must close the session and connection and decrement the
+// active sessions
+func (s *Service) dialSSH(logger *slog.Logger, rec *transcript, hostname string, config *ssh.ClientConfig) (*ssh.Client, *ssh.Session, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		rec.attempt()
+		conn, session, err := s.dialSSHOnce(logger, hostname, config)
+		if err == nil {
+			return conn, session, nil
+		}
+		class := classifyError(err)
+		if !transientError(class) || attempt >= s.retry.attempts {
+			return nil, nil, err
+		}
+		wait := s.retry.delay(attempt)
+		if s.retry.budget > 0 && time.Since(start)+wait > s.retry.budget {
+			logger.Warn("ssh retry budget exhausted", "attempts", attempt, "budget", s.retry.budget)
+			return nil, nil, err
+		}
+		s.metrics.sshRetries.WithLabelValues(hostname, class).Inc()
+		logger.Warn("transient ssh failure, retrying", "class", class, "attempt", attempt, "retry_in", wait, "error", err)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	_, refused := net.Dial("tcp", l.Addr().String())
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{refused, ErrorRefused},
+		{fmt.Errorf("interface GigabitEthernet 1: %w", &commandError{lines: []string{"% Invalid input"}}), ErrorRejected},
+		{&RPCError{Type: "application", Message: "invalid value"}, ErrorRejected},
+		{fmt.Errorf("waiting for prompt: %w after 30s", errPromptTimeout), ErrorTimeout},
+		{&authError{err: errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain")}, ErrorAuth},
+		{errors.New("ssh: handshake failed: EOF"), ErrorClosed},
+		{status.Error(codes.Unauthenticated, "bad credentials"), ErrorAuth},
+		{status.Error(codes.InvalidArgument, "invalid mtu"), ErrorRejected},
+		{errors.New("unsupported platform"), ErrorOther},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// busyProxy forwards connections to addr after closing the first busy of them straight away, as a device
+// does when every VTY line is in use
+type busyProxy struct {
+	addr string
+	mu   sync.Mutex
+	busy int
+	seen int
+}
+
+func newBusyProxy(t *testing.T, addr string, busy int) *busyProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	p := &busyProxy{addr: l.Addr().String(), busy: busy}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			p.seen++
+			closing := p.seen <= p.busy
+			p.mu.Unlock()
+			if closing {
+				conn.Close()
+				continue
+			}
+			go forward(conn, addr)
+		}
+	}()
+	return p
+}
+
+func forward(conn net.Conn, addr string) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func (p *busyProxy) connections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seen
+}
+
+// pushedOperation creates item and returns the operation that pushed it
+func pushedOperation(t *testing.T, s *Service, item Item) *Operation {
+	t.Helper()
+	rec := serve(s, http.MethodPost, "/item", item)
+	s.operations.RLock()
+	defer s.operations.RUnlock()
+	op, ok := s.operations.operations[rec.Header().Get(OperationIDHeader)]
+	if !ok {
+		t.Fatalf("no operation recorded: %d %s", rec.Code, rec.Body)
+	}
+	return op
+}
+
+func TestSSHRetry(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	p := newBusyProxy(t, d.addr, 2)
+	s := newTestService(WithSSHRetry(3, time.Millisecond, time.Second))
+
+	op := pushedOperation(t, s, savedItem(p.addr))
+	if !op.Success || op.Attempts != 3 || op.ErrorClass != "" {
+		t.Errorf("expected the push to succeed on the third attempt, got %+v", op)
+	}
+}
+
+func TestSSHRetryGivesUp(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	p := newBusyProxy(t, d.addr, 100)
+	s := newTestService(WithSSHRetry(2, time.Millisecond, time.Second))
+
+	op := pushedOperation(t, s, savedItem(p.addr))
+	if op.Success || op.Attempts != 2 || op.ErrorClass != ErrorClosed || p.connections() != 2 {
+		t.Errorf("expected the push to fail as closed after 2 attempts, got %+v with %d connections", op, p.connections())
+	}
+}
+
+func TestSSHRetryBudget(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	p := newBusyProxy(t, d.addr, 100)
+	s := newTestService(WithSSHRetry(10, 40*time.Millisecond, 100*time.Millisecond))
+
+	op := pushedOperation(t, s, savedItem(p.addr))
+	if op.Success || op.Attempts < 2 || op.Attempts > 3 {
+		t.Errorf("expected the budget to stop retrying after 2 or 3 attempts, got %+v", op)
+	}
+}
+
+func TestSSHNoRetryOnAuthFailure(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService(WithSSHRetry(3, time.Millisecond, time.Second))
+	item := savedItem(d.addr)
+	item.Password = "wrong"
+
+	op := pushedOperation(t, s, item)
+	if op.Success || op.Attempts != 1 || op.ErrorClass != ErrorAuth {
+		t.Errorf("expected a single failed attempt classed auth, got %+v", op)
+	}
+}
+
+func TestSSHNoRetryOnRejectedCommand(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	d.errors["interface GigabitEthernet 1"] = "% Invalid input detected at '^' marker."
+	s := newTestService(WithSSHRetry(3, time.Millisecond, time.Second))
+
+	op := pushedOperation(t, s, savedItem(d.addr))
+	if op.Success || op.Attempts != 1 || op.ErrorClass != ErrorRejected {
+		t.Errorf("expected a single failed attempt classed rejected, got %+v", op)
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// JumpHost is an SSH server, such as a bastion, that devices are reached through when the server can't dial
+// them directly
+type JumpHost struct {
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	// PrivateKeyFile is the location of an unencrypted PEM private key to authenticate with, tried before
+	// the password
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	// HostKey is the public key the jump host must present, in authorized_keys format
+	HostKey string `json:"host_key,omitempty"`
+	// KnownHostsFile is the location of a known_hosts file the jump host's key is checked against when
+	// HostKey is empty
+	KnownHostsFile string `json:"known_hosts_file,omitempty"`
+	// InsecureIgnoreHostKey accepts any key when neither HostKey nor KnownHostsFile is set
+	InsecureIgnoreHostKey bool `json:"insecure_ignore_host_key,omitempty"`
+}
+
+// SOCKS5Proxy is a SOCKS5 proxy connections are made through, authenticated if Username is set
+type SOCKS5Proxy struct {
+	Address  string `json:"address"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Route is how the SSH connections to some devices are made. Each jump host is dialed through the one
+// before it, the first one through the SOCKS5 proxy if there is one, and the device through the last one
+type Route struct {
+	// Hosts are patterns matched against the item host with path.Match, e.g. "10.1.*". A route without
+	// hosts matches every device
+	Hosts     []string     `json:"hosts,omitempty"`
+	JumpHosts []JumpHost   `json:"jump_hosts,omitempty"`
+	SOCKS5    *SOCKS5Proxy `json:"socks5,omitempty"`
+}
+
+// matches reports whether the route is used for hostname
+func (r Route) matches(hostname string) bool {
+	if len(r.Hosts) == 0 {
+		return true
+	}
+	for _, pattern := range r.Hosts {
+		if ok, _ := path.Match(pattern, hostname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRoute checks that a route's patterns are valid and that its jump hosts can be authenticated
+// with and have their key checked
+func ValidateRoute(route Route) error {
+	for _, pattern := range route.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: %w", pattern, err)
+		}
+	}
+	if route.SOCKS5 != nil {
+		if _, _, err := net.SplitHostPort(route.SOCKS5.Address); err != nil {
+			return fmt.Errorf("socks5 proxy: %w", err)
+		}
+	}
+	for _, jump := range route.JumpHosts {
+		if _, _, err := net.SplitHostPort(jump.Address); err != nil {
+			return fmt.Errorf("jump host: %w", err)
+		}
+		if _, err := jumpHostConfig(jump); err != nil {
+			return fmt.Errorf("jump host %s: %w", jump.Address, err)
+		}
+	}
+	return nil
+}
+
+// jumpHostConfig returns the client configuration authenticating with jump and checking its host key
+func jumpHostConfig(jump JumpHost) (*ssh.ClientConfig, error) {
+	if jump.Username == "" {
+		return nil, errors.New("a username is required")
+	}
+	var auth []ssh.AuthMethod
+	if jump.PrivateKeyFile != "" {
+		pem, err := os.ReadFile(jump.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", jump.PrivateKeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if jump.Password != "" {
+		auth = append(auth, ssh.Password(jump.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("a password or private key file is required")
+	}
+
+	var hostKey ssh.HostKeyCallback
+	switch {
+	case jump.HostKey != "":
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(jump.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("host key: %w", err)
+		}
+		hostKey = ssh.FixedHostKey(key)
+	case jump.KnownHostsFile != "":
+		callback, err := knownhosts.New(jump.KnownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		hostKey = callback
+	case jump.InsecureIgnoreHostKey:
+		hostKey = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, errors.New("a host key or known hosts file is required unless insecure_ignore_host_key is set")
+	}
+
+	return &ssh.ClientConfig{
+		User:            jump.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         dialTimeout,
+	}, nil
+}
+
+// routeTo returns the first route matching hostname, or nil if it is dialed directly
+func (s *Service) routeTo(hostname string) *Route {
+	for i := range s.routes {
+		if s.routes[i].matches(hostname) {
+			return &s.routes[i]
+		}
+	}
+	return nil
+}
+
+// dialer opens connections, directly or through a proxy or jump host
+type dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// dialDevice opens a TCP connection to hostname along its route. Closing the connection closes the jump
+// host connections it was tunnelled through
+func (s *Service) dialDevice(logger *slog.Logger, hostname string) (net.Conn, error) {
+	var d dialer = &net.Dialer{Timeout: dialTimeout}
+	route := s.routeTo(hostname)
+	if route == nil {
+		return d.Dial("tcp", hostname)
+	}
+
+	if route.SOCKS5 != nil {
+		var auth *proxy.Auth
+		if route.SOCKS5.Username != "" {
+			auth = &proxy.Auth{User: route.SOCKS5.Username, Password: route.SOCKS5.Password}
+		}
+		socks, err := proxy.SOCKS5("tcp", route.SOCKS5.Address, auth, d)
+		if err != nil {
+			return nil, fmt.Errorf("socks5 proxy %s: %w", route.SOCKS5.Address, err)
+		}
+		d = socks
+		logger.Debug("dialing through socks5 proxy", "proxy", route.SOCKS5.Address)
+	}
+
+	tunnel := &tunnelConn{}
+	for _, jump := range route.JumpHosts {
+		client, err := dialJumpHost(d, jump)
+		if err != nil {
+			tunnel.closeHops()
+			return nil, err
+		}
+		tunnel.hops = append(tunnel.hops, client)
+		d = client
+		logger.Debug("connected to jump host", "jump_host", jump.Address)
+	}
+
+	conn, err := d.Dial("tcp", hostname)
+	if err != nil {
+		tunnel.closeHops()
+		return nil, err
+	}
+	if len(tunnel.hops) == 0 {
+		return conn, nil
+	}
+	tunnel.Conn = conn
+	return tunnel, nil
+}
+
+// dialJumpHost connects to jump with d and returns a client that can dial through it
+func dialJumpHost(d dialer, jump JumpHost) (*ssh.Client, error) {
+	config, err := jumpHostConfig(jump)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", jump.Address, err)
+	}
+	conn, err := d.Dial("tcp", jump.Address)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", jump.Address, err)
+	}
+	client, err := sshClient(conn, jump.Address, config)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", jump.Address, err)
+	}
+	return client, nil
+}
+
+// sshClient starts an SSH connection over conn, closing conn if the handshake fails
+func sshClient(conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		// the ssh package only has a typed authentication error on the server side, ServerAuthError, and
+		// formats the client's, so it is told apart here where the handshake fails
+		if strings.Contains(err.Error(), "ssh: unable to authenticate") {
+			return nil, &authError{err: err}
+		}
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// tunnelConn is a connection to a device through jump hosts, closing them when it is closed
+type tunnelConn struct {
+	net.Conn
+	hops []io.Closer
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.closeHops()
+	return err
+}
+
+// closeHops closes the jump host connections, the last one first
+func (c *tunnelConn) closeHops() {
+	for i := len(c.hops) - 1; i >= 0; i-- {
+		c.hops[i].Close()
+	}
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpHost is an SSH server accepting the username and password jump that forwards direct-tcpip channels,
+// recording the addresses it forwarded to
+type jumpHost struct {
+	addr string
+	key  ssh.PublicKey
+
+	mu        sync.Mutex
+	forwarded []string
+}
+
+func newJumpHost(t *testing.T) *jumpHost {
+	t.Helper()
+	signer := newHostKey(t)
+	j := &jumpHost{key: signer.PublicKey()}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "jump" && string(password) == "jump" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", c.User())
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	j.addr = l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go j.serve(conn, config)
+		}
+	}()
+	return j
+}
+
+func (j *jumpHost) serve(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+			continue
+		}
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		addr := net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port)))
+		upstream, err := net.Dial("tcp", addr)
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, reqs, err := newChannel.Accept()
+		if err != nil {
+			upstream.Close()
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+		j.mu.Lock()
+		j.forwarded = append(j.forwarded, addr)
+		j.mu.Unlock()
+		go pipe(channel, upstream)
+	}
+}
+
+func (j *jumpHost) jump() JumpHost {
+	return JumpHost{Address: j.addr, Username: "jump", Password: "jump", HostKey: string(ssh.MarshalAuthorizedKey(j.key))}
+}
+
+func (j *jumpHost) forwards() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]string(nil), j.forwarded...)
+}
+
+// pipe copies between a and b until either is closed, then closes both
+func pipe(a, b io.ReadWriteCloser) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// socksProxy is a SOCKS5 server requiring the username and password socks, recording the addresses it
+// connected to
+type socksProxy struct {
+	addr      string
+	mu        sync.Mutex
+	connected []string
+}
+
+func newSOCKSProxy(t *testing.T) *socksProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	p := &socksProxy{addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+// serve handles a single CONNECT with username and password authentication, as in RFC 1928 and RFC 1929
+func (p *socksProxy) serve(conn net.Conn) {
+	read := func(n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil
+		}
+		return buf
+	}
+	greeting := read(2)
+	if greeting == nil || read(int(greeting[1])) == nil {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 2})
+	auth := read(2)
+	if auth == nil {
+		conn.Close()
+		return
+	}
+	user := string(read(int(auth[1])))
+	password := string(read(int(read(1)[0])))
+	if user != "socks" || password != "socks" {
+		conn.Write([]byte{1, 1})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	request := read(4)
+	if request == nil {
+		conn.Close()
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		host = net.IP(read(4)).String()
+	case 3:
+		host = string(read(int(read(1)[0])))
+	case 4:
+		host = net.IP(read(16)).String()
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(read(2)))))
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	p.mu.Lock()
+	p.connected = append(p.connected, addr)
+	p.mu.Unlock()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipe(conn, upstream)
+}
+
+func (p *socksProxy) connections() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.connected...)
+}
+
+func TestJumpHostChain(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	bastion, inner := newJumpHost(t), newJumpHost(t)
+	s := newTestService(WithSSHRetry(1, 0, 0), WithRoutes(Route{JumpHosts: []JumpHost{bastion.jump(), inner.jump()}}))
+
+	op := pushedOperation(t, s, savedItem(d.addr))
+	if !op.Success {
+		t.Fatalf("expected the push through both jump hosts to succeed, got %+v", op)
+	}
+	if got := bastion.forwards(); len(got) != 1 || got[0] != inner.addr {
+		t.Errorf("expected the bastion to forward to the inner jump host, got %v", got)
+	}
+	if got := inner.forwards(); len(got) != 1 || got[0] != d.addr {
+		t.Errorf("expected the inner jump host to forward to the device, got %v", got)
+	}
+}
+
+func TestJumpHostKeyMismatch(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	bastion, other := newJumpHost(t), newJumpHost(t)
+	jump := bastion.jump()
+	jump.HostKey = other.jump().HostKey
+	s := newTestService(WithSSHRetry(1, 0, 0), WithRoutes(Route{JumpHosts: []JumpHost{jump}}))
+
+	op := pushedOperation(t, s, savedItem(d.addr))
+	if op.Success || len(bastion.forwards()) != 0 || len(d.received()) != 0 {
+		t.Errorf("expected a jump host with the wrong key not to be used, got %+v", op)
+	}
+}
+
+func TestJumpHostUnreachableDevice(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	bastion := newJumpHost(t)
+	s := newTestService(WithSSHRetry(1, 0, 0), WithRoutes(Route{JumpHosts: []JumpHost{bastion.jump()}}))
+
+	op := pushedOperation(t, s, savedItem(l.Addr().String()))
+	if op.Success || op.ErrorClass != ErrorRefused {
+		t.Errorf("expected the jump host's refusal to be classed refused, got %+v", op)
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	d, direct := newFakeDevice(t, "router", true), newFakeDevice(t, "switch", true)
+	p := newSOCKSProxy(t)
+	s := newTestService(WithSSHRetry(1, 0, 0), WithRoutes(Route{
+		Hosts:  []string{d.addr},
+		SOCKS5: &SOCKS5Proxy{Address: p.addr, Username: "socks", Password: "socks"},
+	}))
+
+	if op := pushedOperation(t, s, savedItem(d.addr)); !op.Success {
+		t.Fatalf("expected the push through the proxy to succeed, got %+v", op)
+	}
+	if op := pushedOperation(t, s, savedItem(direct.addr)); !op.Success {
+		t.Fatalf("expected the push to a device without a route to succeed, got %+v", op)
+	}
+	if got := p.connections(); len(got) != 1 || got[0] != d.addr {
+		t.Errorf("expected only the routed device to be reached through the proxy, got %v", got)
+	}
+}
+
+func TestSOCKS5ProxyToJumpHost(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	p, bastion := newSOCKSProxy(t), newJumpHost(t)
+	s := newTestService(WithSSHRetry(1, 0, 0), WithRoutes(Route{
+		JumpHosts: []JumpHost{bastion.jump()},
+		SOCKS5:    &SOCKS5Proxy{Address: p.addr, Username: "socks", Password: "socks"},
+	}))
+
+	if op := pushedOperation(t, s, savedItem(d.addr)); !op.Success {
+		t.Fatalf("expected the push to succeed, got %+v", op)
+	}
+	if got := p.connections(); len(got) != 1 || got[0] != bastion.addr {
+		t.Errorf("expected the proxy to connect to the jump host, got %v", got)
+	}
+	if got := bastion.forwards(); len(got) != 1 || got[0] != d.addr {
+		t.Errorf("expected the jump host to forward to the device, got %v", got)
+	}
+}
+
+func TestRouteTo(t *testing.T) {
+	s := newTestService(WithSSHRetry(1, 0, 0), WithRoutes(
+		Route{Hosts: []string{"10.1.*", "core-?:22"}, SOCKS5: &SOCKS5Proxy{Address: "proxy:1080"}},
+		Route{JumpHosts: []JumpHost{{Address: "bastion:22"}}},
+	))
+	tests := []struct {
+		hostname string
+		want     int
+	}{
+		{"10.1.0.1:22", 0},
+		{"core-1:22", 0},
+		{"10.2.0.1:22", 1},
+		{"core-10:22", 1},
+	}
+	for _, tt := range tests {
+		if got := s.routeTo(tt.hostname); got != &s.routes[tt.want] {
+			t.Errorf("%s: got %+v, want route %d", tt.hostname, got, tt.want)
+		}
+	}
+	if got := newTestService(WithSSHRetry(1, 0, 0)).routeTo("10.1.0.1:22"); got != nil {
+		t.Errorf("expected no route without routes, got %+v", got)
+	}
+}
+
+func TestValidateRoute(t *testing.T) {
+	jump := JumpHost{Address: "bastion:22", Username: "jump", Password: "jump", InsecureIgnoreHostKey: true}
+	tests := []struct {
+		route Route
+		valid bool
+	}{
+		{Route{JumpHosts: []JumpHost{jump}}, true},
+		{Route{Hosts: []string{"10.1.*"}, SOCKS5: &SOCKS5Proxy{Address: "proxy:1080"}}, true},
+		{Route{Hosts: []string{"10.1.["}, JumpHosts: []JumpHost{jump}}, false},
+		{Route{SOCKS5: &SOCKS5Proxy{Address: "proxy"}}, false},
+		{Route{JumpHosts: []JumpHost{{Address: "bastion:22", Username: "jump", InsecureIgnoreHostKey: true}}}, false},
+		{Route{JumpHosts: []JumpHost{{Address: "bastion:22", Username: "jump", Password: "jump"}}}, false},
+		{Route{JumpHosts: []JumpHost{{Address: "bastion:22", Username: "jump", Password: "jump", HostKey: "ssh-ed25519 invalid"}}}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateRoute(tt.route); (err == nil) != tt.valid {
+			t.Errorf("%+v: got %v", tt.route, err)
+		}
+	}
+}
+
+func TestTunnelConnClosesJumpHosts(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	bastion := newJumpHost(t)
+	s := newTestService(WithSSHRetry(1, 0, 0), WithRoutes(Route{JumpHosts: []JumpHost{bastion.jump()}}))
+
+	conn, err := s.dialDevice(s.logger, d.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel, ok := conn.(*tunnelConn)
+	if !ok || len(tunnel.hops) != 1 {
+		t.Fatalf("expected a tunnel through one jump host, got %T", conn)
+	}
+	client := tunnel.hops[0].(*ssh.Client)
+	conn.Close()
+	done := make(chan error, 1)
+	go func() { done <- client.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("expected closing the tunnel to close the jump host connection")
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Save policies deciding when the running configuration of a device is copied to its startup configuration
+// after a change. Saving is always available on demand with POST /device/{host}/save
+const (
+	// SaveAlways saves after every successful change, before the change's response is sent
+	SaveAlways = "always"
+	// SaveIdle saves once no change has been made to the device for the idle period, so that a Terraform
+	// apply touching many interfaces on a device is saved once
+	SaveIdle = "idle"
+	// SaveNever leaves saving to POST /device/{host}/save
+	SaveNever = "never"
+
+	DefaultSavePolicy = SaveNever
+)
+
+// SavePolicies are the supported save policies
+var SavePolicies = []string{SaveAlways, SaveIdle, SaveNever}
+
+const (
+	// saveTimeout is how long copying the running configuration to the startup configuration can take
+	saveTimeout = 2 * time.Minute
+	// defaultSaveIdle is how long a device has to be left unchanged before it is saved with SaveIdle
+	defaultSaveIdle = time.Minute
+)
+
+// errSaveUnsupported is returned when an item's transport has no way to save the configuration
+var errSaveUnsupported = errors.New("gnmi has no operation saving the running configuration, save over another transport")
+
+// saveScheduler runs the delayed saves of the idle policy, restarting the delay of a device every time it is
+// changed
+type saveScheduler struct {
+	sync.Mutex
+	policy  string
+	idle    time.Duration
+	pending map[string]*time.Timer
+}
+
+func newSaveScheduler() *saveScheduler {
+	return &saveScheduler{policy: DefaultSavePolicy, idle: defaultSaveIdle, pending: map[string]*time.Timer{}}
+}
+
+// schedule runs save once host has not been scheduled again for the idle period
+func (q *saveScheduler) schedule(host string, save func()) {
+	q.Lock()
+	defer q.Unlock()
+	if timer, ok := q.pending[host]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(q.idle, func() {
+		q.Lock()
+		// a timer that was replaced while it fired leaves the save to its replacement
+		if q.pending[host] != timer {
+			q.Unlock()
+			return
+		}
+		delete(q.pending, host)
+		q.Unlock()
+		save()
+	})
+	q.pending[host] = timer
+}
+
+// cancel drops the pending save of host, as it is being saved now
+func (q *saveScheduler) cancel(host string) {
+	q.Lock()
+	defer q.Unlock()
+	if timer, ok := q.pending[host]; ok {
+		timer.Stop()
+		delete(q.pending, host)
+	}
+}
+
+// savePush returns the push saving the running configuration of item's device over its transport
+func (s *Service) savePush(item Item) (*push, error) {
+	driver, err := driverFor(item.Platform)
+	if err != nil {
+		return nil, err
+	}
+	sshConfig := loadSshConfig(item)
+	p := &push{platform: driver.Platform(), transport: item.Transport}
+
+	switch item.Transport {
+	case TransportNETCONF:
+		p.apply = func(logger *slog.Logger, rec *transcript, hostname string) error {
+			return s.saveNETCONF(logger, rec, hostname, sshConfig)
+		}
+	case TransportRESTCONF:
+		p.apply = func(logger *slog.Logger, rec *transcript, hostname string) error {
+			return s.saveRESTCONF(logger, rec, item)
+		}
+	case TransportGNMI:
+		return nil, errSaveUnsupported
+	default:
+		p.apply = func(logger *slog.Logger, rec *transcript, hostname string) error {
+			return s.saveConfig(logger, rec, driver, hostname, sshConfig)
+		}
+	}
+	return p, nil
+}
+
+// save saves the running configuration of item's device, recording it as a save operation whose ID is
+// returned. A pending idle save of the device is dropped
+func (s *Service) save(ctx context.Context, item Item) ([]string, error) {
+	s.saves.cancel(item.Host)
+	p, err := s.savePush(item)
+	if err != nil {
+		return nil, err
+	}
+	return s.pushConfig(ctx, "save", p, []string{item.Host}, item.Password)
+}
+
+// saveAfterChange applies the save policy once a change to item's device has been pushed, returning
+// operationIDs with the ID of the save operation if the device was saved straight away. A failed save is
+// logged but doesn't fail the change, which has been applied
+func (s *Service) saveAfterChange(ctx context.Context, item Item, operationIDs []string) []string {
+	logger := loggerFrom(ctx).With("host", item.Host)
+	if s.saves.policy != SaveNever && item.Transport == TransportGNMI {
+		logger.Warn("not saving configuration", "error", errSaveUnsupported)
+		return operationIDs
+	}
+	switch s.saves.policy {
+	case SaveAlways:
+		saveIDs, err := s.save(ctx, item)
+		if err != nil {
+			logger.Error("error saving configuration", "error", err)
+		}
+		return append(operationIDs, saveIDs...)
+	case SaveIdle:
+		s.saves.schedule(item.Host, func() {
+			ctx := withNamespace(context.WithValue(context.Background(), loggerKey, s.logger), item.Namespace)
+			if _, err := s.save(ctx, item); err != nil {
+				s.logger.Error("error saving configuration", "host", item.Host, "error", err)
+			}
+		})
+	}
+	return operationIDs
+}
+
+// itemOnHost returns the item configuring host, the first by name if there are several. Does not lock access
+// to the itemService, expects this to be done by the calling method
+func (s *Service) itemOnHost(host string) (Item, bool) {
+	var names []string
+	for name, item := range s.items {
+		if item.Host == host {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return Item{}, false
+	}
+	sort.Strings(names)
+	return s.items[names[0]], true
+}
+
+// SaveDevice handles saving the running configuration of a device to its startup configuration, reaching
+// it with the credentials and transport of an item configured on it
+func (s *Service) SaveDevice(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	host := mux.Vars(r)["host"]
+
+	s.RLock()
+	item, ok := s.itemOnHost(host)
+	tags := s.deviceTags(host)
+	s.RUnlock()
+	if !ok || item.Namespace != namespaceFrom(r.Context()) {
+		httpError(w, fmt.Sprintf("no item is configured on %s", host), http.StatusNotFound, CodeNotFound)
+		return
+	}
+	r, allowed := s.changeAllowed(w, r, host, tags, nil)
+	if !allowed {
+		return
+	}
+
+	operationIDs, err := s.save(r.Context(), item)
+	if errors.Is(err, errSaveUnsupported) {
+		writeError(w, http.StatusUnprocessableEntity, &Error{Code: CodeInvalidField, Message: err.Error(), Field: "transport"})
+		return
+	}
+	setOperationIDs(w, operationIDs)
+	if err != nil {
+		logger.Error("error saving configuration", "host", host, "error", err)
+		httpError(w, fmt.Sprintf("unable to save configuration on %s: %s", host, err), http.StatusBadGateway, CodeDeviceError)
+		return
+	}
+
+	s.operations.RLock()
+	op := Operation{ID: operationIDs[0], Host: host}
+	if stored, ok := s.operations.operations[op.ID]; ok {
+		op = *stored
+	}
+	s.operations.RUnlock()
+	op.Transcript = nil
+	err = writeJSON(w, op)
+	if err != nil {
+		logger.Error("error sending response", "error", err)
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// serve sends a request with a JSON body to the service's handler
+func serve(s *Service, method, path string, body interface{}) *httptest.ResponseRecorder {
+	return serveWithHeader(s, method, path, body, nil)
+}
+
+// serveWithHeader is serve sending header as well
+func serveWithHeader(s *Service, method, path string, body interface{}, header http.Header) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		encoded, _ := json.Marshal(body)
+		reader = strings.NewReader(string(encoded))
+	}
+	req := httptest.NewRequest(method, path, reader)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "token")
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func savedItem(addr string) Item {
+	item := deviceItem(addr)
+	item.IntfType, item.Number = "GigabitEthernet", "1"
+	return itemDefaults(item)
+}
+
+func count(commands []string, cmd string) int {
+	n := 0
+	for _, c := range commands {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSaveDevice(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	item := savedItem(d.addr)
+	item.Namespace = DefaultNamespace
+	s := newTestService(WithSavePolicy(SaveNever, 0))
+	s.items["router"] = item
+
+	rec := serve(s, http.MethodPost, "/device/"+d.addr+"/save", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	var op Operation
+	if err := json.Unmarshal(rec.Body.Bytes(), &op); err != nil {
+		t.Fatal(err)
+	}
+	if op.Type != "save" || !op.Success || rec.Header().Get(OperationIDHeader) != op.ID {
+		t.Errorf("unexpected operation %+v", op)
+	}
+	if got := d.received(); got[len(got)-1] != "write memory" {
+		t.Errorf("expected the configuration to be saved, got %q", got)
+	}
+
+	if rec := serve(s, http.MethodPost, "/device/192.0.2.1:22/save", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown device to be not found, got %d", rec.Code)
+	}
+
+	item.Transport = TransportGNMI
+	s.items["router"] = item
+	if rec := serve(s, http.MethodPost, "/device/"+d.addr+"/save", nil); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected saving over gnmi to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestDriverSave(t *testing.T) {
+	tests := []struct {
+		driver   Driver
+		hostname string
+		save     string
+	}{
+		{iosxeDriver, "router", "write memory"},
+		{nxosDriver, "switch", "copy running-config startup-config"},
+		{iosxrDriver, "RP/0/RSP0/CPU0:router", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.driver.Platform(), func(t *testing.T) {
+			d := newFakeDevice(t, tt.hostname, true)
+			s := newTestService()
+			err := s.saveConfig(s.logger, newTranscript(s.redactor), tt.driver, d.addr, loadSshConfig(deviceItem(d.addr)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := d.received()
+			if tt.save == "" && got[len(got)-1] != "terminal width 0" {
+				t.Errorf("expected nothing to be sent as commits are persisted, got %q", got)
+			}
+			if tt.save != "" && got[len(got)-1] != tt.save {
+				t.Errorf("expected %s, got %q", tt.save, got)
+			}
+		})
+	}
+}
+
+func TestSaveAlways(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService(WithSavePolicy(SaveAlways, 0))
+
+	rec := serve(s, http.MethodPost, "/item", savedItem(d.addr))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	got := d.received()
+	if count(got, "write memory") != 1 || got[len(got)-1] != "write memory" {
+		t.Errorf("expected the change to be saved, got %q", got)
+	}
+	if ids := rec.Header().Values(OperationIDHeader); len(ids) != 2 {
+		t.Errorf("expected the push and save operations, got %q", ids)
+	}
+}
+
+func TestSaveAlwaysSkipsFailedChange(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	d.errors["interface GigabitEthernet 1"] = "% Invalid input detected at '^' marker."
+	s := newTestService(WithSavePolicy(SaveAlways, 0))
+
+	serve(s, http.MethodPost, "/item", savedItem(d.addr))
+	if got := d.received(); slices.Contains(got, "write memory") {
+		t.Errorf("expected a failed change not to be saved, got %q", got)
+	}
+}
+
+func TestSaveIdle(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService(WithSavePolicy(SaveIdle, 100*time.Millisecond))
+	item := savedItem(d.addr)
+
+	serve(s, http.MethodPost, "/item", item)
+	item.Description = "uplink"
+	serve(s, http.MethodPut, "/item/"+d.addr, item)
+	if got := d.received(); slices.Contains(got, "write memory") {
+		t.Fatalf("expected the save to wait for the device to be idle, got %q", got)
+	}
+
+	// the save is done once it is recorded, which is after the device has received it
+	saved := func() *Operation {
+		s.operations.RLock()
+		defer s.operations.RUnlock()
+		ops := s.operations.sorted(d.addr)
+		if last := ops[len(ops)-1]; last.Type == "save" {
+			return last
+		}
+		return nil
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for saved() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if op := saved(); op == nil || !op.Success {
+		t.Errorf("expected the save to be recorded, got %+v", op)
+	}
+	if n := count(d.received(), "write memory"); n != 1 {
+		t.Errorf("expected both changes to be saved once, got %d saves", n)
+	}
+}
+
+func TestSaveNETCONF(t *testing.T) {
+	f := newFakeNETCONF(t, capabilityBase10, capabilityBase11)
+	s := newTestService()
+	if err := s.saveNETCONF(s.logger, newTranscript(s.redactor), f.addr, loadSshConfig(deviceItem(f.addr))); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.received(); !slices.Equal(got, []string{"save-config", "close-session"}) {
+		t.Errorf("got operations %q", got)
+	}
+}
+
+func TestSaveRESTCONF(t *testing.T) {
+	f := newFakeRESTCONF(t)
+	s := f.service()
+	if err := s.saveRESTCONF(s.logger, newTranscript(s.redactor), f.item()); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.received(); !slices.Equal(got, []string{"POST /restconf/operations/cisco-ia:save-config"}) {
+		t.Errorf("got requests %q", got)
+	}
+}
@@ -1,9 +1,15 @@
 package server
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -12,57 +18,211 @@ import (
 type Service struct {
 	connectionString string
 	items            map[string]Item
+	metrics          *metrics
+	logger           *slog.Logger
+	operations       *operationStore
+	redactor         *redactor
+	openAPI          *openAPI
+	checkResponses   bool
+	templates        *templateRegistry
+	templateReload   time.Duration
+	restconf         *http.Client
+	gnmiTLS          *tls.Config
+	saves            *saveScheduler
+	backups          *backupStore
+	events           *eventBus
+	webhooks         *webhookConfig
+	deadLetters      *deadLetters
+	retry            retryPolicy
+	routes           []Route
+	calendar         *calendar
+	changes          *changeQueue
+	approvalTags     []string
+	tokens           map[string]string
+	cluster          *cluster
+	jobs             *jobStore
+	grpcAddress      string
+	grpcTLS          *tls.Config
+	// router is the router of Handler for the requests the Service makes to itself, built once by
+	// selfHandler
+	router     http.Handler
+	routerOnce sync.Once
+	// revision is the last revision an item was stored with
+	revision int64
 	sync.RWMutex
 }
 
 // NewService returns a Service with a connectionString configured and can be a map of items setup. The items map can be empty,
-// or can contain items
-func NewService(connectionString string, items map[string]Item) *Service {
-	return &Service{
+// or can contain items. Optional behaviour is configured with opts
+func NewService(connectionString string, items map[string]Item, opts ...Option) *Service {
+	m := newMetrics()
+	m.items.Set(float64(len(items)))
+	// items seeded before platforms and transports were supported are all IOS-XE configured over the CLI,
+	// and those seeded before namespaces in the default namespace. Seeded items are given revisions in the
+	// order of their names, so that instances of a cluster seeded alike agree on them
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var revision int64
+	for _, name := range names {
+		item := itemDefaults(items[name])
+		if item.Namespace == "" {
+			item.Namespace = DefaultNamespace
+		}
+		revision++
+		item.Revision = revision
+		items[name] = item
+	}
+	s := &Service{
 		connectionString: connectionString,
 		items:            items,
+		metrics:          m,
+		logger:           newLogger(),
+		operations:       newOperationStore(),
+		redactor:         newRedactor(),
+		openAPI:          mustOpenAPI(),
+		templates:        newTemplateRegistry(),
+		restconf:         newRESTCONFClient(nil),
+		saves:            newSaveScheduler(),
+		backups:          newBackupStore(),
+		events:           newEventBus(),
+		webhooks:         &webhookConfig{attempts: defaultWebhookAttempts, backoff: defaultWebhookBackoff},
+		deadLetters:      &deadLetters{},
+		retry:            retryPolicy{attempts: 1},
+		calendar:         &calendar{},
+		changes:          newChangeQueue(),
+		jobs:             newJobStore(),
+		revision:         revision,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	s.startWebhooks()
+	s.startCluster()
+	return s
 }
 
-// ListenAndServe registers the routes to the server and starts the server on the host:port configured in Service
-func (s *Service) ListenAndServe() error {
+// Handler returns the router with every route of the server registered under the prefix of each version
+// of the API, and unversioned for the clients from before the API had versions
+func (s *Service) Handler() http.Handler {
 	r := mux.NewRouter()
+	for _, version := range APIVersions {
+		s.register(r.PathPrefix("/v" + version).Subrouter())
+	}
+	s.register(r)
+	return r
+}
 
-	// Each handler is wrapped in logs() and auth() to log out the method and path and to
-	// ensure that a non-empty Authorization header is present
-	r.HandleFunc("/item", logs(auth(s.PostItem))).Methods("POST")
-	r.HandleFunc("/item", logs(auth(s.GetItems))).Methods("GET")
-	r.HandleFunc("/item/{name}", logs(auth(s.GetItem))).Methods("GET")
-	r.HandleFunc("/item/{name}", logs(auth(s.PutItem))).Methods("PUT")
-	r.HandleFunc("/item/{name}", logs(auth(s.DeleteItem))).Methods("DELETE")
+// selfHandler returns the router the Service makes its own requests with, such as the replays of queued
+// changes and the RPCs of the gRPC API, building it the first time it is needed
+func (s *Service) selfHandler() http.Handler {
+	s.routerOnce.Do(func() { s.router = s.Handler() })
+	return s.router
+}
+
+// register registers every route of the server on r
+func (s *Service) register(r *mux.Router) {
+	// The routes of what belongs to a namespace are served in the namespace of the token, or the default
+	// namespace, and under the namespace they name
+	for _, prefix := range []string{"", "/namespace/{namespace}"} {
+		r.HandleFunc(prefix+"/item", s.handle(s.PostItem)).Methods("POST")
+		r.HandleFunc(prefix+"/item", s.handleLocal(s.GetItems)).Methods("GET")
+		r.HandleFunc(prefix+"/item/{name}", s.handleLocal(s.GetItem)).Methods("GET")
+		r.HandleFunc(prefix+"/item/{name}", s.handle(s.PutItem)).Methods("PUT")
+		r.HandleFunc(prefix+"/item/{name}", s.handle(s.PatchItem)).Methods("PATCH")
+		r.HandleFunc(prefix+"/item/{name}", s.handle(s.DeleteItem)).Methods("DELETE")
+		r.HandleFunc(prefix+"/item/{name}/config", s.handleLocal(s.GetItemConfig)).Methods("GET")
+		r.HandleFunc(prefix+"/device/{host}/save", s.handle(s.SaveDevice)).Methods("POST")
+		r.HandleFunc(prefix+"/device/{host}/backup", s.handle(s.GetBackups)).Methods("GET")
+		r.HandleFunc(prefix+"/device/{host}/backup/{version}", s.handle(s.GetBackup)).Methods("GET")
+		r.HandleFunc(prefix+"/device/{host}/diff", s.handle(s.GetBackupDiff)).Methods("GET")
+		r.HandleFunc(prefix+"/change", s.handle(s.GetChanges)).Methods("GET")
+		r.HandleFunc(prefix+"/change/{id}", s.handle(s.GetChange)).Methods("GET")
+		r.HandleFunc(prefix+"/change/{id}", s.handle(s.CancelChange)).Methods("DELETE")
+		r.HandleFunc(prefix+"/change/{id}/approve", s.handle(s.ApproveChange)).Methods("POST")
+		r.HandleFunc(prefix+"/change/{id}/reject", s.handle(s.RejectChange)).Methods("POST")
+		r.HandleFunc(prefix+"/event", s.handle(s.GetEvents)).Methods("GET")
+		r.HandleFunc(prefix+"/operation", s.handle(s.GetOperations)).Methods("GET")
+		r.HandleFunc(prefix+"/operation/{id}", s.handle(s.GetOperation)).Methods("GET")
+		r.HandleFunc(prefix+"/window", s.handle(s.GetWindows)).Methods("GET")
+		r.HandleFunc(prefix+"/window", s.handle(s.PostWindow)).Methods("POST")
+		r.HandleFunc(prefix+"/window/{name}", s.handle(s.DeleteWindow)).Methods("DELETE")
+		r.HandleFunc(prefix+"/webhook/dead-letter", s.handle(s.GetDeadLetters)).Methods("GET")
+	}
+	r.HandleFunc("/template", s.handle(s.GetTemplates)).Methods("GET")
+	r.HandleFunc("/cluster", s.handleLocal(s.GetCluster)).Methods("GET")
+
+	// The instances of a cluster authenticate to each other with the secret of the cluster, and call each
+	// other too often to log every call
+	r.HandleFunc("/cluster/vote", s.metrics.instrument(s.clusterAuth(s.PostClusterVote))).Methods("POST")
+	r.HandleFunc("/cluster/append", s.metrics.instrument(s.clusterAuth(s.PostClusterAppend))).Methods("POST")
+
+	// The OpenAPI document and the metrics endpoint are left unauthenticated so that they can be
+	// fetched by tooling and scraped by Prometheus
+	r.HandleFunc("/openapi.json", s.metrics.instrument(s.logs(s.GetOpenAPI))).Methods("GET")
+	r.Handle("/metrics", s.metrics.handler()).Methods("GET")
+}
 
-	log.Printf("Starting server on %s", s.connectionString)
-	err := http.ListenAndServe(s.connectionString, r)
+// ListenAndServe loads the templates, registers the routes to the server and starts the server on the host:port
+// configured in Service, and the gRPC server on its own host:port if one is configured
+func (s *Service) ListenAndServe() error {
+	if s.templates.dir != "" {
+		if err := s.templates.load(); err != nil {
+			return err
+		}
+		if s.templateReload > 0 {
+			go s.templates.watch(context.Background(), s.logger, s.templateReload)
+		}
+	}
+	if s.grpcAddress != "" {
+		// the tokens and item credentials sent over the gRPC API are only sent in the clear on the host
+		if s.grpcTLS == nil && !loopback(s.grpcAddress) {
+			return fmt.Errorf("the gRPC API can only be served without TLS on a loopback address, not %s", s.grpcAddress)
+		}
+		listener, err := net.Listen("tcp", s.grpcAddress)
+		if err != nil {
+			return err
+		}
+		s.logger.Info("starting grpc server", "address", s.grpcAddress)
+		go func() {
+			if err := s.GRPCServer().Serve(listener); err != nil {
+				s.logger.Error("grpc server stopped", "error", err)
+			}
+		}()
+	}
+	s.logger.Info("starting server", "address", s.connectionString, "templates", s.templates.list())
+	err := http.ListenAndServe(s.connectionString, s.Handler())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// logs prints the Method and Path to stdout
-func logs(handlerFunc http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		method := r.Method
-		path := r.URL.Path
-		log.Printf("%s %s", method, path)
-		handlerFunc(w, r)
-		return
-	}
+// handle wraps handlerFunc in instrument() to record request counts and latency, logs() to log the
+// request with its request ID, auth() to ensure that a valid Authorization header is present,
+// versioned() to negotiate the version of the API, toLeader() to forward the request to the leader of
+// the cluster and validateRequest() to check the request body against the OpenAPI document. If response
+// checking is enabled, responses that do not match the document are logged
+func (s *Service) handle(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return s.wrap(s.toLeader(s.validated(handlerFunc)))
 }
 
-// auth checks that a non-empty authorization header has been sent with the request
-func auth(handlerFunc http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("Authorization") == "" {
-			http.Error(w, "Please supply and Authorization token", http.StatusUnauthorized)
-			return
-		}
-		handlerFunc(w, r)
-		return
+// handleLocal is handle for the routes every instance of a cluster answers itself, from its replica of
+// the items
+func (s *Service) handleLocal(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return s.wrap(s.validated(handlerFunc))
+}
+
+func (s *Service) validated(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	handlerFunc = s.validateRequest(handlerFunc)
+	if s.checkResponses {
+		handlerFunc = s.validateResponses(handlerFunc)
 	}
+	return handlerFunc
+}
+
+func (s *Service) wrap(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return s.metrics.instrument(s.logs(s.auth(versioned(handlerFunc))))
 }
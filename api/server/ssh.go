@@ -0,0 +1,228 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// dialTimeout limits how long establishing the SSH connection to a device can take
+	dialTimeout = 15 * time.Second
+	// commandTimeout is how long to wait for the prompt after sending a command
+	commandTimeout = 30 * time.Second
+	// showTimeout is how long to wait for the whole running configuration to be shown
+	showTimeout = 2 * time.Minute
+)
+
+// morePrompt is shown by devices that page output
+var morePrompt = regexp.MustCompile(`-+ ?\(?[Mm]ore\)? ?-+`)
+
+func loadSshConfig(item Item) *ssh.ClientConfig {
+	sshConf := ssh.Config{}
+	sshConf.SetDefaults()
+	sshConf.KeyExchanges = append(
+		sshConf.KeyExchanges,
+		"diffie-hellman-group-exchange-sha256",
+		"diffie-hellman-group-exchange-sha1",
+	)
+
+	config := &ssh.ClientConfig{
+		User: item.Username,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(item.Password),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Config:          sshConf,
+		Timeout:         dialTimeout,
+	}
+	return config
+}
+
+// cliSession is an interactive shell on a device. Commands are sent one at a time and the output is read
+// until the device shows its prompt again, so that each command's output can be checked for errors
+type cliSession struct {
+	logger  *slog.Logger
+	rec     *transcript
+	prompt  *regexp.Regexp
+	conn    *ssh.Client
+	session *ssh.Session
+	stdin   io.Writer
+	output  chan string
+	readErr error
+	// last is the output of the last command, ending with the prompt it was read up to
+	last   string
+	done   chan struct{}
+	closed func()
+}
+
+// dialSSHOnce opens an SSH session on hostname along its route, recording failures and the open session in the metrics
+func (s *Service) dialSSHOnce(logger *slog.Logger, hostname string, config *ssh.ClientConfig) (*ssh.Client, *ssh.Session, error) {
+	logger.Debug("dialing device")
+	netConn, err := s.dialDevice(logger, hostname)
+	var conn *ssh.Client
+	if err == nil {
+		conn, err = sshClient(netConn, hostname, config)
+	}
+	if err != nil {
+		s.metrics.sshFailure(hostname, err)
+		logger.Error("ssh dial failed", "error", err)
+		return nil, nil, err
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		s.metrics.sshFailures.WithLabelValues(hostname, "session").Inc()
+		logger.Error("ssh session failed", "error", err)
+		return nil, nil, err
+	}
+	s.metrics.sshSessions.Inc()
+	logger.Debug("ssh session opened")
+	return conn, session, nil
+}
+
+// dialCLI opens a shell on hostname and waits for the first prompt. The caller must close the session
+func (s *Service) dialCLI(logger *slog.Logger, rec *transcript, hostname string, config *ssh.ClientConfig, prompt *regexp.Regexp) (*cliSession, error) {
+	conn, session, err := s.dialSSH(logger, rec, hostname, config)
+	if err != nil {
+		return nil, err
+	}
+
+	cli := &cliSession{
+		logger:  logger,
+		rec:     rec,
+		prompt:  prompt,
+		conn:    conn,
+		session: session,
+		output:  make(chan string, 64),
+		done:    make(chan struct{}),
+		closed:  s.metrics.sshSessions.Dec,
+	}
+	if err := cli.start(); err != nil {
+		cli.close()
+		return nil, err
+	}
+	return cli, nil
+}
+
+// start requests a terminal, starts the shell and waits for the device to show its prompt
+func (c *cliSession) start() error {
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          0,     // disable echoing
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+	// You can use session.Run() here but that only works
+	// if you need a run a single command or you commands
+	// are independent of each other.
+	err := c.session.RequestPty("xterm", 80, 40, modes)
+	if err != nil {
+		return fmt.Errorf("request for pseudo terminal failed: %s", err)
+	}
+	stdout, err := c.session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("request for stdout pipe failed: %s", err)
+	}
+	c.stdin, err = c.session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("request for stdin pipe failed: %s", err)
+	}
+	err = c.session.Shell()
+	if err != nil {
+		return fmt.Errorf("failed to start shell: %s", err)
+	}
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				select {
+				case c.output <- string(buf[:n]):
+				case <-c.done:
+					return
+				}
+			}
+			if err != nil {
+				c.readErr = err
+				close(c.output)
+				return
+			}
+		}
+	}()
+
+	banner, err := c.read(commandTimeout)
+	if err != nil {
+		return fmt.Errorf("waiting for prompt: %w", err)
+	}
+	c.rec.received(banner)
+	return nil
+}
+
+// send writes cmd to the device and returns its output once the prompt is shown again
+func (c *cliSession) send(cmd string) (string, error) {
+	return c.sendTimeout(cmd, commandTimeout)
+}
+
+// sendTimeout is send for commands that can take longer than usual, such as a commit
+func (c *cliSession) sendTimeout(cmd string, timeout time.Duration) (string, error) {
+	c.logger.Debug("sending command", "command", c.rec.redactor.redact(cmd, c.rec.secrets...))
+	c.rec.sent(cmd)
+	if _, err := c.stdin.Write([]byte(cmd + "\n")); err != nil {
+		return "", err
+	}
+	output, err := c.read(timeout)
+	c.rec.received(output)
+	if err != nil {
+		c.logger.Error("reading device output failed", "command", cmd, "error", err)
+	}
+	return output, err
+}
+
+// read collects output until it ends with the prompt, answering any paging prompt on the way
+func (c *cliSession) read(timeout time.Duration) (string, error) {
+	var output strings.Builder
+	deadline := time.After(timeout)
+	for {
+		select {
+		case chunk, ok := <-c.output:
+			if !ok {
+				if c.readErr != nil && !errors.Is(c.readErr, io.EOF) {
+					return output.String(), c.readErr
+				}
+				return output.String(), io.ErrUnexpectedEOF
+			}
+			if morePrompt.MatchString(chunk) {
+				chunk = morePrompt.ReplaceAllString(chunk, "")
+				if _, err := c.stdin.Write([]byte(" ")); err != nil {
+					return output.String(), err
+				}
+			}
+			output.WriteString(chunk)
+			if c.prompt.MatchString(output.String()) {
+				c.last = output.String()
+				return c.last, nil
+			}
+		case <-deadline:
+			return output.String(), fmt.Errorf("%w after %s", errPromptTimeout, timeout)
+		}
+	}
+}
+
+// privileged reports whether the device showed a privileged EXEC or configuration prompt last
+func (c *cliSession) privileged() bool {
+	return strings.HasSuffix(strings.TrimSpace(c.last), "#")
+}
+
+func (c *cliSession) close() {
+	close(c.done)
+	c.session.Close()
+	c.conn.Close()
+	c.closed()
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	templates "github.com/meirizal/terraform-experiment/api/template"
+)
+
+// The templates rendered for item operations. Each platform has its own, named with the platform as a
+// prefix, e.g. iosxe_interface_ethernet
+const (
+	templateInterface       = "interface_ethernet"
+	templateInterfaceDelete = "interface_ethernet_delete"
+)
+
+// templateName returns the name of the template for platform
+func templateName(platform, name string) string {
+	return platform + "_" + name
+}
+
+// Sources a template can be loaded from
+const (
+	templateSourceEmbedded = "embedded"
+	templateSourceOverride = "override"
+)
+
+// TemplateInfo describes a loaded template. Version is derived from the template content so it changes
+// whenever the template does
+type TemplateInfo struct {
+	Name    string    `json:"name"`
+	Source  string    `json:"source"`
+	Version string    `json:"version"`
+	Loaded  time.Time `json:"loaded"`
+}
+
+type loadedTemplate struct {
+	TemplateInfo
+	tmpl *template.Template
+}
+
+// templateRegistry holds the parsed configuration templates. The embedded defaults are always loaded, and
+// any template in the override directory replaces the default of the same name or adds a new template
+type templateRegistry struct {
+	sync.RWMutex
+	dir       string
+	templates map[string]*loadedTemplate
+	// signature of the override directory when it was last loaded, used to detect changes
+	signature string
+}
+
+func newTemplateRegistry() *templateRegistry {
+	r := &templateRegistry{}
+	if err := r.load(); err != nil {
+		// the embedded templates are covered by the tests so this can't happen at runtime
+		panic(err)
+	}
+	return r
+}
+
+// load parses and validates every template, replacing the loaded templates only if all of them are valid
+func (r *templateRegistry) load() error {
+	loaded := map[string]*loadedTemplate{}
+	err := fs.WalkDir(templates.FS, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != templates.Extension {
+			return err
+		}
+		source, err := fs.ReadFile(templates.FS, path)
+		if err != nil {
+			return err
+		}
+		t, err := parseTemplate(path, string(source), templateSourceEmbedded)
+		if err != nil {
+			return err
+		}
+		loaded[t.Name] = t
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var signature string
+	if r.dir != "" {
+		files, sig, err := r.overrideFiles()
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			source, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			t, err := parseTemplate(file, string(source), templateSourceOverride)
+			if err != nil {
+				return err
+			}
+			loaded[t.Name] = t
+		}
+		signature = sig
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.templates = loaded
+	r.signature = signature
+	return nil
+}
+
+// overrideFiles returns the templates in the override directory along with a signature of their names,
+// sizes and modification times
+func (r *templateRegistry) overrideFiles() ([]string, string, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to read template directory: %w", err)
+	}
+	var files []string
+	var signature strings.Builder
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != templates.Extension {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, "", err
+		}
+		files = append(files, filepath.Join(r.dir, entry.Name()))
+		fmt.Fprintf(&signature, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return files, signature.String(), nil
+}
+
+// parseTemplate parses source and checks that it renders for a valid item, so that a template referring
+// to a field that does not exist is rejected when it is loaded rather than when an item is pushed
+func parseTemplate(path, source, origin string) (*loadedTemplate, error) {
+	name := strings.TrimSuffix(filepath.Base(path), templates.Extension)
+	t, err := newCLITemplate(name, source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse template %s: %w", path, err)
+	}
+	if err := t.Execute(&bytes.Buffer{}, exampleItem); err != nil {
+		return nil, fmt.Errorf("template %s does not render: %w", path, err)
+	}
+	sum := sha256.Sum256([]byte(source))
+	return &loadedTemplate{
+		TemplateInfo: TemplateInfo{
+			Name:    name,
+			Source:  origin,
+			Version: hex.EncodeToString(sum[:])[:12],
+			Loaded:  time.Now(),
+		},
+		tmpl: t,
+	}, nil
+}
+
+// exampleItem is used to check that templates render when they are loaded
+var exampleItem = Item{
+	Host:                "192.0.2.1:22",
+	Description:         "example",
+	IntfType:            "GigabitEthernet",
+	Number:              "1",
+	Ipv4Address:         "192.0.2.1",
+	Ipv4AddressMask:     "255.255.255.0",
+	Mtu:                 1500,
+	Shutdown:            true,
+	ServicePolicyInput:  "IN",
+	ServicePolicyOutput: "OUT",
+}
+
+// render executes the named template for item, returning the non-empty lines as commands along with the
+// template that was used
+func (r *templateRegistry) render(name string, item Item) ([]string, TemplateInfo, error) {
+	r.RLock()
+	t, ok := r.templates[name]
+	r.RUnlock()
+	if !ok {
+		return nil, TemplateInfo{}, fmt.Errorf("template %s does not exist", name)
+	}
+
+	commands, err := execute(t.tmpl, item)
+	return commands, t.TemplateInfo, err
+}
+
+// renderSections is render with only the sections of the named template that a change to fields, the
+// names of fields of Item, affects. A section is an if, range or with at the top of the template, and is
+// rendered if it refers to one of fields. What is outside the sections, like the line entering the
+// interface, is rendered with them, and if it refers to one of fields the whole template is rendered.
+// No commands are returned if nothing in the template refers to fields
+func (r *templateRegistry) renderSections(name string, item Item, fields []string) ([]string, TemplateInfo, error) {
+	r.RLock()
+	t, ok := r.templates[name]
+	r.RUnlock()
+	if !ok {
+		return nil, TemplateInfo{}, fmt.Errorf("template %s does not exist", name)
+	}
+
+	tree := t.tmpl.Tree.Copy()
+	var nodes []parse.Node
+	affected := false
+	for _, node := range tree.Root.Nodes {
+		refers := refersTo(node, fields)
+		switch node.(type) {
+		case *parse.IfNode, *parse.RangeNode, *parse.WithNode:
+			if refers {
+				nodes = append(nodes, node)
+				affected = true
+			}
+		default:
+			if refers {
+				return r.render(name, item)
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	if !affected {
+		return nil, t.TemplateInfo, nil
+	}
+	tree.Root.Nodes = nodes
+
+	// the clone keeps the helper functions and the templates the sections may call
+	sections, err := t.tmpl.Clone()
+	if err == nil {
+		sections, err = sections.AddParseTree(name, tree)
+	}
+	if err != nil {
+		return nil, t.TemplateInfo, err
+	}
+	commands, err := execute(sections, item)
+	return commands, t.TemplateInfo, err
+}
+
+// execute renders t for item, returning the non-empty lines as commands
+func execute(t *template.Template, item Item) ([]string, error) {
+	// 'buf' is an io.Writter to capture the template execution output
+	buf := new(bytes.Buffer)
+	err := t.Execute(buf, item)
+	if err != nil {
+		return nil, err
+	}
+	commands := strings.Split(buf.String(), "\n")
+	return removeEmptyStrings(commands), nil
+}
+
+// list returns the loaded templates sorted by name
+func (r *templateRegistry) list() []TemplateInfo {
+	r.RLock()
+	defer r.RUnlock()
+	infos := make([]TemplateInfo, 0, len(r.templates))
+	for _, t := range r.templates {
+		infos = append(infos, t.TemplateInfo)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// watch reloads the templates whenever the override directory changes, until ctx is done. A reload that
+// fails leaves the previously loaded templates in place
+func (r *templateRegistry) watch(ctx context.Context, logger *slog.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, signature, err := r.overrideFiles()
+		if err != nil {
+			logger.Error("unable to check template directory", "error", err)
+			continue
+		}
+		r.RLock()
+		changed := signature != r.signature
+		r.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.load(); err != nil {
+			logger.Error("template reload failed, keeping the previous templates", "error", err)
+			// remember the broken state so the error is not logged on every tick
+			r.Lock()
+			r.signature = signature
+			r.Unlock()
+			continue
+		}
+		logger.Info("templates reloaded", "templates", r.list())
+	}
+}
+
+// GetTemplates returns the loaded templates and their versions
+func (s *Service) GetTemplates(w http.ResponseWriter, r *http.Request) {
+	err := writeJSON(w, s.templates.list())
+	if err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTemplateOverride(t *testing.T) {
+	dir := t.TempDir()
+	r := newTemplateRegistry()
+	embedded := r.list()
+
+	writeFile(t, filepath.Join(dir, "iosxe_interface_ethernet.cfg"), "interface {{.IntfType}} {{.Number}}\n")
+	writeFile(t, filepath.Join(dir, "extra.cfg"), "hostname {{.Host}}\n")
+	writeFile(t, filepath.Join(dir, "ignored.txt"), "not a template")
+	r.dir = dir
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	infos := map[string]TemplateInfo{}
+	for _, info := range r.list() {
+		infos[info.Name] = info
+	}
+	if len(infos) != len(embedded)+1 {
+		t.Fatalf("expected %d templates, got %v", len(embedded)+1, infos)
+	}
+	if infos["iosxe_interface_ethernet"].Source != templateSourceOverride || infos["extra"].Source != templateSourceOverride {
+		t.Errorf("expected override templates, got %v", infos)
+	}
+	if infos["iosxe_interface_ethernet_delete"].Source != templateSourceEmbedded {
+		t.Errorf("expected the embedded delete template, got %v", infos)
+	}
+	if infos["iosxe_interface_ethernet"].Version == embedded[0].Version {
+		t.Errorf("expected the override to change the template version")
+	}
+
+	commands, info, err := r.render(templateName(DefaultPlatform, templateInterface), exampleItem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 1 || commands[0] != "interface GigabitEthernet 1" || info.Source != templateSourceOverride {
+		t.Errorf("unexpected render %v from %v", commands, info)
+	}
+}
+
+func TestTemplateInvalidOverride(t *testing.T) {
+	dir := t.TempDir()
+	r := newTemplateRegistry()
+	embedded := len(r.list())
+	r.dir = dir
+
+	writeFile(t, filepath.Join(dir, "bad.cfg"), "interface {{.NoSuchField}}\n")
+	if err := r.load(); err == nil {
+		t.Error("expected a template referring to an unknown field to be rejected")
+	}
+	writeFile(t, filepath.Join(dir, "bad.cfg"), "interface {{.IntfType\n")
+	if err := r.load(); err == nil {
+		t.Error("expected a template that does not parse to be rejected")
+	}
+	if len(r.list()) != embedded {
+		t.Errorf("expected the embedded templates to remain loaded, got %v", r.list())
+	}
+}
+
+func TestTemplateReload(t *testing.T) {
+	dir := t.TempDir()
+	r := newTemplateRegistry()
+	embedded := len(r.list())
+	r.dir = dir
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.watch(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), 10*time.Millisecond)
+
+	writeFile(t, filepath.Join(dir, "extra.cfg"), "hostname {{.Host}}\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.list()) != embedded+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("templates were not reloaded, got %v", r.list())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
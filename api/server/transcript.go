@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+// defaultRedactPatterns catch the common IOS-XE secrets that can appear in commands or device output
+var defaultRedactPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(?:password|secret)\s+(?:\d+\s+)?(\S+)`),
+	regexp.MustCompile(`(?i)\bkey-string\s+(?:\d+\s+)?(\S+)`),
+	regexp.MustCompile(`(?i)\bsnmp-server\s+community\s+(\S+)`),
+}
+
+// TranscriptEntry is a single chunk of a CLI session, either a command sent to the device or output
+// received from it
+type TranscriptEntry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Data      string    `json:"data"`
+}
+
+const (
+	directionSent     = "sent"
+	directionReceived = "received"
+)
+
+// redactor removes credentials and anything matching its patterns from transcript data
+type redactor struct {
+	patterns []*regexp.Regexp
+}
+
+func newRedactor() *redactor {
+	return &redactor{patterns: append([]*regexp.Regexp{}, defaultRedactPatterns...)}
+}
+
+// minSecretLength is the length of the shortest secret redacted wherever it appears as a whole token.
+// Shorter secrets, which would match parts of ordinary output, are only caught by the patterns
+const minSecretLength = 4
+
+// redact returns data with every secret and every pattern match replaced
+func (r *redactor) redact(data string, secrets ...string) string {
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLength {
+			data = redactToken(data, secret)
+		}
+	}
+	for _, pattern := range r.patterns {
+		data = redactPattern(pattern, data)
+	}
+	return data
+}
+
+// redactToken replaces the occurrences of secret in data that aren't part of a longer word, so that a
+// secret which is also a substring of a command or an interface name doesn't mangle it
+func redactToken(data, secret string) string {
+	var b strings.Builder
+	last := 0
+	for i := 0; ; {
+		j := strings.Index(data[i:], secret)
+		if j < 0 {
+			break
+		}
+		start, end := i+j, i+j+len(secret)
+		if (start == 0 || !wordByte(data[start-1]) || !wordByte(secret[0])) &&
+			(end == len(data) || !wordByte(data[end]) || !wordByte(secret[len(secret)-1])) {
+			b.WriteString(data[last:start])
+			b.WriteString(redacted)
+			last = end
+			i = end
+		} else {
+			i = start + 1
+		}
+	}
+	if last == 0 {
+		return data
+	}
+	b.WriteString(data[last:])
+	return b.String()
+}
+
+// wordByte reports whether c is a letter, a digit or an underscore
+func wordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+func redactPattern(pattern *regexp.Regexp, data string) string {
+	matches := pattern.FindAllStringSubmatchIndex(data, -1)
+	if matches == nil {
+		return data
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		spans := [][2]int{{m[0], m[1]}}
+		if len(m) > 2 {
+			spans = spans[:0]
+			for i := 2; i < len(m); i += 2 {
+				if m[i] >= 0 {
+					spans = append(spans, [2]int{m[i], m[i+1]})
+				}
+			}
+		}
+		for _, span := range spans {
+			if span[0] < last {
+				continue
+			}
+			b.WriteString(data[last:span[0]])
+			b.WriteString(redacted)
+			last = span[1]
+		}
+	}
+	b.WriteString(data[last:])
+	return b.String()
+}
+
+// transcript records a CLI session, redacting each entry as it is added so that secrets are never stored
+type transcript struct {
+	sync.Mutex
+	entries  []TranscriptEntry
+	redactor *redactor
+	secrets  []string
+	// attempts counts the SSH connections made for the session, including those that failed
+	attempts int
+	// output is called with every entry as it is recorded, if it is set
+	output func(TranscriptEntry)
+}
+
+func newTranscript(r *redactor, secrets ...string) *transcript {
+	return &transcript{redactor: r, secrets: secrets}
+}
+
+func (t *transcript) sent(data string) {
+	t.add(directionSent, data)
+}
+
+func (t *transcript) received(data string) {
+	t.add(directionReceived, data)
+}
+
+func (t *transcript) add(direction, data string) {
+	if t == nil {
+		return
+	}
+	entry := TranscriptEntry{
+		Time:      time.Now(),
+		Direction: direction,
+		Data:      t.redactor.redact(data, t.secrets...),
+	}
+	t.Lock()
+	t.entries = append(t.entries, entry)
+	output := t.output
+	t.Unlock()
+	if output != nil {
+		output(entry)
+	}
+}
+
+// attempt counts a connection made for the session
+func (t *transcript) attempt() {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.attempts++
+}
+
+// connectAttempts returns the number of connections made for the session
+func (t *transcript) connectAttempts() int {
+	t.Lock()
+	defer t.Unlock()
+	return t.attempts
+}
+
+// withPushOutput returns a copy of ctx whose pushes call output with every entry of their transcripts as it
+// is recorded, along with the host and ID of the operation it belongs to
+func withPushOutput(ctx context.Context, output func(host, operationID string, entry TranscriptEntry)) context.Context {
+	return context.WithValue(ctx, pushOutputKey, output)
+}
+
+// pushOutputFrom returns the function set by withPushOutput on ctx, or nil if there is none
+func pushOutputFrom(ctx context.Context) func(host, operationID string, entry TranscriptEntry) {
+	output, _ := ctx.Value(pushOutputKey).(func(host, operationID string, entry TranscriptEntry))
+	return output
+}
+
+// snapshot returns a copy of the recorded entries
+func (t *transcript) snapshot() []TranscriptEntry {
+	t.Lock()
+	defer t.Unlock()
+	return append([]TranscriptEntry{}, t.entries...)
+}
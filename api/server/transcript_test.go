@@ -0,0 +1,75 @@
+package server
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestRedact(t *testing.T) {
+	r := newRedactor()
+	r.patterns = append(r.patterns, regexp.MustCompile(`community-\w+`))
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"login admin/hunter2", "login admin/<redacted>"},
+		{"username bob password 0 s3cr3t", "username bob password 0 <redacted>"},
+		{"enable secret 9 $9$abc", "enable secret 9 <redacted>"},
+		{" key-string 7 0822455D0A16", " key-string 7 <redacted>"},
+		{"snmp-server community public RO", "snmp-server community <redacted> RO"},
+		{"set community-internal here", "set <redacted> here"},
+		{"interface GigabitEthernet 1", "interface GigabitEthernet 1"},
+	}
+	for _, c := range cases {
+		if got := r.redact(c.in, "hunter2"); got != c.want {
+			t.Errorf("redact(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestRedactSecretTokens(t *testing.T) {
+	r := newRedactor()
+	cases := []struct {
+		in, secret, want string
+	}{
+		// a secret inside a longer word is left alone rather than mangling the output
+		{"interface GigabitEthernet1\nend", "Ethernet", "interface GigabitEthernet1\nend"},
+		{"show interfaces cisco\nrouter#", "cisco", "show interfaces <redacted>\nrouter#"},
+		{"login cisco/cisco123", "cisco", "login <redacted>/cisco123"},
+		{"token=p@ss!w0rd;", "p@ss!w0rd", "token=<redacted>;"},
+		{"!p@ss", "!p@ss", "<redacted>"},
+		// secrets too short to tell apart from output are left to the patterns
+		{"interface GigabitEthernet 1\nrouter#", "1", "interface GigabitEthernet 1\nrouter#"},
+		{"username a password 0 abc", "abc", "username a password 0 <redacted>"},
+	}
+	for _, c := range cases {
+		if got := r.redact(c.in, c.secret); got != c.want {
+			t.Errorf("redact(%q, %q) = %q, want %q", c.in, c.secret, got, c.want)
+		}
+	}
+}
+
+func TestOperationStorePrune(t *testing.T) {
+	store := newOperationStore()
+	store.maxOperations = 2
+	store.maxAge = time.Hour
+
+	now := time.Now()
+	store.add(&Operation{ID: "expired", Started: now.Add(-3 * time.Hour), Finished: now.Add(-2 * time.Hour)})
+	store.add(&Operation{ID: "first", Started: now.Add(-3 * time.Minute), Finished: now})
+	store.add(&Operation{ID: "second", Started: now.Add(-2 * time.Minute), Finished: now})
+	store.add(&Operation{ID: "third", Started: now.Add(-time.Minute), Finished: now})
+
+	for _, id := range []string{"expired", "first"} {
+		if _, ok := store.operations[id]; ok {
+			t.Errorf("expected operation %s to be pruned", id)
+		}
+	}
+	for _, id := range []string{"second", "third"} {
+		if _, ok := store.operations[id]; !ok {
+			t.Errorf("expected operation %s to be kept", id)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/openconfig/gnmi/proto/gnmi"
+	"golang.org/x/exp/slices"
+	"google.golang.org/protobuf/encoding/prototext"
+)
+
+// Transports an item can be pushed with. The CLI works on every platform, the model driven transports only
+// on the platforms whose YANG models an item can be translated into
+const (
+	TransportCLI      = "cli"
+	TransportNETCONF  = "netconf"
+	TransportRESTCONF = "restconf"
+	TransportGNMI     = "gnmi"
+
+	DefaultTransport = TransportCLI
+)
+
+// Transports are the supported transports
+var Transports = []string{TransportCLI, TransportNETCONF, TransportRESTCONF, TransportGNMI}
+
+// transportPlatforms are the platforms each model driven transport supports
+var transportPlatforms = map[string][]string{
+	TransportNETCONF:  {"iosxe"},
+	TransportRESTCONF: {"iosxe"},
+	// OpenConfig models are vendor neutral, and every platform names its interfaces by type and number
+	TransportGNMI: {"iosxe", "iosxr", "nxos"},
+}
+
+// supportsTransport reports whether items on platform can be pushed with transport
+func supportsTransport(platform, transport string) bool {
+	if transport == TransportCLI {
+		return true
+	}
+	return slices.Contains(transportPlatforms[transport], platform)
+}
+
+// itemDefaults returns item with an empty platform or transport set to its default
+func itemDefaults(item Item) Item {
+	if item.Platform == "" {
+		item.Platform = DefaultPlatform
+	}
+	if item.Transport == "" {
+		item.Transport = DefaultTransport
+	}
+	return item
+}
+
+// nativeConfigs build the NETCONF equivalent of each item template
+var nativeConfigs = map[string]func(Item) ([]byte, error){
+	templateInterface:       nativeInterfaceConfig,
+	templateInterfaceDelete: nativeInterfaceDeleteConfig,
+}
+
+// restconfChanges build the RESTCONF requests equivalent to each item template
+var restconfChanges = map[string]func(Item) []restconfRequest{
+	templateInterface:       restconfInterfaceRequests,
+	templateInterfaceDelete: restconfInterfaceDeleteRequests,
+}
+
+// openconfigChanges build the gNMI Set request equivalent to each item template
+var openconfigChanges = map[string]func(Item) (*gnmi.SetRequest, error){
+	templateInterface:       openconfigInterfaceSet,
+	templateInterfaceDelete: openconfigInterfaceDeleteSet,
+}
+
+// push is the configuration pushed to the hosts of an operation and how it is applied to each of them
+type push struct {
+	platform  string
+	transport string
+	// tmpl is the template the configuration was rendered from, which is empty for model driven transports
+	tmpl TemplateInfo
+	// config is the rendered configuration, CLI commands or the body of each NETCONF, RESTCONF or gNMI
+	// request, as shown in the diff of a change waiting for approval
+	config string
+	apply  func(logger *slog.Logger, rec *transcript, hostname string) error
+	// backup reads the whole running configuration of a host before and after apply, and is nil for
+	// operations that don't change the configuration
+	backup func(logger *slog.Logger, rec *transcript, hostname string) (string, error)
+}
+
+// preparePush builds item's configuration for the named template, rendering the template for the CLI or
+// translating the item for a model driven transport. An error response is sent if it can't be built
+func (s *Service) preparePush(w http.ResponseWriter, r *http.Request, item Item, name string) (*push, bool) {
+	return s.preparePartialPush(w, r, item, name, nil)
+}
+
+// preparePartialPush is preparePush for a change to fields of item, the names of the fields of Item that
+// changed. Only the sections of a CLI template that refer to them are rendered, and the push has no config
+// if none do. Model driven transports send the whole configuration of the item whatever changed
+func (s *Service) preparePartialPush(w http.ResponseWriter, r *http.Request, item Item, name string, fields []string) (*push, bool) {
+	driver, ok := itemDriver(w, item)
+	if !ok {
+		return nil, false
+	}
+	sshConfig := loadSshConfig(item)
+	p := &push{platform: driver.Platform(), transport: item.Transport, backup: s.runningConfig(driver, item)}
+
+	switch item.Transport {
+	case TransportNETCONF:
+		config, err := nativeConfigs[name](item)
+		if err != nil {
+			loggerFrom(r.Context()).Error("error building netconf configuration", "error", err)
+			httpError(w, fmt.Sprintf("unable to build configuration: %s", err), http.StatusInternalServerError, CodeInternal)
+			return nil, false
+		}
+		p.config = string(config)
+		p.apply = func(logger *slog.Logger, rec *transcript, hostname string) error {
+			return s.applyNETCONF(logger, rec, hostname, config, sshConfig)
+		}
+	case TransportRESTCONF:
+		requests := restconfChanges[name](item)
+		p.config = restconfConfig(requests)
+		p.apply = func(logger *slog.Logger, rec *transcript, hostname string) error {
+			item := item
+			item.Host = hostname
+			return s.applyRESTCONF(logger, rec, item, requests)
+		}
+	case TransportGNMI:
+		req, err := openconfigChanges[name](item)
+		if err != nil {
+			loggerFrom(r.Context()).Error("error building gnmi request", "error", err)
+			httpError(w, fmt.Sprintf("unable to build configuration: %s", err), http.StatusInternalServerError, CodeInternal)
+			return nil, false
+		}
+		p.config = prototext.Format(req)
+		p.apply = func(logger *slog.Logger, rec *transcript, hostname string) error {
+			item := item
+			item.Host = hostname
+			return s.applyGNMI(logger, rec, item, req)
+		}
+	default:
+		commands, tmpl, ok := s.renderConfig(w, r, driver, name, item, fields)
+		if !ok {
+			return nil, false
+		}
+		p.tmpl = tmpl
+		p.config = strings.Join(commands, "\n")
+		p.apply = func(logger *slog.Logger, rec *transcript, hostname string) error {
+			return s.applyConfig(logger, rec, driver, hostname, commands, sshConfig)
+		}
+	}
+	return p, true
+}
+
+// readItemConfig reads the running configuration of item's interface with its transport
+func (s *Service) readItemConfig(logger *slog.Logger, rec *transcript, driver Driver, item Item) (string, error) {
+	sshConfig := loadSshConfig(item)
+	switch item.Transport {
+	case TransportNETCONF:
+		filter, err := nativeInterfaceFilter(item)
+		if err != nil {
+			return "", err
+		}
+		config, err := s.readNETCONF(logger, rec, item.Host, filter, sshConfig)
+		return string(config), err
+	case TransportRESTCONF:
+		return s.readRESTCONF(logger, rec, item)
+	case TransportGNMI:
+		return s.readGNMI(logger, rec, item)
+	default:
+		return s.readConfig(logger, rec, driver, item.Host, item, sshConfig)
+	}
+}
+
+// runningConfig returns a function reading the whole running configuration of a host with item's transport
+func (s *Service) runningConfig(driver Driver, item Item) func(logger *slog.Logger, rec *transcript, hostname string) (string, error) {
+	sshConfig := loadSshConfig(item)
+	return func(logger *slog.Logger, rec *transcript, hostname string) (string, error) {
+		item := item
+		item.Host = hostname
+		switch item.Transport {
+		case TransportNETCONF:
+			config, err := s.readNETCONF(logger, rec, hostname, nil, sshConfig)
+			return string(config), err
+		case TransportRESTCONF:
+			return s.readRESTCONFPath(logger, rec, item, "Cisco-IOS-XE-native:native")
+		case TransportGNMI:
+			return s.readGNMIRequest(logger, rec, item, &gnmi.GetRequest{
+				Path:     []*gnmi.Path{{}},
+				Type:     gnmi.GetRequest_CONFIG,
+				Encoding: gnmi.Encoding_JSON_IETF,
+			})
+		default:
+			return s.readRunningConfig(logger, rec, driver, hostname, sshConfig)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"math/bits"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// InterfaceTypes are the interface types an Item can configure on any platform. Which of them are valid
+// for an item depends on its platform, see PlatformInterfaceTypes
+var InterfaceTypes = allInterfaceTypes()
+
+// The MTU range accepted by interfaces. An MTU of 0 leaves the interface at its default
+const (
+	MinMtu = 64
+	MaxMtu = 9216
+)
+
+// MaxDescriptionLength is the longest interface description IOS-XE accepts
+const MaxDescriptionLength = 240
+
+var (
+	// interface numbers are slot/subslot/port style with an optional subinterface, e.g. 1, 0/0/1 or 1/0/1.100
+	interfaceNumber = regexp.MustCompile(`^\d+(/\d+){0,3}(\.\d+)?$`)
+	// policy-map names must start with an alphanumeric and are at most 40 characters
+	policyName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.\-]{0,39}$`)
+	// device tags, such as core or site:ams1
+	tagName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:/\-]{0,63}$`)
+)
+
+// ValidateItem checks every field of item, returning an Error for each invalid field or nil if the item
+// can be rendered and pushed to a device
+func ValidateItem(item Item) []*Error {
+	var errs []*Error
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, &Error{Code: CodeInvalidField, Message: fmt.Sprintf(format, args...), Field: field})
+	}
+
+	// every string field ends up on a CLI line, so none of them can contain anything that would end the
+	// line or be interpreted by the shell
+	cliFields := []struct {
+		name  string
+		value string
+	}{
+		{"host", item.Host},
+		{"description", item.Description},
+		{"username", item.Username},
+		{"password", item.Password},
+		{"type", item.IntfType},
+		{"number", item.Number},
+		{"ipv4_address", item.Ipv4Address},
+		{"ipv4_address_mask", item.Ipv4AddressMask},
+		{"service_policy_input", item.ServicePolicyInput},
+		{"service_policy_output", item.ServicePolicyOutput},
+	}
+	unsafe := map[string]bool{}
+	for _, f := range cliFields {
+		if err := checkCLIValue(f.value); err != "" {
+			invalid(f.name, err)
+			unsafe[f.name] = true
+		}
+	}
+
+	if err := validateHost(item.Host); err != "" && !unsafe["host"] {
+		invalid("host", err)
+	}
+	if driver, err := driverFor(item.Platform); err != nil {
+		invalid("platform", "must be one of %s", strings.Join(Platforms(), ", "))
+	} else {
+		if types := driver.InterfaceTypes(); !slices.Contains(types, item.IntfType) {
+			invalid("type", "must be one of %s on %s", strings.Join(types, ", "), driver.Platform())
+		}
+		transport := item.Transport
+		if transport == "" {
+			transport = DefaultTransport
+		}
+		if !slices.Contains(Transports, transport) {
+			invalid("transport", "must be one of %s", strings.Join(Transports, ", "))
+		} else if !supportsTransport(driver.Platform(), transport) {
+			invalid("transport", "%s is not supported on %s", transport, driver.Platform())
+		} else if transport == TransportGNMI {
+			// openconfig-interfaces has no equivalent of an MQC service-policy
+			if item.ServicePolicyInput != "" {
+				invalid("service_policy_input", "is not supported with the gnmi transport")
+			}
+			if item.ServicePolicyOutput != "" {
+				invalid("service_policy_output", "is not supported with the gnmi transport")
+			}
+		}
+	}
+	if !interfaceNumber.MatchString(item.Number) {
+		invalid("number", "must be an interface number such as 1, 0/0/1 or 1/0/1.100")
+	}
+	if len(item.Description) > MaxDescriptionLength {
+		invalid("description", "must be at most %d characters", MaxDescriptionLength)
+	}
+
+	switch {
+	case item.Ipv4Address == "" && item.Ipv4AddressMask != "":
+		invalid("ipv4_address", "must be set when ipv4_address_mask is set")
+	case item.Ipv4Address != "" && item.Ipv4AddressMask == "":
+		invalid("ipv4_address_mask", "must be set when ipv4_address is set")
+	case item.Ipv4Address != "":
+		if ip := net.ParseIP(item.Ipv4Address); ip == nil || ip.To4() == nil || strings.Contains(item.Ipv4Address, ":") {
+			invalid("ipv4_address", "must be an IPv4 address")
+		}
+		if err := validateMask(item.Ipv4AddressMask); err != "" {
+			invalid("ipv4_address_mask", err)
+		}
+	}
+
+	if item.Mtu != 0 && (item.Mtu < MinMtu || item.Mtu > MaxMtu) {
+		invalid("mtu", "must be between %d and %d", MinMtu, MaxMtu)
+	}
+	if item.ServicePolicyInput != "" && !policyName.MatchString(item.ServicePolicyInput) {
+		invalid("service_policy_input", "must be a policy-map name of up to 40 letters, digits, '_', '-' or '.'")
+	}
+	if item.ServicePolicyOutput != "" && !policyName.MatchString(item.ServicePolicyOutput) {
+		invalid("service_policy_output", "must be a policy-map name of up to 40 letters, digits, '_', '-' or '.'")
+	}
+	for _, tag := range item.Tags {
+		if err := validateTag(tag); err != "" {
+			invalid("tags", err)
+			break
+		}
+	}
+	return errs
+}
+
+// ValidateChange checks the changes from stored to item that can't be pushed to the device, returning an
+// Error for each such field or nil if the change can be made
+func ValidateChange(stored, item Item) []*Error {
+	var errs []*Error
+	// the NX-OS CLI only removes a service-policy by name, which the template rendered for item doesn't have
+	if item.Platform == "nxos" && item.Transport == TransportCLI && stored.Platform == item.Platform {
+		if stored.ServicePolicyInput != "" && item.ServicePolicyInput == "" {
+			errs = append(errs, &Error{Code: CodeInvalidField, Message: "can't be cleared on nxos with the cli transport, replace it with another policy or delete the item", Field: "service_policy_input"})
+		}
+		if stored.ServicePolicyOutput != "" && item.ServicePolicyOutput == "" {
+			errs = append(errs, &Error{Code: CodeInvalidField, Message: "can't be cleared on nxos with the cli transport, replace it with another policy or delete the item", Field: "service_policy_output"})
+		}
+	}
+	return errs
+}
+
+// validateTag returns a description of what is wrong with a device tag, or an empty string if it is valid
+func validateTag(tag string) string {
+	if !tagName.MatchString(tag) {
+		return "must be tags of up to 64 letters, digits, '_', '-', '.', ':' or '/'"
+	}
+	return ""
+}
+
+// validateHost returns a description of what is wrong with host, or an empty string if it is a valid
+// host:port
+func validateHost(host string) string {
+	if host == "" {
+		return "is required"
+	}
+	if strings.ContainsAny(host, " \t\r\n") {
+		return "cannot contain whitespace"
+	}
+	_, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return "must be in the form host:port"
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "must have a port between 1 and 65535"
+	}
+	return ""
+}
+
+// validateMask returns a description of what is wrong with mask, or an empty string if it is a dotted
+// decimal IPv4 netmask with contiguous ones
+func validateMask(mask string) string {
+	ip := net.ParseIP(mask)
+	if ip == nil || ip.To4() == nil || strings.Contains(mask, ":") {
+		return "must be a dotted decimal netmask such as 255.255.255.0"
+	}
+	ip = ip.To4()
+	m := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+	if m == 0 {
+		return "must not be 0.0.0.0"
+	}
+	// a contiguous mask is all ones followed by all zeros, so inverting it leaves all zeros followed by
+	// all ones
+	if ones := bits.LeadingZeros32(^m); ones != 32 && bits.TrailingZeros32(m) != 32-ones {
+		return "must be a contiguous netmask"
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"testing"
+)
+
+func validItemForTest() Item {
+	return Item{
+		Host:                "10.0.0.1:22",
+		IntfType:            "GigabitEthernet",
+		Number:              "1/0/1",
+		Ipv4Address:         "192.0.2.1",
+		Ipv4AddressMask:     "255.255.255.0",
+		Mtu:                 1500,
+		ServicePolicyInput:  "IN_POLICY",
+		ServicePolicyOutput: "out-policy.v2",
+	}
+}
+
+func TestValidateItem(t *testing.T) {
+	if errs := ValidateItem(validItemForTest()); errs != nil {
+		t.Fatalf("expected a valid item, got %v", errs)
+	}
+
+	cases := []struct {
+		name   string
+		modify func(*Item)
+		field  string
+	}{
+		{"host without port", func(i *Item) { i.Host = "10.0.0.1" }, "host"},
+		{"host with whitespace", func(i *Item) { i.Host = "10.0.0.1 :22" }, "host"},
+		{"port out of range", func(i *Item) { i.Host = "10.0.0.1:70000" }, "host"},
+		{"unknown type", func(i *Item) { i.IntfType = "GigabitEthernetX" }, "type"},
+		{"type of another platform", func(i *Item) { i.IntfType = "TenGigE" }, "type"},
+		{"unknown platform", func(i *Item) { i.Platform = "junos" }, "platform"},
+		{"unknown transport", func(i *Item) { i.Transport = "telnet" }, "transport"},
+		{"netconf on nxos", func(i *Item) { i.Platform, i.IntfType, i.Transport = "nxos", "Ethernet", TransportNETCONF }, "transport"},
+		{"service policy with gnmi", func(i *Item) { i.Transport, i.ServicePolicyOutput = TransportGNMI, "" }, "service_policy_input"},
+		{"bad number", func(i *Item) { i.Number = "1/a" }, "number"},
+		{"address not ip", func(i *Item) { i.Ipv4Address = "banana" }, "ipv4_address"},
+		{"address ipv6", func(i *Item) { i.Ipv4Address = "2001:db8::1" }, "ipv4_address"},
+		{"mask without address", func(i *Item) { i.Ipv4Address = "" }, "ipv4_address"},
+		{"address without mask", func(i *Item) { i.Ipv4AddressMask = "" }, "ipv4_address_mask"},
+		{"non contiguous mask", func(i *Item) { i.Ipv4AddressMask = "255.0.255.0" }, "ipv4_address_mask"},
+		{"zero mask", func(i *Item) { i.Ipv4AddressMask = "0.0.0.0" }, "ipv4_address_mask"},
+		{"negative mtu", func(i *Item) { i.Mtu = -5 }, "mtu"},
+		{"mtu too large", func(i *Item) { i.Mtu = 9217 }, "mtu"},
+		{"policy with space", func(i *Item) { i.ServicePolicyInput = "IN POLICY" }, "service_policy_input"},
+		{"policy too long", func(i *Item) { i.ServicePolicyOutput = "P123456789012345678901234567890123456789" + "0" }, "service_policy_output"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			item := validItemForTest()
+			c.modify(&item)
+			errs := ValidateItem(item)
+			if len(errs) != 1 || errs[0].Field != c.field {
+				t.Errorf("expected a single error for %s, got %v", c.field, errs)
+			}
+		})
+	}
+}
+
+func TestValidateMask(t *testing.T) {
+	for _, mask := range []string{"255.255.255.255", "255.255.255.254", "255.255.0.0", "128.0.0.0"} {
+		if err := validateMask(mask); err != "" {
+			t.Errorf("validateMask(%q) = %q, want valid", mask, err)
+		}
+	}
+	for _, mask := range []string{"255.255.255.1", "0.255.255.255", "255.255.256.0", "24"} {
+		if err := validateMask(mask); err == "" {
+			t.Errorf("validateMask(%q) should be invalid", mask)
+		}
+	}
+}
+
+func TestValidateChange(t *testing.T) {
+	stored := itemDefaults(validItemForTest())
+	stored.Platform, stored.IntfType = "nxos", "Ethernet"
+
+	cases := []struct {
+		name   string
+		modify func(*Item)
+		fields []string
+	}{
+		{"unchanged", func(i *Item) {}, nil},
+		{"policy replaced", func(i *Item) { i.ServicePolicyInput = "OTHER" }, nil},
+		{"input cleared", func(i *Item) { i.ServicePolicyInput = "" }, []string{"service_policy_input"}},
+		{"both cleared", func(i *Item) { i.ServicePolicyInput, i.ServicePolicyOutput = "", "" }, []string{"service_policy_input", "service_policy_output"}},
+		{"cleared with gnmi", func(i *Item) { i.ServicePolicyInput, i.Transport = "", TransportGNMI }, nil},
+		{"cleared on iosxe", func(i *Item) { i.ServicePolicyInput, i.Platform = "", "iosxe" }, nil},
+	}
+	for _, c := range cases {
+		item := stored
+		c.modify(&item)
+		var fields []string
+		for _, err := range ValidateChange(stored, item) {
+			fields = append(fields, err.Field)
+		}
+		if len(fields) != len(c.fields) || (len(fields) > 0 && fields[len(fields)-1] != c.fields[len(c.fields)-1]) {
+			t.Errorf("%s: got errors for %v, want %v", c.name, fields, c.fields)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// APIVersionHeader is the header a client asks for a version of the API with, and the server answers with
+// the version it served the request with
+const APIVersionHeader = "API-Version"
+
+// APIVersion1 is the first version of the API, which has the routes and the shape of the Item the API had
+// before it was versioned
+const APIVersion1 = "1"
+
+// APIVersions are the versions of the API the server serves, each under the prefix /v{version}, oldest
+// first. A change to the shape of a resource, or to what a route does, is made in a new version so that
+// clients of the older ones keep working
+var APIVersions = []string{APIVersion1}
+
+// pathVersion returns the version of the API path is in and the prefix of the version, e.g. /v1, or an
+// empty prefix if path is unversioned
+func pathVersion(path string) (version, prefix string) {
+	for _, version := range APIVersions {
+		prefix := "/v" + version
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return version, prefix
+		}
+	}
+	return "", ""
+}
+
+// versioned negotiates the version of the API a request is served with. A versioned route is served in its
+// version, and an unversioned route in the version asked for in APIVersionHeader, or APIVersion1 for the
+// clients from before the API had versions. A request asking for a version the server doesn't serve, or
+// for another than the version of its route, is rejected with a 400
+func versioned(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		asked := r.Header.Get(APIVersionHeader)
+		version, _ := pathVersion(routeTemplate(r))
+		switch {
+		case asked != "" && !slices.Contains(APIVersions, asked):
+			httpError(w, fmt.Sprintf("API version %s is not supported, the supported versions are %s", asked, strings.Join(APIVersions, ", ")), http.StatusBadRequest, CodeUnsupportedVersion)
+			return
+		case asked != "" && version != "" && asked != version:
+			httpError(w, fmt.Sprintf("API version %s was asked for a route of version %s", asked, version), http.StatusBadRequest, CodeUnsupportedVersion)
+			return
+		case version == "" && asked != "":
+			version = asked
+		case version == "":
+			version = APIVersion1
+		}
+		w.Header().Set(APIVersionHeader, version)
+		handlerFunc(w, r)
+	}
+}
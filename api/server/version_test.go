@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAPIVersions(t *testing.T) {
+	s := newTestService()
+	s.items["router"] = Item{Host: "router", Namespace: DefaultNamespace}
+
+	tests := []struct {
+		path, asked string
+		status      int
+		version     string
+	}{
+		{"/item/router", "", http.StatusOK, APIVersion1},
+		{"/item/router", APIVersion1, http.StatusOK, APIVersion1},
+		{"/v1/item/router", "", http.StatusOK, APIVersion1},
+		{"/v1/namespace/default/item/router", APIVersion1, http.StatusOK, APIVersion1},
+		{"/item/router", "2", http.StatusBadRequest, ""},
+		{"/v1/item/router", "2", http.StatusBadRequest, ""},
+		{"/v2/item/router", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		header.Set(APIVersionHeader, tt.asked)
+		rec := serveWithHeader(s, http.MethodGet, tt.path, nil, header)
+		if rec.Code != tt.status || rec.Header().Get(APIVersionHeader) != tt.version {
+			t.Errorf("%s with version %q: expected %d in version %q, got %d in version %q %s", tt.path, tt.asked, tt.status, tt.version, rec.Code, rec.Header().Get(APIVersionHeader), rec.Body)
+		}
+		var e Error
+		if json.Unmarshal(rec.Body.Bytes(), &e); rec.Code == http.StatusBadRequest && e.Code != CodeUnsupportedVersion {
+			t.Errorf("%s with version %q: expected the version to be unsupported, got %s", tt.path, tt.asked, rec.Body)
+		}
+	}
+}
+
+func TestQueuedChangeLocationVersion(t *testing.T) {
+	d := newFakeDevice(t, "prod", true)
+	s := newTestService(WithApprovals("production"), approvalTokens())
+
+	rec := serveWithHeader(s, http.MethodPost, "/v1/item", taggedItem(d.addr, "production"), as("alice"))
+	var change QueuedChange
+	json.Unmarshal(rec.Body.Bytes(), &change)
+	if rec.Code != http.StatusAccepted || rec.Header().Get("Location") != "/v1/change/"+change.ID {
+		t.Fatalf("expected the change to be followed in the version it was requested in, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := serve(s, http.MethodGet, rec.Header().Get("Location"), nil); rec.Code != http.StatusOK {
+		t.Errorf("expected the change at its location, got %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Headers sent with every webhook delivery
+const (
+	EventIDHeader   = "X-Event-ID"
+	EventTypeHeader = "X-Event-Type"
+	// SignatureHeader holds "sha256=" and the hex HMAC-SHA256 of the body keyed with the webhook's secret
+	SignatureHeader = "X-Signature-256"
+)
+
+const (
+	// defaultWebhookAttempts is how many times a delivery is attempted before it is dead-lettered
+	defaultWebhookAttempts = 5
+	// defaultWebhookBackoff is the wait before the first retry, doubled for every retry after it
+	defaultWebhookBackoff = time.Second
+	// webhookTimeout limits how long a single delivery attempt can take
+	webhookTimeout = 10 * time.Second
+	// webhookQueue is how many events can wait for delivery to a webhook before they are dead-lettered
+	webhookQueue = 1000
+	// maxDeadLetters is how many failed deliveries are kept, the oldest being dropped first
+	maxDeadLetters = 1000
+)
+
+// Webhook is an outbound receiver of events. Every delivery is signed with Secret in SignatureHeader
+type Webhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	// Events are the event types sent to the webhook, all of them if it is empty
+	Events []string `json:"events,omitempty"`
+}
+
+// DeadLetter is an event that could not be delivered to a webhook
+type DeadLetter struct {
+	Webhook  string    `json:"webhook"`
+	Event    Event     `json:"event"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Failed   time.Time `json:"failed"`
+}
+
+// Sign returns the value of SignatureHeader for body sent with secret, for receivers to compare with the
+// header using hmac.Equal
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetters keeps the failed deliveries of every webhook
+type deadLetters struct {
+	sync.RWMutex
+	letters []DeadLetter
+}
+
+func (d *deadLetters) add(letter DeadLetter) {
+	d.Lock()
+	defer d.Unlock()
+	d.letters = append(d.letters, letter)
+	if len(d.letters) > maxDeadLetters {
+		d.letters = d.letters[len(d.letters)-maxDeadLetters:]
+	}
+}
+
+// webhookSender delivers the events of one webhook in order, retrying failed deliveries with exponential
+// backoff and dead-lettering those that fail every attempt
+type webhookSender struct {
+	Webhook
+	logger   *slog.Logger
+	client   *http.Client
+	queue    chan Event
+	attempts int
+	backoff  time.Duration
+	dead     *deadLetters
+}
+
+// webhookConfig is the webhooks events are delivered to and how failed deliveries are retried
+type webhookConfig struct {
+	hooks    []Webhook
+	attempts int
+	backoff  time.Duration
+}
+
+// startWebhooks starts delivering events to every configured webhook
+func (s *Service) startWebhooks() {
+	for _, hook := range s.webhooks.hooks {
+		h := &webhookSender{
+			Webhook:  hook,
+			logger:   s.logger.With("webhook", hook.URL),
+			client:   &http.Client{Timeout: webhookTimeout},
+			queue:    make(chan Event, webhookQueue),
+			attempts: s.webhooks.attempts,
+			backoff:  s.webhooks.backoff,
+			dead:     s.deadLetters,
+		}
+		s.events.webhooks = append(s.events.webhooks, h)
+		go h.run()
+	}
+}
+
+// enqueue queues e for delivery, dead-lettering it straight away if the queue is full
+func (h *webhookSender) enqueue(e Event) {
+	select {
+	case h.queue <- e:
+	default:
+		h.logger.Error("webhook queue full, dead-lettering event", "event_id", e.ID)
+		h.dead.add(DeadLetter{Webhook: h.URL, Event: e, Error: "delivery queue full", Failed: time.Now()})
+	}
+}
+
+func (h *webhookSender) run() {
+	for e := range h.queue {
+		h.deliver(e)
+	}
+}
+
+// deliver sends e until the webhook accepts it or every attempt has failed
+func (h *webhookSender) deliver(e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		h.logger.Error("error encoding event", "event_id", e.ID, "error", err)
+		return
+	}
+	wait := h.backoff
+	for attempt := 1; ; attempt++ {
+		err = h.send(e, body)
+		if err == nil {
+			h.logger.Debug("event delivered", "event_id", e.ID, "attempt", attempt)
+			return
+		}
+		if attempt >= h.attempts {
+			h.logger.Error("event not delivered, dead-lettering", "event_id", e.ID, "attempts", attempt, "error", err)
+			h.dead.add(DeadLetter{Webhook: h.URL, Event: e, Attempts: attempt, Error: err.Error(), Failed: time.Now()})
+			return
+		}
+		h.logger.Warn("event delivery failed, retrying", "event_id", e.ID, "attempt", attempt, "retry_in", wait, "error", err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// send makes a single delivery attempt, failing unless the webhook answers with a 2xx status
+func (h *webhookSender) send(e Event, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, strconv.FormatInt(e.ID, 10))
+	req.Header.Set(EventTypeHeader, e.Type)
+	req.Header.Set(SignatureHeader, Sign(h.Secret, body))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ValidateWebhook checks that a webhook has a URL the server can post to, a secret and known event types
+func ValidateWebhook(hook Webhook) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s: must be an http or https URL", hook.URL)
+	}
+	if hook.Secret == "" {
+		return errors.New(hook.URL + ": a secret is required to sign deliveries")
+	}
+	for _, typ := range hook.Events {
+		if !slices.Contains(EventTypes, typ) {
+			return fmt.Errorf("%s: unknown event type %s", hook.URL, typ)
+		}
+	}
+	return nil
+}
+
+// GetDeadLetters returns the events of the namespace that could not be delivered to a webhook, oldest first
+func (s *Service) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	namespace := namespaceFrom(r.Context())
+	letters := []DeadLetter{}
+	s.deadLetters.RLock()
+	for _, letter := range s.deadLetters.letters {
+		if letter.Event.Namespace == namespace {
+			letters = append(letters, letter)
+		}
+	}
+	s.deadLetters.RUnlock()
+
+	err := writeJSON(w, letters)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
+	}
+}
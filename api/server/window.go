@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slices"
+)
+
+// Window kinds
+const (
+	// WindowMaintenance allows changes to the devices it applies to while it is open. Once a device has a
+	// maintenance window it can only be changed during one of its maintenance windows
+	WindowMaintenance = "maintenance"
+	// WindowFreeze forbids changes to the devices it applies to while it is open, even during a maintenance
+	// window
+	WindowFreeze = "freeze"
+)
+
+// WindowKinds are the kinds of window in the change calendar
+var WindowKinds = []string{WindowMaintenance, WindowFreeze}
+
+// OverrideHeader carries the reason for an emergency change, which goes ahead whatever the change calendar
+// says and is recorded in the override of its operations
+const OverrideHeader = "X-Emergency-Override"
+
+// Window is a maintenance window or change freeze in the change calendar, open from Start until End
+type Window struct {
+	Name string `json:"name"`
+	// Namespace limits the window to the devices of a namespace. The windows added with the API are in the
+	// namespace of the request, and a window without one, which can only be configured with the server,
+	// applies to the devices of every namespace
+	Namespace   string    `json:"namespace,omitempty"`
+	Kind        string    `json:"kind"`
+	Description string    `json:"description,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	// Tags limit the window to the devices with an item tagged with one of them. A window without tags
+	// applies to every device
+	Tags []string `json:"tags,omitempty"`
+}
+
+// appliesTo reports whether the window applies to a device in namespace with tags
+func (w Window) appliesTo(namespace string, tags []string) bool {
+	if w.Namespace != "" && w.Namespace != namespace {
+		return false
+	}
+	if len(w.Tags) == 0 {
+		return true
+	}
+	for _, tag := range w.Tags {
+		if slices.Contains(tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// openAt reports whether the window is open at t
+func (w Window) openAt(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// ValidateWindow checks every field of window, returning an Error for each invalid field or nil if the
+// window can be added to the calendar
+func ValidateWindow(window Window) []*Error {
+	var errs []*Error
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, &Error{Code: CodeInvalidField, Message: fmt.Sprintf(format, args...), Field: field})
+	}
+	if window.Name == "" || strings.ContainsAny(window.Name, "/ \t\r\n") {
+		invalid("name", "must be a non-empty name without slashes or whitespace")
+	}
+	if window.Namespace != "" {
+		if err := ValidateNamespace(window.Namespace); err != nil {
+			invalid("namespace", err.Error())
+		}
+	}
+	if !slices.Contains(WindowKinds, window.Kind) {
+		invalid("kind", "must be one of %s", strings.Join(WindowKinds, ", "))
+	}
+	if window.Start.IsZero() {
+		invalid("start", "must be set")
+	}
+	if !window.End.After(window.Start) {
+		invalid("end", "must be after start")
+	}
+	for _, tag := range window.Tags {
+		if err := validateTag(tag); err != "" {
+			invalid("tags", err)
+			break
+		}
+	}
+	return errs
+}
+
+// calendar holds the maintenance windows and change freezes, ordered by start
+type calendar struct {
+	sync.RWMutex
+	windows []Window
+}
+
+// add adds window, returning false if there is already a window with its name in its namespace
+func (c *calendar) add(window Window) bool {
+	c.Lock()
+	defer c.Unlock()
+	for _, w := range c.windows {
+		if w.Name == window.Name && w.Namespace == window.Namespace {
+			return false
+		}
+	}
+	c.windows = append(c.windows, window)
+	sort.SliceStable(c.windows, func(i, j int) bool { return c.windows[i].Start.Before(c.windows[j].Start) })
+	return true
+}
+
+// remove removes the window called name in namespace, returning it and whether there was one
+func (c *calendar) remove(namespace, name string) (Window, bool) {
+	c.Lock()
+	defer c.Unlock()
+	for i, w := range c.windows {
+		if w.Name == name && w.Namespace == namespace {
+			c.windows = append(c.windows[:i], c.windows[i+1:]...)
+			return w, true
+		}
+	}
+	return Window{}, false
+}
+
+// list returns the windows of namespace and those of every namespace
+func (c *calendar) list(namespace string) []Window {
+	c.RLock()
+	defer c.RUnlock()
+	windows := []Window{}
+	for _, w := range c.windows {
+		if w.Namespace == "" || w.Namespace == namespace {
+			windows = append(windows, w)
+		}
+	}
+	return windows
+}
+
+// closed returns why a device in namespace with tags can't be changed at t, or an empty string if it can
+func (c *calendar) closed(namespace string, tags []string, t time.Time) string {
+	c.RLock()
+	defer c.RUnlock()
+	return closedAt(c.windows, namespace, tags, t)
+}
+
+func closedAt(windows []Window, namespace string, tags []string, t time.Time) string {
+	maintained, open := false, false
+	for _, w := range windows {
+		if !w.appliesTo(namespace, tags) {
+			continue
+		}
+		switch w.Kind {
+		case WindowFreeze:
+			if w.openAt(t) {
+				return fmt.Sprintf("changes are frozen by %s until %s", w.Name, w.End.Format(time.RFC3339))
+			}
+		case WindowMaintenance:
+			maintained = true
+			open = open || w.openAt(t)
+		}
+	}
+	if maintained && !open {
+		return "changes are only allowed during a maintenance window"
+	}
+	return ""
+}
+
+// next returns the earliest time from t on when a device in namespace with tags can be changed, and false
+// if the calendar has no such time
+func (c *calendar) next(namespace string, tags []string, t time.Time) (time.Time, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	// changes can only start being allowed when a maintenance window opens or a freeze ends
+	candidates := []time.Time{t}
+	for _, w := range c.windows {
+		if !w.appliesTo(namespace, tags) || !w.End.After(t) {
+			continue
+		}
+		if w.Kind == WindowMaintenance && w.Start.After(t) {
+			candidates = append(candidates, w.Start)
+		}
+		if w.Kind == WindowFreeze {
+			candidates = append(candidates, w.End)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	for _, candidate := range candidates {
+		if closedAt(c.windows, namespace, tags, candidate) == "" {
+			return candidate, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// deviceTags returns the tags of every item on host and of items, which are being changed on it. Does not
+// lock access to the itemService, expects this to be done by the calling method
+func (s *Service) deviceTags(host string, items ...Item) []string {
+	var tags []string
+	add := func(item Item) {
+		for _, tag := range item.Tags {
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	for _, item := range s.items {
+		if item.Host == host {
+			add(item)
+		}
+	}
+	for _, item := range items {
+		add(item)
+	}
+	return tags
+}
+
+// changeAllowed checks a change to host against the change calendar. A change that is allowed, or that is
+// sent with OverrideHeader, goes ahead, with the override recorded in the returned request's context.
+// Otherwise the change is queued until the calendar next allows it when the client prefers an
+// asynchronous response and the Service isn't in a cluster, and rejected with a 423 if not. body is the request body to queue the change with
+func (s *Service) changeAllowed(w http.ResponseWriter, r *http.Request, host string, tags []string, body []byte) (*http.Request, bool) {
+	logger := loggerFrom(r.Context())
+	now := time.Now()
+	namespace := namespaceFrom(r.Context())
+	reason := s.calendar.closed(namespace, tags, now)
+	if reason == "" {
+		return r, true
+	}
+	if override := r.Header.Get(OverrideHeader); override != "" {
+		logger.Warn("change window overridden", "host", host, "closed", reason, "override", override)
+		return r.WithContext(withOverride(r.Context(), override)), true
+	}
+
+	next, ok := s.calendar.next(namespace, tags, now)
+	if !ok {
+		logger.Warn("change rejected by the change calendar", "host", host, "closed", reason)
+		httpError(w, fmt.Sprintf("%s: %s, and no window allows it later", host, reason), http.StatusLocked, CodeChangeWindow)
+		return r, false
+	}
+	// a queued change is not replicated, so it would be lost if the leader of a cluster changed
+	if s.cluster != nil || !strings.Contains(r.Header.Get("Prefer"), "respond-async") {
+		logger.Warn("change rejected by the change calendar", "host", host, "closed", reason, "next", next)
+		httpError(w, fmt.Sprintf("%s: %s, the next change can be made at %s", host, reason, next.Format(time.RFC3339)), http.StatusLocked, CodeChangeWindow)
+		return r, false
+	}
+
+	change := s.queueChange(r, host, tags, body, next)
+	logger.Info("change queued", "host", host, "closed", reason, "change_id", change.ID, "not_before", next)
+	w.Header().Set("Preference-Applied", "respond-async")
+	writeQueuedChange(w, logger, change)
+	return r, false
+}
+
+// withOverride returns a copy of ctx carrying the reason for an emergency change
+func withOverride(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, overrideKey, reason)
+}
+
+// overrideFrom returns the reason for an emergency change stored in ctx, or an empty string if there is none
+func overrideFrom(ctx context.Context) string {
+	reason, _ := ctx.Value(overrideKey).(string)
+	return reason
+}
+
+// GetWindows returns the maintenance windows and change freezes of the namespace and of every namespace,
+// ordered by start
+func (s *Service) GetWindows(w http.ResponseWriter, r *http.Request) {
+	err := writeJSON(w, s.calendar.list(namespaceFrom(r.Context())))
+	if err != nil {
+		loggerFrom(r.Context()).Error("error sending response", "error", err)
+	}
+}
+
+// PostWindow adds a maintenance window or change freeze to the calendar, in the namespace of the request.
+// The calendar of a cluster can't be changed with the API
+func (s *Service) PostWindow(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if s.cluster != nil {
+		writeError(w, http.StatusForbidden, errWindowsInCluster)
+		return
+	}
+	var window Window
+	if err := json.NewDecoder(r.Body).Decode(&window); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest, CodeBadRequest)
+		return
+	}
+	namespace := namespaceFrom(r.Context())
+	if window.Namespace != "" && window.Namespace != namespace {
+		writeError(w, http.StatusUnprocessableEntity, &Error{
+			Code:    CodeValidationFailed,
+			Message: "window is invalid",
+			Errors:  []*Error{{Code: CodeInvalidField, Message: "must be the namespace of the request, " + namespace, Field: "namespace"}},
+		})
+		return
+	}
+	window.Namespace = namespace
+	if errs := ValidateWindow(window); errs != nil {
+		writeError(w, http.StatusUnprocessableEntity, &Error{Code: CodeValidationFailed, Message: "window is invalid", Errors: errs})
+		return
+	}
+	if !s.calendar.add(window) {
+		writeError(w, http.StatusUnprocessableEntity, &Error{
+			Code:    CodeValidationFailed,
+			Message: "window is invalid",
+			Errors:  []*Error{{Code: CodeInvalidField, Message: "a window with this name already exists", Field: "name"}},
+		})
+		return
+	}
+	logger.Info("added window", "name", window.Name, "namespace", window.Namespace, "kind", window.Kind, "start", window.Start, "end", window.End, "tags", window.Tags)
+	err := writeJSON(w, window)
+	if err != nil {
+		logger.Error("error sending response", "error", err)
+	}
+}
+
+// DeleteWindow removes a maintenance window or change freeze of the namespace from the calendar, returning
+// it. The windows of every namespace, and the windows of a cluster, can only be removed from the
+// configuration of the server
+func (s *Service) DeleteWindow(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if s.cluster != nil {
+		writeError(w, http.StatusForbidden, errWindowsInCluster)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	window, ok := s.calendar.remove(namespaceFrom(r.Context()), name)
+	if !ok {
+		for _, window := range s.calendar.list("") {
+			if window.Name == name {
+				httpError(w, fmt.Sprintf("window %s applies to every namespace and can only be removed from the configuration of the server", name), http.StatusForbidden, CodeForbidden)
+				return
+			}
+		}
+		httpError(w, fmt.Sprintf("window %s does not exist", name), http.StatusNotFound, CodeNotFound)
+		return
+	}
+	logger.Info("deleted window", "name", name)
+	err := writeJSON(w, window)
+	if err != nil {
+		logger.Error("error sending response", "error", err)
+	}
+}
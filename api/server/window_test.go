@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendarClosed(t *testing.T) {
+	now := time.Now()
+	c := &calendar{}
+	c.add(Window{Name: "core-weekly", Kind: WindowMaintenance, Start: now.Add(time.Hour), End: now.Add(2 * time.Hour), Tags: []string{"core"}})
+	c.add(Window{Name: "year-end", Kind: WindowFreeze, Start: now.Add(90 * time.Minute), End: now.Add(3 * time.Hour)})
+
+	tests := []struct {
+		tags   []string
+		at     time.Time
+		closed string
+	}{
+		{nil, now, ""},
+		{[]string{"edge"}, now, ""},
+		{[]string{"core"}, now, "only allowed during a maintenance window"},
+		{[]string{"edge", "core"}, now.Add(time.Hour), ""},
+		{[]string{"core"}, now.Add(2 * time.Hour), "frozen by year-end"},
+		{[]string{"edge"}, now.Add(100 * time.Minute), "frozen by year-end"},
+		{[]string{"edge"}, now.Add(3 * time.Hour), ""},
+	}
+	for _, tt := range tests {
+		got := c.closed(DefaultNamespace, tt.tags, tt.at)
+		if (tt.closed == "") != (got == "") || !strings.Contains(got, tt.closed) {
+			t.Errorf("%v at %s: got %q, want %q", tt.tags, tt.at.Sub(now), got, tt.closed)
+		}
+	}
+}
+
+func TestCalendarNext(t *testing.T) {
+	now := time.Now()
+	c := &calendar{}
+	c.add(Window{Name: "core-early", Kind: WindowMaintenance, Start: now.Add(time.Hour), End: now.Add(2 * time.Hour), Tags: []string{"core"}})
+	c.add(Window{Name: "core-late", Kind: WindowMaintenance, Start: now.Add(4 * time.Hour), End: now.Add(5 * time.Hour), Tags: []string{"core"}})
+	c.add(Window{Name: "incident", Kind: WindowFreeze, Start: now.Add(-time.Hour), End: now.Add(90 * time.Minute), Tags: []string{"core", "edge"}})
+
+	tests := []struct {
+		tags []string
+		want time.Duration
+	}{
+		{nil, 0},
+		// the first window opens during the freeze, so changes are allowed from the end of the freeze
+		{[]string{"core"}, 90 * time.Minute},
+		{[]string{"edge"}, 90 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got, ok := c.next(DefaultNamespace, tt.tags, now); !ok || got.Sub(now) != tt.want {
+			t.Errorf("%v: got %s, %t, want %s", tt.tags, got.Sub(now), ok, tt.want)
+		}
+	}
+	if got, ok := c.next(DefaultNamespace, []string{"core"}, now.Add(5*time.Hour)); ok {
+		t.Errorf("expected no time after the last window, got %s", got.Sub(now))
+	}
+}
+
+func taggedItem(addr string, tags ...string) Item {
+	item := savedItem(addr)
+	item.Tags = tags
+	return item
+}
+
+func TestChangeWindowRejects(t *testing.T) {
+	core, edge := newFakeDevice(t, "core", true), newFakeDevice(t, "edge", true)
+	start := time.Now().Add(time.Hour)
+	s := newTestService(WithWindows(Window{Name: "core-weekly", Kind: WindowMaintenance, Start: start, End: start.Add(time.Hour), Tags: []string{"core"}}))
+
+	rec := serve(s, http.MethodPost, "/item", taggedItem(core.addr, "core"))
+	var e Error
+	json.Unmarshal(rec.Body.Bytes(), &e)
+	if rec.Code != http.StatusLocked || e.Code != CodeChangeWindow || !strings.Contains(e.Message, start.Format(time.RFC3339)) {
+		t.Errorf("expected a 423 naming the next window, got %d %s", rec.Code, rec.Body)
+	}
+	if len(core.received()) != 0 || s.itemExists(core.addr) {
+		t.Errorf("expected the rejected change not to be made, got %v", core.received())
+	}
+
+	if rec := serve(s, http.MethodPost, "/item", taggedItem(edge.addr, "edge")); rec.Code != http.StatusOK {
+		t.Errorf("expected a device without maintenance windows to be changed, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestChangeFreezeRejectsSave(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService()
+	serve(s, http.MethodPost, "/item", taggedItem(d.addr, "core"))
+	// a freeze added after the item was created, with no end in sight
+	s.calendar.add(Window{Name: "incident", Kind: WindowFreeze, Start: time.Now().Add(-time.Minute), End: time.Now().Add(24 * time.Hour), Tags: []string{"core"}})
+
+	rec := serve(s, http.MethodPost, "/device/"+d.addr+"/save", nil)
+	if rec.Code != http.StatusLocked || !strings.Contains(rec.Body.String(), "frozen by incident") {
+		t.Errorf("expected the save to be rejected by the freeze, got %d %s", rec.Code, rec.Body)
+	}
+	rec = serve(s, http.MethodDelete, "/item/"+d.addr, taggedItem(d.addr))
+	if rec.Code != http.StatusLocked {
+		t.Errorf("expected the delete to be rejected by the stored item's tags, got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestChangeWindowOverride(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	s := newTestService(WithWindows(Window{Name: "incident", Kind: WindowFreeze, Start: time.Now().Add(-time.Minute), End: time.Now().Add(time.Hour)}))
+
+	rec := serveWithHeader(s, http.MethodPost, "/item", savedItem(d.addr), http.Header{OverrideHeader: {"INC-1234 uplink down"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the override to let the change through, got %d %s", rec.Code, rec.Body)
+	}
+	s.operations.RLock()
+	op := s.operations.operations[rec.Header().Get(OperationIDHeader)]
+	s.operations.RUnlock()
+	if op == nil || op.Override != "INC-1234 uplink down" {
+		t.Errorf("expected the override to be recorded on the operation, got %+v", op)
+	}
+}
+
+func TestChangeQueued(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	start := time.Now().Add(200 * time.Millisecond)
+	s := newTestService(WithWindows(Window{Name: "now-ish", Kind: WindowMaintenance, Start: start, End: start.Add(time.Hour)}))
+
+	rec := serveWithHeader(s, http.MethodPost, "/item", savedItem(d.addr), http.Header{"Prefer": {"respond-async"}})
+	var change QueuedChange
+	json.Unmarshal(rec.Body.Bytes(), &change)
+	if rec.Code != http.StatusAccepted || rec.Header().Get("Location") != "/change/"+change.ID || change.Status != ChangeQueued || !change.NotBefore.Equal(start) {
+		t.Fatalf("expected the change to be queued until the window opens, got %d %s", rec.Code, rec.Body)
+	}
+	if len(d.received()) != 0 {
+		t.Errorf("expected the queued change not to be made yet, got %v", d.received())
+	}
+
+	if !eventually(t, func() bool {
+		json.Unmarshal(serve(s, http.MethodGet, "/change/"+change.ID, nil).Body.Bytes(), &change)
+		return change.Status != ChangeQueued
+	}) {
+		t.Fatal("expected the change to be made once the window opened")
+	}
+	if change.Status != ChangeApplied || change.StatusCode != http.StatusOK || len(change.OperationIDs) != 1 {
+		t.Errorf("expected the change to be applied, got %+v", change)
+	}
+	if len(d.received()) == 0 || serve(s, http.MethodGet, "/item/"+d.addr, nil).Code != http.StatusOK {
+		t.Error("expected the queued change to configure the device and store the item")
+	}
+}
+
+func TestQueuedChangePushFails(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	d.errors["mtu 1500"] = "% Invalid input detected at '^' marker."
+	start := time.Now().Add(100 * time.Millisecond)
+	s := newTestService(WithWindows(Window{Name: "now-ish", Kind: WindowMaintenance, Start: start, End: start.Add(time.Hour)}))
+
+	item := savedItem(d.addr)
+	item.Mtu = 1500
+	var change QueuedChange
+	json.Unmarshal(serveWithHeader(s, http.MethodPost, "/item", item, http.Header{"Prefer": {"respond-async"}}).Body.Bytes(), &change)
+	if !eventually(t, func() bool {
+		json.Unmarshal(serve(s, http.MethodGet, "/change/"+change.ID, nil).Body.Bytes(), &change)
+		return change.Status != ChangeQueued
+	}) {
+		t.Fatal("expected the change to be made once the window opened")
+	}
+	if change.Status != ChangeFailed || len(change.OperationIDs) != 1 || !strings.Contains(change.Error, "Invalid input") {
+		t.Errorf("expected the change whose push failed to fail, got %+v", change)
+	}
+}
+
+func TestChangeQueueCancel(t *testing.T) {
+	d := newFakeDevice(t, "router", true)
+	start := time.Now().Add(time.Hour)
+	s := newTestService(WithWindows(Window{Name: "later", Kind: WindowMaintenance, Start: start, End: start.Add(time.Hour)}))
+
+	var change QueuedChange
+	json.Unmarshal(serveWithHeader(s, http.MethodPost, "/item", savedItem(d.addr), http.Header{"Prefer": {"respond-async"}}).Body.Bytes(), &change)
+	if rec := serve(s, http.MethodDelete, "/change/"+change.ID, nil); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), ChangeCancelled) {
+		t.Errorf("expected the change to be cancelled, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(s, http.MethodDelete, "/change/"+change.ID, nil); rec.Code != http.StatusConflict {
+		t.Errorf("expected a cancelled change not to be cancelled again, got %d %s", rec.Code, rec.Body)
+	}
+	var changes []QueuedChange
+	json.Unmarshal(serve(s, http.MethodGet, "/change", nil).Body.Bytes(), &changes)
+	if len(changes) != 1 || changes[0].Status != ChangeCancelled {
+		t.Errorf("expected the cancelled change to be listed, got %+v", changes)
+	}
+}
+
+func TestWindowRoutes(t *testing.T) {
+	s := newTestService()
+	start := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	window := Window{Name: "core-weekly", Kind: WindowMaintenance, Start: start, End: start.Add(time.Hour), Tags: []string{"core"}}
+
+	if rec := serve(s, http.MethodPost, "/window", window); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(s, http.MethodPost, "/window", window); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected a duplicate name to be rejected, got %d", rec.Code)
+	}
+	invalid := Window{Name: "backwards", Kind: WindowFreeze, Start: start, End: start.Add(-time.Hour)}
+	if rec := serve(s, http.MethodPost, "/window", invalid); rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"end"`) {
+		t.Errorf("expected a window ending before it starts to be rejected, got %d %s", rec.Code, rec.Body)
+	}
+
+	var windows []Window
+	json.Unmarshal(serve(s, http.MethodGet, "/window", nil).Body.Bytes(), &windows)
+	if len(windows) != 1 || windows[0].Name != window.Name || !windows[0].Start.Equal(start) {
+		t.Errorf("expected the window to be listed, got %+v", windows)
+	}
+	if rec := serve(s, http.MethodDelete, "/window/core-weekly", nil); rec.Code != http.StatusOK {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(s, http.MethodDelete, "/window/core-weekly", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected a deleted window not to be found, got %d", rec.Code)
+	}
+}
+
+func TestWindowNamespaces(t *testing.T) {
+	core, other := newFakeDevice(t, "router", true), newFakeDevice(t, "router", true)
+	start := time.Now().Add(-time.Minute)
+	shared := Window{Name: "year-end", Kind: WindowFreeze, Start: start.Add(time.Hour), End: start.Add(2 * time.Hour)}
+	s := newTestService(WithWindows(shared))
+	freeze := Window{Name: "incident", Kind: WindowFreeze, Start: start, End: start.Add(time.Hour)}
+
+	if rec := serve(s, http.MethodPost, "/namespace/team-a/window", freeze); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"namespace":"team-a"`) {
+		t.Fatalf("expected the window to be added to the namespace of the route, got %d %s", rec.Code, rec.Body)
+	}
+	freeze.Namespace = "team-a"
+	if rec := serve(s, http.MethodPost, "/namespace/team-b/window", freeze); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected a window in another namespace to be rejected, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(s, http.MethodPost, "/namespace/team-a/item", savedItem(core.addr)); rec.Code != http.StatusLocked {
+		t.Errorf("expected the freeze to apply to its namespace, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(s, http.MethodPost, "/namespace/team-b/item", savedItem(other.addr)); rec.Code != http.StatusOK {
+		t.Errorf("expected the freeze not to apply to another namespace, got %d %s", rec.Code, rec.Body)
+	}
+
+	var windows []Window
+	json.Unmarshal(serve(s, http.MethodGet, "/namespace/team-b/window", nil).Body.Bytes(), &windows)
+	if len(windows) != 1 || windows[0].Name != shared.Name {
+		t.Errorf("expected only the windows of every namespace to be listed, got %+v", windows)
+	}
+	if rec := serve(s, http.MethodDelete, "/namespace/team-b/window/incident", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the window of another namespace not to be found, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(s, http.MethodDelete, "/namespace/team-b/window/year-end", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("expected a window of every namespace not to be removed, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(s, http.MethodDelete, "/namespace/team-a/window/incident", nil); rec.Code != http.StatusOK {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,13 @@
+// Package template holds the default configuration templates rendered by the server, embedded so that
+// the server does not depend on the directory it is started from
+package template
+
+import "embed"
+
+// Extension is the file extension of configuration templates
+const Extension = ".cfg"
+
+// FS contains the default templates, named after their file without the extension
+//
+//go:embed *.cfg
+var FS embed.FS
@@ -27,3 +27,10 @@ resource "iosxe_interface_ethernet" "netsim_local" {
   service_policy_input = "IN_asdasd"
   service_policy_output = "OUT_ert324sdf"
 }
+
+resource "iosxe_save_config" "netsim_local" {
+  host = "localhost:9992"
+  triggers = {
+    interface = jsonencode(iosxe_interface_ethernet.netsim_local)
+  }
+}
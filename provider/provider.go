@@ -1,8 +1,14 @@
 package provider
 
 import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
 	"github.com/meirizal/terraform-experiment/api/client"
+	"github.com/meirizal/terraform-experiment/api/server"
 )
 
 func Provider() *schema.Provider {
@@ -23,18 +29,70 @@ func Provider() *schema.Provider {
 				Required:    true,
 				DefaultFunc: schema.EnvDefaultFunc("SERVICE_TOKEN", ""),
 			},
+			"emergency_override": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("SERVICE_EMERGENCY_OVERRIDE", ""),
+				Description: "The reason for an emergency change, sent with every change so that it is made outside maintenance windows and during change freezes",
+			},
+			"namespace": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				DefaultFunc:  schema.EnvDefaultFunc("SERVICE_NAMESPACE", ""),
+				Description:  "The namespace items are managed in, which must be the token's namespace if the server has tokens. Default is the token's namespace",
+				ValidateFunc: validateNamespace,
+			},
+			"api_version": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				DefaultFunc:  schema.EnvDefaultFunc("SERVICE_API_VERSION", server.APIVersion1),
+				Description:  "The version of the server's API to use. Empty uses the unversioned routes of servers from before the API had versions",
+				ValidateFunc: validateAPIVersion,
+			},
 		},
 		ResourcesMap: map[string]*schema.Resource{
 			"iosxe_interface_ethernet": resourceItem(),
+			"iosxe_save_config":        resourceSaveConfig(),
 		},
 		ConfigureFunc: providerConfigure,
 	}
 }
 
+func validateNamespace(v interface{}, k string) (ws []string, es []error) {
+	value, ok := v.(string)
+	if !ok {
+		return nil, []error{fmt.Errorf("Expected namespace to be string")}
+	}
+	if value == "" {
+		return nil, nil
+	}
+	if err := server.ValidateNamespace(value); err != nil {
+		return nil, []error{err}
+	}
+	return nil, nil
+}
+
+func validateAPIVersion(v interface{}, k string) (ws []string, es []error) {
+	value, ok := v.(string)
+	if !ok {
+		return nil, []error{fmt.Errorf("Expected api_version to be string")}
+	}
+	if value != "" && !slices.Contains(server.APIVersions, value) {
+		return nil, []error{fmt.Errorf("api_version %s is not supported, the supported versions are %s", value, strings.Join(server.APIVersions, ", "))}
+	}
+	return nil, nil
+}
+
 func providerConfigure(d *schema.ResourceData) (interface{}, error) {
 	address := d.Get("address").(string)
 	port := d.Get("port").(int)
 	token := d.Get("token").(string)
-	return client.NewClient(address, port, token), nil
+	c := client.NewClient(address, port, token)
+	c.SetEmergencyOverride(d.Get("emergency_override").(string))
+	c.SetNamespace(d.Get("namespace").(string))
+	if err := c.SetAPIVersion(d.Get("api_version").(string)); err != nil {
+		return nil, err
+	}
+	return c, nil
 
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"golang.org/x/exp/slices"
 
@@ -42,14 +43,43 @@ func validateInterfaceType(v interface{}, k string) (ws []string, es []error) {
 		errs = append(errs, fmt.Errorf("Expected name to be string"))
 		return warns, errs
 	}
-	list := []string{"GigabitEthernet", "TwoGigabitEthernet", "FiveGigabitEthernet", "TenGigabitEthernet", "TwentyFiveGigE", "FortyGigabitEthernet", "HundredGigE", "TwoHundredGigE", "FourHundredGigE"}
-	if !slices.Contains(list, value) {
+	if !slices.Contains(server.InterfaceTypes, value) {
 		errs = append(errs, fmt.Errorf("Interface type is not valid. Got %s", value))
 		return warns, errs
 	}
 	return warns, errs
 }
 
+func validatePlatform(v interface{}, k string) (ws []string, es []error) {
+	var errs []error
+	var warns []string
+	value, ok := v.(string)
+	if !ok {
+		errs = append(errs, fmt.Errorf("Expected platform to be string"))
+		return warns, errs
+	}
+	if !slices.Contains(server.Platforms(), value) {
+		errs = append(errs, fmt.Errorf("Platform is not valid. Got %s", value))
+		return warns, errs
+	}
+	return warns, errs
+}
+
+func validateTransport(v interface{}, k string) (ws []string, es []error) {
+	var errs []error
+	var warns []string
+	value, ok := v.(string)
+	if !ok {
+		errs = append(errs, fmt.Errorf("Expected transport to be string"))
+		return warns, errs
+	}
+	if !slices.Contains(server.Transports, value) {
+		errs = append(errs, fmt.Errorf("Transport is not valid. Got %s", value))
+		return warns, errs
+	}
+	return warns, errs
+}
+
 func resourceItem() *schema.Resource {
 	fmt.Print()
 	return &schema.Resource{
@@ -78,6 +108,21 @@ func resourceItem() *schema.Resource {
 				Description: "Default is 'admin'",
 				Default:     "admin",
 			},
+			"platform": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The platform of the device, one of " + strings.Join(server.Platforms(), ", ") + ". Default is '" + server.DefaultPlatform + "'",
+				Default:      server.DefaultPlatform,
+				ForceNew:     true,
+				ValidateFunc: validatePlatform,
+			},
+			"transport": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "How configuration is pushed to the device, one of " + strings.Join(server.Transports, ", ") + ". Default is '" + server.DefaultTransport + "'",
+				Default:      server.DefaultTransport,
+				ValidateFunc: validateTransport,
+			},
 			"type": {
 				Type:         schema.TypeString,
 				Description:  "Interface type",
@@ -119,6 +164,22 @@ func resourceItem() *schema.Resource {
 				Optional:    true,
 				Description: "Service Policy output",
 			},
+			"tags": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Tags of the device, such as its role or site, that maintenance windows and change freezes are scoped by",
+			},
+			"namespace": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The namespace the item belongs to, set by the provider's namespace",
+			},
+			"revision": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "The revision of the item when it was last read, changes made on the server since then are not overwritten",
+			},
 		},
 		Create: resourceCreateItem,
 		Read:   resourceReadItem,
@@ -128,11 +189,17 @@ func resourceItem() *schema.Resource {
 		Importer: &schema.ResourceImporter{
 			State: schema.ImportStatePassthrough,
 		},
+		// a change to a device that needs approval is waited for until it is approved and made
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(30 * time.Minute),
+			Update: schema.DefaultTimeout(30 * time.Minute),
+			Delete: schema.DefaultTimeout(30 * time.Minute),
+		},
 	}
 }
 
 func resourceCreateItem(d *schema.ResourceData, m interface{}) error {
-	apiClient := m.(*client.Client)
+	apiClient := m.(*client.Client).WithChangeTimeout(d.Timeout(schema.TimeoutCreate))
 	item := getItemData(d)
 
 	err := apiClient.NewItem(&item)
@@ -142,7 +209,7 @@ func resourceCreateItem(d *schema.ResourceData, m interface{}) error {
 	}
 	d.SetId(item.Host)
 
-	return nil
+	return resourceReadItem(d, m)
 }
 
 func resourceReadItem(d *schema.ResourceData, m interface{}) error {
@@ -151,16 +218,18 @@ func resourceReadItem(d *schema.ResourceData, m interface{}) error {
 	itemId := d.Id()
 	item, err := apiClient.GetItem(itemId)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
+		if client.IsNotFound(err) {
 			d.SetId("")
-		} else {
-			return fmt.Errorf("error finding Item with ID %s", itemId)
+			return nil
 		}
+		return fmt.Errorf("error finding Item with ID %s: %s", itemId, err)
 	}
 
 	d.SetId(item.Host)
 	d.Set("host", item.Host)
 	d.Set("description", item.Description)
+	d.Set("platform", item.Platform)
+	d.Set("transport", item.Transport)
 	d.Set("type", item.IntfType)
 	d.Set("number", item.Number)
 	d.Set("ipv4_address", item.Ipv4Address)
@@ -169,39 +238,51 @@ func resourceReadItem(d *schema.ResourceData, m interface{}) error {
 	d.Set("shutdown", item.Shutdown)
 	d.Set("service_policy_input", item.ServicePolicyInput)
 	d.Set("service_policy_output", item.ServicePolicyOutput)
+	d.Set("tags", item.Tags)
+	d.Set("namespace", item.Namespace)
+	d.Set("revision", item.Revision)
 	return nil
 }
 
 func resourceUpdateItem(d *schema.ResourceData, m interface{}) error {
-	apiClient := m.(*client.Client)
+	apiClient := m.(*client.Client).WithChangeTimeout(d.Timeout(schema.TimeoutUpdate))
 	item := getItemData(d)
 
 	err := apiClient.UpdateItem(&item)
 	if err != nil {
-		return err
+		return changedItemError(item, err)
 	}
-	return nil
+	return resourceReadItem(d, m)
 }
 
 func resourceDeleteItem(d *schema.ResourceData, m interface{}) error {
-	apiClient := m.(*client.Client)
+	apiClient := m.(*client.Client).WithChangeTimeout(d.Timeout(schema.TimeoutDelete))
 	item := getItemData(d)
 
 	err := apiClient.DeleteItem(&item)
 	if err != nil {
-		return err
+		return changedItemError(item, err)
 	}
 	d.SetId("")
 	return nil
 }
 
+// changedItemError explains how to resolve err if it refused a change because the item was changed on the
+// server since Terraform last read it
+func changedItemError(item server.Item, err error) error {
+	if client.IsPreconditionFailed(err) {
+		return fmt.Errorf("item %s was changed on the server since it was last read at revision %d, refresh and plan again to see the changes: %w", item.Host, item.Revision, err)
+	}
+	return err
+}
+
 func resourceExistsItem(d *schema.ResourceData, m interface{}) (bool, error) {
 	apiClient := m.(*client.Client)
 
 	itemId := d.Id()
 	_, err := apiClient.GetItem(itemId)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
+		if client.IsNotFound(err) {
 			return false, nil
 		} else {
 			return false, err
@@ -216,6 +297,8 @@ func getItemData(d *schema.ResourceData) server.Item {
 		Description:         d.Get("description").(string),
 		Username:            d.Get("username").(string),
 		Password:            d.Get("password").(string),
+		Platform:            d.Get("platform").(string),
+		Transport:           d.Get("transport").(string),
 		IntfType:            d.Get("type").(string),
 		Number:              d.Get("number").(string),
 		Ipv4Address:         d.Get("ipv4_address").(string),
@@ -224,6 +307,10 @@ func getItemData(d *schema.ResourceData) server.Item {
 		Shutdown:            d.Get("shutdown").(bool),
 		ServicePolicyInput:  d.Get("service_policy_input").(string),
 		ServicePolicyOutput: d.Get("service_policy_output").(string),
+		Revision:            int64(d.Get("revision").(int)),
+	}
+	for _, tag := range d.Get("tags").(*schema.Set).List() {
+		item.Tags = append(item.Tags, tag.(string))
 	}
 
 	return item
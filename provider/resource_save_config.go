@@ -0,0 +1,69 @@
+package provider
+
+import (
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/meirizal/terraform-experiment/api/client"
+)
+
+// resourceSaveConfig saves the running configuration of a device when it is created. Every argument forces
+// a new resource, so changing triggers, e.g. to the attributes of the interfaces on the device, saves it
+// again. Destroying it only removes it from the state
+func resourceSaveConfig() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"host": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				Description:  "The host:port of the device, as configured on its iosxe_interface_ethernet resources",
+				ValidateFunc: validateName,
+			},
+			"triggers": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				ForceNew:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Arbitrary values that save the device again when they change",
+			},
+			"operation_id": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The ID of the save operation, whose transcript the server keeps",
+			},
+			"saved": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "When the configuration was saved, in RFC 3339 format",
+			},
+		},
+		Create: resourceCreateSaveConfig,
+		Read:   resourceReadSaveConfig,
+		Delete: resourceDeleteSaveConfig,
+	}
+}
+
+func resourceCreateSaveConfig(d *schema.ResourceData, m interface{}) error {
+	apiClient := m.(*client.Client)
+	host := d.Get("host").(string)
+
+	operation, err := apiClient.SaveDevice(host)
+	if err != nil {
+		return err
+	}
+	d.SetId(host)
+	d.Set("operation_id", operation.ID)
+	d.Set("saved", operation.Finished.Format(time.RFC3339))
+	return nil
+}
+
+// resourceReadSaveConfig has nothing to refresh, a save is a point in time action
+func resourceReadSaveConfig(d *schema.ResourceData, m interface{}) error {
+	return nil
+}
+
+func resourceDeleteSaveConfig(d *schema.ResourceData, m interface{}) error {
+	d.SetId("")
+	return nil
+}